@@ -19,21 +19,20 @@ package main
 import (
 	"flag"
 
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/agent"
-	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/tkestack"
+	// register the built-in hook providers
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/providers"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/signals"
 	"github.com/tkestack/tke-excalibur/pkg/version"
 )
 
 func main() {
 	klog.InitFlags(nil)
 	defer klog.Flush()
-	// set hook provider for testing
-	provider := &tkestack.TKEStackProvider{}
-	cmd := agent.NewTunnelAgentCommand(provider, wait.NeverStop)
-	cmd.Flags().AddGoFlagSet(flag.CommandLine)
+	cmd := agent.NewTunnelAgentCommand(signals.SetupSignalHandler())
+	cmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
 	if err := cmd.Execute(); err != nil {
 		klog.Fatalf("%s failed: %s", version.GetAgentName(), err)
 	}
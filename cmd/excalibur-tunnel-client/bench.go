@@ -0,0 +1,486 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/signals"
+)
+
+const (
+	// requestGet reads the response of a GET request
+	requestGet = "get"
+	// requestUpload posts a large body and reads the response
+	requestUpload = "upload"
+	// requestWatch holds a long-lived streaming GET request
+	requestWatch = "watch"
+
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var requestKinds = []string{requestGet, requestUpload, requestWatch}
+
+// benchOptions are the options of the bench subcommand
+type benchOptions struct {
+	*GrpcProxyClientOptions
+	target                string
+	workers               int
+	duration              time.Duration
+	requests              int64
+	mix                   string
+	getPath               string
+	uploadPath            string
+	watchPath             string
+	bodySize              int
+	watchDuration         time.Duration
+	timeout               time.Duration
+	disableKeepAlives     bool
+	kubeConfig            string
+	insecureSkipTLSVerify bool
+	reportInterval        time.Duration
+	output                string
+
+	weights map[string]int
+}
+
+func newBenchCommand(o *GrpcProxyClientOptions) *cobra.Command {
+	bo := &benchOptions{
+		GrpcProxyClientOptions: o,
+		target:                 "http://localhost:8000",
+		workers:                10,
+		duration:               30 * time.Second,
+		mix:                    requestGet + "=1",
+		getPath:                "/",
+		uploadPath:             "/",
+		watchPath:              "/",
+		bodySize:               1 << 20,
+		watchDuration:          10 * time.Second,
+		timeout:                30 * time.Second,
+		reportInterval:         10 * time.Second,
+		output:                 outputText,
+	}
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Run a load or soak test against a destination through the tunnel server",
+		Long: `Run concurrent workers sending a mix of requests to the destination through the
+tunnel server for a duration, and report the throughput, the latency percentiles
+and the errors. The request kinds of --mix are:
+
+  get     GET --get-path and read the whole response
+  upload  POST a body of --body-size bytes to --upload-path
+  watch   GET --watch-path and read the stream for --watch-duration, the latency
+          is the time to the response headers
+
+For example, to soak the apiserver of a registered cluster for an hour:
+
+  excalibur-tunnel-client bench --mode=http-connect --proxy-host=10.0.0.10 --proxy-port=10263 \
+    --ca-cert=ca.crt --client-cert=client.crt --client-key=client.key \
+    --target=https://cls-t8gz6mgd:6443 --kubeconfig=cls-t8gz6mgd.kubeconfig \
+    --get-path=/api/v1/namespaces/default/pods --watch-path='/api/v1/pods?watch=true' \
+    --mix=get=9,watch=1 --workers=50 --duration=1h -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := bo.validate(); err != nil {
+				return fmt.Errorf("failed to validate bench options, got %v", err)
+			}
+			return bo.run(signals.SetupSignalHandler())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&bo.target, "target", bo.target,
+		"The base url of the destination, whose host is dialed through the tunnel.")
+	flags.IntVar(&bo.workers, "workers", bo.workers, "The number of concurrent workers.")
+	flags.DurationVar(&bo.duration, "duration", bo.duration, "How long to run, 0 to run until --requests are sent.")
+	flags.Int64Var(&bo.requests, "requests", bo.requests, "The total number of requests to send, 0 means unlimited.")
+	flags.StringVar(&bo.mix, "mix", bo.mix,
+		"The weighted mix of the request kinds, e.g. get=8,upload=1,watch=1, the kinds are get, upload and watch.")
+	flags.StringVar(&bo.getPath, "get-path", bo.getPath, "The path of the get requests.")
+	flags.StringVar(&bo.uploadPath, "upload-path", bo.uploadPath, "The path of the upload requests.")
+	flags.StringVar(&bo.watchPath, "watch-path", bo.watchPath, "The path of the watch requests.")
+	flags.IntVar(&bo.bodySize, "body-size", bo.bodySize, "The size in bytes of the body of the upload requests.")
+	flags.DurationVar(&bo.watchDuration, "watch-duration", bo.watchDuration, "How long to hold a watch request.")
+	flags.DurationVar(&bo.timeout, "timeout", bo.timeout, "The timeout of the get and upload requests.")
+	flags.BoolVar(&bo.disableKeepAlives, "disable-keep-alives", bo.disableKeepAlives,
+		"If true, each request dials a new tunnel instead of reusing the idle connections.")
+	flags.StringVar(&bo.kubeConfig, "kubeconfig", bo.kubeConfig,
+		"Path to the kubeconfig file, whose CA and credentials are used to access the destination, its server is ignored.")
+	flags.BoolVar(&bo.insecureSkipTLSVerify, "insecure-skip-tls-verify", bo.insecureSkipTLSVerify,
+		"If true, the certificate of the destination will not be checked for validity.")
+	flags.DurationVar(&bo.reportInterval, "report-interval", bo.reportInterval,
+		"The interval to log the progress, 0 to disable.")
+	flags.StringVarP(&bo.output, "output", "o", bo.output, "The output format of the report, one of text and json.")
+	return cmd
+}
+
+func (o *benchOptions) validate() error {
+	if err := o.validateTunnel(); err != nil {
+		return err
+	}
+	u, err := url.Parse(o.target)
+	if err != nil {
+		return fmt.Errorf("invalid target %s: %v", o.target, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("the scheme of target must be either 'http' or 'https' not %q", u.Scheme)
+	}
+	if o.workers < 1 {
+		return fmt.Errorf("please do not ask for fewer than 1 worker(%d)", o.workers)
+	}
+	if o.duration < 0 || o.requests < 0 {
+		return errors.New("--duration and --requests must not be negative")
+	}
+	if o.duration == 0 && o.requests == 0 {
+		return errors.New("either --duration or --requests is required")
+	}
+	if o.bodySize < 0 {
+		return fmt.Errorf("invalid body size %d", o.bodySize)
+	}
+	if o.watchDuration <= 0 || o.timeout <= 0 {
+		return errors.New("--watch-duration and --timeout must be positive")
+	}
+	if o.output != outputText && o.output != outputJSON {
+		return fmt.Errorf("output must be set to either 'text' or 'json' not %q", o.output)
+	}
+	weights, err := parseMix(o.mix)
+	if err != nil {
+		return fmt.Errorf("invalid mix %s: %v", o.mix, err)
+	}
+	o.weights = weights
+	return nil
+}
+
+// parseMix parses the weights of the request kinds, e.g. get=8,watch=2
+func parseMix(mix string) (map[string]int, error) {
+	weights := map[string]int{}
+	total := 0
+	for _, item := range strings.Split(mix, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		kind, weight := parts[0], 1
+		if len(parts) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(parts[1]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight %s of %s", parts[1], kind)
+			}
+		}
+		if kind != requestGet && kind != requestUpload && kind != requestWatch {
+			return nil, fmt.Errorf("unknown request kind %s", kind)
+		}
+		weights[kind] += weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("no request kind is weighted")
+	}
+	return weights, nil
+}
+
+// transport creates the transport to the destination, which dials
+// through the tunnel and authenticates by the kubeconfig
+func (o *benchOptions) transport() (http.RoundTripper, error) {
+	config := &rest.Config{}
+	if o.kubeConfig != "" {
+		var err error
+		if config, err = clientcmd.BuildConfigFromFlags("", o.kubeConfig); err != nil {
+			return nil, err
+		}
+	}
+	config.Host = o.target
+	if o.insecureSkipTLSVerify {
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.CAData = nil
+	}
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := newTunnelDialer(o.GrpcProxyClientOptions)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, &dialError{err: err}
+			}
+			return conn, nil
+		},
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: o.workers,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   o.disableKeepAlives,
+	}
+	return rest.HTTPWrappersForConfig(config, transport)
+}
+
+func (o *benchOptions) run(stopCh <-chan struct{}) error {
+	transport, err := o.transport()
+	if err != nil {
+		return err
+	}
+	b := &bench{
+		o:      o,
+		client: &http.Client{Transport: transport},
+		body:   bytes.Repeat([]byte("x"), o.bodySize),
+		stats:  map[string]*requestStats{},
+	}
+	for _, kind := range requestKinds {
+		if o.weights[kind] > 0 {
+			b.stats[kind] = newRequestStats()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if o.duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.duration)
+		defer cancel()
+	}
+	go func() {
+		select {
+		case <-stopCh:
+			klog.Info("Interrupted, stopping the workers")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	klog.Infof("Running %d workers against %s with mix %s", o.workers, o.target, o.mix)
+	start := time.Now()
+	if o.reportInterval > 0 {
+		go b.reportProgress(ctx, start)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < o.workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			b.work(ctx, rand.New(rand.NewSource(seed)))
+		}(start.UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	report := b.report(time.Since(start))
+	if o.output == outputJSON {
+		return report.printJSON(os.Stdout)
+	}
+	return report.printText(os.Stdout)
+}
+
+// bench sends the requests of the workers and records the results
+type bench struct {
+	o      *benchOptions
+	client *http.Client
+	body   []byte
+	// sent is the number of requests sent
+	sent int64
+	// the stats are keyed by the request kinds
+	stats map[string]*requestStats
+}
+
+// work sends requests until the context is done or enough requests are sent
+func (b *bench) work(ctx context.Context, r *rand.Rand) {
+	for ctx.Err() == nil {
+		if n := atomic.AddInt64(&b.sent, 1); b.o.requests > 0 && n > b.o.requests {
+			return
+		}
+		kind := b.pick(r)
+		result := b.do(ctx, kind)
+		// the requests interrupted by the end of the run are not errors
+		if result.err != nil && ctx.Err() != nil {
+			return
+		}
+		b.stats[kind].record(result)
+	}
+}
+
+// pick picks a request kind by the weights
+func (b *bench) pick(r *rand.Rand) string {
+	total := 0
+	for _, weight := range b.o.weights {
+		total += weight
+	}
+	n := r.Intn(total)
+	for _, kind := range requestKinds {
+		if n < b.o.weights[kind] {
+			return kind
+		}
+		n -= b.o.weights[kind]
+	}
+	return requestGet
+}
+
+// result is the result of a request
+type result struct {
+	latency  time.Duration
+	bytesIn  int64
+	bytesOut int64
+	err      error
+}
+
+func (b *bench) do(ctx context.Context, kind string) result {
+	switch kind {
+	case requestUpload:
+		ctx, cancel := context.WithTimeout(ctx, b.o.timeout)
+		defer cancel()
+		res := b.roundTrip(ctx, http.MethodPost, b.o.uploadPath, b.body, false)
+		res.bytesOut = int64(len(b.body))
+		return res
+	case requestWatch:
+		ctx, cancel := context.WithTimeout(ctx, b.o.watchDuration)
+		defer cancel()
+		return b.roundTrip(ctx, http.MethodGet, b.o.watchPath, nil, true)
+	default:
+		ctx, cancel := context.WithTimeout(ctx, b.o.timeout)
+		defer cancel()
+		return b.roundTrip(ctx, http.MethodGet, b.o.getPath, nil, false)
+	}
+}
+
+// roundTrip sends a request and reads the whole response, the latency
+// is the time to the response headers if stream is set, and the stream
+// ends without error once the context is done
+func (b *bench) roundTrip(ctx context.Context, method, path string, body []byte, stream bool) result {
+	var res result
+	req, err := http.NewRequest(method, strings.TrimSuffix(b.o.target, "/")+path, nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+	if stream {
+		res.latency = time.Since(start)
+	}
+	res.bytesIn, err = io.Copy(ioutil.Discard, resp.Body)
+	if !stream {
+		res.latency = time.Since(start)
+	}
+	switch {
+	case resp.StatusCode >= http.StatusBadRequest:
+		res.err = &statusError{code: resp.StatusCode}
+	case err != nil && !(stream && ctx.Err() != nil):
+		res.err = err
+	}
+	return res
+}
+
+// reportProgress logs the progress periodically until the context is done
+func (b *bench) reportProgress(ctx context.Context, start time.Time) {
+	ticker := time.NewTicker(b.o.reportInterval)
+	defer ticker.Stop()
+	var lastRequests int64
+	last := start
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var requests, errs int64
+			for _, s := range b.stats {
+				n, e := s.counts()
+				requests += n
+				errs += e
+			}
+			klog.Infof("%s elapsed, %d requests, %d errors, %.1f requests/s",
+				now.Sub(start).Round(time.Second), requests, errs,
+				float64(requests-lastRequests)/now.Sub(last).Seconds())
+			lastRequests, last = requests, now
+		}
+	}
+}
+
+// dialError is the error of dialing through the tunnel
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return fmt.Sprintf("failed to dial through the tunnel: %v", e.err)
+}
+
+// statusError is the error of an unexpected status code
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+}
+
+// errorReason classifies the error for the error breakdown
+func errorReason(err error) string {
+	var (
+		dialErr   *dialError
+		statusErr *statusError
+		netErr    net.Error
+	)
+	switch {
+	case errors.As(err, &dialErr):
+		return "dial"
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("http %d", statusErr.code)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// the latencies are recorded into the buckets growing by 2 percent
+	// from 1 microsecond, which covers about 5 hours
+	histogramBase    = time.Microsecond
+	histogramGrowth  = 1.02
+	histogramBuckets = 1200
+)
+
+// histogram records the latencies into the exponential buckets, so that
+// the memory is bounded however long the soak test runs
+type histogram struct {
+	buckets [histogramBuckets]int64
+	count   int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+func (h *histogram) record(d time.Duration) {
+	i := 0
+	if d > histogramBase {
+		i = int(math.Ceil(math.Log(float64(d)/float64(histogramBase)) / math.Log(histogramGrowth)))
+		if i >= histogramBuckets {
+			i = histogramBuckets - 1
+		}
+	}
+	h.buckets[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) merge(other *histogram) {
+	if other.count == 0 {
+		return
+	}
+	for i, n := range other.buckets {
+		h.buckets[i] += n
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// percentile returns the upper bound of the bucket of the percentile
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.count)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			// the last bucket holds all of the latencies out of range
+			if i == histogramBuckets-1 {
+				return h.max
+			}
+			d := time.Duration(float64(histogramBase) * math.Pow(histogramGrowth, float64(i)))
+			if d > h.max {
+				return h.max
+			}
+			if d < h.min {
+				return h.min
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+// requestStats are the stats of a request kind
+type requestStats struct {
+	mu       sync.Mutex
+	requests int64
+	errors   int64
+	bytesIn  int64
+	bytesOut int64
+	latency  histogram
+	// reasons counts the errors by reason and keeps the last one as sample
+	reasons map[string]*errorCount
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{reasons: map[string]*errorCount{}}
+}
+
+func (s *requestStats) record(res result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.bytesIn += res.bytesIn
+	s.bytesOut += res.bytesOut
+	if res.err != nil {
+		s.errors++
+		reason := errorReason(res.err)
+		c, ok := s.reasons[reason]
+		if !ok {
+			c = &errorCount{Reason: reason}
+			s.reasons[reason] = c
+		}
+		c.Count++
+		c.Sample = res.err.Error()
+		return
+	}
+	s.latency.record(res.latency)
+}
+
+func (s *requestStats) counts() (requests, errors int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.errors
+}
+
+// benchReport is the report of a bench run
+type benchReport struct {
+	Target          string          `json:"target"`
+	Workers         int             `json:"workers"`
+	Mix             string          `json:"mix"`
+	DurationSeconds float64         `json:"durationSeconds"`
+	Total           requestReport   `json:"total"`
+	Kinds           []requestReport `json:"kinds"`
+	Errors          []*errorCount   `json:"errors,omitempty"`
+}
+
+// requestReport is the report of a request kind or all of them
+type requestReport struct {
+	Kind string `json:"kind"`
+	// Requests includes the failed ones
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	// Throughput is the number of successful requests per second
+	Throughput        float64       `json:"throughput"`
+	BytesInPerSecond  float64       `json:"bytesInPerSecond"`
+	BytesOutPerSecond float64       `json:"bytesOutPerSecond"`
+	Latency           latencyReport `json:"latency"`
+}
+
+func newRequestReport(kind string, s *requestStats, latency *histogram, elapsed time.Duration) requestReport {
+	seconds := elapsed.Seconds()
+	return requestReport{
+		Kind:              kind,
+		Requests:          s.requests,
+		Errors:            s.errors,
+		BytesIn:           s.bytesIn,
+		BytesOut:          s.bytesOut,
+		Throughput:        float64(s.requests-s.errors) / seconds,
+		BytesInPerSecond:  float64(s.bytesIn) / seconds,
+		BytesOutPerSecond: float64(s.bytesOut) / seconds,
+		Latency:           newLatencyReport(latency),
+	}
+}
+
+// latencyReport is the latency of the successful requests in milliseconds
+type latencyReport struct {
+	Min  float64 `json:"minMs"`
+	Mean float64 `json:"meanMs"`
+	P50  float64 `json:"p50Ms"`
+	P90  float64 `json:"p90Ms"`
+	P99  float64 `json:"p99Ms"`
+	Max  float64 `json:"maxMs"`
+}
+
+// errorCount is the number of the errors of a reason
+type errorCount struct {
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+	// Sample is the last error of the reason
+	Sample string `json:"sample"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newLatencyReport(h *histogram) latencyReport {
+	if h.count == 0 {
+		return latencyReport{}
+	}
+	return latencyReport{
+		Min:  milliseconds(h.min),
+		Mean: milliseconds(h.sum / time.Duration(h.count)),
+		P50:  milliseconds(h.percentile(50)),
+		P90:  milliseconds(h.percentile(90)),
+		P99:  milliseconds(h.percentile(99)),
+		Max:  milliseconds(h.max),
+	}
+}
+
+// report builds the report once the workers are stopped
+func (b *bench) report(elapsed time.Duration) *benchReport {
+	report := &benchReport{
+		Target:          b.o.target,
+		Workers:         b.o.workers,
+		Mix:             b.o.mix,
+		DurationSeconds: elapsed.Seconds(),
+	}
+	total := newRequestStats()
+	reasons := map[string]*errorCount{}
+	for _, kind := range requestKinds {
+		s, ok := b.stats[kind]
+		if !ok {
+			continue
+		}
+		report.Kinds = append(report.Kinds, newRequestReport(kind, s, &s.latency, elapsed))
+		total.requests += s.requests
+		total.errors += s.errors
+		total.bytesIn += s.bytesIn
+		total.bytesOut += s.bytesOut
+		total.latency.merge(&s.latency)
+		for reason, c := range s.reasons {
+			if _, ok := reasons[reason]; !ok {
+				reasons[reason] = &errorCount{Reason: reason}
+			}
+			reasons[reason].Count += c.Count
+			reasons[reason].Sample = c.Sample
+		}
+	}
+	report.Total = newRequestReport("total", total, &total.latency, elapsed)
+	for _, c := range reasons {
+		report.Errors = append(report.Errors, c)
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Count > report.Errors[j].Count
+	})
+	return report
+}
+
+func (r *benchReport) printJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func (r *benchReport) printText(out io.Writer) error {
+	fmt.Fprintf(out, "Target:   %s\nWorkers:  %d\nMix:      %s\nDuration: %s\n\n",
+		r.Target, r.Workers, r.Mix, time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond))
+
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "KIND\tREQUESTS\tERRORS\tTHROUGHPUT\tIN MB/S\tOUT MB/S\tP50 MS\tP90 MS\tP99 MS\tMAX MS")
+	for _, k := range append(r.Kinds, r.Total) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\n",
+			k.Kind, k.Requests, k.Errors, k.Throughput, k.BytesInPerSecond/1e6, k.BytesOutPerSecond/1e6,
+			k.Latency.P50, k.Latency.P90, k.Latency.P99, k.Latency.Max)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(r.Errors) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "REASON\tCOUNT\tSAMPLE")
+	for _, c := range r.Errors {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", c.Reason, c.Count, c.Sample)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	h := &histogram{}
+	if got := h.percentile(50); got != 0 {
+		t.Errorf("expected 0 of the empty histogram, got %v", got)
+	}
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	for _, p := range []float64{1, 50, 90, 99, 99.9} {
+		expected := time.Duration(p*10) * time.Millisecond
+		// the percentile is the upper bound of its bucket, which is at
+		// most 2 percent greater than the exact one
+		got := h.percentile(p)
+		if got < expected || float64(got) > float64(expected)*histogramGrowth {
+			t.Errorf("expected p%v in [%v, %v], got %v", p, expected,
+				time.Duration(float64(expected)*histogramGrowth), got)
+		}
+	}
+	if got := h.percentile(100); got != time.Second {
+		t.Errorf("expected p100 to be the max %v, got %v", time.Second, got)
+	}
+	if h.min != time.Millisecond || h.max != time.Second || h.count != 1000 {
+		t.Errorf("unexpected min %v, max %v and count %d", h.min, h.max, h.count)
+	}
+}
+
+func TestHistogramBounds(t *testing.T) {
+	h := &histogram{}
+	h.record(1500 * time.Microsecond)
+	// the bucket bounds are clamped to the recorded values
+	if got := h.percentile(50); got != 1500*time.Microsecond {
+		t.Errorf("expected the only latency, got %v", got)
+	}
+
+	h = &histogram{}
+	h.record(0)
+	h.record(24 * time.Hour)
+	if h.buckets[0] != 1 || h.buckets[histogramBuckets-1] != 1 {
+		t.Error("expected the latencies out of range to be recorded into the first and last buckets")
+	}
+	if got := h.percentile(50); got != histogramBase {
+		t.Errorf("expected p50 %v, got %v", histogramBase, got)
+	}
+	if got := h.percentile(99); got != 24*time.Hour {
+		t.Errorf("expected p99 to be the max, got %v", got)
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b, all := &histogram{}, &histogram{}, &histogram{}
+	for i := 1; i <= 100; i++ {
+		d := time.Duration(i*i) * time.Microsecond
+		if i%3 == 0 {
+			a.record(d)
+		} else {
+			b.record(d)
+		}
+		all.record(d)
+	}
+	merged := &histogram{}
+	merged.merge(&histogram{})
+	merged.merge(a)
+	merged.merge(b)
+	if !reflect.DeepEqual(merged, all) {
+		t.Errorf("expected the merged histogram to equal the one recording all of the latencies")
+	}
+}
+
+func TestRequestStats(t *testing.T) {
+	s := newRequestStats()
+	s.record(result{latency: time.Millisecond, bytesIn: 10, bytesOut: 1})
+	s.record(result{latency: 3 * time.Millisecond, bytesIn: 20, bytesOut: 2})
+	s.record(result{err: &statusError{code: 503}, bytesOut: 3})
+	s.record(result{err: fmt.Errorf("read body: %w", &statusError{code: 503})})
+
+	report := newRequestReport(requestGet, s, &s.latency, 2*time.Second)
+	expected := requestReport{
+		Kind:              requestGet,
+		Requests:          4,
+		Errors:            2,
+		BytesIn:           30,
+		BytesOut:          6,
+		Throughput:        1,
+		BytesInPerSecond:  15,
+		BytesOutPerSecond: 3,
+		Latency: latencyReport{
+			Min:  1,
+			Mean: 2,
+			P50:  1,
+			P90:  3,
+			P99:  3,
+			Max:  3,
+		},
+	}
+	// the p50 is the upper bound of the bucket of 1ms
+	expected.Latency.P50 = report.Latency.P50
+	if report.Latency.P50 < 1 || report.Latency.P50 > histogramGrowth {
+		t.Errorf("unexpected p50 %vms", report.Latency.P50)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+	c := s.reasons["http 503"]
+	if len(s.reasons) != 1 || c == nil || c.Count != 2 || c.Sample != "read body: unexpected status 503 Service Unavailable" {
+		t.Errorf("unexpected error reasons %v", s.reasons)
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	cases := []struct {
+		mix      string
+		expected map[string]int
+		err      bool
+	}{
+		{mix: "get", expected: map[string]int{requestGet: 1}},
+		{mix: "get=8, watch=2,", expected: map[string]int{requestGet: 8, requestWatch: 2}},
+		{mix: "get=1,get=2,upload=0", expected: map[string]int{requestGet: 3, requestUpload: 0}},
+		{mix: "get=-1", err: true},
+		{mix: "get=a", err: true},
+		{mix: "delete=1", err: true},
+		{mix: "get=0", err: true},
+		{mix: "", err: true},
+	}
+	for _, c := range cases {
+		got, err := parseMix(c.mix)
+		if c.err {
+			if err == nil {
+				t.Errorf("expected error of %q, got %v", c.mix, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("expected %v of %q, got %v, %v", c.expected, c.mix, got, err)
+		}
+	}
+}
+
+// timeoutError is a net.Error which times out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorReason(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{err: &dialError{err: errors.New("denied")}, expected: "dial"},
+		{err: fmt.Errorf("get: %w", &statusError{code: 404}), expected: "http 404"},
+		{err: context.DeadlineExceeded, expected: "timeout"},
+		{err: fmt.Errorf("read: %w", timeoutError{}), expected: "timeout"},
+		{err: io.ErrUnexpectedEOF, expected: "eof"},
+		{err: errors.New("connection reset"), expected: "other"},
+	}
+	for _, c := range cases {
+		if got := errorReason(c.err); got != c.expected {
+			t.Errorf("expected reason %s of %v, got %s", c.expected, c.err, got)
+		}
+	}
+}
@@ -17,28 +17,22 @@ limitations under the License.
 package main
 
 import (
-	"bufio"
 	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
@@ -46,8 +40,12 @@ func main() {
 	client := &Client{}
 	o := newGrpcProxyClientOptions()
 	command := newGrpcProxyClientCommand(client, o)
-	flags := command.Flags()
-	flags.AddFlagSet(o.Flags())
+	command.Flags().AddFlagSet(o.Flags())
+	flags := command.PersistentFlags()
+	flags.AddFlagSet(o.TunnelFlags())
+	command.AddCommand(newProxyCommand(o))
+	command.AddCommand(newKubeconfigCommand(o))
+	command.AddCommand(newBenchCommand(o))
 	local := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	klog.InitFlags(local)
 	local.Set("v", "4")
@@ -81,20 +79,27 @@ type GrpcProxyClientOptions struct {
 	kubeConfig   string
 }
 
-func (o *GrpcProxyClientOptions) Flags() *pflag.FlagSet {
-	flags := pflag.NewFlagSet("proxy", pflag.ContinueOnError)
+// TunnelFlags are the flags of connecting to the tunnel server, which
+// are shared by the subcommands
+func (o *GrpcProxyClientOptions) TunnelFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("tunnel", pflag.ContinueOnError)
 	flags.StringVar(&o.clientCert, "client-cert", o.clientCert, "If non-empty secure communication with this cert.")
 	flags.StringVar(&o.clientKey, "client-key", o.clientKey, "If non-empty secure communication with this key.")
 	flags.StringVar(&o.caCert, "ca-cert", o.caCert, "If non-empty the CAs we use to validate clients.")
-	flags.StringVar(&o.requestProto, "request-proto", o.requestProto, "The protocol for the request to send through the proxy.")
-	flags.StringVar(&o.requestPath, "request-path", o.requestPath, "The url request to send through the proxy.")
-	flags.StringVar(&o.requestHost, "request-host", o.requestHost, "The host of the request server.")
-	flags.IntVar(&o.requestPort, "request-port", o.requestPort, "The port the request server is listening on.")
 	flags.StringVar(&o.proxyHost, "proxy-host", o.proxyHost, "The host of the proxy server.")
 	flags.IntVar(&o.proxyPort, "proxy-port", o.proxyPort, "The port the proxy server is listening on.")
 	flags.StringVar(&o.proxyUdsName, "proxy-uds", o.proxyUdsName, "The UDS name to connect to.")
 	flags.StringVar(&o.mode, "mode", o.mode, "Mode can be either 'grpc' or 'http-connect'.")
 	flags.StringVar(&o.userAgent, "user-agent", o.userAgent, "User agent to pass to the proxy server")
+	return flags
+}
+
+func (o *GrpcProxyClientOptions) Flags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("proxy", pflag.ContinueOnError)
+	flags.StringVar(&o.requestProto, "request-proto", o.requestProto, "The protocol for the request to send through the proxy.")
+	flags.StringVar(&o.requestPath, "request-path", o.requestPath, "The url request to send through the proxy.")
+	flags.StringVar(&o.requestHost, "request-host", o.requestHost, "The host of the request server.")
+	flags.IntVar(&o.requestPort, "request-port", o.requestPort, "The port the request server is listening on.")
 	flags.IntVar(&o.testRequests, "test-requests", o.testRequests, "The number of times to send the request.")
 	flags.IntVar(&o.testDelaySec, "test-delay", o.testDelaySec, "The delay in seconds between sending requests.")
 	flags.StringVar(&o.kubeConfig, "kubeconfig", o.kubeConfig, "Path to the kubeconfig file.")
@@ -118,6 +123,26 @@ func (o *GrpcProxyClientOptions) Print() {
 }
 
 func (o *GrpcProxyClientOptions) validate() error {
+	if err := o.validateTunnel(); err != nil {
+		return err
+	}
+	if o.requestProto != "http" && o.requestProto != "https" {
+		return fmt.Errorf("request protocol must be set to either 'http' or 'https' not %q", o.requestProto)
+	}
+	if o.requestPort > 49151 {
+		return fmt.Errorf("please do not try to use ephemeral port %d for the request server port", o.requestPort)
+	}
+	if o.testRequests < 1 {
+		return fmt.Errorf("please do not ask for fewer than 1 test request(%d)", o.testRequests)
+	}
+	if o.testDelaySec < 0 {
+		return fmt.Errorf("please do not ask for less than a 0 second delay(%d)", o.testDelaySec)
+	}
+	return nil
+}
+
+// validateTunnel validates the options of connecting to the tunnel server
+func (o *GrpcProxyClientOptions) validateTunnel() error {
 	if o.clientKey != "" {
 		if _, err := os.Stat(o.clientKey); os.IsNotExist(err) {
 			return err
@@ -139,15 +164,9 @@ func (o *GrpcProxyClientOptions) validate() error {
 			return err
 		}
 	}
-	if o.requestProto != "http" && o.requestProto != "https" {
-		return fmt.Errorf("request protocol must be set to either 'http' or 'https' not %q", o.requestProto)
-	}
 	if o.mode != "grpc" && o.mode != "http-connect" {
 		return fmt.Errorf("mode must be set to either 'grpc' or 'http-connect' not %q", o.mode)
 	}
-	if o.requestPort > 49151 {
-		return fmt.Errorf("please do not try to use ephemeral port %d for the request server port", o.requestPort)
-	}
 	if o.proxyPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the proxy server port", o.proxyPort)
 	}
@@ -166,12 +185,6 @@ func (o *GrpcProxyClientOptions) validate() error {
 				o.clientKey, o.clientCert, o.caCert)
 		}
 	}
-	if o.testRequests < 1 {
-		return fmt.Errorf("please do not ask for fewer than 1 test request(%d)", o.testRequests)
-	}
-	if o.testDelaySec < 0 {
-		return fmt.Errorf("please do not ask for less than a 0 second delay(%d)", o.testDelaySec)
-	}
 	return nil
 }
 
@@ -238,13 +251,13 @@ func (c *Client) run(o *GrpcProxyClientOptions) error {
 	} else {
 		config, err := clientcmd.BuildConfigFromFlags("", o.kubeConfig)
 		if err != nil {
-			panic(err.Error())
+			return fmt.Errorf("failed to load kubeconfig %s, got %v", o.kubeConfig, err)
 		}
 		config.Dial = dialer
 		// Create an API Clientset (k8s.io/client-go/kubernetes)
 		k8sClient, err = kubernetes.NewForConfig(config)
 		if err != nil {
-			panic(err.Error())
+			return fmt.Errorf("failed to create client of %s, got %v", config.Host, err)
 		}
 	}
 
@@ -290,7 +303,7 @@ func (c *Client) listPod(client *kubernetes.Clientset) error {
 	// Get a *PodList (k8s.io/api/core/v1)
 	pods, err := coreV1Client.Pods("").List(metaV1.ListOptions{})
 	if err != nil {
-		panic(err.Error())
+		return fmt.Errorf("failed to list pods, got %v", err)
 	}
 	for i, pod := range pods.Items {
 		fmt.Printf("Pod %d: %s\n", i+1, pod.ObjectMeta.Name)
@@ -318,153 +331,12 @@ func (c *Client) makeRequest(o *GrpcProxyClientOptions, client *http.Client) err
 	return nil
 }
 
+// getDialer returns a dialer which dials a fresh tunnel through the proxy
+// server for each connection
 func (c *Client) getDialer(o *GrpcProxyClientOptions) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
-	if o.proxyUdsName != "" {
-		return c.getUDSDialer(o)
-	}
-	return c.getMTLSDialer(o)
-}
-
-func (c *Client) getUDSDialer(o *GrpcProxyClientOptions) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
-	var proxyConn net.Conn
-	var err error
-
-	// Setup signal handler
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch)
-
-	go func() {
-		<-ch
-		if proxyConn != nil {
-			err := proxyConn.Close()
-			klog.ErrorS(err, "connection closed")
-		}
-	}()
-
-	switch o.mode {
-	case "grpc":
-		dialOption := grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
-			// Ignoring addr and timeout arguments:
-			// addr - comes from the closure
-			// timeout - is turned off as this is test code and eases debugging.
-			c, err := net.DialTimeout("unix", o.proxyUdsName, 0)
-			if err != nil {
-				klog.ErrorS(err, "failed to create connection to uds", "name", o.proxyUdsName)
-			}
-			return c, err
-		})
-		tunnel, err := client.CreateSingleUseGrpcTunnel(o.proxyUdsName, dialOption, grpc.WithInsecure(), grpc.WithUserAgent(o.userAgent))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create tunnel %s, got %v", o.proxyUdsName, err)
-		}
-
-		requestAddress := fmt.Sprintf("%s:%d", o.requestHost, o.requestPort)
-		proxyConn, err = tunnel.Dial("tcp", requestAddress)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial request %s, got %v", requestAddress, err)
-		}
-	case "http-connect":
-		requestAddress := fmt.Sprintf("%s:%d", o.requestHost, o.requestPort)
-
-		proxyConn, err = net.Dial("unix", o.proxyUdsName)
-		if err != nil {
-			return nil, fmt.Errorf("dialing proxy %q failed: %v", o.proxyUdsName, err)
-		}
-		fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n\r\n", requestAddress, "127.0.0.1", o.userAgent)
-		br := bufio.NewReader(proxyConn)
-		res, err := http.ReadResponse(br, nil)
-		if err != nil {
-			return nil, fmt.Errorf("reading HTTP response from CONNECT to %s via uds proxy %s failed: %v",
-				requestAddress, o.proxyUdsName, err)
-		}
-		if res.StatusCode != 200 {
-			return nil, fmt.Errorf("proxy error from %s while dialing %s: %v", o.proxyUdsName, requestAddress, res.Status)
-		}
-
-		// It's safe to discard the bufio.Reader here and return the
-		// original TCP conn directly because we only use this for
-		// TLS, and in TLS the client speaks first, so we know there's
-		// no unbuffered data. But we can double-check.
-		if br.Buffered() > 0 {
-			return nil, fmt.Errorf("unexpected %d bytes of buffered data from CONNECT uds proxy %q",
-				br.Buffered(), o.proxyUdsName)
-		}
-	default:
-		return nil, fmt.Errorf("failed to process mode %s", o.mode)
-	}
-
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return proxyConn, nil
-	}, nil
-}
-
-func (c *Client) getMTLSDialer(o *GrpcProxyClientOptions) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
-	var tlsConfig *tls.Config
-	var err error
-	tlsConfig, err = util.GetClientTLSConfig(o.caCert, o.clientCert, o.clientKey, o.proxyHost)
+	d, err := newTunnelDialer(o)
 	if err != nil {
 		return nil, err
 	}
-
-	var proxyConn net.Conn
-
-	// Setup signal handler
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch)
-
-	go func() {
-		<-ch
-		err := proxyConn.Close()
-		klog.ErrorS(err, "connection closed")
-	}()
-
-	switch o.mode {
-	case "grpc":
-		transportCreds := credentials.NewTLS(tlsConfig)
-		dialOption := grpc.WithTransportCredentials(transportCreds)
-		serverAddress := fmt.Sprintf("%s:%d", o.proxyHost, o.proxyPort)
-		tunnel, err := client.CreateSingleUseGrpcTunnel(serverAddress, dialOption)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create tunnel %s, got %v", serverAddress, err)
-		}
-
-		requestAddress := fmt.Sprintf("%s:%d", o.requestHost, o.requestPort)
-		proxyConn, err = tunnel.Dial("tcp", requestAddress)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial request %s, got %v", requestAddress, err)
-		}
-	case "http-connect":
-		proxyAddress := fmt.Sprintf("%s:%d", o.proxyHost, o.proxyPort)
-		requestAddress := fmt.Sprintf("%s:%d", o.requestHost, o.requestPort)
-
-		proxyConn, err = tls.Dial("tcp", proxyAddress, tlsConfig)
-		if err != nil {
-			return nil, fmt.Errorf("dialing proxy %q failed: %v", proxyAddress, err)
-		}
-		fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", requestAddress, "127.0.0.1")
-		br := bufio.NewReader(proxyConn)
-		res, err := http.ReadResponse(br, nil)
-		if err != nil {
-			return nil, fmt.Errorf("reading HTTP response from CONNECT to %s via proxy %s failed: %v",
-				requestAddress, proxyAddress, err)
-		}
-		if res.StatusCode != 200 {
-			return nil, fmt.Errorf("proxy error from %s while dialing %s: %v", proxyAddress, requestAddress, res.Status)
-		}
-
-		// It's safe to discard the bufio.Reader here and return the
-		// original TCP conn directly because we only use this for
-		// TLS, and in TLS the client speaks first, so we know there's
-		// no unbuffered data. But we can double-check.
-		if br.Buffered() > 0 {
-			return nil, fmt.Errorf("unexpected %d bytes of buffered data from CONNECT proxy %q",
-				br.Buffered(), proxyAddress)
-		}
-	default:
-		return nil, fmt.Errorf("failed to process mode %s", o.mode)
-	}
-
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return proxyConn, nil
-	}, nil
+	return d.DialContext, nil
 }
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// tunnelDialer dials the destinations through the proxy server, each
+// connection uses a fresh tunnel, since the proxy server closes the
+// tunnel once its connection is closed
+type tunnelDialer struct {
+	o         *GrpcProxyClientOptions
+	tlsConfig *tls.Config
+}
+
+func newTunnelDialer(o *GrpcProxyClientOptions) (*tunnelDialer, error) {
+	d := &tunnelDialer{o: o}
+	if o.proxyUdsName == "" {
+		tlsConfig, err := util.GetClientTLSConfig(o.caCert, o.clientCert, o.clientKey, o.proxyHost)
+		if err != nil {
+			return nil, err
+		}
+		d.tlsConfig = tlsConfig
+	}
+	return d, nil
+}
+
+// proxyAddress returns the address of the proxy server
+func (d *tunnelDialer) proxyAddress() string {
+	if d.o.proxyUdsName != "" {
+		return d.o.proxyUdsName
+	}
+	return net.JoinHostPort(d.o.proxyHost, fmt.Sprint(d.o.proxyPort))
+}
+
+// DialContext dials the address through a new tunnel
+func (d *tunnelDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch d.o.mode {
+	case "grpc":
+		return d.dialGRPC(ctx, addr)
+	case "http-connect":
+		return d.dialHTTPConnect(ctx, addr)
+	default:
+		return nil, fmt.Errorf("failed to process mode %s", d.o.mode)
+	}
+}
+
+func (d *tunnelDialer) dialGRPC(ctx context.Context, addr string) (net.Conn, error) {
+	var dialOptions []grpc.DialOption
+	if d.o.proxyUdsName != "" {
+		dialOptions = append(dialOptions,
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", d.o.proxyUdsName)
+			}),
+			grpc.WithInsecure())
+	} else {
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(d.tlsConfig)))
+	}
+	dialOptions = append(dialOptions, grpc.WithUserAgent(d.o.userAgent))
+
+	tunnel, err := client.CreateSingleUseGrpcTunnel(d.proxyAddress(), dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tunnel %s, got %v", d.proxyAddress(), err)
+	}
+	conn, err := tunnel.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial request %s, got %v", addr, err)
+	}
+	return conn, nil
+}
+
+func (d *tunnelDialer) dialHTTPConnect(ctx context.Context, addr string) (net.Conn, error) {
+	var (
+		proxyConn net.Conn
+		err       error
+	)
+	if d.o.proxyUdsName != "" {
+		var dialer net.Dialer
+		proxyConn, err = dialer.DialContext(ctx, "unix", d.o.proxyUdsName)
+	} else {
+		dialer := &tls.Dialer{Config: d.tlsConfig}
+		proxyConn, err = dialer.DialContext(ctx, "tcp", d.proxyAddress())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy %q failed: %v", d.proxyAddress(), err)
+	}
+
+	fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n\r\n", addr, "127.0.0.1", d.o.userAgent)
+	br := bufio.NewReader(proxyConn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("reading HTTP response from CONNECT to %s via proxy %s failed: %v",
+			addr, d.proxyAddress(), err)
+	}
+	if res.StatusCode != 200 {
+		proxyConn.Close()
+		return nil, fmt.Errorf("proxy error from %s while dialing %s: %v", d.proxyAddress(), addr, res.Status)
+	}
+
+	// It's safe to discard the bufio.Reader here and return the
+	// original TCP conn directly because we only use this for
+	// TLS, and in TLS the client speaks first, so we know there's
+	// no unbuffered data. But we can double-check.
+	if br.Buffered() > 0 {
+		proxyConn.Close()
+		return nil, fmt.Errorf("unexpected %d bytes of buffered data from CONNECT proxy %q",
+			br.Buffered(), d.proxyAddress())
+	}
+	return proxyConn, nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	tunnelk8s "github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
+)
+
+// kubeconfigOptions are the options of the kubeconfig subcommand
+type kubeconfigOptions struct {
+	*GrpcProxyClientOptions
+	cluster               string
+	apiserverPort         int
+	localProxy            string
+	kubeConfig            string
+	token                 string
+	tlsServerName         string
+	insecureSkipTLSVerify bool
+	output                string
+}
+
+func newKubeconfigCommand(o *GrpcProxyClientOptions) *cobra.Command {
+	ko := &kubeconfigOptions{
+		GrpcProxyClientOptions: o,
+		apiserverPort:          6443,
+	}
+	cmd := &cobra.Command{
+		Use:   "kubeconfig",
+		Short: "Generate a kubeconfig which accesses a registered cluster through the tunnel server",
+		Long: `Generate a kubeconfig whose proxy-url points at the HTTP-CONNECT master port of the
+tunnel server, so that the stock kubectl and client-go access the registered cluster
+through the tunnel. The CA and credentials of the cluster are read from --kubeconfig.
+
+By default, the kubeconfig connects to the tunnel server with the client certificate
+of --client-cert, and the apiserver is authenticated by the token. Set --local-proxy
+to the address of 'excalibur-tunnel-client proxy' instead, which connects to the tunnel
+server on behalf of the kubeconfig. For example:
+
+  excalibur-tunnel-client kubeconfig --cluster=cls-t8gz6mgd --proxy-host=10.0.0.10 \
+    --proxy-port=10263 --ca-cert=ca.crt --client-cert=client.crt --client-key=client.key \
+    --kubeconfig=cls-t8gz6mgd.kubeconfig > tunnel.kubeconfig
+  kubectl --kubeconfig=tunnel.kubeconfig get pods -A`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := ko.validate(); err != nil {
+				return fmt.Errorf("failed to validate kubeconfig options, got %v", err)
+			}
+			return ko.run()
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&ko.cluster, "cluster", ko.cluster, "The name of the registered cluster.")
+	flags.IntVar(&ko.apiserverPort, "apiserver-port", ko.apiserverPort,
+		"The port of the apiserver, which is dialed as <cluster>:<port> through the tunnel.")
+	flags.StringVar(&ko.localProxy, "local-proxy", ko.localProxy,
+		"The address of the local 'excalibur-tunnel-client proxy', which is used as the proxy-url if set.")
+	flags.StringVar(&ko.kubeConfig, "kubeconfig", ko.kubeConfig,
+		"Path to the kubeconfig file of the cluster, whose CA and credentials are used to access the apiserver.")
+	flags.StringVar(&ko.token, "token", ko.token, "The bearer token to access the apiserver, which overrides --kubeconfig.")
+	flags.StringVar(&ko.tlsServerName, "tls-server-name", ko.tlsServerName,
+		"The server name to verify the apiserver certificate, which may not contain the cluster name. "+
+			"It requires --local-proxy, since the clients verify the tunnel server with it as well.")
+	flags.BoolVar(&ko.insecureSkipTLSVerify, "insecure-skip-tls-verify", ko.insecureSkipTLSVerify,
+		"If true, the apiserver certificate will not be checked for validity.")
+	flags.StringVarP(&ko.output, "output", "o", ko.output, "The file to write the kubeconfig, stdout if empty.")
+	return cmd
+}
+
+func (o *kubeconfigOptions) validate() error {
+	if o.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+	if o.localProxy != "" {
+		if _, _, err := net.SplitHostPort(o.localProxy); err != nil {
+			return fmt.Errorf("invalid local proxy %s: %v", o.localProxy, err)
+		}
+		return nil
+	}
+	if err := o.validateTunnel(); err != nil {
+		return err
+	}
+	// the clients connect to the HTTP-CONNECT master port regardless of --mode
+	if o.proxyUdsName != "" {
+		return errors.New("the kubeconfig does not support --proxy-uds, set --local-proxy instead")
+	}
+	if o.clientCert == "" || o.caCert == "" {
+		return errors.New("--client-cert, --client-key and --ca-cert are required to connect to the tunnel server")
+	}
+	if o.tlsServerName != "" {
+		return errors.New("--tls-server-name requires --local-proxy")
+	}
+	return nil
+}
+
+func (o *kubeconfigOptions) run() error {
+	cluster, authInfo, err := o.clusterCredentials()
+	if err != nil {
+		return err
+	}
+	cluster.Server = fmt.Sprintf("https://%s", net.JoinHostPort(o.cluster, fmt.Sprint(o.apiserverPort)))
+	cluster.TLSServerName = o.tlsServerName
+
+	if o.localProxy != "" {
+		cluster.ProxyURL = "http://" + o.localProxy
+	} else {
+		// the clients verify the tunnel server and present the client
+		// certificate with the same tls config as the apiserver
+		cluster.ProxyURL = fmt.Sprintf("https://%s", net.JoinHostPort(o.proxyHost, fmt.Sprint(o.proxyPort)))
+		if authInfo.Token == "" {
+			return errors.New("a token is required to access the apiserver, since the client certificate " +
+				"is used by the tunnel server, set --token or a kubeconfig with token")
+		}
+		if authInfo.ClientCertificateData, err = ioutil.ReadFile(o.clientCert); err != nil {
+			return err
+		}
+		if authInfo.ClientKeyData, err = ioutil.ReadFile(o.clientKey); err != nil {
+			return err
+		}
+		if !cluster.InsecureSkipTLSVerify {
+			ca, err := ioutil.ReadFile(o.caCert)
+			if err != nil {
+				return err
+			}
+			cluster.CertificateAuthorityData = append(append(cluster.CertificateAuthorityData, '\n'), ca...)
+		}
+	}
+
+	data, err := tunnelk8s.NewKubeConfig(o.cluster, cluster, authInfo).Marshal()
+	if err != nil {
+		return err
+	}
+	if o.output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(o.output, data, 0600)
+}
+
+// clusterCredentials gets the CA and credentials of the cluster from
+// the kubeconfig and the token
+func (o *kubeconfigOptions) clusterCredentials() (tunnelk8s.Cluster, tunnelk8s.AuthInfo, error) {
+	var (
+		cluster  tunnelk8s.Cluster
+		authInfo tunnelk8s.AuthInfo
+	)
+	config := &rest.Config{}
+	if o.kubeConfig != "" {
+		var err error
+		if config, err = clientcmd.BuildConfigFromFlags("", o.kubeConfig); err != nil {
+			return cluster, authInfo, err
+		}
+		if err := rest.LoadTLSFiles(config); err != nil {
+			return cluster, authInfo, err
+		}
+	}
+
+	cluster.InsecureSkipTLSVerify = o.insecureSkipTLSVerify || config.Insecure
+	if !cluster.InsecureSkipTLSVerify {
+		cluster.CertificateAuthorityData = config.CAData
+	}
+	authInfo.Token = config.BearerToken
+	if authInfo.Token == "" && config.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(config.BearerTokenFile)
+		if err != nil {
+			return cluster, authInfo, err
+		}
+		authInfo.Token = string(token)
+	}
+	if o.token != "" {
+		authInfo.Token = o.token
+	}
+	if o.localProxy != "" {
+		authInfo.ClientCertificateData = config.CertData
+		authInfo.ClientKeyData = config.KeyData
+	}
+	return cluster, authInfo, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/signals"
+)
+
+// proxyOptions are the options of the proxy subcommand
+type proxyOptions struct {
+	*GrpcProxyClientOptions
+	cluster               string
+	address               string
+	port                  int
+	apiserverPort         int
+	kubeConfig            string
+	tlsServerName         string
+	insecureSkipTLSVerify bool
+}
+
+func newProxyCommand(o *GrpcProxyClientOptions) *cobra.Command {
+	po := &proxyOptions{
+		GrpcProxyClientOptions: o,
+		address:                "127.0.0.1",
+		port:                   8001,
+		apiserverPort:          6443,
+	}
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Run a proxy to the apiserver of a registered cluster through the tunnel server",
+		Long: `Run a proxy like 'kubectl proxy' which forwards every request, including the watch,
+exec and port-forward upgrades, to the apiserver of the registered cluster through
+the tunnel server, a fresh tunnel is dialed for each connection. The CONNECT requests
+are tunneled as well, so that it serves as the proxy-url of the kubeconfigs generated
+by the kubeconfig subcommand. For example:
+
+  excalibur-tunnel-client proxy --cluster=cls-t8gz6mgd --mode=http-connect \
+    --proxy-host=10.0.0.10 --proxy-port=10263 --ca-cert=ca.crt \
+    --client-cert=client.crt --client-key=client.key --kubeconfig=cls-t8gz6mgd.kubeconfig
+  kubectl --server=http://127.0.0.1:8001 get pods -A`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := po.validate(); err != nil {
+				return fmt.Errorf("failed to validate proxy options, got %v", err)
+			}
+			return po.run(signals.SetupSignalHandler())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&po.cluster, "cluster", po.cluster, "The name of the registered cluster to proxy to.")
+	flags.StringVar(&po.address, "address", po.address, "The IP address on which to serve on.")
+	flags.IntVar(&po.port, "port", po.port, "The port on which to run the proxy.")
+	flags.IntVar(&po.apiserverPort, "apiserver-port", po.apiserverPort,
+		"The port of the apiserver, which is dialed as <cluster>:<port> through the tunnel.")
+	flags.StringVar(&po.kubeConfig, "kubeconfig", po.kubeConfig,
+		"Path to the kubeconfig file of the cluster, whose CA and credentials are used to access the apiserver. "+
+			"The server of the kubeconfig is ignored, and the credentials of the requests are passed through if it is empty.")
+	flags.StringVar(&po.tlsServerName, "tls-server-name", po.tlsServerName,
+		"The server name to verify the apiserver certificate, which may not contain the cluster name.")
+	flags.BoolVar(&po.insecureSkipTLSVerify, "insecure-skip-tls-verify", po.insecureSkipTLSVerify,
+		"If true, the apiserver certificate will not be checked for validity.")
+	return cmd
+}
+
+func (o *proxyOptions) validate() error {
+	if err := o.validateTunnel(); err != nil {
+		return err
+	}
+	if o.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+	if o.port < 0 || o.port > 65535 {
+		return fmt.Errorf("invalid port %d", o.port)
+	}
+	return nil
+}
+
+// target returns the url of the apiserver, whose host is used by the
+// tunnel server to route the connection to the agent of the cluster
+func (o *proxyOptions) target() *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(o.cluster, fmt.Sprint(o.apiserverPort)),
+	}
+}
+
+// transport creates the transport to the apiserver, which dials through
+// the tunnel and authenticates by the kubeconfig
+func (o *proxyOptions) transport(dialer *tunnelDialer) (http.RoundTripper, error) {
+	config := &rest.Config{}
+	if o.kubeConfig != "" {
+		var err error
+		if config, err = clientcmd.BuildConfigFromFlags("", o.kubeConfig); err != nil {
+			return nil, err
+		}
+	}
+	config.Host = o.target().String()
+	if o.tlsServerName != "" {
+		config.TLSClientConfig.ServerName = o.tlsServerName
+	}
+	if o.insecureSkipTLSVerify {
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.CAData = nil
+	}
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+	// http/2 is not used, since it doesn't support the upgrades
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 25,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return rest.HTTPWrappersForConfig(config, transport)
+}
+
+func (o *proxyOptions) run(stopCh <-chan struct{}) error {
+	// the CONNECT requests and the other requests share the dialer
+	dialer, err := newTunnelDialer(o.GrpcProxyClientOptions)
+	if err != nil {
+		return err
+	}
+	transport, err := o.transport(dialer)
+	if err != nil {
+		return err
+	}
+	target := o.target()
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	// flush the responses immediately, e.g. the events of watch
+	proxy.FlushInterval = -1
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		klog.Errorf("failed to proxy %s %s to cluster %s: %v", r.Method, r.URL.Path, o.cluster, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	address := net.JoinHostPort(o.address, fmt.Sprint(o.port))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+	server := &http.Server{Handler: connectHandler(dialer.DialContext, proxy)}
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	fmt.Printf("Starting to serve cluster %s on %s\n", o.cluster, listener.Addr())
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// connectHandler tunnels the CONNECT requests through the dial, i.e. the
+// tunnel server, and passes the other requests to the handler
+func connectHandler(dial func(ctx context.Context, network, addr string) (net.Conn, error), h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		backend, err := dial(r.Context(), "tcp", r.Host)
+		if err != nil {
+			klog.Errorf("failed to tunnel CONNECT %s: %v", r.Host, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+		// the response is written to the hijacked connection, since net/http
+		// would reply a chunked 200, which a CONNECT response must not be
+		conn, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			klog.Errorf("failed to hijack CONNECT %s: %v", r.Host, err)
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			klog.Errorf("failed to reply CONNECT %s: %v", r.Host, err)
+			return
+		}
+
+		done := make(chan struct{}, 2)
+		go func() {
+			// the buffered reader may hold the data read from the connection
+			io.Copy(backend, bufrw.Reader)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, backend)
+			done <- struct{}{}
+		}()
+		<-done
+	})
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// echoServer serves a listener which echoes the data of every connection
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func newTestConnectServer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *httptest.Server {
+	return httptest.NewServer(connectHandler(dial, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+}
+
+func TestConnectHandler(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	var dialer net.Dialer
+	server := newTestConnectServer(dialer.DialContext)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %s", res.Status)
+	}
+	if len(res.TransferEncoding) != 0 || res.Header.Get("Content-Length") != "" {
+		t.Errorf("expected the CONNECT response without a body, got the transfer encoding %v and the headers %v",
+			res.TransferEncoding, res.Header)
+	}
+	if br.Buffered() != 0 {
+		t.Errorf("expected no data after the CONNECT response, got %d bytes", br.Buffered())
+	}
+
+	fmt.Fprint(conn, "ping")
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(br, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Errorf("expected the echo ping, got %q", data)
+	}
+}
+
+func TestConnectHandlerTransport(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	var dialer net.Dialer
+	server := newTestConnectServer(dialer.DialContext)
+	defer server.Close()
+
+	// the transport of net/http tunnels the https requests by CONNECT
+	proxyURL, _ := url.Parse(server.URL)
+	transport := backend.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	defer transport.CloseIdleConnections()
+	res, err := (&http.Client{Transport: transport}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok" {
+		t.Errorf("expected ok, got %q", body)
+	}
+}
+
+func TestConnectHandlerFailures(t *testing.T) {
+	server := newTestConnectServer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("no agent")
+	})
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodConnect, server.URL, nil)
+	req.Host = "cls-a:6443"
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 if the tunnel fails, got %s", res.Status)
+	}
+
+	res, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected the other requests passed to the handler, got %s", res.Status)
+	}
+}
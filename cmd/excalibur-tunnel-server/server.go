@@ -19,19 +19,18 @@ package main
 import (
 	"flag"
 
-	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/tkestack"
+	// register the built-in hook providers
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/providers"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/server"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/signals"
 	"github.com/tkestack/tke-excalibur/pkg/version"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
 func main() {
 	klog.InitFlags(nil)
 	defer klog.Flush()
-	// set hook provider for testing
-	provider := &tkestack.TKEStackProvider{}
-	cmd := server.NewTunnelServerCommand(provider, wait.NeverStop)
+	cmd := server.NewTunnelServerCommand(signals.SetupSignalHandler())
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 	if err := cmd.Execute(); err != nil {
 		klog.Fatalf("%s failed: %s", version.GetServerName(), err)
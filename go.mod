@@ -11,6 +11,7 @@ replace (
 )
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/mux v1.8.0
 	github.com/spf13/cobra v1.1.3
@@ -22,6 +23,7 @@ require (
 	k8s.io/klog/v2 v2.5.0
 	sigs.k8s.io/apiserver-network-proxy v0.0.15
 	sigs.k8s.io/apiserver-network-proxy/konnectivity-client v0.0.7
+	sigs.k8s.io/yaml v1.1.0
 	yunion.io/x/log v0.0.0-20201210064738-43181789dc74 // indirect
 	yunion.io/x/pkg v0.0.0-20210218105412-13a69f60034c
 )
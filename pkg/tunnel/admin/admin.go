@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admin defines the admin API of the tunnel server, which lists
+// the connected agents and force-disconnects them
+package admin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// AgentsPath lists the connected agents, and force-disconnects an
+	// agent by DELETE <AgentsPath>/<agent ID>
+	AgentsPath = "/v1/agents"
+)
+
+// Agent is a connection of an agent to the tunnel server
+type Agent struct {
+	// ID is the agent ID, i.e. the cluster name
+	ID          string `json:"id"`
+	Identifiers string `json:"identifiers,omitempty"`
+	Version     string `json:"version,omitempty"`
+	// RemoteAddr is the address the agent connects from
+	RemoteAddr string `json:"remoteAddr"`
+	// CommonName is the common name of the agent's certificate
+	CommonName     string    `json:"commonName,omitempty"`
+	ConnectedSince time.Time `json:"connectedSince"`
+	// ActiveStreams is the number of the tunneled connections in use
+	ActiveStreams int `json:"activeStreams"`
+	// BytesIn is the number of bytes received from the agent
+	BytesIn int64 `json:"bytesIn"`
+	// BytesOut is the number of bytes sent to the agent
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// AgentList is the response of listing the agents
+type AgentList struct {
+	// Server is the server replica serving the request
+	Server string  `json:"server"`
+	Items  []Agent `json:"items"`
+}
+
+// Client calls the admin API of the tunnel server
+type Client struct {
+	address string
+	client  *http.Client
+}
+
+// NewClient creates a client of the admin API at the given address
+func NewClient(address string, tlsCfg *tls.Config, timeout time.Duration) *Client {
+	return &Client{
+		address: address,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+			Timeout:   timeout,
+		},
+	}
+}
+
+// ListAgents lists the agents connected to the tunnel server
+func (c *Client) ListAgents() (*AgentList, error) {
+	data, err := c.do(http.MethodGet, AgentsPath)
+	if err != nil {
+		return nil, err
+	}
+	list := &AgentList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("failed to decode agent list: %v", err)
+	}
+	return list, nil
+}
+
+// DisconnectAgent force-disconnects all of the connections of the agent
+func (c *Client) DisconnectAgent(id string) error {
+	_, err := c.do(http.MethodDelete, AgentsPath+"/"+url.PathEscape(id))
+	return err
+}
+
+func (c *Client) do(method, path string) ([]byte, error) {
+	req, err := http.NewRequest(method, "https://"+c.address+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s failed with %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
@@ -18,6 +18,9 @@ package agent
 
 import (
 	"crypto/tls"
+	"time"
+
+	"google.golang.org/grpc"
 )
 
 // TunnelAgent sets up tunnel to TunnelServer, receive requests
@@ -26,14 +29,23 @@ type TunnelAgent interface {
 	Run(<-chan struct{})
 }
 
-// NewTunnelAgent generates a new TunnelAgent
+// NewTunnelAgent generates a new TunnelAgent, if identifiersCh is not nil,
+// the agent will re-register with the identifiers received from it, the
+// agent checks its connections every syncInterval and probeInterval, the
+// dialOptions are appended to the options of connecting to the server
 func NewTunnelAgent(tlsCfg *tls.Config,
-	tunnelServerAddr, clusterName, agentIdentifiers string) TunnelAgent {
+	tunnelServerAddr, clusterName, agentIdentifiers string,
+	identifiersCh <-chan string, syncInterval, probeInterval time.Duration,
+	dialOptions ...grpc.DialOption) TunnelAgent {
 	ata := anpTunnelAgent{
 		tlsCfg:           tlsCfg,
 		tunnelServerAddr: tunnelServerAddr,
 		clusterName:      clusterName,
 		agentIdentifiers: agentIdentifiers,
+		identifiersCh:    identifiersCh,
+		syncInterval:     syncInterval,
+		probeInterval:    probeInterval,
+		dialOptions:      dialOptions,
 	}
 
 	return &ata
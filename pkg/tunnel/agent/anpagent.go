@@ -17,13 +17,17 @@ limitations under the License.
 package agent
 
 import (
+	"context"
 	"crypto/tls"
 	"time"
 
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
 	"github.com/tkestack/tke-excalibur/pkg/version"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	anpagent "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 )
@@ -35,25 +39,90 @@ type anpTunnelAgent struct {
 	tunnelServerAddr string
 	clusterName      string
 	agentIdentifiers string
+	// identifiersCh notifies the changed identifiers, the agent will
+	// re-register with the server once received
+	identifiersCh <-chan string
+	// syncInterval is the interval the agent checks that it has
+	// connections to all of the tunnel-server instances
+	syncInterval time.Duration
+	// probeInterval is the interval the agent checks if its connections
+	// to the tunnel-server are ready
+	probeInterval time.Duration
+	dialOptions   []grpc.DialOption
 }
 
 var _ TunnelAgent = &anpTunnelAgent{}
 
 // RunAgent runs the tunnel-agent which will try to connect tunnel-server
 func (ata *anpTunnelAgent) Run(stopChan <-chan struct{}) {
-	dialOption := grpc.WithTransportCredentials(credentials.NewTLS(ata.tlsCfg))
+	if ata.identifiersCh == nil {
+		ata.serve(ata.agentIdentifiers, stopChan)
+		return
+	}
+
+	csStopCh := make(chan struct{})
+	cs := ata.serve(ata.agentIdentifiers, csStopCh)
+	go func() {
+		for {
+			select {
+			case <-stopChan:
+				close(csStopCh)
+				return
+			case identifiers := <-ata.identifiersCh:
+				if identifiers == ata.agentIdentifiers {
+					continue
+				}
+				klog.Infof("re-register to %s with agent identifiers: %s",
+					version.GetServerName(), identifiers)
+				// the identifiers are only sent when connecting, so close
+				// the connections and connect to the server again, the
+				// client set checks the stop channel after each sync
+				close(csStopCh)
+				waitForShutdown(cs, 2*ata.syncInterval)
+				ata.agentIdentifiers = identifiers
+				csStopCh = make(chan struct{})
+				cs = ata.serve(identifiers, csStopCh)
+			}
+		}
+	}()
+}
+
+// serve creates a client set which connects to the tunnel-server with
+// the given identifiers until stopCh is closed
+func (ata *anpTunnelAgent) serve(agentIdentifiers string, stopCh <-chan struct{}) *anpagent.ClientSet {
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(ata.tlsCfg)),
+		grpc.WithChainStreamInterceptor(versionStreamInterceptor),
+	}
 	cc := &anpagent.ClientSetConfig{
 		Address:                 ata.tunnelServerAddr,
 		AgentID:                 ata.clusterName,
-		AgentIdentifiers:        ata.agentIdentifiers,
-		SyncInterval:            5 * time.Second,
-		ProbeInterval:           5 * time.Second,
-		DialOptions:             []grpc.DialOption{dialOption},
+		AgentIdentifiers:        agentIdentifiers,
+		SyncInterval:            ata.syncInterval,
+		ProbeInterval:           ata.probeInterval,
+		DialOptions:             append(dialOptions, ata.dialOptions...),
 		ServiceAccountTokenPath: "",
 	}
 
-	cs := cc.NewAgentClientSet(stopChan)
+	cs := cc.NewAgentClientSet(stopCh)
 	cs.Serve()
 	klog.Infof("start serving grpc request redirected from %s: %s",
 		version.GetServerName(), ata.tunnelServerAddr)
+	return cs
+}
+
+// versionStreamInterceptor sends the version of the agent to the server
+func versionStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		constants.TunnelAgentVersionHeader, version.Get().GitVersion)
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// waitForShutdown waits until all of the clients of the client set are
+// closed or timeout
+func waitForShutdown(cs *anpagent.ClientSet, timeout time.Duration) {
+	_ = wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		return cs.ClientsCount() == 0, nil
+	})
 }
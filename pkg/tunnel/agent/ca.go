@@ -0,0 +1,53 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server/serveraddr"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// tunnelServerCAData returns the CA which verifies the tunnel server, i.e.
+// the CA file, or the CA published in the bootstrap configmap if the CA
+// file doesn't exist, e.g. only the token is mounted since the hub
+// apiserver is trusted by the system roots
+func tunnelServerCAData(caFile string, cloudClient kubernetes.Interface) ([]byte, error) {
+	if caFile != "" {
+		if _, err := os.Stat(caFile); !os.IsNotExist(err) {
+			return ioutil.ReadFile(caFile)
+		}
+	}
+	if cloudClient == nil {
+		return nil, fmt.Errorf("CA file(%s) doesn't exist", caFile)
+	}
+	info, err := serveraddr.GetBootstrapInfo(cloudClient)
+	if err != nil {
+		return nil, fmt.Errorf("CA file(%s) doesn't exist, and failed to get the CA of the bootstrap configmap: %v",
+			caFile, err)
+	}
+	if len(info.CAData) == 0 {
+		return nil, fmt.Errorf("CA file(%s) doesn't exist, and the bootstrap configmap has no CA", caFile)
+	}
+	klog.Infof("CA file(%s) doesn't exist, use the CA of the bootstrap configmap", caFile)
+	return info.CAData, nil
+}
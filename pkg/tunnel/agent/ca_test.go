@@ -0,0 +1,91 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server/serveraddr"
+)
+
+func TestTunnelServerCAData(t *testing.T) {
+	defer setEnv(constants.TunnelServerNSEnv, "tkestack")()
+	dir, err := ioutil.TempDir("", "excalibur-agent-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, []byte("file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bootstrap := func(caData string) kubernetes.Interface {
+		return fake.NewSimpleClientset(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "tkestack",
+				Name:      constants.TunnelServerBootstrapConfigMapName,
+			},
+			Data: map[string]string{serveraddr.BootstrapCAKey: caData},
+		})
+	}
+	absentFile := filepath.Join(dir, "absent.crt")
+
+	cases := []struct {
+		name   string
+		caFile string
+		client kubernetes.Interface
+		// expected is the CA data, or the substring of the error
+		expected string
+		invalid  bool
+	}{
+		{name: "ca file", caFile: caFile, client: bootstrap("configmap"), expected: "file"},
+		{name: "bootstrap configmap", caFile: absentFile, client: bootstrap("configmap"), expected: "configmap"},
+		{name: "unset ca file", client: bootstrap("configmap"), expected: "configmap"},
+		{name: "no hub client", caFile: absentFile, expected: "doesn't exist", invalid: true},
+		{name: "no bootstrap configmap", caFile: absentFile, client: fake.NewSimpleClientset(),
+			expected: "failed to get the CA of the bootstrap configmap", invalid: true},
+		{name: "no ca in bootstrap configmap", caFile: absentFile, client: bootstrap(""),
+			expected: "the bootstrap configmap has no CA", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			caData, err := tunnelServerCAData(c.caFile, c.client)
+			if c.invalid {
+				if err == nil || !strings.Contains(err.Error(), c.expected) {
+					t.Errorf("expected error containing %q, got %v", c.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(caData) != c.expected {
+				t.Errorf("expected CA %q, got %q", c.expected, caData)
+			}
+		})
+	}
+}
@@ -17,19 +17,30 @@ limitations under the License.
 package agent
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/certificate"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 	"yunion.io/x/pkg/util/wait"
 
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/config"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/pki"
@@ -39,9 +50,14 @@ import (
 )
 
 // NewTunnelAgentCommand creates a new tunnel-agent command
-func NewTunnelAgentCommand(provider interfaces.TunnelHookProvider, stopCh <-chan struct{}) *cobra.Command {
+func NewTunnelAgentCommand(stopCh <-chan struct{}) *cobra.Command {
+	// the defaults are the ones of the configuration file
+	cfg := &config.TunnelAgentConfiguration{}
+	config.SetDefaultsTunnelAgentConfiguration(cfg)
 	o := &TunnelAgentOptions{}
+	o.applyConfig(cfg)
 	cmd := &cobra.Command{
+		Use:   version.GetAgentName(),
 		Short: fmt.Sprintf("Launch %s", version.GetAgentName()),
 		RunE: func(c *cobra.Command, args []string) error {
 			if o.version {
@@ -50,10 +66,13 @@ func NewTunnelAgentCommand(provider interfaces.TunnelHookProvider, stopCh <-chan
 			}
 			fmt.Printf("%s version: %#v\n", version.GetAgentName(), version.Get())
 
+			if err := o.loadConfig(c.Flags()); err != nil {
+				return err
+			}
 			if err := o.validate(); err != nil {
 				return err
 			}
-			if err := o.complete(provider); err != nil {
+			if err := o.complete(); err != nil {
 				return err
 			}
 			if err := o.run(stopCh); err != nil {
@@ -63,42 +82,222 @@ func NewTunnelAgentCommand(provider interfaces.TunnelHookProvider, stopCh <-chan
 		},
 	}
 
-	flags := cmd.Flags()
-	flags.BoolVar(&o.version, "version", o.version,
-		"print the version information.")
-	flags.StringVar(&o.clusterName, "cluster-name", o.clusterName,
+	// the flags of connecting to the clusters are shared by the diagnose
+	persistentFlags := cmd.PersistentFlags()
+	persistentFlags.StringVar(&o.configFile, "config", o.configFile,
+		fmt.Sprintf("Path to the %s file of the %s, the flags set on the command line override the file.",
+			config.TunnelAgentConfigurationKind, version.GetAgentName()))
+	persistentFlags.StringVar(&o.clusterName, "cluster-name", o.clusterName,
 		"The name of the cluster.")
-	flags.StringVar(&o.tunnelServerAddr, "tunnelserver-addr", o.tunnelServerAddr,
+	persistentFlags.StringVar(&o.tunnelServerAddr, "tunnelserver-addr", o.tunnelServerAddr,
 		fmt.Sprintf("The address of %s", version.GetServerName()))
-	flags.StringVar(&o.apiserverAddr, "apiserver-addr", o.tunnelServerAddr,
+	persistentFlags.StringVar(&o.apiserverAddr, "apiserver-addr", o.tunnelServerAddr,
 		"A reachable address of the apiserver.")
-	flags.StringVar(&o.kubeConfig, "kube-config", o.kubeConfig,
+	persistentFlags.StringVar(&o.ipFamilyPreference, "ip-family-preference", o.ipFamilyPreference,
+		fmt.Sprintf("The ip family of the discovered %s address, IPv4 or IPv6, the primary family of "+
+			"%s is preferred if not set.", version.GetServerName(), constants.TunnelServerServiceName))
+	persistentFlags.StringVar(&o.kubeConfig, "kube-config", o.kubeConfig,
 		"Path to the kubeconfig file.")
+	persistentFlags.StringVar(&o.caFile, "ca-file", o.caFile,
+		fmt.Sprintf("The CA file of the hub cluster, which verifies the apiserver and %s. If the file "+
+			"doesn't exist, the apiserver is verified by the system roots and %s by the CA of the bootstrap configmap.",
+			version.GetServerName(), version.GetServerName()))
+	persistentFlags.StringVar(&o.tokenFile, "token-file", o.tokenFile,
+		"The token file of the agent service account in the hub cluster.")
+	persistentFlags.StringVar(&o.certDir, "cert-dir", o.certDir,
+		fmt.Sprintf("The directory where the certificate of %s is stored.", version.GetAgentName()))
+
+	flags := cmd.Flags()
+	flags.BoolVar(&o.version, "version", o.version,
+		"print the version information.")
 	flags.StringVar(&o.agentIdentifiers, "agent-identifiers", o.agentIdentifiers,
 		"The identifiers of the agent, which will be used by the server when choosing agent.")
+	flags.BoolVar(&o.dynamicIdentifiers, "dynamic-agent-identifiers", o.dynamicIdentifiers,
+		"Generate agent identifiers from the node internal ips and the dns names of the "+
+			"selected services of the managed cluster, and re-register when they change.")
+	flags.StringVar(&o.identifierServiceSelector, "identifier-service-selector", o.identifierServiceSelector,
+		"The label selector of the services whose dns names are added by --dynamic-agent-identifiers, "+
+			"the names must be unique among the managed clusters.")
+	flags.StringVar(&o.clusterDomain, "cluster-domain", o.clusterDomain,
+		"The dns domain of the managed cluster.")
+	flags.StringVar(&o.allowedCIDRs, "allowed-cidrs", o.allowedCIDRs,
+		fmt.Sprintf("The destination cidrs that %s is allowed to dial. (e.g., cidr1,cidr2)",
+			version.GetServerName()))
+	flags.StringVar(&o.allowedHosts, "allowed-hosts", o.allowedHosts,
+		fmt.Sprintf("The destination hosts that %s is allowed to dial, "+
+			"wildcard like *.example.com is supported. (e.g., host1,host2)", version.GetServerName()))
+	flags.StringVar(&o.allowedPorts, "allowed-ports", o.allowedPorts,
+		fmt.Sprintf("The destination ports that %s is allowed to dial, all ports are allowed if empty. "+
+			"(e.g., port1,port2)", version.GetServerName()))
+	flags.StringVar(&o.dialPolicyConfigMap, "dial-policy-configmap", o.dialPolicyConfigMap,
+		"The namespace/name of the configmap that contains cidrs, hosts and ports of the dial policy, "+
+			"which takes precedence over the --allowed-* flags. Only the local apiserver is allowed "+
+			"if neither of them is set.")
+	flags.StringVar(&o.auditLogPath, "audit-log-path", o.auditLogPath,
+		"If set, the denied dial requests are logged to the file, '-' means standard out.")
+	flags.IntVar(&o.auditLogMaxSize, "audit-log-maxsize", o.auditLogMaxSize,
+		"The maximum size in megabytes of the audit log file before it gets rotated.")
+	flags.IntVar(&o.auditLogMaxBackups, "audit-log-maxbackup", o.auditLogMaxBackups,
+		"The maximum number of rotated audit log files to retain.")
+	flags.StringVar(&o.hookProviderNames, "hook-provider", o.hookProviderNames,
+		fmt.Sprintf("The hook provider, or a comma separated chain of providers executed in order. "+
+			"Available providers: %s", strings.Join(hook.Providers(), ",")))
+	flags.StringVar(&o.hookConfigFile, "hook-config", o.hookConfigFile,
+		"Path to the YAML or JSON file that configures the hook providers, "+
+			"the top level keys are the provider names.")
+	flags.DurationVar(&o.preStopHookTimeout, "pre-stop-hook-timeout", o.preStopHookTimeout,
+		"The time given to the pre-stop hook before the components stop.")
+	flags.DurationVar(&o.syncInterval, "sync-interval", o.syncInterval,
+		fmt.Sprintf("The interval to check the connections to all of the %s instances.",
+			version.GetServerName()))
+	flags.DurationVar(&o.probeInterval, "probe-interval", o.probeInterval,
+		fmt.Sprintf("The interval to check the connections to %s are ready.", version.GetServerName()))
+
+	cmd.AddCommand(newDiagnoseCommand(o))
 	return cmd
 }
 
 // TunnelAgentOptions has the information that required by the
 // tunnel-agent
 type TunnelAgentOptions struct {
+	configFile       string
 	clusterName      string
 	tunnelServerAddr string
 	apiserverAddr    string
-	kubeConfig       string
-	version          bool
+	// the ip family of the discovered tunnel-server address
+	ipFamilyPreference string
+	kubeConfig         string
+	caFile             string
+	tokenFile          string
+	certDir            string
+	version            bool
 	// the clinet to access cloud k8s api server
 	cloudClientSet kubernetes.Interface
 	// the clinet to access local k8s api server
-	localClientSet   kubernetes.Interface
-	agentIdentifiers string
-	hookProvider     interfaces.TunnelHookProvider
+	localClientSet    kubernetes.Interface
+	agentIdentifiers  string
+	hookProviderNames string
+	hookConfigFile    string
+	hookProvider      interfaces.TunnelHookProvider
+	// the time given to the pre-stop hook
+	preStopHookTimeout time.Duration
+	// generate agent identifiers from the managed cluster
+	dynamicIdentifiers        bool
+	identifierServiceSelector string
+	clusterDomain             string
+	// dial policy of the destinations
+	allowedCIDRs        string
+	allowedHosts        string
+	allowedPorts        string
+	dialPolicyConfigMap string
+	auditLogPath        string
+	auditLogMaxSize     int
+	auditLogMaxBackups  int
+	// the intervals of checking the connections to the servers
+	syncInterval  time.Duration
+	probeInterval time.Duration
+}
+
+// applyConfig sets the options from the configuration
+func (o *TunnelAgentOptions) applyConfig(cfg *config.TunnelAgentConfiguration) {
+	o.clusterName = cfg.ClusterName
+	o.tunnelServerAddr = cfg.TunnelServerAddress
+	o.apiserverAddr = cfg.APIServerAddress
+	o.ipFamilyPreference = cfg.IPFamilyPreference
+	o.kubeConfig = cfg.KubeConfig
+	o.caFile = cfg.CAFile
+	o.tokenFile = cfg.TokenFile
+	o.certDir = cfg.CertDir
+	o.agentIdentifiers = cfg.AgentIdentifiers
+	o.dynamicIdentifiers = cfg.DynamicAgentIdentifiers
+	o.identifierServiceSelector = cfg.IdentifierServiceSelector
+	o.clusterDomain = cfg.ClusterDomain
+	o.allowedCIDRs = strings.Join(cfg.DialPolicy.AllowedCIDRs, ",")
+	o.allowedHosts = strings.Join(cfg.DialPolicy.AllowedHosts, ",")
+	ports := make([]string, 0, len(cfg.DialPolicy.AllowedPorts))
+	for _, port := range cfg.DialPolicy.AllowedPorts {
+		ports = append(ports, strconv.Itoa(int(port)))
+	}
+	o.allowedPorts = strings.Join(ports, ",")
+	o.dialPolicyConfigMap = cfg.DialPolicy.ConfigMap
+	o.syncInterval = cfg.SyncInterval.Duration
+	o.probeInterval = cfg.ProbeInterval.Duration
+	o.auditLogPath = cfg.AuditLog.Path
+	o.auditLogMaxSize = int(cfg.AuditLog.MaxSize)
+	o.auditLogMaxBackups = int(cfg.AuditLog.MaxBackups)
+	o.hookProviderNames = strings.Join(cfg.Hook.Providers, ",")
+	o.hookConfigFile = cfg.Hook.ConfigFile
+	o.preStopHookTimeout = cfg.Hook.PreStopTimeout.Duration
+}
+
+// loadConfig loads the configuration file if --config is set, the flags
+// set on the command line take precedence over the file
+func (o *TunnelAgentOptions) loadConfig(flags *pflag.FlagSet) error {
+	if o.configFile == "" {
+		return nil
+	}
+	cfg, err := config.LoadTunnelAgentConfiguration(o.configFile)
+	if err != nil {
+		return err
+	}
+	klog.Infof("load the configuration from %s", o.configFile)
+	return config.ApplyWithFlags(flags, func() { o.applyConfig(cfg) })
+}
+
+// toConfig returns the configuration merged from the file and the flags
+func (o *TunnelAgentOptions) toConfig() (*config.TunnelAgentConfiguration, error) {
+	cfg := &config.TunnelAgentConfiguration{
+		ClusterName:               o.clusterName,
+		TunnelServerAddress:       o.tunnelServerAddr,
+		APIServerAddress:          o.apiserverAddr,
+		IPFamilyPreference:        o.ipFamilyPreference,
+		KubeConfig:                o.kubeConfig,
+		CAFile:                    o.caFile,
+		TokenFile:                 o.tokenFile,
+		CertDir:                   o.certDir,
+		AgentIdentifiers:          o.agentIdentifiers,
+		DynamicAgentIdentifiers:   o.dynamicIdentifiers,
+		IdentifierServiceSelector: o.identifierServiceSelector,
+		ClusterDomain:             o.clusterDomain,
+		DialPolicy: config.DialPolicyOptions{
+			AllowedCIDRs: splitList(o.allowedCIDRs),
+			AllowedHosts: splitList(o.allowedHosts),
+			ConfigMap:    o.dialPolicyConfigMap,
+		},
+		SyncInterval:  metav1.Duration{Duration: o.syncInterval},
+		ProbeInterval: metav1.Duration{Duration: o.probeInterval},
+		AuditLog: config.AuditLogOptions{
+			Path:       o.auditLogPath,
+			MaxSize:    int32(o.auditLogMaxSize),
+			MaxBackups: int32(o.auditLogMaxBackups),
+		},
+		Hook: config.HookOptions{
+			Providers:      splitList(o.hookProviderNames),
+			ConfigFile:     o.hookConfigFile,
+			PreStopTimeout: metav1.Duration{Duration: o.preStopHookTimeout},
+		},
+	}
+	cfg.APIVersion = config.APIVersion
+	cfg.Kind = config.TunnelAgentConfigurationKind
+	for _, port := range splitList(o.allowedPorts) {
+		p, err := strconv.ParseInt(port, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("--allowed-ports is invalid: %v", err)
+		}
+		cfg.DialPolicy.AllowedPorts = append(cfg.DialPolicy.AllowedPorts, int32(p))
+	}
+	return cfg, nil
 }
 
-// validate validates the TunnelServerOptions
+// validate validates the configuration merged from the file and the
+// flags, so that the flags are validated the same as the file
 func (o *TunnelAgentOptions) validate() error {
-	if o.clusterName == "" {
-		return errors.New("--cluster-name is not set")
+	cfg, err := o.toConfig()
+	if err != nil {
+		return err
+	}
+	if err := config.ValidateTunnelAgentConfiguration(cfg).ToAggregate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
 	}
 
 	if !agentIdentifiersAreValid(o.agentIdentifiers) {
@@ -109,9 +308,17 @@ func (o *TunnelAgentOptions) validate() error {
 }
 
 // complete completes all the required options
-func (o *TunnelAgentOptions) complete(provider interfaces.TunnelHookProvider) error {
+func (o *TunnelAgentOptions) complete() error {
 	var err error
 
+	if o.hookProviderNames != "" {
+		o.hookProvider, err = hook.New(o.hookProviderNames, o.hookConfigFile)
+		if err != nil {
+			return err
+		}
+		klog.Infof("set hook provider to [%s].", o.hookProvider.GetProviderName())
+	}
+
 	if len(o.agentIdentifiers) == 0 {
 		o.agentIdentifiers = fmt.Sprintf("host=%s", o.clusterName)
 	}
@@ -119,23 +326,23 @@ func (o *TunnelAgentOptions) complete(provider interfaces.TunnelHookProvider) er
 
 	if o.apiserverAddr != "" {
 		klog.Infof("create the clientset based on the apiserver address(%s).", o.apiserverAddr)
-		o.cloudClientSet, err = k8s.CreateClientSetApiserverAddr(o.apiserverAddr)
-		return err
+		o.cloudClientSet, err = k8s.CreateClientSetApiserverAddr(o.apiserverAddr, o.tokenFile, o.caFile)
+		if err != nil {
+			return err
+		}
 	}
 
 	if o.kubeConfig != "" {
 		klog.Infof("create the clientset based on the kubeconfig(%s).", o.kubeConfig)
 		o.localClientSet, err = k8s.CreateClientSetKubeConfig(o.kubeConfig)
-		return err
 	} else {
 		klog.Infof("create the clientset based on the kubeconfig(in-cluster config).")
 		o.localClientSet, err = k8s.CreateClientSet(o.kubeConfig)
 	}
-
-	if o.hookProvider != nil {
-		o.hookProvider = provider
-		klog.Infof("set hook provider to [%s].", o.hookProvider.GetProviderName())
+	if err != nil {
+		return err
 	}
+
 	return err
 }
 
@@ -143,13 +350,35 @@ func (o *TunnelAgentOptions) complete(provider interfaces.TunnelHookProvider) er
 func (o *TunnelAgentOptions) run(stopCh <-chan struct{}) error {
 	var (
 		tunnelServerAddr string
+		agentIdentifiers string
 		err              error
 		agentCertMgr     certificate.Manager
 	)
 
+	// the components keep running until the pre-stop hook is executed
+	runCh := make(chan struct{})
+	defer close(runCh)
+	hookCtx := hook.ContextForChannel(runCh)
+	newHookContext := func(ctx context.Context, event interfaces.HookEvent) *interfaces.HookContext {
+		hc := &interfaces.HookContext{
+			Context:          ctx,
+			Event:            event,
+			Component:        version.GetAgentName(),
+			ClusterName:      o.clusterName,
+			AgentIdentifiers: agentIdentifiers,
+			ServerAddress:    tunnelServerAddr,
+			CloudClient:      o.cloudClientSet,
+			LocalClient:      o.localClientSet,
+		}
+		if agentCertMgr != nil {
+			hc.Certificate = agentCertMgr.Current()
+		}
+		return hc
+	}
+
 	// 1. excute pre start tunnel agent hook
 	if o.hookProvider != nil {
-		err = o.hookProvider.PreStartTunnelAgent(o.clusterName, o.cloudClientSet, o.localClientSet)
+		err = o.hookProvider.PreStartTunnelAgent(newHookContext(hookCtx, interfaces.PreStartTunnelAgent))
 		if err != nil {
 			return fmt.Errorf("faild to excute %s provider pre-start tunnel agent hook due to %v",
 				o.hookProvider.GetProviderName(), err)
@@ -159,23 +388,32 @@ func (o *TunnelAgentOptions) run(stopCh <-chan struct{}) error {
 	// 2. get the address of the tunnel-server
 	tunnelServerAddr = o.tunnelServerAddr
 	if o.tunnelServerAddr == "" {
-		if tunnelServerAddr, err = serveraddr.GetTunnelServerAddr(o.cloudClientSet); err != nil {
+		// dial the first reachable one of the candidates, e.g. the nodes
+		// of a NodePort service
+		addrs, err := serveraddr.GetTunnelServerAddrs(o.cloudClientSet, v1.IPFamily(o.ipFamilyPreference))
+		if err != nil {
 			return err
 		}
+		tunnelServerAddr = serveraddr.FirstReachableAddr(addrs, constants.TunnelAgentDialTimeoutSec*time.Second)
 	}
 	klog.Infof("%s address: %s", version.GetServerName(), tunnelServerAddr)
 
 	// 3. create a certificate manager
 	agentCertMgr, err =
-		certmanager.NewTunnelAgentCertManager(o.cloudClientSet, o.clusterName)
+		certmanager.NewTunnelAgentCertManager(o.cloudClientSet, o.clusterName, o.certDir)
 	if err != nil {
 		return err
 	}
 	agentCertMgr.Start()
+	defer agentCertMgr.Stop()
 
 	// 4. generate a TLS configuration for securing the connection to server
-	tlsCfg, err := pki.GenTLSConfigUseCertMgrAndCA(agentCertMgr,
-		tunnelServerAddr, constants.TunnelAgentCAFile)
+	caData, err := tunnelServerCAData(o.caFile, o.cloudClientSet)
+	if err != nil {
+		return err
+	}
+	tlsCfg, err := pki.GenTLSConfigUseCertMgrAndCAData(agentCertMgr,
+		tunnelServerAddr, caData)
 	if err != nil {
 		return err
 	}
@@ -188,24 +426,92 @@ func (o *TunnelAgentOptions) run(stopCh <-chan struct{}) error {
 		klog.Infof("waiting for the master to sign the %s certificate",
 			version.GetAgentName())
 		return false, nil
-	}, stopCh)
+	}, runCh)
+	if o.hookProvider != nil {
+		certmanager.WatchRotation(agentCertMgr, func(cert *tls.Certificate) {
+			err := o.hookProvider.CertificateRotated(newHookContext(hookCtx, interfaces.CertificateRotated))
+			if err != nil {
+				klog.Errorf("faild to excute %s provider certificate rotated hook due to %v",
+					o.hookProvider.GetProviderName(), err)
+			}
+		}, runCh)
+	}
 
-	// 6. start the tunnel-agent
-	ta := NewTunnelAgent(tlsCfg, tunnelServerAddr, o.clusterName, o.agentIdentifiers)
-	ta.Run(stopCh)
+	// 6. enforce the dial policy to the requests from the tunnel-server
+	enforcer, err := o.newDialPolicyEnforcer(runCh)
+	if err != nil {
+		return err
+	}
 
-	// 7. excute post start tunnel agent hook
+	// 7. start the tunnel-agent, watch the managed cluster to generate
+	// the agent identifiers if required
+	var identifiersCh <-chan string
+	agentIdentifiers = o.agentIdentifiers
+	if o.dynamicIdentifiers {
+		iw := newIdentifierWatcher(o.localClientSet, o.clusterName,
+			o.agentIdentifiers, o.identifierServiceSelector, o.clusterDomain)
+		if agentIdentifiers, err = iw.Start(runCh); err != nil {
+			return err
+		}
+		identifiersCh = iw.Updates()
+		klog.Infof("%s is generated for agent identifies", agentIdentifiers)
+	}
+	ta := NewTunnelAgent(tlsCfg, tunnelServerAddr, o.clusterName, agentIdentifiers, identifiersCh,
+		o.syncInterval, o.probeInterval,
+		grpc.WithChainStreamInterceptor(enforcer.StreamInterceptor()))
+	ta.Run(runCh)
+
+	// 8. excute post start tunnel agent hook
 	if o.hookProvider != nil {
-		err = o.hookProvider.PostStartTunnelAgent(o.clusterName, o.cloudClientSet, o.localClientSet)
+		err = o.hookProvider.PostStartTunnelAgent(newHookContext(hookCtx, interfaces.PostStartTunnelAgent))
 		if err != nil {
 			return fmt.Errorf("faild to excute %s provider post-start tunnel agent hook due to %v",
 				o.hookProvider.GetProviderName(), err)
 		}
 	}
 	<-stopCh
+
+	// 9. excute pre stop tunnel agent hook before the components stop
+	if o.hookProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), o.preStopHookTimeout)
+		defer cancel()
+		err = o.hookProvider.PreStopTunnelAgent(newHookContext(ctx, interfaces.PreStopTunnelAgent))
+		if err != nil {
+			klog.Errorf("faild to excute %s provider pre-stop tunnel agent hook due to %v",
+				o.hookProvider.GetProviderName(), err)
+		}
+	}
 	return nil
 }
 
+// newDialPolicyEnforcer creates the dial policy enforcer based on the
+// configmap and flags
+func (o *TunnelAgentOptions) newDialPolicyEnforcer(stopCh <-chan struct{}) (*dialPolicyEnforcer, error) {
+	policy := defaultDialPolicy(o.clusterName, o.clusterDomain)
+	if o.allowedCIDRs != "" || o.allowedHosts != "" || o.allowedPorts != "" {
+		var err error
+		policy, err = newDialPolicy(o.allowedCIDRs, o.allowedHosts, o.allowedPorts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial policy: %v", err)
+		}
+	}
+	klog.Infof("dial policy is set to %s", policy)
+
+	auditLogger, err := audit.NewLogger(o.auditLogPath, o.auditLogMaxSize, o.auditLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	enforcer := newDialPolicyEnforcer(policy, o.clusterName, auditLogger)
+
+	if o.dialPolicyConfigMap != "" {
+		ns, name, _ := cache.SplitMetaNamespaceKey(o.dialPolicyConfigMap)
+		if err := enforcer.WatchConfigMap(o.localClientSet, ns, name, stopCh); err != nil {
+			return nil, err
+		}
+	}
+	return enforcer, nil
+}
+
 // agentIdentifiersIsValid verify agent identifiers are valid or not
 func agentIdentifiersAreValid(agentIdentifiers string) bool {
 	if len(agentIdentifiers) == 0 {
@@ -0,0 +1,500 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/certificate"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/pki"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server/serveraddr"
+	"github.com/tkestack/tke-excalibur/pkg/version"
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+// checkResult is the result of a diagnose check, the hint tells how to
+// fix the failure
+type checkResult struct {
+	status checkStatus
+	detail string
+	err    error
+	hint   string
+}
+
+func pass(format string, args ...interface{}) checkResult {
+	return checkResult{status: checkPass, detail: fmt.Sprintf(format, args...)}
+}
+
+func fail(err error, format string, args ...interface{}) checkResult {
+	return checkResult{status: checkFail, err: err, hint: fmt.Sprintf(format, args...)}
+}
+
+func skip(format string, args ...interface{}) checkResult {
+	return checkResult{status: checkSkip, detail: fmt.Sprintf(format, args...)}
+}
+
+// diagnoser runs the checks of the agent connectivity in order, the
+// later checks use the results of the former ones
+type diagnoser struct {
+	o       *TunnelAgentOptions
+	timeout time.Duration
+	out     io.Writer
+
+	cloudClient kubernetes.Interface
+	serverAddr  string
+	cert        *tls.Certificate
+	certLoaded  bool
+	tlsPassed   bool
+}
+
+func newDiagnoseCommand(o *TunnelAgentOptions) *cobra.Command {
+	d := &diagnoser{
+		o:       o,
+		timeout: 10 * time.Second,
+	}
+	cmd := &cobra.Command{
+		Use:   "diagnose",
+		Short: fmt.Sprintf("Diagnose the connectivity of %s", version.GetAgentName()),
+		Long: fmt.Sprintf(`Run the checks of the connectivity step by step with the same flags and files
+as %s, and print whether each check passes along with the hints to fix
+the failures. Run it in the pod of the agent, for example:
+
+  kubectl -n tkestack exec deploy/excalibur-tunnel-agent -- \
+    /app/bin/excalibur-tunnel-agent diagnose --cluster-name=cls-85hbhf4r \
+    --apiserver-addr=132.232.31.102:31501`, version.GetAgentName()),
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(c *cobra.Command, args []string) error {
+			if err := o.loadConfig(c.Flags()); err != nil {
+				return err
+			}
+			if o.clusterName == "" {
+				return errors.New("--cluster-name is not set")
+			}
+			d.out = c.OutOrStdout()
+			return d.run()
+		},
+	}
+	cmd.Flags().DurationVar(&d.timeout, "timeout", d.timeout,
+		"The timeout of each network check.")
+	return cmd
+}
+
+// run runs all of the checks, and returns an error if any of them fails
+func (d *diagnoser) run() error {
+	checks := []struct {
+		name  string
+		check func() checkResult
+	}{
+		{"Reach the hub apiserver with the token and CA", d.checkHubAPIServer},
+		{fmt.Sprintf("Resolve the address of %s", constants.TunnelServerServiceName), d.checkServerAddr},
+		{fmt.Sprintf("Connect to %s over TCP", version.GetServerName()), d.checkTCP},
+		{fmt.Sprintf("TLS handshake with %s", version.GetServerName()), d.checkTLS},
+		{"Permission to create the CSR", d.checkCSRPermission},
+		{fmt.Sprintf("Certificate of %s", version.GetAgentName()), d.checkCertificate},
+		{fmt.Sprintf("gRPC handshake with the agent port of %s", version.GetServerName()), d.checkGRPC},
+		{"Reach the local apiserver", d.checkLocalAPIServer},
+		{fmt.Sprintf("Dial %s in the managed cluster", d.localAPIServerAddr()), d.checkLocalDial},
+	}
+
+	var failed int
+	for i, c := range checks {
+		res := c.check()
+		fmt.Fprintf(d.out, "[%d/%d] %s ... %s\n", i+1, len(checks), c.name, res.status)
+		if res.detail != "" {
+			fmt.Fprintf(d.out, "      %s\n", res.detail)
+		}
+		if res.err != nil {
+			fmt.Fprintf(d.out, "      error: %v\n", res.err)
+		}
+		if res.hint != "" {
+			fmt.Fprintf(d.out, "      hint: %s\n", res.hint)
+		}
+		if res.status == checkFail {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	fmt.Fprintln(d.out, "All checks passed")
+	return nil
+}
+
+func (d *diagnoser) checkHubAPIServer() checkResult {
+	if d.o.apiserverAddr == "" {
+		return fail(errors.New("--apiserver-addr is not set"),
+			"set --apiserver-addr to an address of the hub apiserver reachable from the managed cluster")
+	}
+	// the ca.crt is optional, the system roots verify the hub apiserver
+	// without it
+	if _, err := os.Stat(d.o.tokenFile); err != nil {
+		return fail(err, "mount the token and ca.crt of the agent service account in the hub cluster "+
+			"to %s, or run the diagnose in the pod of the agent", filepath.Dir(d.o.tokenFile))
+	}
+	client, err := k8s.CreateClientSetApiserverAddr(d.o.apiserverAddr, d.o.tokenFile, d.o.caFile)
+	if err != nil {
+		return fail(err, "check the token in %s and the CA in %s", d.o.tokenFile, d.o.caFile)
+	}
+	info, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return fail(err, d.hubAPIServerHint(err))
+	}
+	d.cloudClient = client
+	return pass("https://%s, version %s", d.o.apiserverAddr, info.GitVersion)
+}
+
+// hubAPIServerHint returns the hint of failing to access the hub apiserver
+func (d *diagnoser) hubAPIServerHint(err error) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+	)
+	switch {
+	case apierrors.IsUnauthorized(err):
+		return fmt.Sprintf("the token in %s is invalid or expired, recreate the secret with a valid token "+
+			"of the agent service account", d.o.tokenFile)
+	case errors.As(err, &unknownAuthority):
+		return fmt.Sprintf("the CA in %s doesn't sign the certificate of the hub apiserver", d.o.caFile)
+	case errors.As(err, &hostname):
+		return fmt.Sprintf("the certificate of the hub apiserver is not valid for %s, use an address in its SANs",
+			d.o.apiserverAddr)
+	default:
+		return fmt.Sprintf("check that %s is reachable from the managed cluster, e.g. the routes, "+
+			"the firewall and the security group", d.o.apiserverAddr)
+	}
+}
+
+func (d *diagnoser) checkServerAddr() checkResult {
+	if d.o.tunnelServerAddr != "" {
+		if _, _, err := net.SplitHostPort(d.o.tunnelServerAddr); err != nil {
+			return fail(err, "set --tunnelserver-addr in the form of host:port")
+		}
+		d.serverAddr = d.o.tunnelServerAddr
+		return pass("%s is set by --tunnelserver-addr", d.serverAddr)
+	}
+	if d.cloudClient == nil {
+		return skip("requires the hub apiserver, or set --tunnelserver-addr")
+	}
+	addrs, err := serveraddr.GetTunnelServerAddrs(d.cloudClient, v1.IPFamily(d.o.ipFamilyPreference))
+	if err != nil {
+		ns := os.Getenv(constants.TunnelServerNSEnv)
+		switch {
+		case apierrors.IsNotFound(err):
+			return fail(err, "the service %s is not found in the namespace %q, set env %s to the namespace "+
+				"of %s", constants.TunnelServerServiceName, ns, constants.TunnelServerNSEnv, version.GetServerName())
+		case apierrors.IsForbidden(err):
+			return fail(err, "grant the agent service account get on the configmap %s, or get on services and "+
+				"endpoints and list on nodes in the hub cluster, or set --tunnelserver-addr",
+				constants.TunnelServerBootstrapConfigMapName)
+		default:
+			return fail(err, "check the type and status of the service %s, or set --tunnelserver-addr",
+				constants.TunnelServerServiceName)
+		}
+	}
+	// the agent dials the first reachable one of the candidates, which are
+	// published in the bootstrap configmap if there is one
+	d.serverAddr = serveraddr.FirstReachableAddr(addrs, d.timeout)
+	source := "the service " + constants.TunnelServerServiceName
+	if info, err := serveraddr.GetBootstrapInfo(d.cloudClient); err == nil && len(info.Endpoints) > 0 {
+		source = "the configmap " + constants.TunnelServerBootstrapConfigMapName
+	}
+	if len(addrs) > 1 {
+		return pass("%s is discovered from %s, of the candidates %s", d.serverAddr,
+			source, strings.Join(addrs, ","))
+	}
+	return pass("%s is discovered from %s", d.serverAddr, source)
+}
+
+func (d *diagnoser) checkTCP() checkResult {
+	if d.serverAddr == "" {
+		return skip("requires the address of %s", version.GetServerName())
+	}
+	conn, err := net.DialTimeout("tcp", d.serverAddr, d.timeout)
+	if err != nil {
+		return fail(err, "check that %s is reachable from the managed cluster, e.g. the service type of %s, "+
+			"the %s annotation, the firewall and the security group",
+			d.serverAddr, constants.TunnelServerServiceName, constants.TunnelServerExternalAddrKey)
+	}
+	conn.Close()
+	return pass("connected to %s", d.serverAddr)
+}
+
+func (d *diagnoser) checkTLS() checkResult {
+	if d.serverAddr == "" {
+		return skip("requires the address of %s", version.GetServerName())
+	}
+	roots, err := d.tunnelServerRoots()
+	if err != nil {
+		return fail(err, "mount the ca.crt of the hub cluster to %s", d.o.caFile)
+	}
+	host, _, _ := net.SplitHostPort(d.serverAddr)
+
+	// verify the server certificate after the handshake to tell the
+	// failures of the verification from the ones of the handshake
+	var peerCerts []*x509.Certificate
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				peerCerts = append(peerCerts, cert)
+			}
+			return nil
+		},
+	}
+	if cert := d.agentCertificate(); cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	conn, handshakeErr := tls.DialWithDialer(&net.Dialer{Timeout: d.timeout}, "tcp", d.serverAddr, cfg)
+	if handshakeErr == nil {
+		conn.Close()
+	}
+	if len(peerCerts) == 0 {
+		return fail(handshakeErr, "check that %s is the agent port of %s rather than another service",
+			d.serverAddr, version.GetServerName())
+	}
+
+	leaf := peerCerts[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range peerCerts[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		var hostname x509.HostnameError
+		if errors.As(err, &hostname) {
+			return fail(err, "the SANs of the certificate of %s are %s, add %s by --cert-dns-names or "+
+				"--cert-ips of %s and remove its certificate to regenerate, or connect to an address in the SANs",
+				version.GetServerName(), certificateSANs(leaf), host, version.GetServerName())
+		}
+		return fail(err, "the CA in %s doesn't sign the certificate of %s, mount the ca.crt of the hub cluster",
+			d.o.caFile, version.GetServerName())
+	}
+	if handshakeErr != nil {
+		if d.agentCertificate() == nil {
+			d.tlsPassed = true
+			return pass("the certificate of %s is verified, the handshake is rejected without the agent certificate",
+				version.GetServerName())
+		}
+		return fail(handshakeErr, "%s rejects the agent certificate, check the certificate below",
+			version.GetServerName())
+	}
+	d.tlsPassed = true
+	return pass("the certificate of %s is verified for %s, SANs: %s",
+		version.GetServerName(), host, certificateSANs(leaf))
+}
+
+func (d *diagnoser) checkCSRPermission() checkResult {
+	if d.cloudClient == nil {
+		return skip("requires the hub apiserver")
+	}
+	for _, verb := range []string{"create", "get"} {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Group:    "certificates.k8s.io",
+					Resource: "certificatesigningrequests",
+					Verb:     verb,
+				},
+			},
+		}
+		res, err := d.cloudClient.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+		if err != nil {
+			return fail(err, "check that the hub apiserver serves authorization.k8s.io/v1")
+		}
+		if !res.Status.Allowed {
+			return fail(fmt.Errorf("%s certificatesigningrequests is not allowed", verb),
+				"grant the agent service account create, get, list and watch on certificatesigningrequests "+
+					"in the hub cluster")
+		}
+	}
+	return pass("the agent is allowed to create and get certificatesigningrequests")
+}
+
+func (d *diagnoser) checkCertificate() checkResult {
+	dir := d.o.certDir
+	cert := d.agentCertificate()
+	if cert == nil || cert.Leaf == nil {
+		return fail(fmt.Errorf("there is no certificate in %s", dir),
+			"%s requests the certificate on start, make sure its CSR is approved, which is done by %s "+
+				"for the organization %s, and that env %s is set", version.GetAgentName(),
+			version.GetServerName(), constants.TunnelCSROrg, constants.TunnelAgentPodIPEnv)
+	}
+	leaf := cert.Leaf
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		return fail(fmt.Errorf("the certificate expired at %s", leaf.NotAfter.Format(time.RFC3339)),
+			"remove the certificate in %s and restart %s to request a new one", dir, version.GetAgentName())
+	case now.Before(leaf.NotBefore):
+		return fail(fmt.Errorf("the certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339)),
+			"check the clock of the node")
+	case leaf.Subject.CommonName != d.o.clusterName:
+		return fail(fmt.Errorf("the certificate is issued for %s rather than %s",
+			leaf.Subject.CommonName, d.o.clusterName),
+			"remove the certificate in %s and restart %s to request a new one", dir, version.GetAgentName())
+	}
+	return pass("CN=%s, expires at %s, %s", leaf.Subject.CommonName,
+		leaf.NotAfter.Format(time.RFC3339), pki.CertificateFingerprint(cert))
+}
+
+func (d *diagnoser) checkGRPC() checkResult {
+	if !d.tlsPassed {
+		return skip("requires the TLS handshake with %s", version.GetServerName())
+	}
+	cert := d.agentCertificate()
+	if cert == nil {
+		return skip("requires the certificate of %s", version.GetAgentName())
+	}
+	roots, err := d.tunnelServerRoots()
+	if err != nil {
+		return fail(err, "mount the ca.crt of the hub cluster to %s", d.o.caFile)
+	}
+	host, _, _ := net.SplitHostPort(d.serverAddr)
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   host,
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{*cert},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, d.serverAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(cfg)),
+		grpc.WithBlock(),
+		grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		return fail(err, "%s doesn't accept the gRPC connection, check its logs and that %s is its agent port",
+			version.GetServerName(), d.serverAddr)
+	}
+	conn.Close()
+	return pass("the gRPC connection to %s is ready", d.serverAddr)
+}
+
+func (d *diagnoser) checkLocalAPIServer() checkResult {
+	var (
+		client kubernetes.Interface
+		err    error
+	)
+	if d.o.kubeConfig != "" {
+		client, err = k8s.CreateClientSetKubeConfig(d.o.kubeConfig)
+	} else {
+		client, err = k8s.CreateClientSet("")
+	}
+	if err != nil {
+		return fail(err, "run the diagnose in the pod of the agent, or set --kube-config")
+	}
+	info, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return fail(err, "check the kubeconfig or the service account of the agent in the managed cluster")
+	}
+	return pass("version %s", info.GitVersion)
+}
+
+// localAPIServerAddr returns the address of the local apiserver dialed
+// by the tunnel server
+func (d *diagnoser) localAPIServerAddr() string {
+	return net.JoinHostPort(d.o.clusterName, apiserverSecurePort)
+}
+
+func (d *diagnoser) checkLocalDial() checkResult {
+	addr := d.localAPIServerAddr()
+	conn, err := net.DialTimeout("tcp", addr, d.timeout)
+	if err != nil {
+		return fail(err, "%s dials the apiserver by %s, create a service named %s in the namespace of "+
+			"the agent for the apiserver", version.GetServerName(), addr, d.o.clusterName)
+	}
+	conn.Close()
+	return pass("connected to %s", conn.RemoteAddr())
+}
+
+// tunnelServerRoots returns the roots verifying the tunnel server, which
+// are the same as the agent's
+func (d *diagnoser) tunnelServerRoots() (*x509.CertPool, error) {
+	caData, err := tunnelServerCAData(d.o.caFile, d.cloudClient)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caData) {
+		return nil, errors.New("no certificate is found in the CA data")
+	}
+	return roots, nil
+}
+
+// agentCertificate loads the certificate of the agent from the store
+// once, nil is returned if it is absent
+func (d *diagnoser) agentCertificate() *tls.Certificate {
+	if d.certLoaded {
+		return d.cert
+	}
+	d.certLoaded = true
+	store, err := certificate.NewFileStore(version.GetAgentName(), d.o.certDir, d.o.certDir, "", "")
+	if err != nil {
+		return nil
+	}
+	if d.cert, err = store.Current(); err != nil {
+		d.cert = nil
+	}
+	return d.cert
+}
+
+// certificateSANs returns the DNS names and IPs of the certificate
+func certificateSANs(cert *x509.Certificate) string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return strings.Join(sans, ",")
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
+)
+
+const (
+	// keys of the dial policy configmap, each value is a comma or newline
+	// separated list
+	dialPolicyCIDRsKey = "cidrs"
+	dialPolicyHostsKey = "hosts"
+	dialPolicyPortsKey = "ports"
+
+	// apiserverSecurePort is the secure port of kube-apiserver, which is
+	// exposed by the service named after the cluster
+	apiserverSecurePort = "6443"
+)
+
+// dialPolicy restricts the destinations that the tunnel server is able
+// to dial through the agent, a destination is allowed when its host
+// matches one of the cidrs or hosts, and its port is one of the ports
+type dialPolicy struct {
+	cidrs []*net.IPNet
+	// hosts support wildcard such as "*.example.com", "*" matches all
+	hosts []string
+	// empty ports allow all ports
+	ports sets.String
+}
+
+// newDialPolicy creates a dialPolicy from comma or newline separated lists
+func newDialPolicy(cidrs, hosts, ports string) (*dialPolicy, error) {
+	p := &dialPolicy{
+		hosts: splitList(hosts),
+		ports: sets.NewString(),
+	}
+	for _, cidr := range splitList(cidrs) {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s: %v", cidr, err)
+		}
+		p.cidrs = append(p.cidrs, ipNet)
+	}
+	for _, port := range splitList(ports) {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", port, err)
+		}
+		p.ports.Insert(port)
+	}
+	return p, nil
+}
+
+// defaultDialPolicy creates a dialPolicy that only allows the apiserver
+// of the managed cluster
+func defaultDialPolicy(clusterName, clusterDomain string) *dialPolicy {
+	p := &dialPolicy{
+		hosts: []string{
+			"kubernetes",
+			"kubernetes.default",
+			"kubernetes.default.svc",
+			"kubernetes.default.svc." + clusterDomain,
+			clusterName,
+		},
+		ports: sets.NewString(apiserverSecurePort),
+	}
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			p.cidrs = append(p.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			p.hosts = append(p.hosts, host)
+		}
+	}
+	if port := os.Getenv("KUBERNETES_SERVICE_PORT"); port != "" {
+		p.ports.Insert(port)
+	}
+	return p
+}
+
+// allow checks if the given address is allowed to dial
+func (p *dialPolicy) allow(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+	if p.ports.Len() != 0 && !p.ports.Has(port) {
+		return fmt.Errorf("port %s is not allowed", port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, cidr := range p.cidrs {
+			if cidr.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	for _, pattern := range p.hosts {
+		if hostMatches(pattern, host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %s is not allowed", host)
+}
+
+func (p *dialPolicy) String() string {
+	cidrs := make([]string, 0, len(p.cidrs))
+	for _, cidr := range p.cidrs {
+		cidrs = append(cidrs, cidr.String())
+	}
+	return fmt.Sprintf("cidrs=[%s] hosts=[%s] ports=[%s]",
+		strings.Join(cidrs, ","), strings.Join(p.hosts, ","), strings.Join(p.ports.List(), ","))
+}
+
+// dialPolicyEnforcer rejects the dial requests from the tunnel server
+// which are not allowed by the policy
+type dialPolicyEnforcer struct {
+	mu sync.RWMutex
+	// policy is the policy in use
+	policy *dialPolicy
+	// fallback is the policy used when the configmap is absent
+	fallback    *dialPolicy
+	clusterName string
+	auditLogger *audit.Logger
+}
+
+// newDialPolicyEnforcer creates a dialPolicyEnforcer with the given policy
+func newDialPolicyEnforcer(policy *dialPolicy, clusterName string, auditLogger *audit.Logger) *dialPolicyEnforcer {
+	return &dialPolicyEnforcer{
+		policy:      policy,
+		fallback:    policy,
+		clusterName: clusterName,
+		auditLogger: auditLogger,
+	}
+}
+
+func (e *dialPolicyEnforcer) setPolicy(policy *dialPolicy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.policy = policy
+	klog.Infof("dial policy is set to %s", policy)
+}
+
+func (e *dialPolicyEnforcer) allow(dialReq *client.DialRequest) error {
+	e.mu.RLock()
+	policy := e.policy
+	e.mu.RUnlock()
+
+	err := policy.allow(dialReq.Address)
+	if err != nil {
+		klog.Warningf("deny dial request to %s: %v", dialReq.Address, err)
+		e.auditLogger.Log(&audit.Event{
+			Type:        audit.EventDialDenied,
+			ClusterName: e.clusterName,
+			Protocol:    dialReq.Protocol,
+			Destination: dialReq.Address,
+			Reason:      err.Error(),
+		})
+	}
+	return err
+}
+
+// WatchConfigMap loads the policy from the given configmap and keeps
+// it updated, the fallback policy is used if the configmap is absent
+func (e *dialPolicyEnforcer) WatchConfigMap(
+	clientset kubernetes.Interface,
+	namespace,
+	name string,
+	stopCh <-chan struct{}) error {
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	cmInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+
+	update := func(obj interface{}) {
+		cm, ok := obj.(*v1.ConfigMap)
+		if !ok {
+			return
+		}
+		policy, err := newDialPolicy(cm.Data[dialPolicyCIDRsKey],
+			cm.Data[dialPolicyHostsKey], cm.Data[dialPolicyPortsKey])
+		if err != nil {
+			klog.Errorf("invalid dial policy in configmap %s/%s, keep using the current one: %v",
+				namespace, name, err)
+			return
+		}
+		e.setPolicy(policy)
+	}
+	cmInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: update,
+		UpdateFunc: func(old, new interface{}) {
+			update(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			klog.Warningf("dial policy configmap %s/%s is deleted, use the fallback policy",
+				namespace, name)
+			e.setPolicy(e.fallback)
+		},
+	})
+
+	informerFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, cmInformer.HasSynced) {
+		return fmt.Errorf("failed to sync dial policy configmap %s/%s", namespace, name)
+	}
+	return nil
+}
+
+// StreamInterceptor returns a grpc stream interceptor which checks the
+// dial requests received from the tunnel server
+func (e *dialPolicyEnforcer) StreamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &dialPolicyClientStream{ClientStream: stream, enforcer: e}, nil
+	}
+}
+
+// dialPolicyClientStream answers the denied dial requests by itself, and
+// only passes through the allowed ones to the agent
+type dialPolicyClientStream struct {
+	grpc.ClientStream
+	enforcer *dialPolicyEnforcer
+	// sendLock serializes the responses of denied dial requests with
+	// the packets sent by the agent
+	sendLock sync.Mutex
+}
+
+func (s *dialPolicyClientStream) SendMsg(m interface{}) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *dialPolicyClientStream) RecvMsg(m interface{}) error {
+	for {
+		if err := s.ClientStream.RecvMsg(m); err != nil {
+			return err
+		}
+		pkt, ok := m.(*client.Packet)
+		if !ok || pkt.Type != client.PacketType_DIAL_REQ {
+			return nil
+		}
+		dialReq := pkt.GetDialRequest()
+		err := s.enforcer.allow(dialReq)
+		if err == nil {
+			return nil
+		}
+
+		resp := &client.Packet{
+			Type: client.PacketType_DIAL_RSP,
+			Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{
+				Random: dialReq.Random,
+				Error: fmt.Sprintf("dial %s is denied by the policy of agent %s: %v",
+					dialReq.Address, s.enforcer.clusterName, err),
+			}},
+		}
+		if err := s.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// hostMatches checks if the host matches the pattern, the pattern
+// "*.example.com" matches all of the sub domains of example.com
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return false
+}
+
+// splitList splits a comma or newline separated list
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
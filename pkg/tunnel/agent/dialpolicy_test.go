@@ -0,0 +1,253 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// setEnv sets the environment variable and returns the function that
+// restores it
+func setEnv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestDefaultDialPolicy(t *testing.T) {
+	defer setEnv("KUBERNETES_SERVICE_HOST", "10.96.0.1")()
+	defer setEnv("KUBERNETES_SERVICE_PORT", "443")()
+	policy := defaultDialPolicy("cls-a", "cluster.local")
+
+	cases := []struct {
+		address string
+		allowed bool
+	}{
+		{"cls-a:6443", true},
+		{"kubernetes:443", true},
+		{"kubernetes.default:6443", true},
+		{"kubernetes.default.svc:443", true},
+		{"kubernetes.default.svc.cluster.local.:443", true},
+		{"KUBERNETES.DEFAULT.SVC:443", true},
+		{"10.96.0.1:443", true},
+		{"10.96.0.2:443", false},
+		{"cls-b:6443", false},
+		{"kubernetes.default.svc.cluster.local:22", false},
+		{"kube-dns.kube-system.svc:53", false},
+		{"kubernetes", false},
+	}
+	for _, c := range cases {
+		t.Run(c.address, func(t *testing.T) {
+			err := policy.allow(c.address)
+			if c.allowed && err != nil {
+				t.Errorf("expected %s allowed, got %v", c.address, err)
+			}
+			if !c.allowed && err == nil {
+				t.Errorf("expected %s denied", c.address)
+			}
+		})
+	}
+}
+
+func TestDefaultDialPolicyServiceHostname(t *testing.T) {
+	defer setEnv("KUBERNETES_SERVICE_HOST", "apiserver.example.com")()
+	defer setEnv("KUBERNETES_SERVICE_PORT", "8443")()
+	policy := defaultDialPolicy("cls-a", "cluster.local")
+	if err := policy.allow("apiserver.example.com:8443"); err != nil {
+		t.Errorf("expected the service host allowed, got %v", err)
+	}
+	if err := policy.allow("apiserver.example.com:22"); err == nil {
+		t.Error("expected the other ports of the service host denied")
+	}
+}
+
+func TestNewDialPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		cidrs   string
+		hosts   string
+		ports   string
+		address string
+		allowed bool
+		invalid bool
+	}{
+		{name: "cidr", cidrs: "10.0.0.0/8,192.168.0.0/16", address: "192.168.1.1:80", allowed: true},
+		{name: "ipv6 cidr", cidrs: "fd00::/8", address: "[fd00::1]:80", allowed: true},
+		{name: "outside cidr", cidrs: "10.0.0.0/8", address: "172.16.0.1:80"},
+		{name: "cidr does not match hostname", cidrs: "0.0.0.0/0", address: "example.com:80"},
+		{name: "wildcard host", hosts: "*.svc.cluster.local", address: "a.b.svc.cluster.local:80", allowed: true},
+		{name: "wildcard excludes the domain", hosts: "*.example.com", address: "example.com:80"},
+		{name: "wildcard excludes suffix", hosts: "*.example.com", address: "badexample.com:80"},
+		{name: "any host", hosts: "*", address: "example.com:80", allowed: true},
+		{name: "newline separated", hosts: "a.example.com\nb.example.com", address: "b.example.com:80", allowed: true},
+		{name: "allowed port", hosts: "*", ports: "443,6443", address: "example.com:6443", allowed: true},
+		{name: "denied port", hosts: "*", ports: "443,6443", address: "example.com:22"},
+		{name: "invalid address", hosts: "*", address: "example.com"},
+		{name: "invalid cidr", cidrs: "10.0.0.0", invalid: true},
+		{name: "invalid port", ports: "https-ish", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := newDialPolicy(c.cidrs, c.hosts, c.ports)
+			if c.invalid {
+				if err == nil {
+					t.Errorf("expected the policy invalid")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			err = policy.allow(c.address)
+			if c.allowed && err != nil {
+				t.Errorf("expected %s allowed, got %v", c.address, err)
+			}
+			if !c.allowed && err == nil {
+				t.Errorf("expected %s denied", c.address)
+			}
+		})
+	}
+}
+
+// fakeClientStream receives the packets in order, and records the sent ones
+type fakeClientStream struct {
+	grpc.ClientStream
+	recv []*client.Packet
+	sent []*client.Packet
+}
+
+func (s *fakeClientStream) RecvMsg(m interface{}) error {
+	if len(s.recv) == 0 {
+		return io.EOF
+	}
+	pkt := m.(*client.Packet)
+	pkt.Type, pkt.Payload = s.recv[0].Type, s.recv[0].Payload
+	s.recv = s.recv[1:]
+	return nil
+}
+
+func (s *fakeClientStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m.(*client.Packet))
+	return nil
+}
+
+func dialRequest(address string, random int64) *client.Packet {
+	return &client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol: "tcp",
+			Address:  address,
+			Random:   random,
+		}},
+	}
+}
+
+func TestDialPolicyClientStreamRecvMsg(t *testing.T) {
+	data := &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: []byte("data")}},
+	}
+	cases := []struct {
+		name string
+		recv []*client.Packet
+		// expected is the packet passed to the agent, nil for the end of
+		// the stream
+		expected *client.Packet
+		// denied are the randoms of the dial requests answered by the stream
+		denied []int64
+	}{
+		{
+			name:     "other packets pass through",
+			recv:     []*client.Packet{data},
+			expected: data,
+		},
+		{
+			name:     "allowed dial request passes through",
+			recv:     []*client.Packet{dialRequest("10.0.0.1:443", 1)},
+			expected: dialRequest("10.0.0.1:443", 1),
+		},
+		{
+			name:     "denied dial requests are answered",
+			recv:     []*client.Packet{dialRequest("10.0.0.1:22", 1), dialRequest("172.16.0.1:443", 2), data},
+			expected: data,
+			denied:   []int64{1, 2},
+		},
+		{
+			name:   "denied dial request before the end of the stream",
+			recv:   []*client.Packet{dialRequest("10.0.0.1:22", 1)},
+			denied: []int64{1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := newDialPolicy("10.0.0.0/8", "", "443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeClientStream{recv: c.recv}
+			stream := &dialPolicyClientStream{
+				ClientStream: fake,
+				enforcer:     newDialPolicyEnforcer(policy, "cls-a", nil),
+			}
+
+			pkt := &client.Packet{}
+			err = stream.RecvMsg(pkt)
+			if c.expected == nil {
+				if !errors.Is(err, io.EOF) {
+					t.Errorf("expected EOF, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if pkt.String() != c.expected.String() {
+				t.Errorf("expected packet %v, got %v", c.expected, pkt)
+			}
+
+			if len(fake.sent) != len(c.denied) {
+				t.Fatalf("expected %d dial responses, got %v", len(c.denied), fake.sent)
+			}
+			for i, rsp := range fake.sent {
+				if rsp.Type != client.PacketType_DIAL_RSP {
+					t.Errorf("expected a dial response, got %v", rsp)
+					continue
+				}
+				dialRsp := rsp.GetDialResponse()
+				if dialRsp.Random != c.denied[i] {
+					t.Errorf("expected the response of dial request %d, got %d", c.denied[i], dialRsp.Random)
+				}
+				if !strings.Contains(dialRsp.Error, "denied by the policy of agent cls-a") {
+					t.Errorf("unexpected error of the dial response: %q", dialRsp.Error)
+				}
+				if dialRsp.ConnectID != 0 {
+					t.Errorf("expected no connection of the denied dial request, got %d", dialRsp.ConnectID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+)
+
+// maxServiceIdentifiersLength limits the length of the encoded service dns
+// names, the identifiers are sent in the grpc metadata whose size is
+// limited by the server
+const maxServiceIdentifiersLength = 4096
+
+// identifierWatcher watches the nodes and the selected services of the
+// managed cluster, generates the agent identifiers from them and notifies
+// the changes, so that the agent can re-register with the latest
+// identifiers. The server only chooses the agents by the hosts and ips,
+// so the cidrs of the cluster are not added
+type identifierWatcher struct {
+	clientset         kubernetes.Interface
+	clusterName       string
+	staticIdentifiers string
+	clusterDomain     string
+	// resyncDelay is the time the changes settle before the identifiers
+	// are generated again, which avoids re-registering for each change
+	resyncDelay time.Duration
+
+	informerFactory informers.SharedInformerFactory
+	serviceInformer cache.SharedIndexInformer
+	nodeLister      corelisters.NodeLister
+	serviceLister   corelisters.ServiceLister
+	nodeSynced      cache.InformerSynced
+	serviceSynced   cache.InformerSynced
+
+	// resyncCh is triggered whenever a node ip or a selected service changes
+	resyncCh chan struct{}
+	// updateCh publishes the identifiers once they changed
+	updateCh chan string
+	current  string
+}
+
+// newIdentifierWatcher creates an identifierWatcher based on the clientset
+// of the managed cluster, only the dns names of the services matching the
+// selector are added into the identifiers
+func newIdentifierWatcher(
+	clientset kubernetes.Interface,
+	clusterName,
+	staticIdentifiers,
+	serviceSelector,
+	clusterDomain string) *identifierWatcher {
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	nodeInformer := informerFactory.Core().V1().Nodes()
+	// only the selected services are watched, the other services neither
+	// take memory nor trigger generating the identifiers
+	serviceInformer := coreinformers.NewFilteredServiceInformer(clientset, metav1.NamespaceAll, 0,
+		cache.Indexers{}, func(options *metav1.ListOptions) {
+			options.LabelSelector = serviceSelector
+		})
+
+	iw := &identifierWatcher{
+		clientset:         clientset,
+		clusterName:       clusterName,
+		staticIdentifiers: staticIdentifiers,
+		clusterDomain:     clusterDomain,
+		resyncDelay:       constants.TunnelAgentIdentifierResyncDelaySec * time.Second,
+		informerFactory:   informerFactory,
+		serviceInformer:   serviceInformer,
+		nodeLister:        nodeInformer.Lister(),
+		serviceLister:     corelisters.NewServiceLister(serviceInformer.GetIndexer()),
+		nodeSynced:        nodeInformer.Informer().HasSynced,
+		serviceSynced:     serviceInformer.HasSynced,
+		resyncCh:          make(chan struct{}, 1),
+		updateCh:          make(chan string, 1),
+	}
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			iw.enqueue()
+		},
+		// the status of the nodes is updated periodically, only the
+		// changes of the internal ips matter
+		UpdateFunc: func(old, new interface{}) {
+			oldNode, ok := old.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := new.(*v1.Node)
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(nodeInternalIPs(oldNode), nodeInternalIPs(newNode)) {
+				iw.enqueue()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			iw.enqueue()
+		},
+	})
+	// the name of a service never changes, and a service no longer
+	// matching the selector is deleted from the cache
+	serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			iw.enqueue()
+		},
+		DeleteFunc: func(obj interface{}) {
+			iw.enqueue()
+		},
+	})
+	return iw
+}
+
+// Start starts watching the managed cluster and returns the initial
+// identifiers once the caches are synced
+func (iw *identifierWatcher) Start(stopCh <-chan struct{}) (string, error) {
+	iw.informerFactory.Start(stopCh)
+	go iw.serviceInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, iw.nodeSynced, iw.serviceSynced) {
+		return "", errors.New("failed to sync the node and service caches")
+	}
+
+	identifiers, err := iw.generate()
+	if err != nil {
+		return "", err
+	}
+	iw.current = identifiers
+
+	go iw.run(stopCh)
+	return identifiers, nil
+}
+
+// Updates returns the channel that publishes the changed identifiers
+func (iw *identifierWatcher) Updates() <-chan string {
+	return iw.updateCh
+}
+
+func (iw *identifierWatcher) enqueue() {
+	select {
+	case iw.resyncCh <- struct{}{}:
+	default:
+	}
+}
+
+func (iw *identifierWatcher) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-iw.resyncCh:
+		}
+
+		// wait for the changes to settle, e.g. a rolling update of the
+		// nodes, the changes in the meantime are coalesced
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(iw.resyncDelay):
+		}
+		select {
+		case <-iw.resyncCh:
+		default:
+		}
+
+		identifiers, err := iw.generate()
+		if err != nil {
+			klog.Errorf("failed to generate agent identifiers: %v", err)
+			continue
+		}
+		if identifiers == iw.current {
+			continue
+		}
+		klog.Infof("agent identifiers changed from %s to %s", iw.current, identifiers)
+		iw.current = identifiers
+
+		// drop the stale identifiers that have not been consumed yet
+		select {
+		case <-iw.updateCh:
+		default:
+		}
+		iw.updateCh <- identifiers
+	}
+}
+
+// generate generates the agent identifiers, which consist of the
+// user specified identifiers, the host of cluster name, the node internal
+// ips and the dns names of the selected services
+func (iw *identifierWatcher) generate() (string, error) {
+	identifiers, err := url.ParseQuery(iw.staticIdentifiers)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse agent identifiers %s: %v",
+			iw.staticIdentifiers, err)
+	}
+	add := func(idType agent.IdentifierType, value string) bool {
+		key := string(idType)
+		for _, v := range identifiers[key] {
+			if v == value {
+				return false
+			}
+		}
+		identifiers.Add(key, value)
+		return true
+	}
+	add(agent.Host, iw.clusterName)
+
+	nodes, err := iw.nodeLister.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	for _, node := range nodes {
+		for _, addr := range nodeInternalIPs(node) {
+			if net.ParseIP(addr).To4() != nil {
+				add(agent.IPv4, addr)
+			} else {
+				add(agent.IPv6, addr)
+			}
+		}
+	}
+
+	services, err := iw.serviceLister.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	// add the services in order, so that the same ones are kept once the
+	// length is exceeded
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	length, skipped := 0, 0
+	for _, svc := range services {
+		// the apiserver service exists in every cluster, the server would
+		// not know which agent to choose
+		if svc.Namespace == metav1.NamespaceDefault && svc.Name == "kubernetes" {
+			continue
+		}
+		dnsNames := getServiceDNSNames(svc.Namespace, svc.Name, iw.clusterDomain)
+		svcLength := 0
+		for _, dnsName := range dnsNames {
+			svcLength += len(agent.Host) + len(url.QueryEscape(dnsName)) + 2
+		}
+		if length+svcLength > maxServiceIdentifiersLength {
+			skipped++
+			continue
+		}
+		length += svcLength
+		for _, dnsName := range dnsNames {
+			add(agent.Host, dnsName)
+		}
+	}
+	if skipped > 0 {
+		klog.Warningf("%d services are not added into agent identifiers, "+
+			"the dns names of the services exceed %d bytes, select less services",
+			skipped, maxServiceIdentifiersLength)
+	}
+
+	// sort the identifiers to avoid re-registering for the same identifiers
+	// in different order, url encoding is the format that tunnel server used
+	// to parse the identifiers, and it sorts the identifiers by type as well
+	for idType := range identifiers {
+		sort.Strings(identifiers[idType])
+	}
+	return identifiers.Encode(), nil
+}
+
+// nodeInternalIPs returns the valid internal ips of the node
+func nodeInternalIPs(node *v1.Node) []string {
+	var ips []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP && net.ParseIP(addr.Address) != nil {
+			ips = append(ips, addr.Address)
+		}
+	}
+	return ips
+}
+
+// getServiceDNSNames get the dns names for specified service
+func getServiceDNSNames(ns, name, clusterDomain string) []string {
+	return []string{
+		fmt.Sprintf("%s.%s", name, ns),
+		fmt.Sprintf("%s.%s.svc", name, ns),
+		fmt.Sprintf("%s.%s.svc.%s", name, ns, clusterDomain),
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+)
+
+func newTestNode(name string, ips ...string) *v1.Node {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{PodCIDR: "172.16.0.0/24"},
+	}
+	for _, ip := range ips {
+		node.Status.Addresses = append(node.Status.Addresses,
+			v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip})
+	}
+	node.Status.Addresses = append(node.Status.Addresses,
+		v1.NodeAddress{Type: v1.NodeHostName, Address: name})
+	return node
+}
+
+func newTestService(ns, name string, selected bool) *v1.Service {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+	if selected {
+		svc.Labels = map[string]string{"tunnel.excalibur.io/agent-identifier": "true"}
+	}
+	return svc
+}
+
+func startTestWatcher(t *testing.T, stopCh chan struct{}, clientset *fake.Clientset,
+	staticIdentifiers, selector string) (*identifierWatcher, string) {
+	iw := newIdentifierWatcher(clientset, "cls-a", staticIdentifiers, selector, "cluster.local")
+	iw.resyncDelay = 100 * time.Millisecond
+	identifiers, err := iw.Start(stopCh)
+	if err != nil {
+		t.Fatalf("failed to start the identifier watcher: %v", err)
+	}
+	return iw, identifiers
+}
+
+func TestGenerateIdentifiers(t *testing.T) {
+	cases := []struct {
+		name              string
+		staticIdentifiers string
+		selector          string
+		objects           []runtime.Object
+		expected          string
+	}{
+		{
+			name:     "cluster name only",
+			selector: constants.TunnelAgentIdentifierServiceSelector,
+			expected: "host=cls-a",
+		},
+		{
+			name:     "node internal ips without the cidrs",
+			selector: constants.TunnelAgentIdentifierServiceSelector,
+			objects: []runtime.Object{
+				newTestNode("node-2", "10.0.0.2", "fd00::2"),
+				newTestNode("node-1", "10.0.0.1", "not-an-ip"),
+			},
+			expected: "host=cls-a&ipv4=10.0.0.1&ipv4=10.0.0.2&ipv6=fd00%3A%3A2",
+		},
+		{
+			name:     "only the selected services",
+			selector: constants.TunnelAgentIdentifierServiceSelector,
+			objects: []runtime.Object{
+				newTestService("kube-system", "kube-dns", false),
+				newTestService("monitor", "prometheus", true),
+			},
+			expected: "host=cls-a&host=prometheus.monitor&host=prometheus.monitor.svc" +
+				"&host=prometheus.monitor.svc.cluster.local",
+		},
+		{
+			name:     "the apiserver service is skipped",
+			selector: "",
+			objects: []runtime.Object{
+				newTestService("default", "kubernetes", false),
+			},
+			expected: "host=cls-a",
+		},
+		{
+			name:              "static identifiers are kept",
+			staticIdentifiers: "host=cls-a&host=apiserver.cls-a",
+			selector:          constants.TunnelAgentIdentifierServiceSelector,
+			expected:          "host=apiserver.cls-a&host=cls-a",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			_, identifiers := startTestWatcher(t, stopCh, fake.NewSimpleClientset(c.objects...),
+				c.staticIdentifiers, c.selector)
+			if identifiers != c.expected {
+				t.Errorf("expected identifiers %s, got %s", c.expected, identifiers)
+			}
+		})
+	}
+}
+
+func TestGenerateIdentifiersLimitsServices(t *testing.T) {
+	var objects []runtime.Object
+	for i := 0; i < 200; i++ {
+		objects = append(objects, newTestService("default", fmt.Sprintf("svc-%03d", i), true))
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	_, identifiers := startTestWatcher(t, stopCh, fake.NewSimpleClientset(objects...),
+		"", constants.TunnelAgentIdentifierServiceSelector)
+	if len(identifiers) > maxServiceIdentifiersLength+len("host=cls-a") {
+		t.Errorf("expected identifiers limited to %d bytes, got %d bytes",
+			maxServiceIdentifiersLength, len(identifiers))
+	}
+	// the services are kept in order
+	if !strings.Contains(identifiers, "host=svc-000.default&") {
+		t.Errorf("expected the first service kept, got %s", identifiers)
+	}
+	if strings.Contains(identifiers, "svc-199") {
+		t.Errorf("expected the last service skipped, got %s", identifiers)
+	}
+}
+
+func TestIdentifierWatcherUpdates(t *testing.T) {
+	node := newTestNode("node-1", "10.0.0.1")
+	clientset := fake.NewSimpleClientset(node)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	iw, identifiers := startTestWatcher(t, stopCh, clientset, "", constants.TunnelAgentIdentifierServiceSelector)
+	if identifiers != "host=cls-a&ipv4=10.0.0.1" {
+		t.Fatalf("unexpected initial identifiers %s", identifiers)
+	}
+
+	// the periodical status updates do not change the identifiers
+	node = node.DeepCopy()
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	if _, err := clientset.CoreV1().Nodes().UpdateStatus(node); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case identifiers := <-iw.Updates():
+		t.Fatalf("unexpected update %s", identifiers)
+	case <-time.After(3 * iw.resyncDelay):
+	}
+
+	// the changes in a burst are published once
+	node = node.DeepCopy()
+	node.Status.Addresses[0].Address = "10.0.0.2"
+	if _, err := clientset.CoreV1().Nodes().UpdateStatus(node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().Services("monitor").Create(
+		newTestService("monitor", "prometheus", true)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "host=cls-a&host=prometheus.monitor&host=prometheus.monitor.svc" +
+		"&host=prometheus.monitor.svc.cluster.local&ipv4=10.0.0.2"
+	select {
+	case identifiers := <-iw.Updates():
+		if identifiers != expected {
+			t.Errorf("expected identifiers %s, got %s", expected, identifiers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("identifiers are not updated")
+	}
+	select {
+	case identifiers := <-iw.Updates():
+		t.Errorf("unexpected update %s", identifiers)
+	case <-time.After(3 * iw.resyncDelay):
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// EventType is the type of the audit event
+type EventType string
+
+const (
+	// EventDialDenied is recorded when the agent rejects a dial request
+	// from the tunnel server by the destination policy
+	EventDialDenied EventType = "DialDenied"
+	// EventDialFailed is recorded when the agent fails to dial the
+	// destination requested by the tunnel server
+	EventDialFailed EventType = "DialFailed"
+	// EventConnection is recorded when a tunneled connection is closed
+	EventConnection EventType = "Connection"
+	// EventHTTPRequest is recorded when the reverse proxy finishes a request
+	EventHTTPRequest EventType = "HTTPRequest"
+	// EventAgentConnected is recorded when an agent connects to the server
+	EventAgentConnected EventType = "AgentConnected"
+	// EventAgentDisconnected is recorded when an agent disconnects from the server
+	EventAgentDisconnected EventType = "AgentDisconnected"
+)
+
+// Event is an audit record which will be written as a JSON line
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	Type      EventType `json:"type"`
+	// ClusterName is the cluster name, i.e. the ID of the agent
+	ClusterName string `json:"clusterName,omitempty"`
+	// Source is the peer address of the request, or the uds name
+	Source string `json:"source,omitempty"`
+	// User is the common name of the client certificate
+	User        string `json:"user,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Method      string `json:"method,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	// BytesIn is the number of bytes received from the source
+	BytesIn int64 `json:"bytesIn,omitempty"`
+	// BytesOut is the number of bytes sent to the source
+	BytesOut    int64  `json:"bytesOut,omitempty"`
+	Duration    string `json:"duration,omitempty"`
+	CloseReason string `json:"closeReason,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Logger writes the audit events as JSON lines, a nil Logger discards
+// all of the events
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogger creates an audit logger writes to the given path, the "-"
+// path means stdout, it returns nil logger if the path is empty. The
+// file will be rotated once it exceeds maxSize megabytes, and at most
+// maxBackups rotated files are retained, 0 means no limit
+func NewLogger(path string, maxSize, maxBackups int) (*Logger, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return &Logger{w: os.Stdout}, nil
+	}
+	w, err := newRotatingFile(path, int64(maxSize)*1024*1024, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{w: w}, nil
+}
+
+// Log writes the event into the audit log
+func (l *Logger) Log(e *Event) {
+	if l == nil {
+		return
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		klog.Errorf("failed to marshal audit event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(data); err != nil {
+		klog.Errorf("failed to write audit event: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	logger, err := NewLogger("", 1, 1)
+	if err != nil || logger != nil {
+		t.Fatalf("expected nil logger for the empty path, got %v, %v", logger, err)
+	}
+	// a nil logger discards the events
+	logger.Log(&Event{Type: EventConnection})
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	if logger, err = NewLogger(path, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(&Event{Type: EventDialDenied, ClusterName: "cls-a", Destination: "10.0.0.1:22"})
+	logger.Log(&Event{Type: EventConnection, BytesIn: 10})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", data)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventDialDenied || e.ClusterName != "cls-a" || e.Destination != "10.0.0.1:22" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if e.Timestamp.IsZero() {
+		t.Error("expected the timestamp to be set")
+	}
+	if strings.Contains(lines[1], "clusterName") {
+		t.Errorf("expected the empty fields omitted, got %s", lines[1])
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// backupTimeFormat is the timestamp suffix of the rotated files
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a writer that renames the file with a timestamp suffix
+// and opens a new one once the file exceeds the max size, it is not
+// safe for concurrent use
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0700); err != nil {
+		return fmt.Errorf("failed to create the directory of audit log %s: %v", rf.path, err)
+	}
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %v", rf.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log %s: %v", rf.path, err)
+	}
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+// Write writes the data into the file, rotates the file first if the
+// data makes it exceed the max size. The file keeps growing if it fails
+// to be rotated, and the rotation is retried by the next write
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			if rf.file == nil {
+				return 0, err
+			}
+			klog.Errorf("%v", err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and opens a new one, the file is reopened if it
+// fails to be renamed, and it is nil if it fails to be opened
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		klog.Errorf("failed to close audit log %s: %v", rf.path, err)
+	}
+	rf.file = nil
+	backup := fmt.Sprintf("%s.%s", rf.path, time.Now().Format(backupTimeFormat))
+	if err := os.Rename(rf.path, backup); err != nil {
+		if openErr := rf.open(); openErr != nil {
+			klog.Errorf("%v", openErr)
+		}
+		return fmt.Errorf("failed to rotate audit log %s: %v", rf.path, err)
+	}
+	rf.removeStaleBackups()
+	return rf.open()
+}
+
+// removeStaleBackups removes the oldest rotated files which exceed
+// the max backups
+func (rf *rotatingFile) removeStaleBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups, err := rf.backups()
+	if err != nil {
+		klog.Errorf("failed to list rotated audit logs %s: %v", rf.path, err)
+		return
+	}
+	if len(backups) <= rf.maxBackups {
+		return
+	}
+	// the timestamp suffix sorts the backups from the oldest to newest
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-rf.maxBackups] {
+		if err := os.Remove(backup); err != nil {
+			klog.Errorf("failed to remove rotated audit log %s: %v", backup, err)
+		}
+	}
+}
+
+// backups lists the rotated files, which are named after the path with
+// exactly the timestamp suffix, so that the other files sharing the
+// prefix, e.g. audit.log.bak, are kept
+func (rf *rotatingFile) backups() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Dir(rf.path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(rf.path) + "."
+	var backups []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(name, prefix)
+		if _, err := time.Parse(backupTimeFormat, suffix); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(rf.path), name))
+	}
+	return backups, nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "excalibur-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func backups(t *testing.T, path string) []string {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit", "audit.log")
+
+	rf, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.file.Close()
+
+	// a write larger than the max size is not split, and the file is not
+	// rotated while it is empty
+	if _, err := rf.Write([]byte("0123456789abc")); err != nil {
+		t.Fatal(err)
+	}
+	if got := backups(t, path); len(got) != 0 {
+		t.Fatalf("expected no rotated file, got %v", got)
+	}
+
+	for i, line := range []string{"first", "second", "third"} {
+		// the backups are named after the time in milliseconds
+		time.Sleep(5 * time.Millisecond)
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		expected := i + 1
+		if expected > 2 {
+			expected = 2
+		}
+		if got := backups(t, path); len(got) != expected {
+			t.Fatalf("expected %d rotated files, got %v", expected, got)
+		}
+	}
+
+	got := backups(t, path)
+	if len(got) != 2 {
+		t.Fatalf("expected the rotated files limited to 2, got %v", got)
+	}
+	// the oldest backup holding the oversized write is removed
+	for i, expected := range []string{"first", "second"} {
+		data, err := ioutil.ReadFile(got[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("expected backup %s to be %q, got %q", got[i], expected, data)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "third" {
+		t.Errorf("expected the current file to be %q, got %q", "third", data)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	if err := ioutil.WriteFile(path, []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := newRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.file.Close()
+	// the size of the existing file counts
+	if _, err := rf.Write([]byte("678901")); err != nil {
+		t.Fatal(err)
+	}
+	got := backups(t, path)
+	if len(got) != 1 {
+		t.Fatalf("expected 1 rotated file, got %v", got)
+	}
+	if data, _ := ioutil.ReadFile(got[0]); string(data) != "12345" {
+		t.Errorf("expected the existing content rotated, got %q", data)
+	}
+}
+
+func TestRotatingFileKeepsUnrelatedFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	unrelated := []string{
+		"audit.log.bak",
+		"audit.log.1",
+		"audit.log.2020-01-01T00-00-00.000.gz",
+		"audit.log-2020-01-01T00-00-00.000",
+		"other.log.2020-01-01T00-00-00.000",
+	}
+	for _, name := range unrelated {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the stale backup rotated before is removed
+	stale := path + ".2020-01-01T00-00-00.000"
+	if err := ioutil.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := newRotatingFile(path, 5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.file.Close()
+	for _, line := range []string{"first", "second"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale backup to be removed, got %v", err)
+	}
+	for _, name := range unrelated {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be kept, got %v", name, err)
+		}
+	}
+	got, err := rf.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 rotated file, got %v", got)
+	}
+	if data, _ := ioutil.ReadFile(got[0]); string(data) != "first" {
+		t.Errorf("expected the latest backup to be %q, got %q", "first", data)
+	}
+}
+
+func TestRotatingFileKeepsWritingIfRenameFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// the name of the rotated file exceeds the max length of file names,
+	// so that the rename always fails
+	path := filepath.Join(dir, strings.Repeat("a", 240))
+
+	rf, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.file.Close()
+
+	for _, data := range []string{"01234", "56789", "abcde"} {
+		if _, err := rf.Write([]byte(data)); err != nil {
+			t.Fatalf("unexpected error writing %s: %v", data, err)
+		}
+	}
+	if got := backups(t, path); len(got) != 0 {
+		t.Errorf("expected no rotated file, got %v", got)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789abcde" {
+		t.Errorf("expected the writes appended to the file, got %q", data)
+	}
+}
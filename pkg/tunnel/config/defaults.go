@@ -0,0 +1,137 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	anpserver "sigs.k8s.io/apiserver-network-proxy/pkg/server"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/version"
+)
+
+const (
+	defaultAuditLogMaxSize    = 100
+	defaultAuditLogMaxBackups = 10
+)
+
+// SetDefaultsTunnelServerConfiguration sets the defaults of the unset
+// fields, the defaults are the same as the ones of the flags
+func SetDefaultsTunnelServerConfiguration(cfg *TunnelServerConfiguration) {
+	setDefaultsTypeMeta(&cfg.TypeMeta, TunnelServerConfigurationKind)
+	if cfg.CAFile == "" {
+		cfg.CAFile = constants.TunnelCAFile
+	}
+	if cfg.BindAddress == "" {
+		cfg.BindAddress = "0.0.0.0"
+	}
+	if cfg.InsecureBindAddress == "" {
+		cfg.InsecureBindAddress = "127.0.0.1"
+	}
+	if cfg.PublishBootstrapConfigMap == nil {
+		publish := true
+		cfg.PublishBootstrapConfigMap = &publish
+	}
+	setDefaultPort(&cfg.Ports.Agent, constants.TunnelServerAgentPort)
+	setDefaultPort(&cfg.Ports.Master, constants.TunnelServerMasterPort)
+	setDefaultPort(&cfg.Ports.MasterInsecure, constants.TunnelServerMasterInsecurePort)
+	setDefaultPort(&cfg.Ports.Admin, constants.TunnelServerAdminPort)
+	setDefaultPort(&cfg.Ports.ReverseProxy, constants.TunnelServerReversePorxyPort)
+	if cfg.Certificate.Dir == "" {
+		cfg.Certificate.Dir = fmt.Sprintf(constants.TunnelServerCertDir, version.GetServerName())
+	}
+	if cfg.ServerCount == 0 {
+		cfg.ServerCount = 1
+	}
+	if cfg.ProxyStrategy == "" {
+		cfg.ProxyStrategy = string(anpserver.ProxyStrategyDestHost)
+	}
+	if cfg.NormServerURL == "" {
+		cfg.NormServerURL = constants.TunnelNormServerURL
+	}
+	if cfg.CSRApproverWorkers == 0 {
+		cfg.CSRApproverWorkers = constants.TunnelCSRApproverThreadiness
+	}
+	setDefaultDuration(&cfg.KeepAlive.Time, constants.TunnelANPGrpcKeepAliveTimeSec*time.Second)
+	setDefaultDuration(&cfg.KeepAlive.Timeout, constants.TunnelANPGrpcKeepAliveTimeoutSec*time.Second)
+	setDefaultsAuditLog(&cfg.AuditLog)
+	setDefaultsHook(&cfg.Hook)
+}
+
+// SetDefaultsTunnelAgentConfiguration sets the defaults of the unset
+// fields, the defaults are the same as the ones of the flags
+func SetDefaultsTunnelAgentConfiguration(cfg *TunnelAgentConfiguration) {
+	setDefaultsTypeMeta(&cfg.TypeMeta, TunnelAgentConfigurationKind)
+	if cfg.CAFile == "" {
+		cfg.CAFile = constants.TunnelAgentCAFile
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = constants.TunnelAgentTokenFile
+	}
+	if cfg.CertDir == "" {
+		cfg.CertDir = fmt.Sprintf(constants.TunnelAgentCertDir, version.GetAgentName())
+	}
+	if cfg.IdentifierServiceSelector == "" {
+		cfg.IdentifierServiceSelector = constants.TunnelAgentIdentifierServiceSelector
+	}
+	if cfg.ClusterDomain == "" {
+		cfg.ClusterDomain = "cluster.local"
+	}
+	setDefaultDuration(&cfg.SyncInterval, constants.TunnelAgentSyncIntervalSec*time.Second)
+	setDefaultDuration(&cfg.ProbeInterval, constants.TunnelAgentProbeIntervalSec*time.Second)
+	setDefaultsAuditLog(&cfg.AuditLog)
+	setDefaultsHook(&cfg.Hook)
+}
+
+func setDefaultsTypeMeta(typeMeta *metav1.TypeMeta, kind string) {
+	if typeMeta.APIVersion == "" {
+		typeMeta.APIVersion = APIVersion
+	}
+	if typeMeta.Kind == "" {
+		typeMeta.Kind = kind
+	}
+}
+
+func setDefaultsAuditLog(auditLog *AuditLogOptions) {
+	if auditLog.MaxSize == 0 {
+		auditLog.MaxSize = defaultAuditLogMaxSize
+	}
+	if auditLog.MaxBackups == 0 {
+		auditLog.MaxBackups = defaultAuditLogMaxBackups
+	}
+}
+
+func setDefaultsHook(hook *HookOptions) {
+	setDefaultDuration(&hook.PreStopTimeout, constants.TunnelPreStopHookTimeoutSec*time.Second)
+}
+
+// setDefaultPort defaults the unset port, 0 is kept since it disables
+// the listener
+func setDefaultPort(port **int32, defaultPort int32) {
+	if *port == nil {
+		*port = &defaultPort
+	}
+}
+
+func setDefaultDuration(d *metav1.Duration, defaultDuration time.Duration) {
+	if d.Duration == 0 {
+		d.Duration = defaultDuration
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// LoadTunnelServerConfiguration loads the server configuration from the
+// YAML or JSON file and sets the defaults, the fields are validated by
+// ValidateTunnelServerConfiguration once the flags are applied
+func LoadTunnelServerConfiguration(file string) (*TunnelServerConfiguration, error) {
+	cfg := &TunnelServerConfiguration{}
+	if err := load(file, cfg); err != nil {
+		return nil, err
+	}
+	SetDefaultsTunnelServerConfiguration(cfg)
+	if err := validateTypeMeta(cfg.APIVersion, cfg.Kind, TunnelServerConfigurationKind).ToAggregate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// LoadTunnelAgentConfiguration loads the agent configuration from the
+// YAML or JSON file and sets the defaults, the fields are validated by
+// ValidateTunnelAgentConfiguration once the flags are applied
+func LoadTunnelAgentConfiguration(file string) (*TunnelAgentConfiguration, error) {
+	cfg := &TunnelAgentConfiguration{}
+	if err := load(file, cfg); err != nil {
+		return nil, err
+	}
+	SetDefaultsTunnelAgentConfiguration(cfg)
+	if err := validateTypeMeta(cfg.APIVersion, cfg.Kind, TunnelAgentConfigurationKind).ToAggregate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// load decodes the file strictly, so that a misspelled field is reported
+// instead of being ignored
+func load(file string, cfg interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration %s: %v", file, err)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("failed to decode configuration %s: %v", file, err)
+	}
+	return nil
+}
+
+// ApplyWithFlags applies the configuration file by apply, then sets the
+// flags set on the command line again so that they override the file
+func ApplyWithFlags(flags *pflag.FlagSet, apply func()) error {
+	changed := make(map[string]string)
+	flags.Visit(func(f *pflag.Flag) {
+		changed[f.Name] = f.Value.String()
+	})
+	apply()
+	for name, value := range changed {
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("failed to set --%s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config defines the versioned configuration files of the tunnel
+// server and agent, which are loaded by --config, the flags set on the
+// command line take precedence over the file
+package config
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// GroupName is the api group of the configurations
+	GroupName = "excalibur.tkestack.io"
+	// Version is the version of the configurations
+	Version = "v1alpha1"
+	// APIVersion is the apiVersion of the configuration files
+	APIVersion = GroupName + "/" + Version
+
+	// TunnelServerConfigurationKind is the kind of the server configuration
+	TunnelServerConfigurationKind = "TunnelServerConfiguration"
+	// TunnelAgentConfigurationKind is the kind of the agent configuration
+	TunnelAgentConfigurationKind = "TunnelAgentConfiguration"
+)
+
+// TunnelServerConfiguration configures the tunnel server
+type TunnelServerConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// KubeConfig is the path to the kubeconfig file of the hub cluster,
+	// the in-cluster config is used if it is empty
+	KubeConfig string `json:"kubeConfig,omitempty"`
+	// CAFile verifies the clients when KubeConfig is empty
+	CAFile string `json:"caFile,omitempty"`
+	// BindAddress is the ip address of the agent, master, admin and
+	// reverse proxy ports unless BindAddresses overrides it, a comma
+	// separated IPv4 and IPv6 address pair listens on both of them
+	BindAddress string `json:"bindAddress,omitempty"`
+	// InsecureBindAddress is the ip address of the master insecure port,
+	// it is comma separated as BindAddress
+	InsecureBindAddress string                    `json:"insecureBindAddress,omitempty"`
+	BindAddresses       TunnelServerBindAddresses `json:"bindAddresses,omitempty"`
+	// IPFamilyPreference is the ip family of the server addresses published
+	// in the bootstrap configmap and passed to the hooks, IPv4 or IPv6, the
+	// primary family of the service is preferred if it is empty
+	IPFamilyPreference string `json:"ipFamilyPreference,omitempty"`
+	// PublishBootstrapConfigMap publishes the endpoints and CA bundle of
+	// the tunnel server in the x-tunnel-server-bootstrap configmap, which
+	// the agents prefer to the service, it defaults to true
+	PublishBootstrapConfigMap *bool              `json:"publishBootstrapConfigMap,omitempty"`
+	Ports                     TunnelServerPorts  `json:"ports,omitempty"`
+	Certificate               CertificateOptions `json:"certificate,omitempty"`
+	// ServerCount is the number of the server instances, it should be 1
+	// unless the server is HA
+	ServerCount int32 `json:"serverCount,omitempty"`
+	// ProxyStrategy is the strategy of choosing the agent, destHost or default
+	ProxyStrategy string `json:"proxyStrategy,omitempty"`
+	// UDSName is the unix socket which serves the master instead of the
+	// master ports if it is set
+	UDSName string `json:"udsName,omitempty"`
+	// NormServerURL is the backend of /norm/api of the reverse proxy, the
+	// request path is appended to the path of the url
+	NormServerURL string `json:"normServerURL,omitempty"`
+	// BindAgentIdentity only approves the certificate of an agent
+	// requested by the service account excalibur-agent-<cluster name> in
+	// the namespace of the server, so that an agent can't be issued the
+	// certificate of another cluster
+	BindAgentIdentity bool `json:"bindAgentIdentity,omitempty"`
+	// CSRApproverWorkers is the number of the workers approving the CSRs
+	CSRApproverWorkers int32            `json:"csrApproverWorkers,omitempty"`
+	KeepAlive          KeepAliveOptions `json:"keepAlive,omitempty"`
+	AuditLog           AuditLogOptions  `json:"auditLog,omitempty"`
+	Hook               HookOptions      `json:"hook,omitempty"`
+}
+
+// TunnelServerBindAddresses are the ip addresses of each listener, the
+// listener binds BindAddress if its addresses are empty
+type TunnelServerBindAddresses struct {
+	Agent        []string `json:"agent,omitempty"`
+	Master       []string `json:"master,omitempty"`
+	Admin        []string `json:"admin,omitempty"`
+	ReverseProxy []string `json:"reverseProxy,omitempty"`
+}
+
+// TunnelServerPorts are the ports the tunnel server listens on, the
+// unset ports are defaulted and the listener of port 0 is disabled
+type TunnelServerPorts struct {
+	// Agent accepts the connections of the agents, it can't be disabled
+	Agent *int32 `json:"agent,omitempty"`
+	// Master accepts the HTTP-CONNECT requests with mTLS
+	Master *int32 `json:"master,omitempty"`
+	// MasterInsecure accepts the HTTP-CONNECT requests without tls
+	MasterInsecure *int32 `json:"masterInsecure,omitempty"`
+	// Admin serves the admin api
+	Admin *int32 `json:"admin,omitempty"`
+	// ReverseProxy serves the reverse proxy to the hub cluster
+	ReverseProxy *int32 `json:"reverseProxy,omitempty"`
+}
+
+// CertificateOptions configures the certificate of the tunnel server
+type CertificateOptions struct {
+	// Dir is where the certificate is stored
+	Dir string `json:"dir,omitempty"`
+	// DNSNames are added into the certificate besides the discovered ones
+	DNSNames []string `json:"dnsNames,omitempty"`
+	// IPs are added into the certificate besides the discovered ones
+	IPs []string `json:"ips,omitempty"`
+}
+
+// KeepAliveOptions configures the keepalive of the agent connections
+type KeepAliveOptions struct {
+	// Time is the idle time before the server pings the agent
+	Time metav1.Duration `json:"time,omitempty"`
+	// Timeout is the time to wait for the ping ack before closing the
+	// connection
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// AuditLogOptions configures the audit log
+type AuditLogOptions struct {
+	// Path is the audit log file, '-' means standard out, the audit log
+	// is disabled if it is empty
+	Path string `json:"path,omitempty"`
+	// MaxSize is the maximum size in megabytes of the file before it
+	// gets rotated
+	MaxSize int32 `json:"maxSize,omitempty"`
+	// MaxBackups is the maximum number of the rotated files to retain
+	MaxBackups int32 `json:"maxBackups,omitempty"`
+}
+
+// HookOptions configures the hook providers
+type HookOptions struct {
+	// Providers is the chain of the hook providers executed in order
+	Providers []string `json:"providers,omitempty"`
+	// ConfigFile is the YAML or JSON file that configures the providers
+	ConfigFile string `json:"configFile,omitempty"`
+	// PreStopTimeout is the time given to the pre-stop hooks
+	PreStopTimeout metav1.Duration `json:"preStopTimeout,omitempty"`
+}
+
+// TunnelAgentConfiguration configures the tunnel agent
+type TunnelAgentConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ClusterName is the name of the managed cluster
+	ClusterName string `json:"clusterName,omitempty"`
+	// TunnelServerAddress is the host:port of the tunnel server, it is
+	// discovered from the hub cluster if it is empty
+	TunnelServerAddress string `json:"tunnelServerAddress,omitempty"`
+	// APIServerAddress is the host:port of the hub apiserver
+	APIServerAddress string `json:"apiServerAddress,omitempty"`
+	// IPFamilyPreference is the ip family of the discovered tunnel server
+	// address, IPv4 or IPv6, the primary family of the service is
+	// preferred if it is empty
+	IPFamilyPreference string `json:"ipFamilyPreference,omitempty"`
+	// KubeConfig is the path to the kubeconfig file of the managed
+	// cluster, the in-cluster config is used if it is empty
+	KubeConfig string `json:"kubeConfig,omitempty"`
+	// CAFile verifies the hub apiserver and the tunnel server
+	CAFile string `json:"caFile,omitempty"`
+	// TokenFile is the token of the agent in the hub cluster
+	TokenFile string `json:"tokenFile,omitempty"`
+	// CertDir is where the certificate of the agent is stored
+	CertDir string `json:"certDir,omitempty"`
+	// AgentIdentifiers are the identifiers the server chooses the agent by
+	AgentIdentifiers string `json:"agentIdentifiers,omitempty"`
+	// DynamicAgentIdentifiers generates the identifiers from the managed
+	// cluster and re-registers when they change
+	DynamicAgentIdentifiers bool `json:"dynamicAgentIdentifiers,omitempty"`
+	// IdentifierServiceSelector selects the services whose dns names are
+	// added into the generated identifiers
+	IdentifierServiceSelector string `json:"identifierServiceSelector,omitempty"`
+	// ClusterDomain is the dns domain of the managed cluster
+	ClusterDomain string            `json:"clusterDomain,omitempty"`
+	DialPolicy    DialPolicyOptions `json:"dialPolicy,omitempty"`
+	// SyncInterval is the interval the agent checks that it connects to
+	// all of the server instances
+	SyncInterval metav1.Duration `json:"syncInterval,omitempty"`
+	// ProbeInterval is the interval the agent checks that its connections
+	// are ready
+	ProbeInterval metav1.Duration `json:"probeInterval,omitempty"`
+	AuditLog      AuditLogOptions `json:"auditLog,omitempty"`
+	Hook          HookOptions     `json:"hook,omitempty"`
+}
+
+// DialPolicyOptions are the destinations the tunnel server is allowed to
+// dial, only the local apiserver is allowed if all of them are empty
+type DialPolicyOptions struct {
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// AllowedHosts supports wildcard like *.example.com
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// AllowedPorts allows all ports if it is empty
+	AllowedPorts []int32 `json:"allowedPorts,omitempty"`
+	// ConfigMap is the namespace/name of the configmap of the dial policy,
+	// which takes precedence over the other fields
+	ConfigMap string `json:"configMap,omitempty"`
+}
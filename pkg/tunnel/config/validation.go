@@ -0,0 +1,317 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	anpserver "sigs.k8s.io/apiserver-network-proxy/pkg/server"
+)
+
+// ValidateTunnelServerConfiguration validates the server configuration
+func ValidateTunnelServerConfiguration(cfg *TunnelServerConfiguration) field.ErrorList {
+	allErrs := validateTypeMeta(cfg.APIVersion, cfg.Kind, TunnelServerConfigurationKind)
+	allErrs = append(allErrs, validateBindAddresses(cfg.BindAddress, field.NewPath("bindAddress"))...)
+	allErrs = append(allErrs, validateBindAddresses(cfg.InsecureBindAddress, field.NewPath("insecureBindAddress"))...)
+	allErrs = append(allErrs, validateIPFamily(cfg.IPFamilyPreference, field.NewPath("ipFamilyPreference"))...)
+
+	// the listeners binding the same address can't share a port
+	bindPath := field.NewPath("bindAddresses")
+	portsPath := field.NewPath("ports")
+	var listeners []listener
+	for _, l := range []struct {
+		name  string
+		port  *int32
+		addrs []string
+	}{
+		{"agent", cfg.Ports.Agent, cfg.BindAddresses.Agent},
+		{"master", cfg.Ports.Master, cfg.BindAddresses.Master},
+		{"masterInsecure", cfg.Ports.MasterInsecure, nil},
+		{"admin", cfg.Ports.Admin, cfg.BindAddresses.Admin},
+		{"reverseProxy", cfg.Ports.ReverseProxy, cfg.BindAddresses.ReverseProxy},
+	} {
+		fldPath := portsPath.Child(l.name)
+		if l.port == nil {
+			allErrs = append(allErrs, field.Required(fldPath, ""))
+			continue
+		}
+		if *l.port == 0 {
+			if l.name == "agent" {
+				allErrs = append(allErrs, field.Invalid(fldPath, *l.port, "the agent listener can't be disabled"))
+			}
+			continue
+		}
+		for _, msg := range utilvalidation.IsValidPortNum(int(*l.port)) {
+			allErrs = append(allErrs, field.Invalid(fldPath, *l.port, msg))
+		}
+		for i, ip := range l.addrs {
+			allErrs = append(allErrs, validateIP(ip, bindPath.Child(l.name).Index(i))...)
+		}
+		addrs := l.addrs
+		if len(addrs) == 0 {
+			addrs = strings.Split(cfg.BindAddress, ",")
+			if l.name == "masterInsecure" {
+				addrs = strings.Split(cfg.InsecureBindAddress, ",")
+			}
+		}
+		current := listener{name: l.name, port: *l.port, ips: parseIPs(addrs)}
+		for _, other := range listeners {
+			if current.overlaps(other) {
+				allErrs = append(allErrs, field.Invalid(fldPath, *l.port,
+					"conflicts with "+portsPath.Child(other.name).String()))
+				break
+			}
+		}
+		listeners = append(listeners, current)
+	}
+	if cfg.UDSName == "" && isDisabled(cfg.Ports.Master) && isDisabled(cfg.Ports.MasterInsecure) {
+		allErrs = append(allErrs, field.Invalid(portsPath.Child("master"), 0,
+			"one of the master, masterInsecure ports and udsName must be set"))
+	}
+
+	certPath := field.NewPath("certificate")
+	if cfg.Certificate.Dir == "" {
+		allErrs = append(allErrs, field.Required(certPath.Child("dir"), ""))
+	}
+	for i, name := range cfg.Certificate.DNSNames {
+		for _, msg := range utilvalidation.IsDNS1123Subdomain(strings.TrimPrefix(name, "*.")) {
+			allErrs = append(allErrs, field.Invalid(certPath.Child("dnsNames").Index(i), name, msg))
+		}
+	}
+	for i, ip := range cfg.Certificate.IPs {
+		allErrs = append(allErrs, validateIP(ip, certPath.Child("ips").Index(i))...)
+	}
+
+	if cfg.ServerCount < 1 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("serverCount"), cfg.ServerCount,
+			"must be greater than 0"))
+	}
+	switch anpserver.ProxyStrategy(cfg.ProxyStrategy) {
+	case anpserver.ProxyStrategyDestHost, anpserver.ProxyStrategyDefault:
+	default:
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("proxyStrategy"), cfg.ProxyStrategy,
+			[]string{string(anpserver.ProxyStrategyDestHost), string(anpserver.ProxyStrategyDefault)}))
+	}
+	if u, err := url.Parse(cfg.NormServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("normServerURL"), cfg.NormServerURL,
+			"must be an http or https url"))
+	}
+	if cfg.CSRApproverWorkers < 1 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("csrApproverWorkers"), cfg.CSRApproverWorkers,
+			"must be greater than 0"))
+	}
+
+	keepAlivePath := field.NewPath("keepAlive")
+	if cfg.KeepAlive.Time.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(keepAlivePath.Child("time"), cfg.KeepAlive.Time.Duration.String(),
+			"must be greater than 0"))
+	}
+	if cfg.KeepAlive.Timeout.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(keepAlivePath.Child("timeout"), cfg.KeepAlive.Timeout.Duration.String(),
+			"must be greater than 0"))
+	}
+	allErrs = append(allErrs, validateAuditLog(&cfg.AuditLog, field.NewPath("auditLog"))...)
+	allErrs = append(allErrs, validateHook(&cfg.Hook, field.NewPath("hook"))...)
+	return allErrs
+}
+
+// ValidateTunnelAgentConfiguration validates the agent configuration
+func ValidateTunnelAgentConfiguration(cfg *TunnelAgentConfiguration) field.ErrorList {
+	allErrs := validateTypeMeta(cfg.APIVersion, cfg.Kind, TunnelAgentConfigurationKind)
+	if cfg.ClusterName == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("clusterName"), ""))
+	}
+	if cfg.TunnelServerAddress != "" {
+		allErrs = append(allErrs, validateHostPort(cfg.TunnelServerAddress, field.NewPath("tunnelServerAddress"))...)
+	}
+	if cfg.APIServerAddress != "" {
+		allErrs = append(allErrs, validateHostPort(cfg.APIServerAddress, field.NewPath("apiServerAddress"))...)
+	}
+	allErrs = append(allErrs, validateIPFamily(cfg.IPFamilyPreference, field.NewPath("ipFamilyPreference"))...)
+	if cfg.CertDir == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("certDir"), ""))
+	}
+	if _, err := labels.Parse(cfg.IdentifierServiceSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("identifierServiceSelector"),
+			cfg.IdentifierServiceSelector, err.Error()))
+	}
+
+	dialPolicyPath := field.NewPath("dialPolicy")
+	for i, cidr := range cfg.DialPolicy.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(dialPolicyPath.Child("allowedCIDRs").Index(i), cidr, err.Error()))
+		}
+	}
+	for i, port := range cfg.DialPolicy.AllowedPorts {
+		for _, msg := range utilvalidation.IsValidPortNum(int(port)) {
+			allErrs = append(allErrs, field.Invalid(dialPolicyPath.Child("allowedPorts").Index(i), port, msg))
+		}
+	}
+	if cm := cfg.DialPolicy.ConfigMap; cm != "" {
+		if parts := strings.Split(cm, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			allErrs = append(allErrs, field.Invalid(dialPolicyPath.Child("configMap"), cm,
+				"must be {namespace}/{name}"))
+		}
+	}
+
+	if cfg.SyncInterval.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("syncInterval"), cfg.SyncInterval.Duration.String(),
+			"must be greater than 0"))
+	}
+	if cfg.ProbeInterval.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("probeInterval"), cfg.ProbeInterval.Duration.String(),
+			"must be greater than 0"))
+	}
+	allErrs = append(allErrs, validateAuditLog(&cfg.AuditLog, field.NewPath("auditLog"))...)
+	allErrs = append(allErrs, validateHook(&cfg.Hook, field.NewPath("hook"))...)
+	return allErrs
+}
+
+func validateTypeMeta(apiVersion, kind, expectedKind string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if apiVersion != APIVersion {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("apiVersion"), apiVersion, []string{APIVersion}))
+	}
+	if kind != expectedKind {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("kind"), kind, []string{expectedKind}))
+	}
+	return allErrs
+}
+
+func validateIP(ip string, fldPath *field.Path) field.ErrorList {
+	if net.ParseIP(ip) == nil {
+		return field.ErrorList{field.Invalid(fldPath, ip, "must be a valid IP address")}
+	}
+	return nil
+}
+
+// validateIPFamily validates the ip family, which is empty for no preference
+func validateIPFamily(family string, fldPath *field.Path) field.ErrorList {
+	switch v1.IPFamily(family) {
+	case "", v1.IPv4Protocol, v1.IPv6Protocol:
+		return nil
+	}
+	return field.ErrorList{field.NotSupported(fldPath, family,
+		[]string{string(v1.IPv4Protocol), string(v1.IPv6Protocol)})}
+}
+
+// validateBindAddresses validates the comma separated ip addresses
+func validateBindAddresses(addrs string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for _, ip := range strings.Split(addrs, ",") {
+		allErrs = append(allErrs, validateIP(ip, fldPath)...)
+	}
+	return allErrs
+}
+
+// listener is a port bound to the ip addresses
+type listener struct {
+	name string
+	port int32
+	ips  []net.IP
+}
+
+// overlaps checks if the listeners bind the same address, an unspecified
+// address covers its own family, and :: covers IPv4 as well if it is the
+// only address of the listener
+func (l listener) overlaps(other listener) bool {
+	if l.port != other.port {
+		return false
+	}
+	for _, a := range l.ips {
+		for _, b := range other.ips {
+			if a.Equal(b) ||
+				(a.IsUnspecified() && (isIPv4(a) == isIPv4(b) || (len(l.ips) == 1 && !isIPv4(a)))) ||
+				(b.IsUnspecified() && (isIPv4(a) == isIPv4(b) || (len(other.ips) == 1 && !isIPv4(b)))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseIPs(addrs []string) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+func isDisabled(port *int32) bool {
+	return port == nil || *port == 0
+}
+
+func validateHostPort(address string, fldPath *field.Path) field.ErrorList {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, address, err.Error())}
+	}
+	allErrs := field.ErrorList{}
+	if host == "" {
+		allErrs = append(allErrs, field.Invalid(fldPath, address, "host must not be empty"))
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return append(allErrs, field.Invalid(fldPath, address, "port must be a number"))
+	}
+	for _, msg := range utilvalidation.IsValidPortNum(portNum) {
+		allErrs = append(allErrs, field.Invalid(fldPath, address, msg))
+	}
+	return allErrs
+}
+
+func validateAuditLog(auditLog *AuditLogOptions, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if auditLog.MaxSize < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxSize"), auditLog.MaxSize,
+			"must not be negative"))
+	}
+	if auditLog.MaxBackups < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxBackups"), auditLog.MaxBackups,
+			"must not be negative"))
+	}
+	return allErrs
+}
+
+func validateHook(hook *HookOptions, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, provider := range hook.Providers {
+		if strings.TrimSpace(provider) == "" || strings.Contains(provider, ",") {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("providers").Index(i), provider,
+				"must be the name of a hook provider"))
+		}
+	}
+	if hook.PreStopTimeout.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("preStopTimeout"),
+			hook.PreStopTimeout.Duration.String(), "must not be negative"))
+	}
+	return allErrs
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+// fields joins the fields of the errors to compare them
+func fields(errs []string) string {
+	return strings.Join(errs, ",")
+}
+
+func TestValidateTunnelServerConfiguration(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(cfg *TunnelServerConfiguration)
+		// expected are the fields of the errors, empty means valid
+		expected []string
+	}{
+		{name: "defaults", mutate: func(cfg *TunnelServerConfiguration) {}},
+		{name: "dual-stack bind address", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.BindAddress = "0.0.0.0,::"
+		}},
+		{name: "invalid bind address", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.BindAddress = "0.0.0.0,foo"
+		}, expected: []string{"bindAddress"}},
+		{name: "invalid kind", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Kind = TunnelAgentConfigurationKind
+		}, expected: []string{"kind"}},
+		{name: "invalid ip family", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.IPFamilyPreference = "IPv5"
+		}, expected: []string{"ipFamilyPreference"}},
+		{name: "agent port disabled", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Agent = int32Ptr(0)
+		}, expected: []string{"ports.agent"}},
+		{name: "invalid port", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Admin = int32Ptr(65536)
+		}, expected: []string{"ports.admin"}},
+		{name: "conflicting ports", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Admin = int32Ptr(*cfg.Ports.Agent)
+		}, expected: []string{"ports.admin"}},
+		{name: "same port on different addresses", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Admin = int32Ptr(*cfg.Ports.Agent)
+			cfg.BindAddress = "10.0.0.1"
+			cfg.BindAddresses.Admin = []string{"127.0.0.1"}
+		}},
+		{name: "unspecified ipv6 address covers ipv4", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Admin = int32Ptr(*cfg.Ports.Agent)
+			cfg.BindAddresses.Agent = []string{"::"}
+			cfg.BindAddresses.Admin = []string{"127.0.0.1"}
+		}, expected: []string{"ports.admin"}},
+		{name: "unspecified ipv4 address does not cover ipv6", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Admin = int32Ptr(*cfg.Ports.Agent)
+			cfg.BindAddresses.Agent = []string{"0.0.0.0"}
+			cfg.BindAddresses.Admin = []string{"::1"}
+		}},
+		{name: "invalid listener address", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.BindAddresses.Master = []string{"foo"}
+		}, expected: []string{"bindAddresses.master[0]"}},
+		{name: "no master", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Master = int32Ptr(0)
+			cfg.Ports.MasterInsecure = int32Ptr(0)
+		}, expected: []string{"ports.master"}},
+		{name: "master served by uds", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Ports.Master = int32Ptr(0)
+			cfg.Ports.MasterInsecure = int32Ptr(0)
+			cfg.UDSName = "/var/run/excalibur.sock"
+		}},
+		{name: "invalid certificate", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.Certificate.DNSNames = []string{"*.example.com", "Example_com"}
+			cfg.Certificate.IPs = []string{"10.0.0.1", "10.0.0"}
+		}, expected: []string{"certificate.dnsNames[1]", "certificate.ips[1]"}},
+		{name: "invalid counts", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.ServerCount = -1
+			cfg.CSRApproverWorkers = -1
+		}, expected: []string{"serverCount", "csrApproverWorkers"}},
+		{name: "unknown proxy strategy", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.ProxyStrategy = "random"
+		}, expected: []string{"proxyStrategy"}},
+		{name: "invalid norm server url", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.NormServerURL = "169.254.0.40:80/norm/api"
+		}, expected: []string{"normServerURL"}},
+		{name: "invalid keepalive", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.KeepAlive.Time.Duration = -time.Second
+		}, expected: []string{"keepAlive.time"}},
+		{name: "invalid audit log and hook", mutate: func(cfg *TunnelServerConfiguration) {
+			cfg.AuditLog.MaxBackups = -1
+			cfg.Hook.Providers = []string{"exec,webhook"}
+		}, expected: []string{"auditLog.maxBackups", "hook.providers[0]"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &TunnelServerConfiguration{}
+			SetDefaultsTunnelServerConfiguration(cfg)
+			c.mutate(cfg)
+			var got []string
+			for _, err := range ValidateTunnelServerConfiguration(cfg) {
+				got = append(got, err.Field)
+			}
+			if fields(got) != fields(c.expected) {
+				t.Errorf("expected errors of %v, got %v", c.expected, ValidateTunnelServerConfiguration(cfg))
+			}
+		})
+	}
+}
+
+func TestValidateTunnelAgentConfiguration(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(cfg *TunnelAgentConfiguration)
+		// expected are the fields of the errors, empty means valid
+		expected []string
+	}{
+		{name: "defaults", mutate: func(cfg *TunnelAgentConfiguration) {}},
+		{name: "no cluster name", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.ClusterName = ""
+		}, expected: []string{"clusterName"}},
+		{name: "addresses", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.TunnelServerAddress = "[fd00::1]:10262"
+			cfg.APIServerAddress = "hub.example.com:443"
+		}},
+		{name: "invalid addresses", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.TunnelServerAddress = "fd00::1:10262"
+			cfg.APIServerAddress = ":443"
+		}, expected: []string{"tunnelServerAddress", "apiServerAddress"}},
+		{name: "invalid port", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.APIServerAddress = "hub.example.com:https"
+		}, expected: []string{"apiServerAddress"}},
+		{name: "invalid service selector", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.IdentifierServiceSelector = "a=b=c"
+		}, expected: []string{"identifierServiceSelector"}},
+		{name: "dial policy", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.DialPolicy = DialPolicyOptions{
+				AllowedCIDRs: []string{"10.0.0.0/8"},
+				AllowedHosts: []string{"*.example.com"},
+				AllowedPorts: []int32{443},
+				ConfigMap:    "kube-system/excalibur-dial-policy",
+			}
+		}},
+		{name: "invalid dial policy", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.DialPolicy = DialPolicyOptions{
+				AllowedCIDRs: []string{"10.0.0.1"},
+				AllowedPorts: []int32{443, 0},
+				ConfigMap:    "excalibur-dial-policy",
+			}
+		}, expected: []string{"dialPolicy.allowedCIDRs[0]", "dialPolicy.allowedPorts[1]", "dialPolicy.configMap"}},
+		{name: "invalid intervals", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.SyncInterval.Duration = -time.Second
+			cfg.ProbeInterval.Duration = -time.Second
+		}, expected: []string{"syncInterval", "probeInterval"}},
+		{name: "invalid hook", mutate: func(cfg *TunnelAgentConfiguration) {
+			cfg.Hook.PreStopTimeout.Duration = -time.Second
+		}, expected: []string{"hook.preStopTimeout"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &TunnelAgentConfiguration{ClusterName: "cls-a"}
+			SetDefaultsTunnelAgentConfiguration(cfg)
+			c.mutate(cfg)
+			var got []string
+			for _, err := range ValidateTunnelAgentConfiguration(cfg) {
+				got = append(got, err.Field)
+			}
+			if fields(got) != fields(c.expected) {
+				t.Errorf("expected errors of %v, got %v", c.expected, ValidateTunnelAgentConfiguration(cfg))
+			}
+		})
+	}
+}
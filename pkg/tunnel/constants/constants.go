@@ -21,10 +21,15 @@ const (
 	TunnelServerAgentPort          = 10262
 	TunnelServerMasterPort         = 10263
 	TunnelServerMasterInsecurePort = 10264
+	TunnelServerAdminPort          = 10265
 	TunnelServerServiceName        = "x-tunnel-server-svc"
 	TunnelServerAgentPortName      = "tcp"
 	TunnelServerExternalAddrKey    = "x-tunnel-server-external-addr"
+	TunnelServerExposureKey        = "x-tunnel-server-exposure"
+	TunnelServerNodeAddressTypeKey = "x-tunnel-server-node-address-type"
 	TunnelEndpointsName            = "x-tunnel-server-svc"
+	// the configmap where the tunnel server publishes its connection info
+	TunnelServerBootstrapConfigMapName = "x-tunnel-server-bootstrap"
 
 	// tunnel PKI related constants
 	TunnelCSROrg                 = "excalibur:tunnel"
@@ -37,13 +42,38 @@ const (
 	TunnelServerCertDir          = "/var/lib/%s/pki"
 	TunnelAgentCertDir           = "/var/lib/%s/pki"
 	TunnelCSRApproverThreadiness = 2
+	// the service account in the namespace of the tunnel server that
+	// requests the certificate of an agent is named after its cluster
+	// with the prefix if the identities of the agents are bound
+	TunnelAgentIdentityPrefix = "excalibur-agent-"
 
 	// name of the environment variables used in pod
 	TunnelAgentPodIPEnv = "POD_IP"
+	// the grpc metadata key of the agent version sent to the server
+	TunnelAgentVersionHeader = "x-excalibur-agent-version"
 	// name of the environment variables used in pod
 	TunnelServerNSEnv = "TUNNEL_SERVER_NAMESPACE"
 	// probe the client every 10 seconds to ensure the connection is still active
 	TunnelANPGrpcKeepAliveTimeSec = 10
 	// wait 5 seconds for the probe ack before cutting the connection
 	TunnelANPGrpcKeepAliveTimeoutSec = 5
+	// give the pre-stop hooks 30 seconds before the components stop
+	TunnelPreStopHookTimeoutSec = 30
+	// the agent checks its connections to all of the servers every 5 seconds
+	TunnelAgentSyncIntervalSec = 5
+	// the agent checks its connections are ready every 5 seconds
+	TunnelAgentProbeIntervalSec = 5
+	// the agent waits 5 seconds for each candidate address of the server
+	TunnelAgentDialTimeoutSec = 5
+	// the agent waits 10 seconds for the changes of the managed cluster to
+	// settle before generating its identifiers again
+	TunnelAgentIdentifierResyncDelaySec = 10
+	// only the services labeled with it add their dns names into the
+	// generated agent identifiers by default
+	TunnelAgentIdentifierServiceSelector = "tunnel.excalibur.io/agent-identifier=true"
+	// the server updates the bootstrap configmap every 30 seconds
+	TunnelServerBootstrapSyncIntervalSec = 30
+
+	// the backend of the norm api served by the reverse proxy
+	TunnelNormServerURL = "http://169.254.0.40:80/norm/api"
 )
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ctl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/admin"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/version"
+)
+
+const (
+	outputTable = "table"
+	outputWide  = "wide"
+	outputJSON  = "json"
+)
+
+// NewTunnelCtlCommand creates a new tunnel-ctl command
+func NewTunnelCtlCommand() *cobra.Command {
+	o := NewTunnelCtlOptions()
+
+	cmd := &cobra.Command{
+		Use:   version.GetCtlName(),
+		Short: version.GetCtlName() + " manages the agents connected to " + version.GetServerName(),
+		// the errors are printed by the main function
+		SilenceUsage: true,
+	}
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&o.server, "server", o.server,
+		"The address of the admin api of tunnel server.")
+	flags.StringVar(&o.clientCert, "client-cert", o.clientCert,
+		"The client certificate, which must be signed by the cluster CA and belong to the system:masters group.")
+	flags.StringVar(&o.clientKey, "client-key", o.clientKey,
+		"The key of the client certificate.")
+	flags.StringVar(&o.caCert, "ca-cert", o.caCert,
+		"The CA to verify the tunnel server certificate.")
+	flags.DurationVar(&o.timeout, "timeout", o.timeout,
+		"The timeout of the requests to the tunnel server.")
+	flags.StringVarP(&o.output, "output", "o", o.output,
+		"The output format, one of table, wide and json.")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Run: func(c *cobra.Command, args []string) {
+			fmt.Printf("%s: %#v\n", version.GetCtlName(), version.Get())
+		},
+	})
+	getCmd := &cobra.Command{
+		Use:   "get",
+		Short: "Display the resources of tunnel server",
+	}
+	getCmd.AddCommand(&cobra.Command{
+		Use:     "agents",
+		Aliases: []string{"agent"},
+		Short:   "List the agents connected to the tunnel server",
+		Args:    cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if err := o.validate(); err != nil {
+				return err
+			}
+			if err := o.complete(); err != nil {
+				return err
+			}
+			return o.getAgents(os.Stdout)
+		},
+	})
+	cmd.AddCommand(getCmd)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "disconnect AGENT_ID",
+		Short: "Force-disconnect all of the connections of an agent, the agent reconnects afterwards",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			if err := o.validate(); err != nil {
+				return err
+			}
+			if err := o.complete(); err != nil {
+				return err
+			}
+			if err := o.client.DisconnectAgent(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("agent %s is disconnected\n", args[0])
+			return nil
+		},
+	})
+	return cmd
+}
+
+// TunnelCtlOptions has the information that required by the tunnel-ctl
+type TunnelCtlOptions struct {
+	server     string
+	clientCert string
+	clientKey  string
+	caCert     string
+	timeout    time.Duration
+	output     string
+	client     *admin.Client
+}
+
+// NewTunnelCtlOptions creates a new TunnelCtlOptions
+func NewTunnelCtlOptions() *TunnelCtlOptions {
+	return &TunnelCtlOptions{
+		server:  fmt.Sprintf("127.0.0.1:%d", constants.TunnelServerAdminPort),
+		timeout: 10 * time.Second,
+		output:  outputTable,
+	}
+}
+
+// validate validates the TunnelCtlOptions
+func (o *TunnelCtlOptions) validate() error {
+	if o.clientCert == "" || o.clientKey == "" {
+		return errors.New("--client-cert and --client-key are required")
+	}
+	if o.caCert == "" {
+		return errors.New("--ca-cert is required")
+	}
+	switch o.output {
+	case outputTable, outputWide, outputJSON:
+	default:
+		return fmt.Errorf("unsupported output format %s, must be one of %s, %s and %s",
+			o.output, outputTable, outputWide, outputJSON)
+	}
+	return nil
+}
+
+// complete creates the client of the admin api
+func (o *TunnelCtlOptions) complete() error {
+	cert, err := tls.LoadX509KeyPair(o.clientCert, o.clientKey)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	ca, err := ioutil.ReadFile(o.caCert)
+	if err != nil {
+		return fmt.Errorf("failed to read ca %s: %v", o.caCert, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificate is found in ca %s", o.caCert)
+	}
+	o.client = admin.NewClient(o.server, &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, o.timeout)
+	return nil
+}
+
+// getAgents prints the agents connected to the tunnel server
+func (o *TunnelCtlOptions) getAgents(out io.Writer) error {
+	list, err := o.client.ListAgents()
+	if err != nil {
+		return err
+	}
+	if o.output == outputJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	header := "ID\tVERSION\tREMOTE ADDRESS\tAGE\tSTREAMS\tBYTES IN\tBYTES OUT"
+	if o.output == outputWide {
+		header += "\tIDENTIFIERS"
+	}
+	fmt.Fprintln(w, header)
+	for _, agent := range list.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d",
+			agent.ID, agent.Version, agent.RemoteAddr,
+			duration.HumanDuration(time.Since(agent.ConnectedSince)),
+			agent.ActiveStreams, agent.BytesIn, agent.BytesOut)
+		if o.output == outputWide {
+			fmt.Fprintf(w, "\t%s", agent.Identifiers)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
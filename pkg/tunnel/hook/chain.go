@@ -0,0 +1,117 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"fmt"
+	"strings"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+// chainProvider executes the hooks of the providers in order. The
+// pre-start hooks gate the startup, so they stop at the first failure,
+// while the other hooks are executed by every provider, so that a failing
+// provider never hides the events from the others
+type chainProvider []interfaces.TunnelHookProvider
+
+var _ interfaces.TunnelHookProvider = chainProvider{}
+
+func (c chainProvider) GetProviderName() string {
+	names := make([]string, 0, len(c))
+	for _, provider := range c {
+		names = append(names, provider.GetProviderName())
+	}
+	return strings.Join(names, ",")
+}
+
+func (c chainProvider) PreStartTunnelAgent(hc *interfaces.HookContext) error {
+	return c.each(func(provider interfaces.TunnelHookProvider) error {
+		return provider.PreStartTunnelAgent(hc)
+	})
+}
+
+func (c chainProvider) PostStartTunnelAgent(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.PostStartTunnelAgent(hc)
+	})
+}
+
+func (c chainProvider) PreStopTunnelAgent(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.PreStopTunnelAgent(hc)
+	})
+}
+
+func (c chainProvider) PreStartTunnelServer(hc *interfaces.HookContext) error {
+	return c.each(func(provider interfaces.TunnelHookProvider) error {
+		return provider.PreStartTunnelServer(hc)
+	})
+}
+
+func (c chainProvider) PostStartTunnelServer(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.PostStartTunnelServer(hc)
+	})
+}
+
+func (c chainProvider) PreStopTunnelServer(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.PreStopTunnelServer(hc)
+	})
+}
+
+func (c chainProvider) AgentConnected(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.AgentConnected(hc)
+	})
+}
+
+func (c chainProvider) AgentDisconnected(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.AgentDisconnected(hc)
+	})
+}
+
+func (c chainProvider) CertificateRotated(hc *interfaces.HookContext) error {
+	return c.all(func(provider interfaces.TunnelHookProvider) error {
+		return provider.CertificateRotated(hc)
+	})
+}
+
+// each executes the hook of the providers until the first failure
+func (c chainProvider) each(fn func(provider interfaces.TunnelHookProvider) error) error {
+	for _, provider := range c {
+		if err := fn(provider); err != nil {
+			return fmt.Errorf("%s: %v", provider.GetProviderName(), err)
+		}
+	}
+	return nil
+}
+
+// all executes the hook of every provider and aggregates the failures
+func (c chainProvider) all(fn func(provider interfaces.TunnelHookProvider) error) error {
+	var errs []error
+	for _, provider := range c {
+		if err := fn(provider); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", provider.GetProviderName(), err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,386 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credential
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+)
+
+const (
+	defaultNamespace = metav1.NamespaceSystem
+
+	// managedByLabel marks the resources created by the provider
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "excalibur-tunnel-agent"
+
+	// syncPeriod is the interval of checking the credential and its
+	// registration to the hub, besides the changes of the token watched
+	syncPeriod = time.Minute
+	// the delay of retrying to sync starts from the initial delay and
+	// doubles each time up to the max delay
+	syncRetryInitialDelay = 2 * time.Second
+	syncRetryMaxDelay     = 5 * time.Minute
+)
+
+// defaultRules are the permissions granted to the dedicated service account
+// unless the rules are configured, which read the common workloads and
+// the cluster state, but neither the secrets nor any write verb
+var defaultRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{""},
+		Resources: []string{"pods", "pods/log", "services", "endpoints", "nodes", "namespaces", "configmaps",
+			"events", "persistentvolumes", "persistentvolumeclaims", "replicationcontrollers",
+			"resourcequotas", "limitranges", "serviceaccounts"},
+		Verbs: []string{"get", "list", "watch"},
+	},
+	{
+		APIGroups: []string{"apps", "batch", "autoscaling", "policy", "networking.k8s.io", "storage.k8s.io"},
+		Resources: []string{rbacv1.ResourceAll},
+		Verbs:     []string{"get", "list", "watch"},
+	},
+	{
+		NonResourceURLs: []string{"/healthz", "/livez", "/readyz", "/version", "/api", "/api/*", "/apis", "/apis/*"},
+		Verbs:           []string{"get"},
+	},
+}
+
+// Config configures the credential of the managed cluster registered to
+// the hub, which is used by the hub to manage the cluster
+type Config struct {
+	// UseAgentToken registers the token of the agent's service account,
+	// instead of creating a dedicated one
+	UseAgentToken bool `json:"useAgentToken,omitempty"`
+	// Namespace and Name of the dedicated service account, the cluster
+	// role, cluster role binding and token secret are named after it
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// Rules are the permissions granted to the dedicated service account,
+	// the read-only defaultRules are granted if empty
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+}
+
+// Complete sets the defaults of the config, the dedicated service account
+// is named after defaultName if the name is not set
+func (c *Config) Complete(defaultName string) {
+	if c.Namespace == "" {
+		c.Namespace = defaultNamespace
+	}
+	if c.Name == "" {
+		c.Name = defaultName
+	}
+	if len(c.Rules) == 0 {
+		c.Rules = defaultRules
+	}
+}
+
+// Credential provides the token registered to the hub
+type Credential interface {
+	// Token ensures the credential exists and returns its token
+	Token() (string, error)
+	// Revoke removes the credential
+	Revoke() error
+	// Watch notifies the changes of the token until the context is done,
+	// it returns nil if the token is not watched
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// agentCredential is the token of the agent's service account, which is
+// projected and rotated by the kubelet
+type agentCredential struct {
+	tokenFile string
+}
+
+func (c agentCredential) Token() (string, error) {
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token from %s: %s", c.tokenFile, err)
+	}
+	return string(token), nil
+}
+
+func (agentCredential) Revoke() error {
+	return nil
+}
+
+func (c agentCredential) Watch(ctx context.Context) <-chan struct{} {
+	return watchFile(ctx, c.tokenFile)
+}
+
+// watchFile notifies the changes of the file until the context is done.
+// The directory of the file is watched, since the kubelet replaces the
+// projected files by swapping the symlink of their directory
+func watchFile(ctx context.Context, path string) <-chan struct{} {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("failed to watch %s, it is checked periodically: %v", path, err)
+		return nil
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		klog.Errorf("failed to watch %s, it is checked periodically: %v", path, err)
+		return nil
+	}
+	// the changes are coalesced while the last one is not handled
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				klog.Errorf("failed to watch %s: %v", path, err)
+			}
+		}
+	}()
+	return changed
+}
+
+// serviceAccountCredential is a dedicated service account in the managed
+// cluster, which is bound to a cluster role with the configured rules
+type serviceAccountCredential struct {
+	client    k8s.Interface
+	namespace string
+	name      string
+	rules     []rbacv1.PolicyRule
+}
+
+// New creates the credential in the managed cluster by the config
+func New(config *Config, localclient k8s.Interface) Credential {
+	if config.UseAgentToken {
+		return agentCredential{tokenFile: constants.TunnelTokenFile}
+	}
+	return &serviceAccountCredential{
+		client:    localclient,
+		namespace: config.Namespace,
+		name:      config.Name,
+		rules:     config.Rules,
+	}
+}
+
+func (c *serviceAccountCredential) objectMeta(namespace string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: namespace,
+		Name:      c.name,
+		Labels:    map[string]string{managedByLabel: managedByValue},
+	}
+}
+
+func (c *serviceAccountCredential) secretName() string {
+	return c.name + "-token"
+}
+
+// Token creates the service account, cluster role, cluster role binding
+// and token secret if absent, and returns the token once it is populated.
+// The resources are got before created, so that the periodic syncs only
+// read once the credential exists
+func (c *serviceAccountCredential) Token() (string, error) {
+	// 1. create the service account
+	err := ensure("service account", c.namespace+"/"+c.name, func() error {
+		_, err := c.client.CoreV1().ServiceAccounts(c.namespace).Get(c.name, metav1.GetOptions{})
+		return err
+	}, func() error {
+		sa := &v1.ServiceAccount{ObjectMeta: c.objectMeta(c.namespace)}
+		_, err := c.client.CoreV1().ServiceAccounts(c.namespace).Create(sa)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// 2. create the cluster role, or update its rules
+	cr, err := c.client.RbacV1().ClusterRoles().Get(c.name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		cr = &rbacv1.ClusterRole{ObjectMeta: c.objectMeta(""), Rules: c.rules}
+		if _, err = c.client.RbacV1().ClusterRoles().Create(cr); err != nil {
+			return "", fmt.Errorf("failed to create cluster role %s: %v", c.name, err)
+		}
+	case err != nil:
+		return "", fmt.Errorf("failed to get cluster role %s: %v", c.name, err)
+	case !reflect.DeepEqual(cr.Rules, c.rules):
+		cr.Rules = c.rules
+		if _, err = c.client.RbacV1().ClusterRoles().Update(cr); err != nil {
+			return "", fmt.Errorf("failed to update cluster role %s: %v", c.name, err)
+		}
+		klog.Infof("rules of cluster role %s are updated", c.name)
+	}
+
+	// 3. bind the cluster role to the service account
+	err = ensure("cluster role binding", c.name, func() error {
+		_, err := c.client.RbacV1().ClusterRoleBindings().Get(c.name, metav1.GetOptions{})
+		return err
+	}, func() error {
+		_, err := c.client.RbacV1().ClusterRoleBindings().Create(&rbacv1.ClusterRoleBinding{
+			ObjectMeta: c.objectMeta(""),
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "ClusterRole",
+				Name:     c.name,
+			},
+			Subjects: []rbacv1.Subject{{
+				Kind:      rbacv1.ServiceAccountKind,
+				Namespace: c.namespace,
+				Name:      c.name,
+			}},
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// 4. create the token secret, which is populated by the token controller
+	secret, err := c.client.CoreV1().Secrets(c.namespace).Get(c.secretName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &v1.Secret{
+			ObjectMeta: c.objectMeta(c.namespace),
+			Type:       v1.SecretTypeServiceAccountToken,
+		}
+		secret.Name = c.secretName()
+		secret.Annotations = map[string]string{v1.ServiceAccountNameKey: c.name}
+		_, err = c.client.CoreV1().Secrets(c.namespace).Create(secret)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return "", fmt.Errorf("failed to create token secret %s/%s: %v", c.namespace, secret.Name, err)
+		}
+		return "", fmt.Errorf("token secret %s/%s is not populated yet", c.namespace, c.secretName())
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get token secret %s/%s: %v", c.namespace, c.secretName(), err)
+	}
+	token := secret.Data[v1.ServiceAccountTokenKey]
+	if len(token) == 0 {
+		return "", fmt.Errorf("token secret %s/%s is not populated yet", c.namespace, c.secretName())
+	}
+	return string(token), nil
+}
+
+// ensure creates the object by create unless get finds it
+func ensure(kind, name string, get, create func() error) error {
+	err := get()
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get %s %s: %v", kind, name, err)
+	}
+	if err := create(); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create %s %s: %v", kind, name, err)
+	}
+	return nil
+}
+
+// Revoke deletes the resources of the credential
+func (c *serviceAccountCredential) Revoke() error {
+	deletes := []struct {
+		kind string
+		fn   func() error
+	}{
+		{"cluster role binding", func() error {
+			return c.client.RbacV1().ClusterRoleBindings().Delete(c.name, &metav1.DeleteOptions{})
+		}},
+		{"cluster role", func() error {
+			return c.client.RbacV1().ClusterRoles().Delete(c.name, &metav1.DeleteOptions{})
+		}},
+		{"token secret", func() error {
+			return c.client.CoreV1().Secrets(c.namespace).Delete(c.secretName(), &metav1.DeleteOptions{})
+		}},
+		{"service account", func() error {
+			return c.client.CoreV1().ServiceAccounts(c.namespace).Delete(c.name, &metav1.DeleteOptions{})
+		}},
+	}
+	for _, d := range deletes {
+		if err := d.fn(); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s of credential %s/%s: %v", d.kind, c.namespace, c.name, err)
+		}
+	}
+	return nil
+}
+
+// Watch returns nil, since the token of the secret is not rotated, and it
+// is checked periodically in case the secret is populated again
+func (c *serviceAccountCredential) Watch(ctx context.Context) <-chan struct{} {
+	return nil
+}
+
+// CABundle returns the CA bundle of the managed cluster
+func CABundle() ([]byte, error) {
+	ca, err := ioutil.ReadFile(constants.TunnelCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca from %s: %v", constants.TunnelCAFile, err)
+	}
+	return ca, nil
+}
+
+// Sync runs sync once the token changes, and every minute until the
+// context is done, so that the rotated token is registered to the hub
+// again. The failures are retried with exponential backoff, during which
+// the changes are picked up by the retry
+func Sync(ctx context.Context, clusterName string, changed <-chan struct{}, sync func() error) {
+	delay := syncRetryInitialDelay
+	for {
+		next, watch := syncPeriod, changed
+		if err := sync(); err != nil {
+			klog.Errorf("failed to sync credential of cluster %s, retry in %s: %v", clusterName, delay, err)
+			next, watch = delay, nil
+			if delay *= 2; delay > syncRetryMaxDelay {
+				delay = syncRetryMaxDelay
+			}
+		} else {
+			delay = syncRetryInitialDelay
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-watch:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credential
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCompleteDefaultRulesAreReadOnly(t *testing.T) {
+	c := &Config{}
+	c.Complete("cred")
+	if c.Namespace != defaultNamespace || c.Name != "cred" {
+		t.Errorf("unexpected defaults %s/%s", c.Namespace, c.Name)
+	}
+	for _, rule := range c.Rules {
+		for _, verb := range rule.Verbs {
+			if verb != "get" && verb != "list" && verb != "watch" {
+				t.Errorf("default rule %+v grants %s", rule, verb)
+			}
+		}
+		for _, resource := range rule.Resources {
+			if resource == "secrets" {
+				t.Errorf("default rule %+v grants secrets", rule)
+			}
+		}
+		for _, group := range rule.APIGroups {
+			if group == rbacv1.APIGroupAll || (group == "" && len(rule.Resources) == 1 &&
+				rule.Resources[0] == rbacv1.ResourceAll) {
+				t.Errorf("default rule %+v grants all of the core resources", rule)
+			}
+		}
+	}
+
+	rules := []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"*"}}}
+	c = &Config{Rules: rules}
+	c.Complete("cred")
+	if len(c.Rules) != 1 || c.Rules[0].Verbs[0] != "*" {
+		t.Errorf("configured rules are overridden: %+v", c.Rules)
+	}
+}
+
+func TestServiceAccountCredentialToken(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	config := &Config{}
+	config.Complete("cred")
+	cred := New(config, client)
+
+	// the first call creates the resources, and the token secret is not
+	// populated yet
+	if _, err := cred.Token(); err == nil {
+		t.Fatal("expect the token secret not populated")
+	}
+	secret, err := client.CoreV1().Secrets(defaultNamespace).Get("cred-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("token secret is not created: %v", err)
+	}
+	if secret.Annotations[v1.ServiceAccountNameKey] != "cred" {
+		t.Errorf("token secret is not bound to the service account: %v", secret.Annotations)
+	}
+	secret.Data = map[string][]byte{v1.ServiceAccountTokenKey: []byte("token")}
+	if _, err := client.CoreV1().Secrets(defaultNamespace).Update(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	// the syncs after the credential exists only read
+	client.ClearActions()
+	for i := 0; i < 3; i++ {
+		token, err := cred.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token" {
+			t.Errorf("expect token %q, got %q", "token", token)
+		}
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("unexpected %s %s once the credential exists", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+
+	// the revoked credential is created again
+	if err := cred.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cred.Token(); err == nil {
+		t.Fatal("expect the recreated token secret not populated")
+	}
+	if _, err := client.RbacV1().ClusterRoleBindings().Get("cred", metav1.GetOptions{}); err != nil {
+		t.Errorf("cluster role binding is not recreated: %v", err)
+	}
+}
+
+// waitChanged waits for the notification of the change
+func waitChanged(t *testing.T, changed <-chan struct{}, what string) {
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the change notified once %s", what)
+	}
+}
+
+func TestAgentCredentialWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "excalibur-credential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the projected token is a symlink into the data directory, which is
+	// replaced by swapping the ..data symlink, the same as the kubelet
+	for _, name := range []string{"..2021_03_01_01_00_00.1", "..2021_03_01_02_00_00.2"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "token"), []byte("token of "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("..2021_03_01_01_00_00.1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.Symlink(filepath.Join("..data", "token"), tokenFile); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := agentCredential{tokenFile: tokenFile}
+	changed := c.Watch(ctx)
+	if changed == nil {
+		t.Fatal("expected the token file watched")
+	}
+
+	if err := os.Symlink("..2021_03_01_02_00_00.2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	waitChanged(t, changed, "the data directory is swapped")
+	if token, err := c.Token(); err != nil || token != "token of ..2021_03_01_02_00_00.2" {
+		t.Errorf("expected the rotated token, got %q, %v", token, err)
+	}
+
+	// the changes are coalesced until they are handled
+	time.Sleep(100 * time.Millisecond)
+	for len(changed) > 0 {
+		<-changed
+	}
+	plainFile := filepath.Join(dir, "plain")
+	if err := ioutil.WriteFile(plainFile, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitChanged(t, changed, "a file is written")
+
+	if c := (agentCredential{tokenFile: filepath.Join(dir, "absent", "token")}); c.Watch(ctx) != nil {
+		t.Errorf("expected no watch of the absent directory")
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 1)
+	calls := make(chan int, 10)
+	var n int
+	done := make(chan struct{})
+	go func() {
+		Sync(ctx, "cls-a", changed, func() error {
+			n++
+			calls <- n
+			// the second sync fails, so that the third waits for the retry
+			if n == 2 {
+				return errors.New("unavailable")
+			}
+			return nil
+		})
+		close(done)
+	}()
+
+	expectCall := func(expected int, within time.Duration) {
+		select {
+		case got := <-calls:
+			if got != expected {
+				t.Fatalf("expected sync %d, got %d", expected, got)
+			}
+		case <-time.After(within):
+			t.Fatalf("expected sync %d within %s", expected, within)
+		}
+	}
+	expectCall(1, time.Second)
+	// the change is synced immediately rather than after the sync period
+	changed <- struct{}{}
+	expectCall(2, time.Second)
+	// the change is picked up by the retry after the backoff
+	changed <- struct{}{}
+	select {
+	case got := <-calls:
+		t.Fatalf("expected no sync %d before the backoff", got)
+	case <-time.After(syncRetryInitialDelay / 2):
+	}
+	expectCall(3, syncRetryInitialDelay)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected sync to stop once the context is done")
+	}
+}
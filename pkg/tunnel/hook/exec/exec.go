@@ -0,0 +1,327 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/pki"
+)
+
+// ProviderName is the name of the exec hook provider
+const ProviderName = "exec"
+
+const (
+	defaultTimeout       = 30 * time.Second
+	defaultRetryInterval = 5 * time.Second
+	// maxOutputSize limits the output of the executable kept for logging
+	maxOutputSize = 4096
+
+	// environment variables passed to the executables
+	eventEnv            = "EXCALIBUR_HOOK_EVENT"
+	hookNameEnv         = "EXCALIBUR_HOOK_NAME"
+	componentEnv        = "EXCALIBUR_COMPONENT"
+	clusterNameEnv      = "EXCALIBUR_CLUSTER_NAME"
+	agentIdentifiersEnv = "EXCALIBUR_AGENT_IDENTIFIERS"
+	serverAddressEnv    = "EXCALIBUR_SERVER_ADDRESS"
+	namespaceEnv        = "EXCALIBUR_NAMESPACE"
+)
+
+// FailurePolicy determines what to do once a hook finally fails
+type FailurePolicy string
+
+const (
+	// FailurePolicyAbort aborts the startup of the server or agent
+	FailurePolicyAbort FailurePolicy = "Abort"
+	// FailurePolicyWarn logs a warning and continues the startup
+	FailurePolicyWarn FailurePolicy = "Warn"
+)
+
+// Config is the config of exec hook provider, for example:
+//
+//	exec:
+//	  hooks:
+//	    PostStartTunnelAgent:
+//	    - name: cmdb
+//	      command: ["/opt/hooks/register-cmdb.sh"]
+//	      timeout: 10s
+//	      retries: 3
+//	      failurePolicy: Warn
+type Config struct {
+	// Hooks are the executables run in order for each of the events
+	Hooks map[interfaces.HookEvent][]Hook `json:"hooks"`
+}
+
+// Hook is an executable that runs at a life cycle point
+type Hook struct {
+	// Name is used in logs and passed to the executable
+	Name string `json:"name"`
+	// Command is the executable and its arguments
+	Command []string `json:"command"`
+	// Env is the extra environment variables of the executable
+	Env map[string]string `json:"env,omitempty"`
+	// Timeout of each attempt, defaults to 30s
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Retries is the number of retries after the first attempt fails
+	Retries int `json:"retries,omitempty"`
+	// RetryInterval defaults to 5s
+	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
+	// FailurePolicy defaults to Abort
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+// Payload is the JSON written to the stdin of the executable
+type Payload struct {
+	Event                  interfaces.HookEvent `json:"event"`
+	Hook                   string               `json:"hook"`
+	Component              string               `json:"component,omitempty"`
+	ClusterName            string               `json:"clusterName,omitempty"`
+	AgentIdentifiers       string               `json:"agentIdentifiers,omitempty"`
+	AgentVersion           string               `json:"agentVersion,omitempty"`
+	ServerReplica          string               `json:"serverReplica,omitempty"`
+	ServerAddress          string               `json:"serverAddress,omitempty"`
+	CertificateFingerprint string               `json:"certificateFingerprint,omitempty"`
+	Namespace              string               `json:"namespace,omitempty"`
+	Hostname               string               `json:"hostname,omitempty"`
+	Timestamp              time.Time            `json:"timestamp"`
+}
+
+func init() {
+	hook.Register(ProviderName, func(config []byte) (interfaces.TunnelHookProvider, error) {
+		return NewProvider(config)
+	})
+}
+
+// Provider runs the configured executables at the life cycle points
+type Provider struct {
+	config Config
+}
+
+var _ interfaces.TunnelHookProvider = &Provider{}
+
+// NewProvider creates the exec hook provider from the JSON config
+func NewProvider(config []byte) (*Provider, error) {
+	if config == nil {
+		return nil, errors.New("no hooks are configured")
+	}
+	p := &Provider{}
+	if err := json.Unmarshal(config, &p.config); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+	if err := p.config.complete(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// complete validates the config and sets the defaults
+func (c *Config) complete() error {
+	known := make(map[interfaces.HookEvent]bool)
+	for _, event := range interfaces.HookEvents {
+		known[event] = true
+	}
+	for event, hooks := range c.Hooks {
+		if !known[event] {
+			return fmt.Errorf("unknown hook event %s", event)
+		}
+		for i := range hooks {
+			h := &hooks[i]
+			if len(h.Command) == 0 {
+				return fmt.Errorf("command of %s hook %d is empty", event, i)
+			}
+			if h.Name == "" {
+				h.Name = h.Command[0]
+			}
+			if h.Timeout == nil {
+				h.Timeout = &metav1.Duration{Duration: defaultTimeout}
+			}
+			if h.RetryInterval == nil {
+				h.RetryInterval = &metav1.Duration{Duration: defaultRetryInterval}
+			}
+			if h.Retries < 0 {
+				return fmt.Errorf("retries of %s hook %s can't be negative", event, h.Name)
+			}
+			switch h.FailurePolicy {
+			case "":
+				h.FailurePolicy = FailurePolicyAbort
+			case FailurePolicyAbort, FailurePolicyWarn:
+			default:
+				return fmt.Errorf("unknown failure policy %s of %s hook %s", h.FailurePolicy, event, h.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Provider) GetProviderName() string {
+	return ProviderName
+}
+
+func (p *Provider) PreStartTunnelAgent(hc *interfaces.HookContext) error {
+	return p.run(interfaces.PreStartTunnelAgent, hc)
+}
+
+func (p *Provider) PostStartTunnelAgent(hc *interfaces.HookContext) error {
+	return p.run(interfaces.PostStartTunnelAgent, hc)
+}
+
+func (p *Provider) PreStopTunnelAgent(hc *interfaces.HookContext) error {
+	return p.run(interfaces.PreStopTunnelAgent, hc)
+}
+
+func (p *Provider) PreStartTunnelServer(hc *interfaces.HookContext) error {
+	return p.run(interfaces.PreStartTunnelServer, hc)
+}
+
+func (p *Provider) PostStartTunnelServer(hc *interfaces.HookContext) error {
+	return p.run(interfaces.PostStartTunnelServer, hc)
+}
+
+func (p *Provider) PreStopTunnelServer(hc *interfaces.HookContext) error {
+	return p.run(interfaces.PreStopTunnelServer, hc)
+}
+
+func (p *Provider) AgentConnected(hc *interfaces.HookContext) error {
+	return p.run(interfaces.AgentConnected, hc)
+}
+
+func (p *Provider) AgentDisconnected(hc *interfaces.HookContext) error {
+	return p.run(interfaces.AgentDisconnected, hc)
+}
+
+func (p *Provider) CertificateRotated(hc *interfaces.HookContext) error {
+	return p.run(interfaces.CertificateRotated, hc)
+}
+
+// run runs the hooks of the event in order
+func (p *Provider) run(event interfaces.HookEvent, hc *interfaces.HookContext) error {
+	hostname, _ := os.Hostname()
+	for _, h := range p.config.Hooks[event] {
+		payload := &Payload{
+			Event:                  event,
+			Hook:                   h.Name,
+			Component:              hc.Component,
+			ClusterName:            hc.ClusterName,
+			AgentIdentifiers:       hc.AgentIdentifiers,
+			AgentVersion:           hc.AgentVersion,
+			ServerReplica:          hc.ServerReplica,
+			ServerAddress:          hc.ServerAddress,
+			CertificateFingerprint: pki.CertificateFingerprint(hc.Certificate),
+			Namespace:              os.Getenv(constants.TunnelServerNSEnv),
+			Hostname:               hostname,
+			Timestamp:              time.Now(),
+		}
+		err := runWithRetries(hc.Context, &h, payload)
+		if err == nil {
+			continue
+		}
+		if h.FailurePolicy == FailurePolicyWarn {
+			klog.Warningf("%s hook %s failed, continue as its failure policy is %s: %v",
+				event, h.Name, h.FailurePolicy, err)
+			continue
+		}
+		return fmt.Errorf("%s hook %s failed: %v", event, h.Name, err)
+	}
+	return nil
+}
+
+// runWithRetries runs the hook until it succeeds or the retries are exhausted
+func runWithRetries(ctx context.Context, h *Hook, payload *Payload) error {
+	stdin, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = runOnce(ctx, h, payload, stdin)
+		if err == nil || attempt >= h.Retries {
+			return err
+		}
+		klog.Warningf("%s hook %s failed, retry in %s (%d/%d): %v",
+			payload.Event, h.Name, h.RetryInterval.Duration, attempt+1, h.Retries, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v, give up retrying: %v", err, ctx.Err())
+		case <-time.After(h.RetryInterval.Duration):
+		}
+	}
+}
+
+func runOnce(parent context.Context, h *Hook, payload *Payload, stdin []byte) error {
+	ctx, cancel := context.WithTimeout(parent, h.Timeout.Duration)
+	defer cancel()
+
+	cmd := osexec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		eventEnv+"="+string(payload.Event),
+		hookNameEnv+"="+payload.Hook,
+		componentEnv+"="+payload.Component,
+		clusterNameEnv+"="+payload.ClusterName,
+		agentIdentifiersEnv+"="+payload.AgentIdentifiers,
+		serverAddressEnv+"="+payload.ServerAddress,
+		namespaceEnv+"="+payload.Namespace,
+	)
+	for k, v := range h.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	output := &limitedBuffer{limit: maxOutputSize}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", h.Timeout.Duration)
+	}
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, output.String())
+	}
+	klog.V(4).Infof("%s hook %s finished in %s, output: %s",
+		payload.Event, h.Name, time.Since(start), output.String())
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it, and discards
+// the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - b.Len(); n > 0 {
+		if len(p) > n {
+			b.Buffer.Write(p[:n])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+func TestNewProvider(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		// expected is the substring of the error
+		expected string
+	}{
+		{name: "no config", expected: "no hooks are configured"},
+		{name: "invalid json", config: `{"hooks": []}`, expected: "failed to decode config"},
+		{name: "unknown event", config: `{"hooks": {"PostStart": [{"command": ["true"]}]}}`,
+			expected: "unknown hook event PostStart"},
+		{name: "empty command", config: `{"hooks": {"AgentConnected": [{"name": "a"}]}}`,
+			expected: "command of AgentConnected hook 0 is empty"},
+		{name: "negative retries", config: `{"hooks": {"AgentConnected": [{"command": ["true"], "retries": -1}]}}`,
+			expected: "can't be negative"},
+		{name: "unknown failure policy", config: `{"hooks": {"AgentConnected": [{"command": ["true"], "failurePolicy": "Ignore"}]}}`,
+			expected: "unknown failure policy Ignore"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var config []byte
+			if c.config != "" {
+				config = []byte(c.config)
+			}
+			_, err := NewProvider(config)
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("expected error containing %q, got %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestNewProviderDefaults(t *testing.T) {
+	p, err := NewProvider([]byte(`{"hooks": {"AgentConnected": [{"command": ["/bin/true", "-x"]}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := p.config.Hooks[interfaces.AgentConnected][0]
+	if h.Name != "/bin/true" {
+		t.Errorf("expected the name defaulted to the executable, got %s", h.Name)
+	}
+	if h.Timeout.Duration != defaultTimeout || h.RetryInterval.Duration != defaultRetryInterval {
+		t.Errorf("unexpected default timeout %s and retry interval %s", h.Timeout.Duration, h.RetryInterval.Duration)
+	}
+	if h.FailurePolicy != FailurePolicyAbort {
+		t.Errorf("expected the failure policy defaulted to %s, got %s", FailurePolicyAbort, h.FailurePolicy)
+	}
+}
+
+// newTestProvider creates a provider running the shell script for the
+// AgentConnected event
+func newTestProvider(t *testing.T, hooks ...Hook) *Provider {
+	for i := range hooks {
+		hooks[i].Command = []string{"/bin/sh", "-c", hooks[i].Command[0]}
+	}
+	config, err := json.Marshal(&Config{Hooks: map[interfaces.HookEvent][]Hook{
+		interfaces.AgentConnected: hooks,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRunPassesContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "excalibur-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile, stdinFile := filepath.Join(dir, "env"), filepath.Join(dir, "stdin")
+
+	p := newTestProvider(t, Hook{
+		Name: "record",
+		Command: []string{fmt.Sprintf(`echo "$EXCALIBUR_HOOK_EVENT $EXCALIBUR_HOOK_NAME $EXCALIBUR_CLUSTER_NAME `+
+			`$EXCALIBUR_AGENT_IDENTIFIERS $EXTRA" > %s; cat > %s`, envFile, stdinFile)},
+		Env: map[string]string{"EXTRA": "extra"},
+	})
+	err = p.AgentConnected(&interfaces.HookContext{
+		Context:          context.Background(),
+		Component:        "excalibur-tunnel-server",
+		ClusterName:      "cls-a",
+		AgentIdentifiers: "host=cls-a",
+		AgentVersion:     "v0.3.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "AgentConnected record cls-a host=cls-a extra\n"; string(env) != expected {
+		t.Errorf("expected environment %q, got %q", expected, env)
+	}
+	stdin, err := ioutil.ReadFile(stdinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload Payload
+	if err := json.Unmarshal(stdin, &payload); err != nil {
+		t.Fatalf("failed to decode the payload %s: %v", stdin, err)
+	}
+	if payload.Event != interfaces.AgentConnected || payload.Hook != "record" ||
+		payload.Component != "excalibur-tunnel-server" || payload.ClusterName != "cls-a" ||
+		payload.AgentVersion != "v0.3.0" || payload.Timestamp.IsZero() {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "excalibur-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	interval := &metav1.Duration{Duration: 10 * time.Millisecond}
+
+	cases := []struct {
+		name  string
+		hooks func(counter string) []Hook
+		// expected is the substring of the error, empty for success
+		expected string
+		// attempts is the number of the runs recorded in the counter
+		attempts int
+	}{
+		{
+			name: "succeeds after retries",
+			hooks: func(counter string) []Hook {
+				return []Hook{{Command: []string{fmt.Sprintf(`echo x >> %[1]s; [ $(wc -l < %[1]s) -ge 3 ]`, counter)},
+					Retries: 3, RetryInterval: interval}}
+			},
+			attempts: 3,
+		},
+		{
+			name: "retries exhausted",
+			hooks: func(counter string) []Hook {
+				return []Hook{{Name: "fail", Command: []string{fmt.Sprintf(`echo x >> %s; echo oops; exit 1`, counter)},
+					Retries: 2, RetryInterval: interval}}
+			},
+			expected: "AgentConnected hook fail failed: exit status 1, output: oops",
+			attempts: 3,
+		},
+		{
+			name: "abort stops the following hooks",
+			hooks: func(counter string) []Hook {
+				return []Hook{
+					{Command: []string{"exit 1"}},
+					{Command: []string{fmt.Sprintf(`echo x >> %s`, counter)}},
+				}
+			},
+			expected: "exit status 1",
+		},
+		{
+			name: "warn continues the following hooks",
+			hooks: func(counter string) []Hook {
+				return []Hook{
+					{Command: []string{"exit 1"}, FailurePolicy: FailurePolicyWarn},
+					{Command: []string{fmt.Sprintf(`echo x >> %s`, counter)}},
+				}
+			},
+			attempts: 1,
+		},
+		{
+			name: "timeout",
+			hooks: func(counter string) []Hook {
+				return []Hook{{Command: []string{fmt.Sprintf(`echo x >> %s; exec sleep 10`, counter)},
+					Timeout: interval}}
+			},
+			expected: "timed out after 10ms",
+			attempts: 1,
+		},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			counter := filepath.Join(dir, fmt.Sprintf("counter-%d", i))
+			p := newTestProvider(t, c.hooks(counter)...)
+			err := p.AgentConnected(&interfaces.HookContext{Context: context.Background()})
+			if c.expected == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if c.expected != "" && (err == nil || !strings.Contains(err.Error(), c.expected)) {
+				t.Errorf("expected error containing %q, got %v", c.expected, err)
+			}
+			data, _ := ioutil.ReadFile(counter)
+			if attempts := strings.Count(string(data), "x"); attempts != c.attempts {
+				t.Errorf("expected %d attempts, got %d", c.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestRunGivesUpRetryingOnCancel(t *testing.T) {
+	p := newTestProvider(t, Hook{Command: []string{"exit 1"}, Retries: 10,
+		RetryInterval: &metav1.Duration{Duration: time.Hour}})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := p.AgentConnected(&interfaces.HookContext{Context: ctx})
+	if err == nil || !strings.Contains(err.Error(), "give up retrying") {
+		t.Errorf("expected to give up retrying, got %v", err)
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{limit: 5}
+	for _, p := range []string{"abc", "defg", "hij"} {
+		if n, err := b.Write([]byte(p)); n != len(p) || err != nil {
+			t.Errorf("expected the write of %q to succeed, got %d, %v", p, n, err)
+		}
+	}
+	if b.String() != "abcde" {
+		t.Errorf("expected the first 5 bytes kept, got %q", b.String())
+	}
+}
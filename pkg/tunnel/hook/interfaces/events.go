@@ -0,0 +1,79 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package interfaces
+
+import (
+	"fmt"
+)
+
+// HookEvent is the life cycle point at which the hooks are executed,
+// it is named after the method of TunnelHookProvider
+type HookEvent string
+
+const (
+	PreStartTunnelAgent   HookEvent = "PreStartTunnelAgent"
+	PostStartTunnelAgent  HookEvent = "PostStartTunnelAgent"
+	PreStopTunnelAgent    HookEvent = "PreStopTunnelAgent"
+	PreStartTunnelServer  HookEvent = "PreStartTunnelServer"
+	PostStartTunnelServer HookEvent = "PostStartTunnelServer"
+	PreStopTunnelServer   HookEvent = "PreStopTunnelServer"
+	AgentConnected        HookEvent = "AgentConnected"
+	AgentDisconnected     HookEvent = "AgentDisconnected"
+	CertificateRotated    HookEvent = "CertificateRotated"
+)
+
+// HookEvents are all of the life cycle points
+var HookEvents = []HookEvent{
+	PreStartTunnelAgent,
+	PostStartTunnelAgent,
+	PreStopTunnelAgent,
+	PreStartTunnelServer,
+	PostStartTunnelServer,
+	PreStopTunnelServer,
+	AgentConnected,
+	AgentDisconnected,
+	CertificateRotated,
+}
+
+// Execute executes the hook of the provider according to the event of
+// the context
+func Execute(provider TunnelHookProvider, hc *HookContext) error {
+	var hook func(hc *HookContext) error
+	switch hc.Event {
+	case PreStartTunnelAgent:
+		hook = provider.PreStartTunnelAgent
+	case PostStartTunnelAgent:
+		hook = provider.PostStartTunnelAgent
+	case PreStopTunnelAgent:
+		hook = provider.PreStopTunnelAgent
+	case PreStartTunnelServer:
+		hook = provider.PreStartTunnelServer
+	case PostStartTunnelServer:
+		hook = provider.PostStartTunnelServer
+	case PreStopTunnelServer:
+		hook = provider.PreStopTunnelServer
+	case AgentConnected:
+		hook = provider.AgentConnected
+	case AgentDisconnected:
+		hook = provider.AgentDisconnected
+	case CertificateRotated:
+		hook = provider.CertificateRotated
+	default:
+		return fmt.Errorf("unknown hook event %s", hc.Event)
+	}
+	return hook(hc)
+}
@@ -17,30 +17,100 @@ limitations under the License.
 package interfaces
 
 import (
+	"context"
+	"crypto/tls"
+
 	k8s "k8s.io/client-go/kubernetes"
 )
 
 // TunnelHookProvider is responsible for excute customized hook
 // logic during life cycle. For exampe, after tunnel agent get
 // started, PostStartTunnelAgent hook will refesh admin token to
-// cloud apiserver
-// parameter explanation:
-//   cloudClient: used to accesss cloud side apiserver
-//   localClient: used to accesss local side apiserver
+// cloud apiserver. Providers can embed NopHookProvider to only
+// implement the hooks they care about
 type TunnelHookProvider interface {
 
 	// GetProviderName return provider name for debug ability
 	GetProviderName() string
 
 	// PreStartTunnelAgent excute customized logic before agent get started
-	PreStartTunnelAgent(clusterName string, cloudClient k8s.Interface, localClient k8s.Interface) error
+	PreStartTunnelAgent(hc *HookContext) error
 
 	// PostStartTunnelAgent excute customized logic after agent get started
-	PostStartTunnelAgent(clusterName string, cloudClient k8s.Interface, localClient k8s.Interface) error
+	PostStartTunnelAgent(hc *HookContext) error
+
+	// PreStopTunnelAgent excute customized logic before agent get stopped
+	PreStopTunnelAgent(hc *HookContext) error
 
 	// PreStartTunnelServer excute customized logic before server get started
-	PreStartTunnelServer(localClient k8s.Interface) error
+	PreStartTunnelServer(hc *HookContext) error
 
 	// PostStartTunnelServer excute customized logic after server get started
-	PostStartTunnelServer(localClient k8s.Interface) error
+	PostStartTunnelServer(hc *HookContext) error
+
+	// PreStopTunnelServer excute customized logic before server get stopped
+	PreStopTunnelServer(hc *HookContext) error
+
+	// AgentConnected excute customized logic at server once an agent
+	// connects to it
+	AgentConnected(hc *HookContext) error
+
+	// AgentDisconnected excute customized logic at server once the last
+	// connection of an agent is closed
+	AgentDisconnected(hc *HookContext) error
+
+	// CertificateRotated excute customized logic at both server and
+	// agent once the certificate is rotated
+	CertificateRotated(hc *HookContext) error
+}
+
+// HookContext has the information available at the life cycle point,
+// fields that are not applicable to the event are left empty
+type HookContext struct {
+	// Context is cancelled once the hook should give up
+	Context context.Context
+	Event   HookEvent
+	// Component is the name of the component that executes the hook
+	Component string
+	// ClusterName is the name of the agent's cluster
+	ClusterName      string
+	AgentIdentifiers string
+	// AgentVersion is the version of the agent, it is only set in the
+	// AgentConnected and AgentDisconnected hooks
+	AgentVersion string
+	// AgentCommonName is the common name of the agent's client certificate,
+	// i.e. the cluster name that the agent is authenticated as, it is only
+	// set in the AgentConnected and AgentDisconnected hooks
+	AgentCommonName string
+	// AgentIdentityBound is true if the common names of the agents'
+	// certificates are bound to the identities requesting them, i.e. an
+	// agent can't be authenticated as another cluster, it is only set at
+	// server
+	AgentIdentityBound bool
+	// ServerReplica is the name of the server instance, it is only set
+	// at server
+	ServerReplica string
+	// ServerAddress is the address that the agents connect to
+	ServerAddress string
+	// Certificate is the current certificate of the component
+	Certificate *tls.Certificate
+	// CloudClient is used to access cloud side apiserver, it is only
+	// set at agent
+	CloudClient k8s.Interface
+	// LocalClient is used to access the apiserver of the cluster that
+	// the component runs in
+	LocalClient k8s.Interface
 }
+
+// NopHookProvider implements all of the hooks as no-op
+type NopHookProvider struct{}
+
+func (NopHookProvider) PreStartTunnelAgent(hc *HookContext) error   { return nil }
+func (NopHookProvider) PostStartTunnelAgent(hc *HookContext) error  { return nil }
+func (NopHookProvider) PreStopTunnelAgent(hc *HookContext) error    { return nil }
+func (NopHookProvider) PreStartTunnelServer(hc *HookContext) error  { return nil }
+func (NopHookProvider) PostStartTunnelServer(hc *HookContext) error { return nil }
+func (NopHookProvider) PreStopTunnelServer(hc *HookContext) error   { return nil }
+func (NopHookProvider) AgentConnected(hc *HookContext) error        { return nil }
+func (NopHookProvider) AgentDisconnected(hc *HookContext) error     { return nil }
+func (NopHookProvider) CertificateRotated(hc *HookContext) error    { return nil }
@@ -0,0 +1,295 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package karmada
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/credential"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+	tunnelk8s "github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
+)
+
+// ProviderName is the name of the karmada hook provider
+const ProviderName = "karmada"
+
+const (
+	defaultSecretNamespace = "karmada-cluster"
+	defaultCredentialName  = "karmada-controller-manager"
+
+	// keys of the cluster secret that karmada reads
+	secretTokenKey    = "token"
+	secretCABundleKey = "caBundle"
+
+	clusterAPIVersion = "cluster.karmada.io/v1alpha1"
+	clusterAbsPath    = "apis/cluster.karmada.io/v1alpha1/clusters"
+)
+
+func init() {
+	hook.Register(ProviderName, func(config []byte) (interfaces.TunnelHookProvider, error) {
+		return NewProvider(config)
+	})
+}
+
+// Config is the config of karmada hook provider, for example:
+//
+//	karmada:
+//	  secretNamespace: karmada-cluster
+//	  proxyURL: http://127.0.0.1:8001
+//	  insecureSkipTLSVerification: false
+//	  credential:
+//	    namespace: kube-system
+//	    name: karmada-controller-manager
+type Config struct {
+	// SecretNamespace is the namespace of the cluster secrets in the
+	// karmada control plane, defaults to karmada-cluster
+	SecretNamespace string `json:"secretNamespace"`
+	// APIEndpoint is the apiserver endpoint dialed through the tunnel,
+	// defaults to https://<cluster name>:6443
+	APIEndpoint string `json:"apiEndpoint"`
+	// ProxyURL is the url of the HTTP-CONNECT proxy through which the
+	// karmada controllers reach the tunnel server, it is required
+	ProxyURL string `json:"proxyURL"`
+	// InsecureSkipTLSVerification skips verifying the certificate of the
+	// apiserver, whose SANs may not contain the cluster name
+	InsecureSkipTLSVerification bool              `json:"insecureSkipTLSVerification"`
+	Credential                  credential.Config `json:"credential"`
+}
+
+// Provider registers the managed cluster to the karmada control plane
+// in Push mode, whose apiserver is reached through the tunnel
+type Provider struct {
+	interfaces.NopHookProvider
+	config Config
+}
+
+// NewProvider creates the karmada hook provider from the JSON config
+func NewProvider(config []byte) (*Provider, error) {
+	p := &Provider{}
+	if config != nil {
+		if err := json.Unmarshal(config, &p.config); err != nil {
+			return nil, fmt.Errorf("failed to decode config: %v", err)
+		}
+	}
+	if p.config.SecretNamespace == "" {
+		p.config.SecretNamespace = defaultSecretNamespace
+	}
+	// the insecure master port is not authenticated and not exposed
+	// outside of the server by default, so there is no default proxy
+	if err := tunnelk8s.ValidateProxyURL(p.config.ProxyURL); err != nil {
+		return nil, err
+	}
+	p.config.Credential.Complete(defaultCredentialName)
+	return p, nil
+}
+
+func (p *Provider) GetProviderName() string {
+	return ProviderName
+}
+
+// PostStartTunnelAgent registers the cluster to karmada in the background,
+// and keeps the token in the cluster secret updated until the agent
+// stops. Once the cluster is deleted from karmada, i.e. the cluster is
+// deregistered, its secret and credential are removed, and the cluster
+// is registered again after the agent restarts
+func (p *Provider) PostStartTunnelAgent(hc *interfaces.HookContext) error {
+	r := &registrar{
+		config:      &p.config,
+		clusterName: hc.ClusterName,
+		cloudclient: hc.CloudClient,
+		cred:        credential.New(&p.config.Credential, hc.LocalClient),
+	}
+	ctx, cancel := context.WithCancel(hc.Context)
+	go credential.Sync(ctx, hc.ClusterName, r.cred.Watch(ctx), func() error {
+		deregistered, err := r.sync()
+		if deregistered {
+			cancel()
+		}
+		return err
+	})
+	return nil
+}
+
+// registrar registers the cluster and its secret to karmada
+type registrar struct {
+	config      *Config
+	clusterName string
+	cloudclient k8s.Interface
+	cred        credential.Credential
+	registered  bool
+}
+
+// sync creates or updates the cluster secret and the cluster, it returns
+// true once the cluster is deregistered
+func (r *registrar) sync() (bool, error) {
+	restclient := r.cloudclient.Discovery().RESTClient()
+	data, err := restclient.Get().AbsPath(clusterAbsPath, r.clusterName).DoRaw()
+	if apierrors.IsNotFound(err) && r.registered {
+		klog.Infof("cluster %s is deregistered from karmada, revoke its credential", r.clusterName)
+		if err := r.deregister(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get karmada cluster %s: %v", r.clusterName, err)
+	}
+	exists := err == nil
+
+	// 1. create or update the cluster secret
+	token, err := r.cred.Token()
+	if err != nil {
+		return false, err
+	}
+	ca, err := credential.CABundle()
+	if err != nil {
+		return false, err
+	}
+	if err := r.applySecret(token, ca); err != nil {
+		return false, err
+	}
+
+	// 2. create or update the cluster
+	cluster := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": clusterAPIVersion,
+		"kind":       "Cluster",
+		"metadata": map[string]interface{}{
+			"name": r.clusterName,
+		},
+	}}
+	if exists {
+		if err := cluster.UnmarshalJSON(data); err != nil {
+			return false, err
+		}
+	}
+	spec, _, err := unstructured.NestedMap(cluster.Object, "spec")
+	if err != nil {
+		return false, fmt.Errorf("invalid spec of karmada cluster %s: %v", r.clusterName, err)
+	}
+	desired := r.clusterSpec()
+	changed := false
+	if spec == nil {
+		spec = map[string]interface{}{}
+	}
+	for k, v := range desired {
+		if !reflect.DeepEqual(spec[k], v) {
+			spec[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		r.registered = true
+		return false, nil
+	}
+	if err := unstructured.SetNestedMap(cluster.Object, spec, "spec"); err != nil {
+		return false, err
+	}
+	body, err := cluster.MarshalJSON()
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		err = restclient.Post().AbsPath(clusterAbsPath).
+			SetHeader("Content-Type", "application/json").Body(body).Do().Error()
+	} else {
+		err = restclient.Put().AbsPath(clusterAbsPath, r.clusterName).
+			SetHeader("Content-Type", "application/json").Body(body).Do().Error()
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to apply karmada cluster %s: %v", r.clusterName, err)
+	}
+	klog.Infof("cluster %s is registered to karmada with endpoint %s through %s",
+		r.clusterName, desired["apiEndpoint"], r.config.ProxyURL)
+	r.registered = true
+	return false, nil
+}
+
+// clusterSpec returns the fields of the cluster spec managed by the provider
+func (r *registrar) clusterSpec() map[string]interface{} {
+	endpoint := r.config.APIEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s:6443", r.clusterName)
+	}
+	return map[string]interface{}{
+		"syncMode":    "Push",
+		"apiEndpoint": endpoint,
+		"proxyURL":    r.config.ProxyURL,
+		"secretRef": map[string]interface{}{
+			"namespace": r.config.SecretNamespace,
+			"name":      r.clusterName,
+		},
+		"insecureSkipTLSVerification": r.config.InsecureSkipTLSVerification,
+	}
+}
+
+// applySecret creates the cluster secret, or updates it once the token
+// or ca bundle changes
+func (r *registrar) applySecret(token string, ca []byte) error {
+	secrets := r.cloudclient.CoreV1().Secrets(r.config.SecretNamespace)
+	data := map[string][]byte{
+		secretTokenKey:    []byte(token),
+		secretCABundleKey: ca,
+	}
+	secret, err := secrets.Get(r.clusterName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: r.config.SecretNamespace,
+				Name:      r.clusterName,
+			},
+			Data: data,
+		}
+		if _, err := secrets.Create(secret); err != nil {
+			return fmt.Errorf("failed to create secret of karmada cluster %s: %v", r.clusterName, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secret of karmada cluster %s: %v", r.clusterName, err)
+	}
+	if bytes.Equal(secret.Data[secretTokenKey], data[secretTokenKey]) &&
+		bytes.Equal(secret.Data[secretCABundleKey], data[secretCABundleKey]) {
+		return nil
+	}
+	secret.Data = data
+	if _, err := secrets.Update(secret); err != nil {
+		return fmt.Errorf("failed to update secret of karmada cluster %s: %v", r.clusterName, err)
+	}
+	klog.Infof("secret of karmada cluster %s is updated", r.clusterName)
+	return nil
+}
+
+// deregister deletes the cluster secret and revokes the credential
+func (r *registrar) deregister() error {
+	err := r.cloudclient.CoreV1().Secrets(r.config.SecretNamespace).Delete(r.clusterName, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete secret of karmada cluster %s: %v", r.clusterName, err)
+	}
+	return r.cred.Revoke()
+}
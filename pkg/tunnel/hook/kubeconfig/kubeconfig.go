@@ -0,0 +1,239 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/credential"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+	tunnelk8s "github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
+)
+
+// ProviderName is the name of the kubeconfig hook provider
+const ProviderName = "kubeconfig"
+
+const (
+	// SecretKey is the key of the kubeconfig in the secret
+	SecretKey = "kubeconfig"
+	// ClusterLabel is the label of the secret holding the cluster name
+	ClusterLabel = "tunnel.excalibur.io/cluster"
+	// DeregisteredAnnotation deregisters the cluster once it is set to
+	// "true" on the secret
+	DeregisteredAnnotation = "tunnel.excalibur.io/deregistered"
+
+	defaultCredentialName = "excalibur-kubeconfig-reader"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "excalibur-tunnel-agent"
+)
+
+func init() {
+	hook.Register(ProviderName, func(config []byte) (interfaces.TunnelHookProvider, error) {
+		return NewProvider(config)
+	})
+}
+
+// Config is the config of kubeconfig hook provider, for example:
+//
+//	kubeconfig:
+//	  namespace: tkestack
+//	  proxyURL: http://127.0.0.1:8001
+//	  tlsServerName: kubernetes
+//	  credential:
+//	    namespace: kube-system
+//	    name: excalibur-kubeconfig-reader
+type Config struct {
+	// Namespace is the namespace of the secrets in the hub cluster,
+	// defaults to the namespace of the tunnel server
+	Namespace string `json:"namespace"`
+	// Server is the apiserver dialed through the tunnel, defaults to
+	// https://<cluster name>:6443
+	Server string `json:"server"`
+	// ProxyURL is the url of the HTTP-CONNECT proxy through which the
+	// clients reach the tunnel server, it is required
+	ProxyURL string `json:"proxyURL"`
+	// TLSServerName is used to verify the certificate of the apiserver,
+	// whose SANs may not contain the cluster name
+	TLSServerName         string            `json:"tlsServerName"`
+	InsecureSkipTLSVerify bool              `json:"insecureSkipTLSVerify"`
+	Credential            credential.Config `json:"credential"`
+}
+
+// Provider writes a kubeconfig secret of the managed cluster into the
+// hub cluster, through which any client-go based tool is able to access
+// the managed cluster
+type Provider struct {
+	interfaces.NopHookProvider
+	config Config
+}
+
+// NewProvider creates the kubeconfig hook provider from the JSON config
+func NewProvider(config []byte) (*Provider, error) {
+	p := &Provider{}
+	if config != nil {
+		if err := json.Unmarshal(config, &p.config); err != nil {
+			return nil, fmt.Errorf("failed to decode config: %v", err)
+		}
+	}
+	if p.config.Namespace == "" {
+		p.config.Namespace = os.Getenv(constants.TunnelServerNSEnv)
+	}
+	// the insecure master port is not authenticated and not exposed
+	// outside of the server by default, so there is no default proxy
+	if err := tunnelk8s.ValidateProxyURL(p.config.ProxyURL); err != nil {
+		return nil, err
+	}
+	p.config.Credential.Complete(defaultCredentialName)
+	return p, nil
+}
+
+func (p *Provider) GetProviderName() string {
+	return ProviderName
+}
+
+// PostStartTunnelAgent writes the kubeconfig secret in the background,
+// and refreshes it once the token is rotated until the agent stops. Once
+// the secret is annotated as deregistered, it is deleted and the
+// credential is revoked, and the cluster is registered again after the
+// agent restarts
+func (p *Provider) PostStartTunnelAgent(hc *interfaces.HookContext) error {
+	w := &secretWriter{
+		config:      &p.config,
+		clusterName: hc.ClusterName,
+		cloudclient: hc.CloudClient,
+		cred:        credential.New(&p.config.Credential, hc.LocalClient),
+	}
+	ctx, cancel := context.WithCancel(hc.Context)
+	go credential.Sync(ctx, hc.ClusterName, w.cred.Watch(ctx), func() error {
+		deregistered, err := w.sync()
+		if deregistered {
+			cancel()
+		}
+		return err
+	})
+	return nil
+}
+
+// SecretName returns the name of the kubeconfig secret of the cluster
+func SecretName(clusterName string) string {
+	return clusterName + "-kubeconfig"
+}
+
+// secretWriter writes the kubeconfig secret of the cluster
+type secretWriter struct {
+	config      *Config
+	clusterName string
+	cloudclient k8s.Interface
+	cred        credential.Credential
+}
+
+// sync creates or updates the kubeconfig secret, it returns true once
+// the cluster is deregistered
+func (w *secretWriter) sync() (bool, error) {
+	secrets := w.cloudclient.CoreV1().Secrets(w.config.Namespace)
+	name := SecretName(w.clusterName)
+	secret, err := secrets.Get(name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get kubeconfig secret %s/%s: %v", w.config.Namespace, name, err)
+	}
+	exists := err == nil
+	if exists && secret.Annotations[DeregisteredAnnotation] == "true" {
+		klog.Infof("cluster %s is deregistered, delete its kubeconfig secret and revoke its credential",
+			w.clusterName)
+		err := secrets.Delete(name, &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to delete kubeconfig secret %s/%s: %v", w.config.Namespace, name, err)
+		}
+		if err := w.cred.Revoke(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	kubeconfig, err := w.kubeconfig()
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: w.config.Namespace,
+				Name:      name,
+				Labels: map[string]string{
+					ClusterLabel:   w.clusterName,
+					managedByLabel: managedByValue,
+				},
+			},
+			Data: map[string][]byte{SecretKey: kubeconfig},
+		}
+		if _, err := secrets.Create(secret); err != nil {
+			return false, fmt.Errorf("failed to create kubeconfig secret %s/%s: %v", w.config.Namespace, name, err)
+		}
+		klog.Infof("kubeconfig secret %s/%s of cluster %s is created", w.config.Namespace, name, w.clusterName)
+		return false, nil
+	}
+	if bytes.Equal(secret.Data[SecretKey], kubeconfig) {
+		return false, nil
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[SecretKey] = kubeconfig
+	if _, err := secrets.Update(secret); err != nil {
+		return false, fmt.Errorf("failed to update kubeconfig secret %s/%s: %v", w.config.Namespace, name, err)
+	}
+	klog.Infof("kubeconfig secret %s/%s of cluster %s is updated", w.config.Namespace, name, w.clusterName)
+	return false, nil
+}
+
+// kubeconfig generates the kubeconfig that accesses the apiserver of the
+// cluster through the tunnel server, which routes the request to the
+// agent by the host of the server
+func (w *secretWriter) kubeconfig() ([]byte, error) {
+	token, err := w.cred.Token()
+	if err != nil {
+		return nil, err
+	}
+	cluster := tunnelk8s.Cluster{
+		Server:                w.config.Server,
+		ProxyURL:              w.config.ProxyURL,
+		TLSServerName:         w.config.TLSServerName,
+		InsecureSkipTLSVerify: w.config.InsecureSkipTLSVerify,
+	}
+	if cluster.Server == "" {
+		cluster.Server = fmt.Sprintf("https://%s:6443", w.clusterName)
+	}
+	if !cluster.InsecureSkipTLSVerify {
+		if cluster.CertificateAuthorityData, err = credential.CABundle(); err != nil {
+			return nil, err
+		}
+	}
+	return tunnelk8s.NewKubeConfig(w.clusterName, cluster, tunnelk8s.AuthInfo{Token: token}).Marshal()
+}
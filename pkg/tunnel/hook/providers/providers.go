@@ -0,0 +1,28 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package providers registers all of the built-in hook providers, import
+// it to make them selectable by name
+package providers
+
+import (
+	// register the built-in hook providers
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/exec"
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/karmada"
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/kubeconfig"
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/tkestack"
+	_ "github.com/tkestack/tke-excalibur/pkg/tunnel/hook/webhook"
+)
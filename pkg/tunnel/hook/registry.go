@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+// Factory creates a TunnelHookProvider, the config is the JSON encoded
+// section named after the provider in the hook config file, it is nil
+// if the section is absent
+type Factory func(config []byte) (interfaces.TunnelHookProvider, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+// Register registers the factory of a hook provider by name, providers
+// are supposed to register themselves in init function. It panics if
+// the name is registered twice
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("hook provider %s is registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Providers returns the names of all registered hook providers
+func Providers() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the hook provider by name, the names can be a comma
+// separated list which creates a chain of the providers executed in order.
+// The configFile is a YAML or JSON file whose top level keys are the
+// provider names, and the values are passed to the factories
+func New(names, configFile string) (interfaces.TunnelHookProvider, error) {
+	configs, err := loadConfigs(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers chainProvider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		registryLock.RLock()
+		factory, ok := registry[name]
+		registryLock.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown hook provider %q, available providers: %s",
+				name, strings.Join(Providers(), ","))
+		}
+		provider, err := factory(configs[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create hook provider %s: %v", name, err)
+		}
+		providers = append(providers, provider)
+	}
+
+	switch len(providers) {
+	case 0:
+		return nil, fmt.Errorf("no hook provider is specified in %q", names)
+	case 1:
+		return providers[0], nil
+	}
+	return providers, nil
+}
+
+// loadConfigs loads the config sections of the providers from the file
+func loadConfigs(configFile string) (map[string]json.RawMessage, error) {
+	configs := make(map[string]json.RawMessage)
+	if configFile == "" {
+		return configs, nil
+	}
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hook config %s: %v", configFile, err)
+	}
+	defer f.Close()
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("failed to decode hook config %s: %v", configFile, err)
+	}
+	return configs, nil
+}
+
+// ContextForChannel derives a context from the stop channel, the
+// context is cancelled once the channel is closed
+func ContextForChannel(stopCh <-chan struct{}) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		<-stopCh
+	}()
+	return ctx
+}
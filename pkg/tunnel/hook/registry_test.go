@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+// testProvider records its config and the hooks executed by the providers
+// sharing the calls
+type testProvider struct {
+	interfaces.NopHookProvider
+	name   string
+	config []byte
+	calls  *[]string
+	err    error
+}
+
+func (p *testProvider) GetProviderName() string { return p.name }
+
+func (p *testProvider) PreStartTunnelAgent(hc *interfaces.HookContext) error {
+	*p.calls = append(*p.calls, p.name)
+	return p.err
+}
+
+func (p *testProvider) AgentConnected(hc *interfaces.HookContext) error {
+	*p.calls = append(*p.calls, p.name)
+	return p.err
+}
+
+var testCalls []string
+
+func init() {
+	for _, name := range []string{"test-a", "test-b", "test-failed"} {
+		name := name
+		Register(name, func(config []byte) (interfaces.TunnelHookProvider, error) {
+			p := &testProvider{name: name, config: config, calls: &testCalls}
+			if name == "test-failed" {
+				p.err = errors.New("failed")
+			}
+			return p, nil
+		})
+	}
+	Register("test-invalid", func(config []byte) (interfaces.TunnelHookProvider, error) {
+		return nil, errors.New("invalid config")
+	})
+}
+
+func TestProviders(t *testing.T) {
+	expected := []string{"test-a", "test-b", "test-failed", "test-invalid"}
+	if got := Providers(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected providers %v, got %v", expected, got)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a provider twice to panic")
+		}
+	}()
+	Register("test-a", nil)
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "excalibur-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invalidFile := filepath.Join(dir, "invalid.yaml")
+	if err := ioutil.WriteFile(invalidFile, []byte("- test-a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		names      string
+		configFile string
+		// expected is the name of the provider, or the substring of the error
+		expected string
+		// calls are the providers executed for AgentConnected
+		calls   []string
+		invalid bool
+	}{
+		{name: "single provider", names: "test-a", expected: "test-a", calls: []string{"test-a"}},
+		{name: "chain", names: "test-b, test-a", expected: "test-b,test-a", calls: []string{"test-b", "test-a"}},
+		{name: "chain continues after the failure", names: "test-a,test-failed,test-b",
+			expected: "test-a,test-failed,test-b", calls: []string{"test-a", "test-failed", "test-b"}},
+		{name: "empty names are skipped", names: "test-a,,", expected: "test-a", calls: []string{"test-a"}},
+		{name: "no provider", names: " , ", expected: "no hook provider", invalid: true},
+		{name: "unknown provider", names: "test-a,unknown", expected: `unknown hook provider "unknown"`, invalid: true},
+		{name: "factory error", names: "test-invalid", expected: "invalid config", invalid: true},
+		{name: "absent config file", names: "test-a", configFile: filepath.Join(dir, "absent.yaml"),
+			expected: "failed to open hook config", invalid: true},
+		{name: "invalid config file", names: "test-a", configFile: invalidFile,
+			expected: "failed to decode hook config", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testCalls = nil
+			provider, err := New(c.names, c.configFile)
+			if c.invalid {
+				if err == nil || !strings.Contains(err.Error(), c.expected) {
+					t.Errorf("expected error containing %q, got %v", c.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := provider.GetProviderName(); got != c.expected {
+				t.Errorf("expected provider %s, got %s", c.expected, got)
+			}
+			err = provider.AgentConnected(&interfaces.HookContext{})
+			if !reflect.DeepEqual(testCalls, c.calls) {
+				t.Errorf("expected calls %v, got %v", c.calls, testCalls)
+			}
+			if strings.Contains(c.names, "test-failed") {
+				if err == nil || err.Error() != "test-failed: failed" {
+					t.Errorf("expected the error prefixed by the failed provider, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewPassesConfigSections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "excalibur-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "hook.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("test-a:\n  key: value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := New("test-a,test-b", configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := provider.(chainProvider)
+	if got := string(chain[0].(*testProvider).config); got != `{"key":"value"}` {
+		t.Errorf("expected the section of test-a, got %s", got)
+	}
+	if got := chain[1].(*testProvider).config; got != nil {
+		t.Errorf("expected nil config for the absent section, got %s", got)
+	}
+}
+
+func TestChainFailures(t *testing.T) {
+	var calls []string
+	chain := chainProvider{
+		&testProvider{name: "test-a", calls: &calls},
+		&testProvider{name: "test-failed", calls: &calls, err: errors.New("failed")},
+		&testProvider{name: "test-b", calls: &calls, err: errors.New("unavailable")},
+	}
+
+	// the pre-start hooks gate the startup
+	err := chain.PreStartTunnelAgent(&interfaces.HookContext{})
+	if expected := []string{"test-a", "test-failed"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected the pre-start calls %v, got %v", expected, calls)
+	}
+	if err == nil || err.Error() != "test-failed: failed" {
+		t.Errorf("expected the error of the first failure, got %v", err)
+	}
+
+	// the notifications reach every provider
+	calls = nil
+	err = chain.AgentConnected(&interfaces.HookContext{})
+	if expected := []string{"test-a", "test-failed", "test-b"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected the notification calls %v, got %v", expected, calls)
+	}
+	if err == nil || err.Error() != "[test-failed: failed, test-b: unavailable]" {
+		t.Errorf("expected the aggregated errors, got %v", err)
+	}
+}
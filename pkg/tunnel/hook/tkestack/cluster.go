@@ -0,0 +1,215 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tkestack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+const (
+	// TunnelConnectedCondition is the condition of the cluster which
+	// shows if the agent of the cluster connects to the tunnel server
+	TunnelConnectedCondition = "TunnelConnected"
+
+	// clusterHeartbeatPeriod is the interval of refreshing the last probe
+	// time of the condition while the agent is connected
+	clusterHeartbeatPeriod = time.Minute
+
+	clusterAbsPath = "apis/platform.tkestack.io/v1/clusters"
+)
+
+// clusterStatusUpdater sets the TunnelConnected condition of the clusters
+// as their agents connect to and disconnect from the server
+type clusterStatusUpdater struct {
+	mu sync.Mutex
+	// heartbeats stops refreshing the condition of the connected clusters
+	heartbeats map[string]context.CancelFunc
+}
+
+func newClusterStatusUpdater() *clusterStatusUpdater {
+	return &clusterStatusUpdater{heartbeats: make(map[string]context.CancelFunc)}
+}
+
+// connected marks the cluster connected to this server replica, and
+// keeps refreshing the last probe time until it is disconnected
+func (u *clusterStatusUpdater) connected(hc *interfaces.HookContext) error {
+	message := connectedMessage(hc.AgentVersion, hc.ServerReplica)
+	update := func() error {
+		return updateTunnelCondition(hc.LocalClient, hc.ClusterName,
+			func(cond map[string]interface{}) bool {
+				cond["status"] = "True"
+				cond["reason"] = "AgentConnected"
+				cond["message"] = message
+				return true
+			})
+	}
+
+	ctx, cancel := context.WithCancel(hc.Context)
+	u.mu.Lock()
+	if stop, ok := u.heartbeats[hc.ClusterName]; ok {
+		stop()
+	}
+	u.heartbeats[hc.ClusterName] = cancel
+	u.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(clusterHeartbeatPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := update(); err != nil {
+					klog.Errorf("failed to refresh %s condition of cluster %s: %v",
+						TunnelConnectedCondition, hc.ClusterName, err)
+				}
+			}
+		}
+	}()
+	return update()
+}
+
+// disconnected marks the cluster disconnected, unless another server
+// replica holds the connection of the agent
+func (u *clusterStatusUpdater) disconnected(hc *interfaces.HookContext) error {
+	u.mu.Lock()
+	if stop, ok := u.heartbeats[hc.ClusterName]; ok {
+		stop()
+		delete(u.heartbeats, hc.ClusterName)
+	}
+	u.mu.Unlock()
+
+	return updateTunnelCondition(hc.LocalClient, hc.ClusterName,
+		func(cond map[string]interface{}) bool {
+			message, _ := cond["message"].(string)
+			if cond["status"] == "True" && !strings.HasSuffix(message, replicaSuffix(hc.ServerReplica)) {
+				return false
+			}
+			cond["status"] = "False"
+			cond["reason"] = "AgentDisconnected"
+			cond["message"] = fmt.Sprintf("agent %s is disconnected from server replica %s",
+				hc.AgentVersion, hc.ServerReplica)
+			return true
+		})
+}
+
+func connectedMessage(agentVersion, replica string) string {
+	return fmt.Sprintf("agent %s is connected to%s", agentVersion, replicaSuffix(replica))
+}
+
+func replicaSuffix(replica string) string {
+	return " server replica " + replica
+}
+
+// updateTunnelCondition updates the TunnelConnected condition of the
+// cluster by mutate, the condition is left untouched if mutate returns
+// false. The last probe time is always refreshed, and the last transition
+// time is refreshed once the status changes. The clusters that don't exist
+// are ignored
+func updateTunnelCondition(
+	client k8s.Interface,
+	clusterName string,
+	mutate func(cond map[string]interface{}) bool) error {
+	return updateClusterStatus(client, clusterName, func(cluster *unstructured.Unstructured) (bool, error) {
+		conditions, _, err := unstructured.NestedSlice(cluster.Object, "status", "conditions")
+		if err != nil {
+			return false, fmt.Errorf("invalid conditions of cluster %s: %v", clusterName, err)
+		}
+		var cond map[string]interface{}
+		for _, c := range conditions {
+			if m, ok := c.(map[string]interface{}); ok && m["type"] == TunnelConnectedCondition {
+				cond = m
+				break
+			}
+		}
+		if cond == nil {
+			cond = map[string]interface{}{"type": TunnelConnectedCondition}
+			conditions = append(conditions, cond)
+		}
+		status := cond["status"]
+		if !mutate(cond) {
+			return false, nil
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		cond["lastProbeTime"] = now
+		if status != cond["status"] {
+			cond["lastTransitionTime"] = now
+		}
+		return true, unstructured.SetNestedSlice(cluster.Object, conditions, "status", "conditions")
+	})
+}
+
+// updateClusterStatus updates the status of the cluster by mutate, the
+// update is skipped if mutate returns false or the cluster doesn't exist
+func updateClusterStatus(
+	client k8s.Interface,
+	clusterName string,
+	mutate func(cluster *unstructured.Unstructured) (bool, error)) error {
+	restclient := client.Discovery().RESTClient()
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		cluster, err := getCluster(client, clusterName)
+		if apierrors.IsNotFound(err) {
+			klog.V(4).Infof("cluster %s is not found, skip updating its status", clusterName)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ok, err := mutate(cluster); !ok || err != nil {
+			return err
+		}
+		body, err := cluster.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return restclient.Put().
+			AbsPath(clusterAbsPath, clusterName, "status").
+			SetHeader("Content-Type", "application/json").
+			Body(body).
+			Do().
+			Error()
+	})
+}
+
+// getCluster gets the cluster by name
+func getCluster(client k8s.Interface, clusterName string) (*unstructured.Unstructured, error) {
+	data, err := client.Discovery().RESTClient().Get().AbsPath(clusterAbsPath, clusterName).DoRaw()
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get cluster %s: %v", clusterName, err)
+	}
+	cluster := &unstructured.Unstructured{}
+	if err := cluster.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tkestack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+const (
+	// ApprovalManual waits for the join request to be approved before
+	// registering the cluster
+	ApprovalManual = "Manual"
+	// ApprovalAuto registers the cluster once its agent connects
+	ApprovalAuto = "Auto"
+
+	// JoinRequestLabel is the label of the join request configmaps
+	JoinRequestLabel = "tunnel.excalibur.io/join-request"
+	// JoinRequestApprovedAnnotation approves the join request once it
+	// is set to "true"
+	JoinRequestApprovedAnnotation = "tunnel.excalibur.io/approved"
+
+	// joinRequestPollPeriod is the interval of checking if the join
+	// request is approved
+	joinRequestPollPeriod = 10 * time.Second
+
+	clusterCredentialAbsPath = "apis/platform.tkestack.io/v1/clustercredentials"
+)
+
+// AutoRegisterConfig is the config of registering the clusters to
+// tkestack once their agents connect to the tunnel server
+type AutoRegisterConfig struct {
+	// Enabled enables the auto registration, it is disabled by default
+	Enabled bool `json:"enabled"`
+	// Approval is Manual or Auto, defaults to Manual
+	Approval string `json:"approval"`
+	// TenantID is the tenant of the registered clusters, defaults to "default"
+	TenantID string `json:"tenantID"`
+	// APIServerHost is the advertised apiserver host that is dialed
+	// through the tunnel, defaults to the cluster name
+	APIServerHost string `json:"apiServerHost"`
+	// APIServerPort is the advertised apiserver port, defaults to 6443
+	APIServerPort int32 `json:"apiServerPort"`
+}
+
+func (c *AutoRegisterConfig) complete() error {
+	switch c.Approval {
+	case "":
+		c.Approval = ApprovalManual
+	case ApprovalManual, ApprovalAuto:
+	default:
+		return fmt.Errorf("invalid approval %s, must be %s or %s", c.Approval, ApprovalManual, ApprovalAuto)
+	}
+	if c.TenantID == "" {
+		c.TenantID = "default"
+	}
+	if c.APIServerPort == 0 {
+		c.APIServerPort = 6443
+	}
+	return nil
+}
+
+// clusterRegistrar registers the Registered type clusters and their
+// cluster credentials on the first connections of their agents
+type clusterRegistrar struct {
+	config *AutoRegisterConfig
+
+	mu sync.Mutex
+	// pending stops waiting for the approval of the join requests
+	pending map[string]context.CancelFunc
+}
+
+func newClusterRegistrar(config *AutoRegisterConfig) *clusterRegistrar {
+	return &clusterRegistrar{
+		config:  config,
+		pending: make(map[string]context.CancelFunc),
+	}
+}
+
+// connected registers the cluster of the agent if it is not registered
+// yet, a join request is created and the registration is delayed until
+// it is approved if the approval is Manual
+func (r *clusterRegistrar) connected(hc *interfaces.HookContext) error {
+	// only the agents authenticated by the certificate issued for the
+	// cluster are able to register it, which is requested by the identity
+	// of the cluster if the agent identities are bound, see
+	// PreStartTunnelServer
+	if hc.AgentCommonName != hc.ClusterName {
+		klog.Warningf("agent certificate %s doesn't match cluster %s, skip registering it",
+			hc.AgentCommonName, hc.ClusterName)
+		return nil
+	}
+	_, err := getCluster(hc.LocalClient, hc.ClusterName)
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if r.config.Approval == ApprovalAuto {
+		return r.register(hc)
+	}
+	if err := r.ensureJoinRequest(hc); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(hc.Context)
+	r.mu.Lock()
+	if stop, ok := r.pending[hc.ClusterName]; ok {
+		stop()
+	}
+	r.pending[hc.ClusterName] = cancel
+	r.mu.Unlock()
+
+	go r.waitForApproval(ctx, hc)
+	return nil
+}
+
+// disconnected stops waiting for the approval of the cluster, the join
+// request is kept so that it can be approved before the agent reconnects
+func (r *clusterRegistrar) disconnected(hc *interfaces.HookContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stop, ok := r.pending[hc.ClusterName]; ok {
+		stop()
+		delete(r.pending, hc.ClusterName)
+	}
+}
+
+func (r *clusterRegistrar) waitForApproval(ctx context.Context, hc *interfaces.HookContext) {
+	klog.Infof("waiting for join request %s/%s to be approved", joinRequestNamespace(), joinRequestName(hc.ClusterName))
+	ticker := time.NewTicker(joinRequestPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		approved, err := r.isApproved(hc)
+		if err != nil {
+			klog.Errorf("failed to check join request of cluster %s: %v", hc.ClusterName, err)
+			continue
+		}
+		if !approved {
+			continue
+		}
+		if err := r.register(hc); err != nil {
+			klog.Errorf("failed to register cluster %s: %v", hc.ClusterName, err)
+			continue
+		}
+		r.disconnected(hc)
+		return
+	}
+}
+
+// ensureJoinRequest creates the join request configmap of the cluster
+// if it doesn't exist
+func (r *clusterRegistrar) ensureJoinRequest(hc *interfaces.HookContext) error {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      joinRequestName(hc.ClusterName),
+			Namespace: joinRequestNamespace(),
+			Labels:    map[string]string{JoinRequestLabel: "true"},
+		},
+		Data: map[string]string{
+			"clusterName":      hc.ClusterName,
+			"agentIdentifiers": hc.AgentIdentifiers,
+			"agentVersion":     hc.AgentVersion,
+			"serverReplica":    hc.ServerReplica,
+		},
+	}
+	_, err := hc.LocalClient.CoreV1().ConfigMaps(cm.Namespace).Create(cm)
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create join request of cluster %s: %v", hc.ClusterName, err)
+	}
+	klog.Infof("join request %s/%s of cluster %s is created, annotate it with %s=true to approve",
+		cm.Namespace, cm.Name, hc.ClusterName, JoinRequestApprovedAnnotation)
+	return nil
+}
+
+func (r *clusterRegistrar) isApproved(hc *interfaces.HookContext) (bool, error) {
+	cm, err := hc.LocalClient.CoreV1().ConfigMaps(joinRequestNamespace()).
+		Get(joinRequestName(hc.ClusterName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// recreate the join request if it is deleted by mistake
+		return false, r.ensureJoinRequest(hc)
+	}
+	if err != nil {
+		return false, err
+	}
+	return cm.Annotations[JoinRequestApprovedAnnotation] == "true", nil
+}
+
+// register creates the cluster credential and the Registered type
+// cluster, and advertises the apiserver address dialed through the
+// tunnel. The token of the cluster credential is patched by the agent
+func (r *clusterRegistrar) register(hc *interfaces.HookContext) error {
+	ccName, err := getClusterCredentialName(hc.ClusterName, hc.LocalClient)
+	if err == errClusterCredentialNotFound {
+		ccName, err = createClusterCredential(hc.LocalClient, hc.ClusterName, r.config.TenantID)
+	}
+	if err != nil {
+		return err
+	}
+
+	cluster := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "platform.tkestack.io/v1",
+		"kind":       "Cluster",
+		"metadata": map[string]interface{}{
+			"name": hc.ClusterName,
+		},
+		"spec": map[string]interface{}{
+			"tenantID":    r.config.TenantID,
+			"displayName": hc.ClusterName,
+			"type":        "Registered",
+			"clusterCredentialRef": map[string]interface{}{
+				"name": ccName,
+			},
+		},
+	}}
+	body, err := cluster.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	err = hc.LocalClient.Discovery().RESTClient().Post().
+		AbsPath(clusterAbsPath).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do().
+		Error()
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create cluster %s: %v", hc.ClusterName, err)
+	}
+
+	host := r.config.APIServerHost
+	if host == "" {
+		host = hc.ClusterName
+	}
+	err = updateClusterStatus(hc.LocalClient, hc.ClusterName, func(cluster *unstructured.Unstructured) (bool, error) {
+		addresses := []interface{}{map[string]interface{}{
+			"type": "Advertise",
+			"host": host,
+			"port": int64(r.config.APIServerPort),
+		}}
+		return true, unstructured.SetNestedSlice(cluster.Object, addresses, "status", "addresses")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to advertise apiserver address of cluster %s: %v", hc.ClusterName, err)
+	}
+	klog.Infof("cluster %s is registered with cluster credential %s", hc.ClusterName, ccName)
+	return nil
+}
+
+// createClusterCredential creates an empty cluster credential for the
+// cluster and returns its name
+func createClusterCredential(client k8s.Interface, clusterName, tenantID string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "platform.tkestack.io/v1",
+		"kind":       "ClusterCredential",
+		"metadata": map[string]interface{}{
+			"generateName": "cc-",
+		},
+		"tenantID":    tenantID,
+		"clusterName": clusterName,
+	})
+	if err != nil {
+		return "", err
+	}
+	data, err := client.Discovery().RESTClient().Post().
+		AbsPath(clusterCredentialAbsPath).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw()
+	if err != nil {
+		return "", fmt.Errorf("failed to create cluster credential of cluster %s: %v", clusterName, err)
+	}
+	cc := ClusterCredential{}
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return "", err
+	}
+	return cc.Name, nil
+}
+
+func joinRequestName(clusterName string) string {
+	return "tunnel-join-" + clusterName
+}
+
+func joinRequestNamespace() string {
+	if ns := os.Getenv(constants.TunnelServerNSEnv); ns != "" {
+		return ns
+	}
+	return metav1.NamespaceSystem
+}
@@ -17,18 +17,82 @@ limitations under the License.
 package tkestack
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 
-	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/credential"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
 )
 
+// ProviderName is the name of the tkestack hook provider
+const ProviderName = "tkestack"
+
+// defaultCredentialName is the name of the dedicated service account,
+// which is only granted the read-only default rules
+const defaultCredentialName = "tkestack-platform-reader"
+
+// errClusterCredentialNotFound means the cluster is not registered yet,
+// or has been deregistered
+var errClusterCredentialNotFound = errors.New("cluster credential is not found")
+
+func init() {
+	hook.Register(ProviderName, func(config []byte) (interfaces.TunnelHookProvider, error) {
+		return NewTKEStackProvider(config)
+	})
+}
+
+// Config is the config of tkestack hook provider, the credential is
+// read-only unless its rules are configured, for example to grant the
+// write access:
+//
+//	tkestack:
+//	  credential:
+//	    namespace: kube-system
+//	    name: tkestack-platform-admin
+//	    rules:
+//	    - apiGroups: ["*"]
+//	      resources: ["*"]
+//	      verbs: ["*"]
+//	  autoRegister:
+//	    enabled: true
+//	    approval: Manual
+type Config struct {
+	Credential   credential.Config  `json:"credential"`
+	AutoRegister AutoRegisterConfig `json:"autoRegister"`
+}
+
 // TKEStackProvider for execute
 type TKEStackProvider struct {
+	interfaces.NopHookProvider
+	config        Config
+	statusUpdater *clusterStatusUpdater
+	registrar     *clusterRegistrar
+}
+
+// NewTKEStackProvider creates the tkestack hook provider from the JSON
+// config, the config is optional
+func NewTKEStackProvider(config []byte) (*TKEStackProvider, error) {
+	hook := &TKEStackProvider{statusUpdater: newClusterStatusUpdater()}
+	if config != nil {
+		if err := json.Unmarshal(config, &hook.config); err != nil {
+			return nil, fmt.Errorf("failed to decode config: %v", err)
+		}
+	}
+	hook.config.Credential.Complete(defaultCredentialName)
+	if hook.config.AutoRegister.Enabled {
+		if err := hook.config.AutoRegister.complete(); err != nil {
+			return nil, err
+		}
+		hook.registrar = newClusterRegistrar(&hook.config.AutoRegister)
+	}
+	return hook, nil
 }
 
 // ClusterCredential records the credential information needed to access the cluster.
@@ -47,61 +111,121 @@ type ClusterCredentialList struct {
 }
 
 func (hook *TKEStackProvider) GetProviderName() string {
-	return "tkestack"
+	return ProviderName
 }
 
 func (hook *TKEStackProvider) GetTunnelServerNS(clusterName string) string {
 	return clusterName
 }
 
-func (hook *TKEStackProvider) PreStartTunnelAgent(clusterName string, cloudclient k8s.Interface, localclient k8s.Interface) error {
+// PostStartTunnelAgent registers the credential of the cluster to the
+// cluster credential in the background, and keeps it updated until the
+// agent stops
+func (hook *TKEStackProvider) PostStartTunnelAgent(hc *interfaces.HookContext) error {
+	cred := credential.New(&hook.config.Credential, hc.LocalClient)
+	go syncToken(hc.Context, hc.ClusterName, hc.CloudClient, cred)
 	return nil
 }
 
-func (hook *TKEStackProvider) PostStartTunnelAgent(clusterName string, cloudclient k8s.Interface, localclient k8s.Interface) error {
-	// steps:
-	// 1. get cluster credential by cluster name
-	// 2. patch token field to cluster credential
+// PreStartTunnelServer refuses to register the clusters without approval
+// unless the certificates of the agents are bound to the identities of
+// their clusters, otherwise any agent is able to register any cluster
+func (hook *TKEStackProvider) PreStartTunnelServer(hc *interfaces.HookContext) error {
+	if hook.registrar != nil && hook.config.AutoRegister.Approval == ApprovalAuto && !hc.AgentIdentityBound {
+		return fmt.Errorf("autoRegister.approval %s requires the tunnel server to bind the agent identities, "+
+			"i.e. --bind-agent-identity", ApprovalAuto)
+	}
+	return nil
+}
+
+// AgentConnected registers the cluster if the auto registration is
+// enabled, and sets the TunnelConnected condition of the cluster to
+// True, which is refreshed periodically until the agent disconnects
+func (hook *TKEStackProvider) AgentConnected(hc *interfaces.HookContext) error {
+	if hook.registrar != nil {
+		if err := hook.registrar.connected(hc); err != nil {
+			klog.Errorf("failed to register cluster %s: %v", hc.ClusterName, err)
+		}
+	}
+	return hook.statusUpdater.connected(hc)
+}
+
+// AgentDisconnected sets the TunnelConnected condition of the cluster
+// to False
+func (hook *TKEStackProvider) AgentDisconnected(hc *interfaces.HookContext) error {
+	if hook.registrar != nil {
+		hook.registrar.disconnected(hc)
+	}
+	return hook.statusUpdater.disconnected(hc)
+}
+
+// syncToken patches the token of the credential to the cluster credential,
+// and re-patches it whenever the token changes until the context is done,
+// e.g. the token file is rotated by kubelet. The credential is revoked
+// once the cluster credential is deleted, i.e. the cluster is deregistered
+func syncToken(ctx context.Context, clusterName string, cloudclient k8s.Interface, cred credential.Credential) {
+	var synced string
+	credential.Sync(ctx, clusterName, cred.Watch(ctx), func() error {
+		ccName, err := getClusterCredentialName(clusterName, cloudclient)
+		if err == errClusterCredentialNotFound && synced != "" {
+			klog.Infof("cluster %s is deregistered, revoke its credential", clusterName)
+			if err := cred.Revoke(); err != nil {
+				return err
+			}
+			synced = ""
+		}
+		if err != nil {
+			return err
+		}
+		token, err := cred.Token()
+		if err != nil || token == synced {
+			return err
+		}
+		if err := patchToken(ccName, cloudclient, token); err != nil {
+			return fmt.Errorf("patch cluster credential for cluster %s faild: %s", clusterName, err)
+		}
+		klog.Infof("token of cluster %s is patched to the cluster credential", clusterName)
+		synced = token
+		return nil
+	})
+}
+
+// getClusterCredentialName gets the name of cluster credential by cluster name
+func getClusterCredentialName(clusterName string, cloudclient k8s.Interface) (string, error) {
 	ccl := ClusterCredentialList{}
-	restclient := cloudclient.Discovery().RESTClient()
-	data, err := restclient.
+	data, err := cloudclient.Discovery().RESTClient().
 		Get().
 		AbsPath("apis/platform.tkestack.io/v1/clustercredentials").
 		Param("fieldSelector", "clusterName="+clusterName).
 		SetHeader("Accept", "application/json").
 		DoRaw()
 	if err != nil {
-		return fmt.Errorf("failed to get cluster %s credential: %v", clusterName, err)
+		return "", fmt.Errorf("failed to get cluster %s credential: %v", clusterName, err)
 	}
 	err = json.Unmarshal(data, &ccl)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if len(ccl.Items) == 0 {
-		return fmt.Errorf("cluster credential for cluster: %s is not ready", clusterName)
+		return "", errClusterCredentialNotFound
 	}
-	tokenByte, err := ioutil.ReadFile(constants.TunnelTokenFile)
+	return ccl.Items[0].Name, nil
+}
+
+// patchToken patches the token field of the cluster credential
+func patchToken(ccName string, cloudclient k8s.Interface, token string) error {
+	value, err := json.Marshal(token)
 	if err != nil {
-		return fmt.Errorf("failed to read token from %s: %s", constants.TunnelTokenFile, err)
+		return err
 	}
-	patchBody := fmt.Sprintf(`[{"op":"replace","path":"/token","value":"%s"}]`, string(tokenByte))
-	err = restclient.Patch(types.JSONPatchType).
+	// "add" replaces the token if it exists, and adds it otherwise
+	patchBody := fmt.Sprintf(`[{"op":"add","path":"/token","value":%s}]`, value)
+	return cloudclient.Discovery().RESTClient().
+		Patch(types.JSONPatchType).
 		AbsPath("apis/platform.tkestack.io/v1").
 		Resource("clustercredentials").
-		Name(ccl.Items[0].Name).
+		Name(ccName).
 		Body([]byte(patchBody)).
 		Do().
 		Error()
-	if err != nil {
-		return fmt.Errorf("patch cluster credential for cluster %s faild: %s", clusterName, err)
-	}
-	return nil
-}
-
-func (hook *TKEStackProvider) PreStartTunnelServer(localclient k8s.Interface) error {
-	return nil
-}
-
-func (hook *TKEStackProvider) PostStartTunnelServer(localclient k8s.Interface) error {
-	return nil
 }
@@ -0,0 +1,48 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tkestack
+
+import (
+	"testing"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+func TestPreStartTunnelServerRequiresBoundIdentityForAutoApproval(t *testing.T) {
+	tests := []struct {
+		config  string
+		bound   bool
+		wantErr bool
+	}{
+		{`{}`, false, false},
+		{`{"autoRegister":{"enabled":true}}`, false, false},
+		{`{"autoRegister":{"enabled":true,"approval":"Manual"}}`, false, false},
+		{`{"autoRegister":{"enabled":true,"approval":"Auto"}}`, false, true},
+		{`{"autoRegister":{"enabled":true,"approval":"Auto"}}`, true, false},
+		{`{"autoRegister":{"enabled":false,"approval":"Auto"}}`, false, false},
+	}
+	for _, test := range tests {
+		provider, err := NewTKEStackProvider([]byte(test.config))
+		if err != nil {
+			t.Fatalf("%s: %v", test.config, err)
+		}
+		err = provider.PreStartTunnelServer(&interfaces.HookContext{AgentIdentityBound: test.bound})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s with bound identity %v: expect error %v, got %v", test.config, test.bound, test.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/pki"
+)
+
+// ProviderName is the name of the webhook hook provider
+const ProviderName = "webhook"
+
+const (
+	// APIVersion is the version of the payload, it will be bumped once
+	// an incompatible change is made to the payload
+	APIVersion = "tunnel.excalibur.io/v1alpha1"
+	// Kind is the kind of the payload
+	Kind = "TunnelHookEvent"
+
+	// headers of the webhook request
+	EventHeader     = "X-Excalibur-Event"
+	DeliveryHeader  = "X-Excalibur-Delivery"
+	SignatureHeader = "X-Excalibur-Signature"
+
+	defaultTimeout      = 10 * time.Second
+	defaultInitialDelay = time.Second
+	// maxResponseSize limits the response body kept for logging
+	maxResponseSize = 4096
+)
+
+// FailurePolicy determines what to do once the webhook finally fails
+type FailurePolicy string
+
+const (
+	// FailurePolicyFail fails the startup of the server or agent, i.e.
+	// fail-closed
+	FailurePolicyFail FailurePolicy = "Fail"
+	// FailurePolicyIgnore logs a warning and continues the startup,
+	// i.e. fail-open
+	FailurePolicyIgnore FailurePolicy = "Ignore"
+)
+
+// Config is the config of webhook hook provider, for example:
+//
+//	webhook:
+//	  url: https://hub.example.com/excalibur/events
+//	  caFile: /etc/excalibur/webhook/ca.crt
+//	  certFile: /etc/excalibur/webhook/tls.crt
+//	  keyFile: /etc/excalibur/webhook/tls.key
+//	  hmacSecretFile: /etc/excalibur/webhook/hmac-secret
+//	  retries: 3
+//	  failurePolicy: Ignore
+type Config struct {
+	// URL is the https endpoint that the payloads are posted to
+	URL string `json:"url"`
+	// CAFile verifies the certificate of the endpoint, the system
+	// roots are used if empty
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the client certificate for mTLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// HMACSecretFile contains the secret to sign the payload, the
+	// signature is set in the X-Excalibur-Signature header
+	HMACSecretFile string `json:"hmacSecretFile,omitempty"`
+	// Events are the events posted to the endpoint, all of the events
+	// are posted if empty
+	Events []interfaces.HookEvent `json:"events,omitempty"`
+	// Timeout of each attempt, defaults to 10s
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Retries is the number of retries after the first attempt fails,
+	// the delay between attempts starts from RetryInitialDelay and
+	// doubles each time
+	Retries           int              `json:"retries,omitempty"`
+	RetryInitialDelay *metav1.Duration `json:"retryInitialDelay,omitempty"`
+	// FailurePolicy defaults to Fail
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+// Payload is the JSON posted to the endpoint
+type Payload struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// ID is unique for each event, and is the same across the retries
+	ID        string               `json:"id"`
+	Event     interfaces.HookEvent `json:"event"`
+	Timestamp time.Time            `json:"timestamp"`
+	// Component is the name of the component that sends the event
+	Component string `json:"component"`
+	// ClusterName is empty for the events of tunnel server, except
+	// AgentConnected and AgentDisconnected
+	ClusterName      string `json:"clusterName,omitempty"`
+	AgentIdentifiers string `json:"agentIdentifiers,omitempty"`
+	AgentVersion     string `json:"agentVersion,omitempty"`
+	ServerReplica    string `json:"serverReplica,omitempty"`
+	// ServerAddress is the address that the agents connect to
+	ServerAddress string `json:"serverAddress,omitempty"`
+	// CertificateFingerprint is the fingerprint of the certificate of
+	// the component which sends the event
+	CertificateFingerprint string `json:"certificateFingerprint,omitempty"`
+}
+
+func init() {
+	hook.Register(ProviderName, func(config []byte) (interfaces.TunnelHookProvider, error) {
+		return NewProvider(config)
+	})
+}
+
+// Provider posts the payload of the life cycle events to the endpoint
+type Provider struct {
+	config     Config
+	client     *http.Client
+	hmacSecret []byte
+	events     map[interfaces.HookEvent]bool
+}
+
+var _ interfaces.TunnelHookProvider = &Provider{}
+
+// NewProvider creates the webhook hook provider from the JSON config
+func NewProvider(config []byte) (*Provider, error) {
+	if config == nil {
+		return nil, errors.New("webhook is not configured")
+	}
+	p := &Provider{}
+	if err := json.Unmarshal(config, &p.config); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+	if err := p.complete(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// complete validates the config, sets the defaults and creates the client
+func (p *Provider) complete() error {
+	c := &p.config
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %s: %v", c.URL, err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("url %s is not https", c.URL)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("certFile and keyFile must be set together")
+	}
+	if c.Timeout == nil {
+		c.Timeout = &metav1.Duration{Duration: defaultTimeout}
+	}
+	if c.RetryInitialDelay == nil {
+		c.RetryInitialDelay = &metav1.Duration{Duration: defaultInitialDelay}
+	}
+	if c.Retries < 0 {
+		return errors.New("retries can't be negative")
+	}
+	switch c.FailurePolicy {
+	case "":
+		c.FailurePolicy = FailurePolicyFail
+	case FailurePolicyFail, FailurePolicyIgnore:
+	default:
+		return fmt.Errorf("unknown failure policy %s", c.FailurePolicy)
+	}
+
+	known := make(map[interfaces.HookEvent]bool)
+	for _, event := range interfaces.HookEvents {
+		known[event] = true
+	}
+	p.events = make(map[interfaces.HookEvent]bool)
+	for _, event := range c.Events {
+		if !known[event] {
+			return fmt.Errorf("unknown hook event %s", event)
+		}
+		p.events[event] = true
+	}
+
+	if c.HMACSecretFile != "" {
+		secret, err := ioutil.ReadFile(c.HMACSecretFile)
+		if err != nil {
+			return fmt.Errorf("failed to read hmac secret: %v", err)
+		}
+		p.hmacSecret = bytes.TrimSpace(secret)
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		if tlsCfg.RootCAs, err = pki.GenCertPoolUseCA(c.CAFile); err != nil {
+			return err
+		}
+	}
+	if c.CertFile != "" {
+		// load the client certificate on each handshake to pick up the
+		// rotated one
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+			}
+			return &cert, nil
+		}
+	}
+	p.client = &http.Client{
+		Timeout:   c.Timeout.Duration,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg, Proxy: http.ProxyFromEnvironment},
+	}
+	return nil
+}
+
+func (p *Provider) GetProviderName() string {
+	return ProviderName
+}
+
+func (p *Provider) PreStartTunnelAgent(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.PreStartTunnelAgent, hc))
+}
+
+func (p *Provider) PostStartTunnelAgent(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.PostStartTunnelAgent, hc))
+}
+
+func (p *Provider) PreStopTunnelAgent(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.PreStopTunnelAgent, hc))
+}
+
+func (p *Provider) PreStartTunnelServer(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.PreStartTunnelServer, hc))
+}
+
+func (p *Provider) PostStartTunnelServer(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.PostStartTunnelServer, hc))
+}
+
+func (p *Provider) PreStopTunnelServer(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.PreStopTunnelServer, hc))
+}
+
+func (p *Provider) AgentConnected(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.AgentConnected, hc))
+}
+
+func (p *Provider) AgentDisconnected(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.AgentDisconnected, hc))
+}
+
+func (p *Provider) CertificateRotated(hc *interfaces.HookContext) error {
+	return p.post(hc.Context, newPayload(interfaces.CertificateRotated, hc))
+}
+
+func newPayload(event interfaces.HookEvent, hc *interfaces.HookContext) *Payload {
+	return &Payload{
+		APIVersion:             APIVersion,
+		Kind:                   Kind,
+		ID:                     uuid.New().String(),
+		Event:                  event,
+		Timestamp:              time.Now(),
+		Component:              hc.Component,
+		ClusterName:            hc.ClusterName,
+		AgentIdentifiers:       hc.AgentIdentifiers,
+		AgentVersion:           hc.AgentVersion,
+		ServerReplica:          hc.ServerReplica,
+		ServerAddress:          hc.ServerAddress,
+		CertificateFingerprint: pki.CertificateFingerprint(hc.Certificate),
+	}
+}
+
+// post posts the payload with retries, the failure is ignored if the
+// failure policy is Ignore
+func (p *Provider) post(ctx context.Context, payload *Payload) error {
+	if len(p.events) != 0 && !p.events[payload.Event] {
+		return nil
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	err = p.postWithRetries(ctx, payload, body)
+	if err == nil {
+		return nil
+	}
+	if p.config.FailurePolicy == FailurePolicyIgnore {
+		klog.Warningf("webhook %s failed on %s event, continue as its failure policy is %s: %v",
+			p.config.URL, payload.Event, p.config.FailurePolicy, err)
+		return nil
+	}
+	return fmt.Errorf("webhook %s failed on %s event: %v", p.config.URL, payload.Event, err)
+}
+
+// postWithRetries posts the body until it succeeds, the failure is not
+// worth retrying or the retries are exhausted, the delay between the
+// attempts doubles each time
+func (p *Provider) postWithRetries(ctx context.Context, payload *Payload, body []byte) error {
+	delay := p.config.RetryInitialDelay.Duration
+	for attempt := 0; ; attempt++ {
+		retryable, err := p.postOnce(ctx, payload, body)
+		if err == nil || !retryable || attempt >= p.config.Retries {
+			return err
+		}
+		interval := wait.Jitter(delay, 0.1)
+		klog.Warningf("failed to post %s event %s to webhook %s, retry in %s (%d/%d): %v",
+			payload.Event, payload.ID, p.config.URL, interval, attempt+1, p.config.Retries, err)
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%v, give up retrying: %v", err, ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// postOnce posts the body once, it returns whether the failure is
+// worth retrying
+func (p *Provider) postOnce(ctx context.Context, payload *Payload, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, p.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(payload.Event))
+	req.Header.Set(DeliveryHeader, payload.ID)
+	if p.hmacSecret != nil {
+		req.Header.Set(SignatureHeader, Sign(p.hmacSecret, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		klog.V(4).Infof("posted %s event %s to webhook %s", payload.Event, payload.ID, p.config.URL)
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	default:
+		return false, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+}
+
+// Sign returns the signature of the body in the form of "sha256=<hex>",
+// which is the HMAC-SHA256 of the body using the secret
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
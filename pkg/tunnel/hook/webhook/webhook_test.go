@@ -0,0 +1,243 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+func TestSign(t *testing.T) {
+	// the signature of the RFC 4231 test case 2
+	expected := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got := Sign([]byte("Jefe"), []byte("what do ya want for nothing?")); got != expected {
+		t.Errorf("expected signature %s, got %s", expected, got)
+	}
+	if Sign([]byte("a"), []byte("body")) == Sign([]byte("b"), []byte("body")) {
+		t.Error("expected the signatures of different secrets to differ")
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		// expected is the substring of the error
+		expected string
+	}{
+		{name: "no config", expected: "webhook is not configured"},
+		{name: "invalid json", config: `{"url": 1}`, expected: "failed to decode config"},
+		{name: "not https", config: `{"url": "http://hub.example.com"}`, expected: "is not https"},
+		{name: "cert without key", config: `{"url": "https://hub.example.com", "certFile": "tls.crt"}`,
+			expected: "certFile and keyFile must be set together"},
+		{name: "negative retries", config: `{"url": "https://hub.example.com", "retries": -1}`,
+			expected: "retries can't be negative"},
+		{name: "unknown failure policy", config: `{"url": "https://hub.example.com", "failurePolicy": "Retry"}`,
+			expected: "unknown failure policy Retry"},
+		{name: "unknown event", config: `{"url": "https://hub.example.com", "events": ["AgentConnected", "Connected"]}`,
+			expected: "unknown hook event Connected"},
+		{name: "missing hmac secret", config: `{"url": "https://hub.example.com", "hmacSecretFile": "/nonexistent"}`,
+			expected: "failed to read hmac secret"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var config []byte
+			if c.config != "" {
+				config = []byte(c.config)
+			}
+			_, err := NewProvider(config)
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("expected error containing %q, got %v", c.expected, err)
+			}
+		})
+	}
+
+	p, err := NewProvider([]byte(`{"url": "https://hub.example.com"}`))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	if p.config.FailurePolicy != FailurePolicyFail {
+		t.Errorf("expected failure policy %s, got %s", FailurePolicyFail, p.config.FailurePolicy)
+	}
+	if p.config.Timeout.Duration != defaultTimeout || p.config.RetryInitialDelay.Duration != defaultInitialDelay {
+		t.Errorf("unexpected defaults timeout %v and retry initial delay %v",
+			p.config.Timeout.Duration, p.config.RetryInitialDelay.Duration)
+	}
+}
+
+// recorder records the requests posted to the test server and answers
+// them with the statuses in order, the last one is repeated
+type recorder struct {
+	sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.Lock()
+	defer r.Unlock()
+	status := r.statuses[len(r.statuses)-1]
+	if len(r.requests) < len(r.statuses) {
+		status = r.statuses[len(r.requests)]
+	}
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	w.WriteHeader(status)
+	w.Write([]byte("status body"))
+}
+
+// newTestProvider creates the provider posting to a tls test server
+func newTestProvider(t *testing.T, config Config, statuses ...int) (*Provider, *recorder, func()) {
+	r := &recorder{statuses: statuses}
+	server := httptest.NewTLSServer(r)
+	config.URL = server.URL
+	if config.RetryInitialDelay == nil {
+		config.RetryInitialDelay = &metav1.Duration{Duration: 10 * time.Millisecond}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	p, err := NewProvider(data)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	p.client = server.Client()
+	return p, r, server.Close
+}
+
+func TestPost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "hmac-secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("failed to write hmac secret: %v", err)
+	}
+
+	p, r, stop := newTestProvider(t, Config{HMACSecretFile: secretFile}, http.StatusOK)
+	defer stop()
+	hc := &interfaces.HookContext{
+		Context:     context.Background(),
+		Component:   "excalibur-tunnel-server",
+		ClusterName: "cls-a",
+	}
+	if err := p.AgentConnected(hc); err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	if len(r.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(r.requests))
+	}
+
+	req, body := r.requests[0], r.bodies[0]
+	payload := &Payload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	if payload.APIVersion != APIVersion || payload.Kind != Kind || payload.Event != interfaces.AgentConnected ||
+		payload.Component != hc.Component || payload.ClusterName != hc.ClusterName || payload.ID == "" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+	if got := req.Header.Get(EventHeader); got != string(interfaces.AgentConnected) {
+		t.Errorf("expected event header %s, got %s", interfaces.AgentConnected, got)
+	}
+	if got := req.Header.Get(DeliveryHeader); got != payload.ID {
+		t.Errorf("expected delivery header %s, got %s", payload.ID, got)
+	}
+	// the trailing newline of the secret file is trimmed
+	if expected, got := Sign([]byte("secret"), body), req.Header.Get(SignatureHeader); got != expected {
+		t.Errorf("expected signature %s, got %s", expected, got)
+	}
+}
+
+func TestPostFailures(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   Config
+		statuses []int
+		// requests is the number of the attempts expected
+		requests int
+		// expected is the substring of the error, empty means no error
+		expected string
+	}{
+		{name: "retry server error", config: Config{Retries: 2},
+			statuses: []int{http.StatusInternalServerError, http.StatusOK}, requests: 2},
+		{name: "retry too many requests", config: Config{Retries: 1},
+			statuses: []int{http.StatusTooManyRequests, http.StatusNoContent}, requests: 2},
+		{name: "retries exhausted", config: Config{Retries: 2},
+			statuses: []int{http.StatusBadGateway}, requests: 3, expected: "unexpected status 502: status body"},
+		{name: "client error is not retried", config: Config{Retries: 2},
+			statuses: []int{http.StatusForbidden}, requests: 1, expected: "unexpected status 403"},
+		{name: "ignore failure", config: Config{Retries: 1, FailurePolicy: FailurePolicyIgnore},
+			statuses: []int{http.StatusServiceUnavailable}, requests: 2},
+		{name: "event not subscribed", config: Config{Events: []interfaces.HookEvent{interfaces.AgentDisconnected}},
+			statuses: []int{http.StatusInternalServerError}, requests: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, r, stop := newTestProvider(t, c.config, c.statuses...)
+			defer stop()
+			err := p.AgentConnected(&interfaces.HookContext{Context: context.Background()})
+			if c.expected == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if c.expected != "" && (err == nil || !strings.Contains(err.Error(), c.expected)) {
+				t.Errorf("expected error containing %q, got %v", c.expected, err)
+			}
+			if len(r.requests) != c.requests {
+				t.Errorf("expected %d requests, got %d", c.requests, len(r.requests))
+			}
+		})
+	}
+}
+
+func TestPostGivesUpRetryingOnCancel(t *testing.T) {
+	p, r, stop := newTestProvider(t, Config{Retries: 5,
+		RetryInitialDelay: &metav1.Duration{Duration: time.Minute}}, http.StatusInternalServerError)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := p.AgentConnected(&interfaces.HookContext{Context: ctx})
+	if err == nil || !strings.Contains(err.Error(), "give up retrying") {
+		t.Errorf("expected the cancelled post to give up retrying, got %v", err)
+	}
+	// the delay between the attempts is interrupted once the context is done
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the post to return once the context is done, got %v", elapsed)
+	}
+	if len(r.requests) != 1 {
+		t.Errorf("expected 1 request, got %d", len(r.requests))
+	}
+}
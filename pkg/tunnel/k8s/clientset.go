@@ -31,8 +31,6 @@ import (
 	"k8s.io/client-go/transport"
 	certutil "k8s.io/client-go/util/cert"
 	"k8s.io/klog/v2"
-
-	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
 )
 
 // CreateClientSet creates a clientset based on:
@@ -72,25 +70,25 @@ func CreateClientSetKubeConfig(kubeConfig string) (*kubernetes.Clientset, error)
 }
 
 // CreateClientSetApiserverAddr creates a clientset based on the given apiserverAddr.
-// The clientset uses the serviceaccount's CA and Token for authentication and
-// authorization
-func CreateClientSetApiserverAddr(apiserverAddr string) (*kubernetes.Clientset, error) {
+// The clientset uses the serviceaccount's CA and Token in the given files for
+// authentication and authorization
+func CreateClientSetApiserverAddr(apiserverAddr, tokenFile, caFile string) (*kubernetes.Clientset, error) {
 	if apiserverAddr == "" {
 		return nil, errors.New("apiserver addr can't be empty")
 	}
 
-	token, err := ioutil.ReadFile(constants.TunnelAgentTokenFile)
+	token, err := ioutil.ReadFile(tokenFile)
 	if err != nil {
 		return nil, err
 	}
 
 	tlsClientConfig := rest.TLSClientConfig{}
 
-	if _, err := certutil.NewPool(constants.TunnelAgentCAFile); err != nil {
+	if _, err := certutil.NewPool(caFile); err != nil {
 		klog.Errorf("Expected to load root CA config from %s, but got err: %v",
-			constants.TunnelAgentCAFile, err)
+			caFile, err)
 	} else {
-		tlsClientConfig.CAFile = constants.TunnelAgentCAFile
+		tlsClientConfig.CAFile = caFile
 
 	}
 
@@ -98,7 +96,7 @@ func CreateClientSetApiserverAddr(apiserverAddr string) (*kubernetes.Clientset,
 		Host:            "https://" + apiserverAddr,
 		TLSClientConfig: tlsClientConfig,
 		BearerToken:     string(token),
-		BearerTokenFile: constants.TunnelAgentTokenFile,
+		BearerTokenFile: tokenFile,
 	}
 
 	transportConfig, err := restConfig.TransportConfig()
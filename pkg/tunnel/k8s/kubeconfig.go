@@ -0,0 +1,119 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8s
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"sigs.k8s.io/yaml"
+)
+
+// the kubeconfig types are defined here, since the client-go in use
+// lacks the proxy-url field of the cluster
+
+// KubeConfig is the kubeconfig file
+type KubeConfig struct {
+	APIVersion     string              `json:"apiVersion"`
+	Kind           string              `json:"kind"`
+	Clusters       []NamedCluster      `json:"clusters"`
+	Users          []NamedAuthInfo     `json:"users"`
+	Contexts       []NamedContext      `json:"contexts"`
+	CurrentContext string              `json:"current-context"`
+	Preferences    map[string]struct{} `json:"preferences"`
+}
+
+// NamedCluster is the cluster of the kubeconfig
+type NamedCluster struct {
+	Name    string  `json:"name"`
+	Cluster Cluster `json:"cluster"`
+}
+
+// Cluster is the apiserver to access
+type Cluster struct {
+	Server                   string `json:"server"`
+	ProxyURL                 string `json:"proxy-url,omitempty"`
+	TLSServerName            string `json:"tls-server-name,omitempty"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify,omitempty"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data,omitempty"`
+}
+
+// NamedAuthInfo is the user of the kubeconfig
+type NamedAuthInfo struct {
+	Name     string   `json:"name"`
+	AuthInfo AuthInfo `json:"user"`
+}
+
+// AuthInfo is the credential to access the apiserver
+type AuthInfo struct {
+	Token                 string `json:"token,omitempty"`
+	ClientCertificateData []byte `json:"client-certificate-data,omitempty"`
+	ClientKeyData         []byte `json:"client-key-data,omitempty"`
+}
+
+// NamedContext is the context of the kubeconfig
+type NamedContext struct {
+	Name    string  `json:"name"`
+	Context Context `json:"context"`
+}
+
+// Context binds the cluster and the user
+type Context struct {
+	Cluster  string `json:"cluster"`
+	AuthInfo string `json:"user"`
+}
+
+// NewKubeConfig creates a kubeconfig of the single cluster, whose cluster,
+// user and context are all named after the cluster name
+func NewKubeConfig(clusterName string, cluster Cluster, authInfo AuthInfo) *KubeConfig {
+	return &KubeConfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		Clusters:       []NamedCluster{{Name: clusterName, Cluster: cluster}},
+		Users:          []NamedAuthInfo{{Name: clusterName, AuthInfo: authInfo}},
+		Contexts:       []NamedContext{{Name: clusterName, Context: Context{Cluster: clusterName, AuthInfo: clusterName}}},
+		CurrentContext: clusterName,
+		Preferences:    map[string]struct{}{},
+	}
+}
+
+// Marshal encodes the kubeconfig as yaml
+func (c *KubeConfig) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// ValidateProxyURL validates the proxy-url of a cluster, which client-go
+// supports with the http, https and socks5 schemes
+func ValidateProxyURL(proxyURL string) error {
+	if proxyURL == "" {
+		return errors.New("proxy url is required")
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url %q: %v", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("invalid proxy url %q: scheme must be http, https or socks5", proxyURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid proxy url %q: host is missing", proxyURL)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8s
+
+import (
+	"testing"
+)
+
+func TestValidateProxyURL(t *testing.T) {
+	tests := []struct {
+		proxyURL string
+		valid    bool
+	}{
+		{"http://127.0.0.1:8001", true},
+		{"https://proxy.example.com:443", true},
+		{"socks5://[::1]:1080", true},
+		{"", false},
+		{"ftp://proxy.example.com", false},
+		{"127.0.0.1:8001", false},
+		{"http://", false},
+		{"http://%zz", false},
+	}
+	for _, test := range tests {
+		err := ValidateProxyURL(test.proxyURL)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("ValidateProxyURL(%q) = %v, expect valid %v", test.proxyURL, err, test.valid)
+		}
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package certmanager
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -24,6 +25,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
@@ -38,12 +40,18 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// rotationCheckInterval is the interval of checking if the certificate
+// is rotated
+const rotationCheckInterval = 10 * time.Second
+
 // NewTunnelServerCertManager creates a certificate manager for
-// the tunnel-server
+// the tunnel-server, which stores the certificate in certDir
 func NewTunnelServerCertManager(
 	clientset kubernetes.Interface,
+	certDir,
 	clCertNames,
 	clIPs string,
+	serverCSRs *ServerCSRs,
 	stopCh <-chan struct{}) (certificate.Manager, error) {
 	// get server DNS names and IPs
 	var (
@@ -71,18 +79,20 @@ func NewTunnelServerCertManager(
 	return newCertManager(
 		clientset,
 		version.GetServerName(),
-		fmt.Sprintf(constants.TunnelServerCertDir, version.GetServerName()),
+		certDir,
 		constants.TunnelServerCSRCN,
 		[]string{constants.TunnelServerCSROrg, constants.TunnelCSROrg},
 		dnsNames,
-		ips)
+		ips,
+		serverCSRs)
 }
 
 // NewTunnelAgentCertManager creates a certificate manager for
-// the tunnel-agent
+// the tunnel-agent, which stores the certificate in certDir
 func NewTunnelAgentCertManager(
 	clientset kubernetes.Interface,
-	clusterName string) (certificate.Manager, error) {
+	clusterName,
+	certDir string) (certificate.Manager, error) {
 	podIP := os.Getenv(constants.TunnelAgentPodIPEnv)
 	if podIP == "" {
 		return nil, fmt.Errorf("env %s is not set",
@@ -91,15 +101,38 @@ func NewTunnelAgentCertManager(
 	return newCertManager(
 		clientset,
 		version.GetAgentName(),
-		fmt.Sprintf(constants.TunnelAgentCertDir, version.GetAgentName()),
+		certDir,
 		clusterName,
 		[]string{constants.TunnelCSROrg},
 		[]string{clusterName},
-		[]net.IP{net.ParseIP(podIP)})
+		[]net.IP{net.ParseIP(podIP)},
+		nil)
 }
 
-// NewCertManager creates a certificate manager that will generates a
-// certificate by sending a csr to the apiserver
+// WatchRotation polls the current certificate of the manager, and calls
+// onRotated with the new certificate once it is rotated, the first
+// certificate signed is not regarded as a rotation
+func WatchRotation(
+	m certificate.Manager,
+	onRotated func(cert *tls.Certificate),
+	stopCh <-chan struct{}) {
+	var last []byte
+	go wait.Until(func() {
+		cert := m.Current()
+		if cert == nil || len(cert.Certificate) == 0 {
+			return
+		}
+		current := cert.Certificate[0]
+		if last != nil && !bytes.Equal(last, current) {
+			onRotated(cert)
+		}
+		last = current
+	}, rotationCheckInterval, stopCh)
+}
+
+// newCertManager creates a certificate manager that will generates a
+// certificate by sending a csr to the apiserver, the requests are recorded
+// in serverCSRs unless it is nil
 func newCertManager(
 	clientset kubernetes.Interface,
 	componentName,
@@ -107,7 +140,8 @@ func newCertManager(
 	commonName string,
 	organizations,
 	dnsNames []string,
-	ipAddrs []net.IP) (certificate.Manager, error) {
+	ipAddrs []net.IP,
+	serverCSRs *ServerCSRs) (certificate.Manager, error) {
 	certificateStore, err :=
 		certificate.NewFileStore(componentName, certDir, certDir, "", "")
 	if err != nil {
@@ -127,7 +161,11 @@ func newCertManager(
 
 	certManager, err := certificate.NewManager(&certificate.Config{
 		ClientFn: func(current *tls.Certificate) (clicert.CertificateSigningRequestInterface, error) {
-			return clientset.CertificatesV1beta1().CertificateSigningRequests(), nil
+			client := clientset.CertificatesV1beta1().CertificateSigningRequests()
+			if serverCSRs != nil {
+				return &recordingCSRClient{CertificateSigningRequestInterface: client, serverCSRs: serverCSRs}, nil
+			}
+			return client, nil
 		},
 		GetTemplate: getTemplate,
 		Usages: []certificates.KeyUsage{
@@ -141,3 +179,42 @@ func newCertManager(
 
 	return certManager, nil
 }
+
+// ServerCSRs records the certificate requests of the tunnel server, so
+// that the approver only approves the system:masters certificates that
+// the server requests by itself
+type ServerCSRs struct {
+	mu       sync.Mutex
+	requests map[string]bool
+}
+
+// NewServerCSRs creates an empty ServerCSRs
+func NewServerCSRs() *ServerCSRs {
+	return &ServerCSRs{requests: make(map[string]bool)}
+}
+
+func (s *ServerCSRs) add(request []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[string(request)] = true
+}
+
+// Has checks if the PEM encoded request is requested by the server
+func (s *ServerCSRs) Has(request []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[string(request)]
+}
+
+// recordingCSRClient records the requests before creating the csrs, so
+// that they are known once the approver sees the csrs
+type recordingCSRClient struct {
+	clicert.CertificateSigningRequestInterface
+	serverCSRs *ServerCSRs
+}
+
+func (c *recordingCSRClient) Create(
+	csr *certificates.CertificateSigningRequest) (*certificates.CertificateSigningRequest, error) {
+	c.serverCSRs.add(csr.Spec.Request)
+	return c.CertificateSigningRequestInterface.Create(csr)
+}
@@ -20,11 +20,14 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	certificates "k8s.io/api/certificates/v1beta1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	certv1beta1 "k8s.io/client-go/informers/certificates/v1beta1"
 	"k8s.io/client-go/kubernetes"
@@ -37,12 +40,19 @@ import (
 	"github.com/tkestack/tke-excalibur/pkg/version"
 )
 
-// TunnelCSRApprover is the controller that auto approve all
-// tunnel related CSR
+// TunnelCSRApprover is the controller that auto approve the tunnel
+// related CSRs, i.e. the ones of the agents and of the server itself, and
+// denies the others requesting the excalibur:tunnel organization
 type TunnelCSRApprover struct {
 	csrInformer certv1beta1.CertificateSigningRequestInformer
 	csrClient   typev1beta1.CertificateSigningRequestInterface
 	workqueue   workqueue.RateLimitingInterface
+	// serverCSRs are the requests of the server, which are the only
+	// system:masters ones approved
+	serverCSRs *ServerCSRs
+	// bindAgentIdentity only approves the agent CSRs requested by the
+	// identity of the cluster, see AgentIdentity
+	bindAgentIdentity bool
 }
 
 // Run starts the TunnelCSRApprover
@@ -90,7 +100,7 @@ func (eca *TunnelCSRApprover) processNextItem() bool {
 		return true
 	}
 
-	if err := approveTunnelCSR(csr, eca.csrClient); err != nil {
+	if err := eca.approveTunnelCSR(csr); err != nil {
 		runtime.HandleError(err)
 		enqueueObj(eca.workqueue, csr)
 		return true
@@ -108,10 +118,14 @@ func enqueueObj(wq workqueue.RateLimitingInterface, obj interface{}) {
 	wq.AddRateLimited(key)
 }
 
-// NewCSRApprover creates a new TunnelCSRApprover
+// NewCSRApprover creates a new TunnelCSRApprover, which approves the
+// server CSRs recorded in serverCSRs, and the agent CSRs requested by the
+// identities of their clusters if bindAgentIdentity is set
 func NewCSRApprover(
 	clientset kubernetes.Interface,
-	csrInformer certv1beta1.CertificateSigningRequestInformer) *TunnelCSRApprover {
+	csrInformer certv1beta1.CertificateSigningRequestInformer,
+	serverCSRs *ServerCSRs,
+	bindAgentIdentity bool) *TunnelCSRApprover {
 
 	wq := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
 	csrInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -123,23 +137,24 @@ func NewCSRApprover(
 		},
 	})
 	return &TunnelCSRApprover{
-		csrInformer: csrInformer,
-		csrClient:   clientset.CertificatesV1beta1().CertificateSigningRequests(),
-		workqueue:   wq,
+		csrInformer:       csrInformer,
+		csrClient:         clientset.CertificatesV1beta1().CertificateSigningRequests(),
+		workqueue:         wq,
+		serverCSRs:        serverCSRs,
+		bindAgentIdentity: bindAgentIdentity,
 	}
 }
 
 // approveTunnelCSR checks the csr status, if it is neither approved nor
-// denied, it will try to approve the csr.
-func approveTunnelCSR(
-	obj interface{},
-	csrClient typev1beta1.CertificateSigningRequestInterface) error {
+// denied, it will try to approve or deny the csr.
+func (eca *TunnelCSRApprover) approveTunnelCSR(obj interface{}) error {
 	csr, ok := obj.(*certificates.CertificateSigningRequest)
 	if !ok {
 		return nil
 	}
 
-	if !isExcaliburtunelCSR(csr) {
+	x509cr := parseExcaliburtunelCSR(csr)
+	if x509cr == nil {
 		klog.Infof("csr(%s) is not %s csr", csr.GetName(), version.GetTunnelName())
 		return nil
 	}
@@ -155,44 +170,96 @@ func approveTunnelCSR(
 		return nil
 	}
 
-	// approve the tunnel related csr
-	csr.Status.Conditions = append(csr.Status.Conditions,
-		certificates.CertificateSigningRequestCondition{
-			Type:    certificates.CertificateApproved,
-			Reason:  "AutoApproved",
-			Message: fmt.Sprintf("self-approving %s csr", version.GetTunnelName()),
-		})
+	approve, reason := eca.reviewTunnelCSR(csr, x509cr)
+	if !approve && reason == "" {
+		return nil
+	}
+	condition := certificates.CertificateSigningRequestCondition{
+		Type:    certificates.CertificateApproved,
+		Reason:  "AutoApproved",
+		Message: fmt.Sprintf("self-approving %s csr", version.GetTunnelName()),
+	}
+	if !approve {
+		condition = certificates.CertificateSigningRequestCondition{
+			Type:    certificates.CertificateDenied,
+			Reason:  "AutoDenied",
+			Message: reason,
+		}
+	}
+	csr.Status.Conditions = append(csr.Status.Conditions, condition)
 
-	result, err := csrClient.UpdateApproval(csr)
+	result, err := eca.csrClient.UpdateApproval(csr)
 	if err != nil {
-		klog.Errorf("failed to approve %s csr(%s), %v", version.GetTunnelName(), csr.GetName(), err)
+		klog.Errorf("failed to review %s csr(%s), %v", version.GetTunnelName(), csr.GetName(), err)
 		return err
 	}
+	if !approve {
+		klog.Warningf("deny %s csr(%s): %s", version.GetTunnelName(), result.Name, reason)
+		return nil
+	}
 	klog.Infof("successfully approve %s csr(%s)", version.GetTunnelName(), result.Name)
 	return nil
 }
 
-// isExcaliburtunelCSR checks if given csr is a tunnel related csr, i.e.,
-// the organizations' list contains "excalibur:tunnel"
-func isExcaliburtunelCSR(csr *certificates.CertificateSigningRequest) bool {
+// reviewTunnelCSR decides whether to approve the tunnel csr, the reason
+// is set if it is denied, and the csr is left pending if neither, e.g.
+// the server csr of another server replica
+func (eca *TunnelCSRApprover) reviewTunnelCSR(
+	csr *certificates.CertificateSigningRequest,
+	x509cr *x509.CertificateRequest) (approve bool, reason string) {
+	orgs := sets.NewString(x509cr.Subject.Organization...)
+	commonName := x509cr.Subject.CommonName
+	switch {
+	case orgs.Equal(sets.NewString(constants.TunnelCSROrg)):
+		// the certificate of an agent authenticates to the hub apiserver
+		// as well, so it must not be a system user
+		if commonName == "" || commonName == constants.TunnelServerCSRCN ||
+			strings.HasPrefix(commonName, "system:") {
+			return false, fmt.Sprintf("common name %q is not allowed", commonName)
+		}
+		if eca.bindAgentIdentity && csr.Spec.Username != AgentIdentity(commonName) {
+			return false, fmt.Sprintf("common name %q is not requested by %s but %q",
+				commonName, AgentIdentity(commonName), csr.Spec.Username)
+		}
+		return true, ""
+	case orgs.Equal(sets.NewString(constants.TunnelServerCSROrg, constants.TunnelCSROrg)) &&
+		commonName == constants.TunnelServerCSRCN:
+		if eca.serverCSRs != nil && eca.serverCSRs.Has(csr.Spec.Request) {
+			return true, ""
+		}
+		klog.V(4).Infof("csr(%s) is not requested by this server", csr.GetName())
+		return false, ""
+	default:
+		return false, fmt.Sprintf("organizations %v are not allowed", orgs.List())
+	}
+}
+
+// AgentIdentity is the service account that requests the certificate of
+// the agent of the cluster if the identities of the agents are bound
+func AgentIdentity(clusterName string) string {
+	return fmt.Sprintf("system:serviceaccount:%s:%s%s", os.Getenv(constants.TunnelServerNSEnv),
+		constants.TunnelAgentIdentityPrefix, clusterName)
+}
+
+// parseExcaliburtunelCSR parses the given csr if it is a tunnel related
+// csr, i.e., the organizations' list contains "excalibur:tunnel", it
+// returns nil otherwise
+func parseExcaliburtunelCSR(csr *certificates.CertificateSigningRequest) *x509.CertificateRequest {
 	pemBytes := csr.Spec.Request
 	block, _ := pem.Decode(pemBytes)
 	if block == nil || block.Type != "CERTIFICATE REQUEST" {
-		return false
+		return nil
 	}
 	x509cr, err := x509.ParseCertificateRequest(block.Bytes)
 	if err != nil {
-		return false
+		return nil
 	}
-	for i, org := range x509cr.Subject.Organization {
+	for _, org := range x509cr.Subject.Organization {
 		if org == constants.TunnelCSROrg {
-			break
-		}
-		if i == len(x509cr.Subject.Organization)-1 {
-			return false
+			return x509cr
 		}
 	}
-	return true
+	return nil
 }
 
 // checkCertApprovalCondition checks if the given csr's status is
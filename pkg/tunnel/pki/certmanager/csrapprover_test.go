@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	certificates "k8s.io/api/certificates/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+)
+
+func newTestCSR(t *testing.T, name, commonName string, orgs ...string) *certificates.CertificateSigningRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName, Organization: orgs},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certificates.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: certificates.CertificateSigningRequestSpec{
+			Request: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+		},
+	}
+}
+
+func TestApproveTunnelCSR(t *testing.T) {
+	const (
+		approved = "Approved"
+		denied   = "Denied"
+		pending  = "Pending"
+	)
+	serverCSRs := NewServerCSRs()
+	ownServerCSR := newTestCSR(t, "own-server", constants.TunnelServerCSRCN,
+		constants.TunnelServerCSROrg, constants.TunnelCSROrg)
+	serverCSRs.add(ownServerCSR.Spec.Request)
+
+	tests := []struct {
+		csr    *certificates.CertificateSigningRequest
+		expect string
+	}{
+		{newTestCSR(t, "agent", "cls-a", constants.TunnelCSROrg), approved},
+		{ownServerCSR, approved},
+		// the server csrs of the other replicas are left to them
+		{newTestCSR(t, "other-server", constants.TunnelServerCSRCN,
+			constants.TunnelServerCSROrg, constants.TunnelCSROrg), pending},
+		{newTestCSR(t, "agent-masters", "cls-a", constants.TunnelServerCSROrg, constants.TunnelCSROrg), denied},
+		{newTestCSR(t, "agent-extra-org", "cls-a", constants.TunnelCSROrg, "system:nodes"), denied},
+		{newTestCSR(t, "agent-server-cn", constants.TunnelServerCSRCN, constants.TunnelCSROrg), denied},
+		{newTestCSR(t, "agent-system-user", "system:kube-controller-manager", constants.TunnelCSROrg), denied},
+		{newTestCSR(t, "agent-empty-cn", "", constants.TunnelCSROrg), denied},
+		// the csrs of the other signers are not touched
+		{newTestCSR(t, "kubelet", "system:node:n1", "system:nodes"), pending},
+		{newTestCSR(t, "no-org", "cls-a"), pending},
+	}
+	for _, test := range tests {
+		t.Run(test.csr.Name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.csr)
+			eca := &TunnelCSRApprover{
+				csrClient:  client.CertificatesV1beta1().CertificateSigningRequests(),
+				serverCSRs: serverCSRs,
+			}
+			if err := eca.approveTunnelCSR(test.csr.DeepCopy()); err != nil {
+				t.Fatal(err)
+			}
+			csr, err := eca.csrClient.Get(test.csr.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := pending
+			if isApproved, isDenied := checkCertApprovalCondition(&csr.Status); isApproved {
+				got = approved
+			} else if isDenied {
+				got = denied
+			}
+			if got != test.expect {
+				t.Errorf("expect csr %s %s, got %s", test.csr.Name, test.expect, got)
+			}
+		})
+	}
+}
+
+func TestApproveBoundAgentCSR(t *testing.T) {
+	os.Setenv(constants.TunnelServerNSEnv, "tkestack")
+	defer os.Unsetenv(constants.TunnelServerNSEnv)
+
+	tests := []struct {
+		name     string
+		username string
+		approve  bool
+	}{
+		{"own identity", "system:serviceaccount:tkestack:excalibur-agent-cls-a", true},
+		{"identity of another cluster", "system:serviceaccount:tkestack:excalibur-agent-cls-b", false},
+		{"identity in another namespace", "system:serviceaccount:default:excalibur-agent-cls-a", false},
+		{"shared agent identity", "system:serviceaccount:tkestack:excalibur-tunnel-agent-sa", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csr := newTestCSR(t, "agent", "cls-a", constants.TunnelCSROrg)
+			csr.Spec.Username = test.username
+			client := fake.NewSimpleClientset(csr)
+			eca := &TunnelCSRApprover{
+				csrClient:         client.CertificatesV1beta1().CertificateSigningRequests(),
+				bindAgentIdentity: true,
+			}
+			if err := eca.approveTunnelCSR(csr.DeepCopy()); err != nil {
+				t.Fatal(err)
+			}
+			csr, err := eca.csrClient.Get(csr.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			approved, denied := checkCertApprovalCondition(&csr.Status)
+			if approved != test.approve || denied == test.approve {
+				t.Errorf("expect approved %v, got approved %v and denied %v", test.approve, approved, denied)
+			}
+		})
+	}
+}
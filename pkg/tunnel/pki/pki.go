@@ -17,6 +17,7 @@ limitations under the License.
 package pki
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -24,6 +25,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/certificate"
@@ -66,6 +68,18 @@ func GenTLSConfigUseCertMgrAndCertPool(
 // GenRootCertPool generates a x509 CertPool based on the given kubeconfig,
 // if the kubeConfig is empty, it will creates the CertPool using the CA file
 func GenRootCertPool(kubeConfig, caFile string) (*x509.CertPool, error) {
+	caData, err := GenRootCAData(kubeConfig, caFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCertPool := x509.NewCertPool()
+	rootCertPool.AppendCertsFromPEM(caData)
+	return rootCertPool, nil
+}
+
+// GenRootCAData gets the PEM encoded root CA of the given kubeconfig, or the
+// CA file if the kubeConfig is empty
+func GenRootCAData(kubeConfig, caFile string) ([]byte, error) {
 	if kubeConfig != "" {
 		// kubeconfig is given, generate the clientset based on it
 		if _, err := os.Stat(kubeConfig); os.IsNotExist(err) {
@@ -101,13 +115,11 @@ func GenRootCertPool(kubeConfig, caFile string) (*x509.CertPool, error) {
 				ctx.Cluster, kubeConfig)
 		}
 
-		rootCertPool := x509.NewCertPool()
-		rootCertPool.AppendCertsFromPEM(cluster.CertificateAuthorityData)
-		return rootCertPool, nil
+		return cluster.CertificateAuthorityData, nil
 	}
 
-	// kubeConfig is missing, generate the cluster root ca based on the given ca file
-	return GenCertPoolUseCA(caFile)
+	// kubeConfig is missing, read the cluster root ca from the given ca file
+	return readCAFile(caFile)
 }
 
 // GenTGenTLSConfigUseCertMgrAndCA generates a TLS configuration based on the
@@ -119,7 +131,26 @@ func GenTLSConfigUseCertMgrAndCA(
 	if err != nil {
 		return nil, err
 	}
+	return genTLSConfigUseCertMgrAndCertPool(m, serverAddr, root)
+}
 
+// GenTLSConfigUseCertMgrAndCAData generates a TLS configuration based on
+// the given certificate manager and the PEM encoded CA data
+func GenTLSConfigUseCertMgrAndCAData(
+	m certificate.Manager,
+	serverAddr string, caData []byte) (*tls.Config, error) {
+	root := x509.NewCertPool()
+	if !root.AppendCertsFromPEM(caData) {
+		return nil, errors.New("no certificate is found in the CA data")
+	}
+	return genTLSConfigUseCertMgrAndCertPool(m, serverAddr, root)
+}
+
+// genTLSConfigUseCertMgrAndCertPool generates a TLS configuration which
+// verifies the server of the address by the cert pool
+func genTLSConfigUseCertMgrAndCertPool(
+	m certificate.Manager,
+	serverAddr string, root *x509.CertPool) (*tls.Config, error) {
 	host, _, err := net.SplitHostPort(serverAddr)
 	if err != nil {
 		return nil, err
@@ -156,6 +187,18 @@ func GenTLSConfigUseCertMgrAndCA(
 
 // GenCertPoolUseCA generates a x509 CertPool based on the given CA file
 func GenCertPoolUseCA(caFile string) (*x509.CertPool, error) {
+	caData, err := readCAFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(caData)
+	return certPool, nil
+}
+
+// readCAFile reads the PEM encoded CA file
+func readCAFile(caFile string) ([]byte, error) {
 	if caFile == "" {
 		return nil, errors.New("CA file is not set")
 	}
@@ -167,12 +210,20 @@ func GenCertPoolUseCA(caFile string) (*x509.CertPool, error) {
 		return nil, fmt.Errorf("fail to stat the CA file(%s): %s", caFile, err)
 	}
 
-	caData, err := ioutil.ReadFile(caFile)
-	if err != nil {
-		return nil, err
-	}
+	return ioutil.ReadFile(caFile)
+}
 
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(caData)
-	return certPool, nil
+// CertificateFingerprint returns the SHA-256 fingerprint of the leaf
+// certificate in the form of "sha256:ab:cd:...", or empty string if the
+// certificate is absent
+func CertificateFingerprint(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	hexes := make([]string, 0, len(sum))
+	for _, b := range sum {
+		hexes = append(hexes, fmt.Sprintf("%02x", b))
+	}
+	return "sha256:" + strings.Join(hexes, ":")
 }
@@ -0,0 +1,275 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/admin"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+)
+
+// agentTracker tracks the connections of the agents for the admin API
+type agentTracker struct {
+	mu    sync.Mutex
+	conns map[*agentConn]struct{}
+}
+
+// agentConn is a connection of an agent
+type agentConn struct {
+	info admin.Agent
+	// kick force-disconnects the connection once it is closed
+	kick     chan struct{}
+	kickOnce sync.Once
+
+	// bytesIn and bytesOut are updated atomically
+	bytesIn  int64
+	bytesOut int64
+
+	mu sync.Mutex
+	// streams are the connect IDs of the tunneled connections in use
+	streams map[int64]struct{}
+}
+
+func newAgentTracker() *agentTracker {
+	return &agentTracker{conns: make(map[*agentConn]struct{})}
+}
+
+// StreamServerInterceptor returns a grpc interceptor of the agent server
+// which tracks the agents, and closes the stream once the agent is
+// force-disconnected
+func (t *agentTracker) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		conn := &agentConn{
+			info: admin.Agent{
+				ID:             getStreamAgentID(ss),
+				Identifiers:    getStreamMetadata(ss, header.AgentIdentifiers),
+				Version:        getStreamMetadata(ss, constants.TunnelAgentVersionHeader),
+				RemoteAddr:     getStreamPeerAddr(ss),
+				CommonName:     getStreamPeerCommonName(ss),
+				ConnectedSince: time.Now(),
+			},
+			kick:    make(chan struct{}),
+			streams: make(map[int64]struct{}),
+		}
+		t.mu.Lock()
+		t.conns[conn] = struct{}{}
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+
+		// the stream is closed once the handler returns, which stops the
+		// proxy server serving the agent
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- handler(srv, &trackedServerStream{ServerStream: ss, conn: conn})
+		}()
+		select {
+		case err := <-errCh:
+			return err
+		case <-conn.kick:
+			klog.Infof("agent %s from %s is force-disconnected", conn.info.ID, conn.info.RemoteAddr)
+			return status.Errorf(codes.Aborted, "agent %s is force-disconnected by the admin", conn.info.ID)
+		}
+	}
+}
+
+// List returns the connections of the agents sorted by agent ID
+func (t *agentTracker) List() []admin.Agent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	agents := make([]admin.Agent, 0, len(t.conns))
+	for conn := range t.conns {
+		agent := conn.info
+		agent.BytesIn = atomic.LoadInt64(&conn.bytesIn)
+		agent.BytesOut = atomic.LoadInt64(&conn.bytesOut)
+		conn.mu.Lock()
+		agent.ActiveStreams = len(conn.streams)
+		conn.mu.Unlock()
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].ID != agents[j].ID {
+			return agents[i].ID < agents[j].ID
+		}
+		return agents[i].ConnectedSince.Before(agents[j].ConnectedSince)
+	})
+	return agents
+}
+
+// Disconnect force-disconnects all of the connections of the agent, it
+// returns the number of the disconnected connections
+func (t *agentTracker) Disconnect(agentID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for conn := range t.conns {
+		if conn.info.ID == agentID {
+			conn.kickOnce.Do(func() { close(conn.kick) })
+			count++
+		}
+	}
+	return count
+}
+
+// trackedServerStream counts the tunneled connections and the bytes
+// between the server and agent
+type trackedServerStream struct {
+	grpc.ServerStream
+	conn *agentConn
+}
+
+func (s *trackedServerStream) SendMsg(m interface{}) error {
+	if pkt, ok := m.(*client.Packet); ok && pkt.Type == client.PacketType_DATA {
+		atomic.AddInt64(&s.conn.bytesOut, int64(len(pkt.GetData().Data)))
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *trackedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	pkt, ok := m.(*client.Packet)
+	if !ok {
+		return nil
+	}
+	switch pkt.Type {
+	case client.PacketType_DATA:
+		atomic.AddInt64(&s.conn.bytesIn, int64(len(pkt.GetData().Data)))
+	case client.PacketType_DIAL_RSP:
+		if resp := pkt.GetDialResponse(); resp.Error == "" {
+			s.conn.mu.Lock()
+			s.conn.streams[resp.ConnectID] = struct{}{}
+			s.conn.mu.Unlock()
+		}
+	case client.PacketType_CLOSE_RSP:
+		s.conn.mu.Lock()
+		delete(s.conn.streams, pkt.GetCloseResponse().ConnectID)
+		s.conn.mu.Unlock()
+	}
+	return nil
+}
+
+// adminServer serves the admin API over mTLS, only the clients whose
+// certificates are signed by the cluster CA and belong to the
+// system:masters group are allowed
+type adminServer struct {
+	addresses []string
+	tlsCfg    *tls.Config
+	tracker   *agentTracker
+}
+
+// newAdminServer creates an adminServer, the client certificates are
+// verified by the root CAs of the given tls config
+func newAdminServer(addresses []string, tlsCfg *tls.Config, tracker *agentTracker) *adminServer {
+	tlsClone := tlsCfg.Clone()
+	tlsClone.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsClone.ClientCAs = tlsCfg.RootCAs
+	return &adminServer{
+		addresses: addresses,
+		tlsCfg:    tlsClone,
+		tracker:   tracker,
+	}
+}
+
+// Run starts serving the admin API in the background until stopCh is
+// closed
+func (s *adminServer) Run(stopCh <-chan struct{}) error {
+	r := mux.NewRouter()
+	r.HandleFunc(admin.AgentsPath, s.listAgents).Methods(http.MethodGet)
+	r.HandleFunc(admin.AgentsPath+"/{id}", s.disconnectAgent).Methods(http.MethodDelete)
+
+	listeners, err := listen(s.addresses)
+	if err != nil {
+		return err
+	}
+	serve(&http.Server{
+		Handler:   authorizeAdmin(r),
+		TLSConfig: s.tlsCfg,
+	}, listeners, true, stopCh)
+	klog.Infof("start handling admin api requests at %s", strings.Join(s.addresses, ","))
+	return nil
+}
+
+func (s *adminServer) listAgents(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+	writeJSON(w, http.StatusOK, &admin.AgentList{
+		Server: hostname,
+		Items:  s.tracker.List(),
+	})
+}
+
+func (s *adminServer) disconnectAgent(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if s.tracker.Disconnect(id) == 0 {
+		http.Error(w, fmt.Sprintf("agent %s is not connected", id), http.StatusNotFound)
+		return
+	}
+	klog.Infof("agent %s is force-disconnected by %s", id, getPeerCommonName(r))
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// authorizeAdmin only allows the clients in the system:masters group
+func authorizeAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !isMaster(r.TLS.PeerCertificates[0]) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isMaster(cert *x509.Certificate) bool {
+	for _, org := range cert.Subject.Organization {
+		if org == constants.TunnelServerCSROrg {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("failed to write admin api response: %v", err)
+	}
+}
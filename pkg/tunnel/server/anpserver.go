@@ -23,11 +23,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
@@ -43,19 +44,23 @@ var udsListenerLock sync.Mutex
 // anpTunnelServer implements the TunnelServer interface using the
 // apiserver-network-proxy package
 type anpTunnelServer struct {
-	serverMasterAddr         string
-	serverMasterInsecureAddr string
-	serverAgentAddr          string
-	serverCount              int
-	tlsCfg                   *tls.Config
-	proxyStrategy            string
-	udsName                  string
+	serverMasterAddrs         []string
+	serverMasterInsecureAddrs []string
+	serverAgentAddrs          []string
+	serverCount               int
+	tlsCfg                    *tls.Config
+	proxyStrategy             string
+	udsName                   string
+	keepAliveTime             time.Duration
+	keepAliveTimeout          time.Duration
+	auditLogger               *audit.Logger
+	interceptors              []grpc.StreamServerInterceptor
 }
 
 var _ TunnelServer = &anpTunnelServer{}
 
-// Run runs the tunnel-server
-func (ats *anpTunnelServer) Run() error {
+// Run runs the tunnel-server until stopCh is closed
+func (ats *anpTunnelServer) Run(stopCh <-chan struct{}) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	var masterServerErr error
 	defer cancel()
@@ -64,26 +69,39 @@ func (ats *anpTunnelServer) Run() error {
 		[]anpserver.ProxyStrategy{anpserver.ProxyStrategy(ats.proxyStrategy)},
 		ats.serverCount,
 		&anpserver.AgentTokenAuthenticationOptions{})
+	auditor := newConnectionAuditor(ats.auditLogger)
 
 	// 2. start the master server
 	if ats.udsName != "" {
 		masterServerErr = runUDSMasterServer(
 			ctx,
-			proxyServer,
+			auditor.WrapTunnel(&anpserver.Tunnel{Server: proxyServer}, ats.udsName),
 			ats.udsName,
+			stopCh,
 		)
 	} else {
 		masterServerErr = runMTLSMasterServer(
-			ats.serverMasterAddr,
-			ats.serverMasterInsecureAddr,
+			ats.serverMasterAddrs,
+			ats.serverMasterInsecureAddrs,
 			ats.tlsCfg,
-			proxyServer)
+			auditor.WrapTunnel(&anpserver.Tunnel{Server: proxyServer}, ""),
+			stopCh)
 	}
 	if masterServerErr != nil {
 		return fmt.Errorf("fail to run master server: %s", masterServerErr)
 	}
 	// 3. start the agent server
-	agentServerErr := runAgentServer(ats.tlsCfg, ats.serverAgentAddr, proxyServer)
+	ka := keepalive.ServerParameters{
+		// Ping the client if it is idle for `Time` to ensure the
+		// connection is still active
+		Time: ats.keepAliveTime,
+		// Wait `Timeout` for the ping ack before assuming the
+		// connection is dead
+		Timeout: ats.keepAliveTimeout,
+	}
+	agentServerErr := runAgentServer(ats.tlsCfg, ats.serverAgentAddrs, ka, proxyServer, stopCh,
+		grpc.ChainStreamInterceptor(append([]grpc.StreamServerInterceptor{
+			auditor.StreamServerInterceptor()}, ats.interceptors...)...))
 	if agentServerErr != nil {
 		return fmt.Errorf("fail to run agent server: %s", agentServerErr)
 	}
@@ -91,67 +109,69 @@ func (ats *anpTunnelServer) Run() error {
 	return nil
 }
 
-// runMTLSMasterServer runs an https server to handle requests from apiserver
+// runMTLSMasterServer runs an https server to handle requests from apiserver,
+// and an http one on the insecure addresses, either of them is disabled if
+// it has no address
 func runMTLSMasterServer(
-	masterServerAddr string,
-	masterServerInsecureAddr string,
+	masterServerAddrs []string,
+	masterServerInsecureAddrs []string,
 	tlsCfg *tls.Config,
-	s *anpserver.ProxyServer) error {
-	go func() {
-		klog.Infof("start handling https request from master at %s", masterServerAddr)
-		server := &http.Server{
-			Addr:      masterServerAddr,
-			TLSConfig: tlsCfg,
-			Handler: &anpserver.Tunnel{
-				Server: s,
-			},
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		}
-		if err := server.ListenAndServeTLS("", ""); err != nil {
-			klog.Errorf("failed to serve https request from master: %v", err)
+	handler http.Handler,
+	stopCh <-chan struct{}) error {
+	listeners, err := listen(masterServerAddrs)
+	if err != nil {
+		return err
+	}
+	insecureListeners, err := listen(masterServerInsecureAddrs)
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
 		}
-	}()
-	go func() {
-		klog.Infof("start handling http request from master at %s", masterServerInsecureAddr)
-		server := &http.Server{
-			Addr:      masterServerInsecureAddr,
-			TLSConfig: tlsCfg,
-			Handler: &anpserver.Tunnel{
-				Server: s,
-			},
+		return err
+	}
+	if len(listeners) > 0 {
+		klog.Infof("start handling https request from master at %s", strings.Join(masterServerAddrs, ","))
+		serve(&http.Server{
+			TLSConfig:    tlsCfg,
+			Handler:      handler,
 			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		}
-		if err := server.ListenAndServe(); err != nil {
-			klog.Errorf("failed to serve http request from master: %v", err)
-		}
-	}()
+		}, listeners, true, stopCh)
+	}
+	if len(insecureListeners) > 0 {
+		klog.Infof("start handling http request from master at %s", strings.Join(masterServerInsecureAddrs, ","))
+		serve(&http.Server{
+			Handler:      handler,
+			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		}, insecureListeners, false, stopCh)
+	}
 	return nil
 }
 
 func runUDSMasterServer(
 	ctx context.Context,
-	s *anpserver.ProxyServer,
-	udsName string) error {
+	handler http.Handler,
+	udsName string,
+	stopCh <-chan struct{}) error {
 	if err := os.Remove(udsName); err != nil && !os.IsNotExist(err) {
 		klog.ErrorS(err, "failed to delete file", "file", udsName)
 	}
 
 	go func() {
 		server := &http.Server{
-			Handler: &anpserver.Tunnel{
-				Server: s,
-			},
+			Handler:     handler,
 			ReadTimeout: 10 * time.Second,
 		}
 		udsListener, err := getUDSListener(ctx, udsName)
 		if err != nil {
 			klog.ErrorS(err, "failed to get uds listener")
+			return
 		}
 		defer func() {
 			udsListener.Close()
 		}()
+		closeOnStop(server, stopCh)
 		err = server.Serve(udsListener)
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			klog.ErrorS(err, "failed to serve uds requests")
 		}
 
@@ -165,29 +185,29 @@ func runUDSMasterServer(
 // and tunnel-agent, and the proxy server is responsible for redirecting requests
 // to corresponding tunnel-agent
 func runAgentServer(tlsCfg *tls.Config,
-	agentServerAddr string,
-	proxyServer *anpserver.ProxyServer) error {
+	agentServerAddrs []string,
+	ka keepalive.ServerParameters,
+	proxyServer *anpserver.ProxyServer,
+	stopCh <-chan struct{},
+	opts ...grpc.ServerOption) error {
 	serverOption := grpc.Creds(credentials.NewTLS(tlsCfg))
 
-	ka := keepalive.ServerParameters{
-		// Ping the client if it is idle for `Time` seconds to ensure the
-		// connection is still active
-		Time: constants.TunnelANPGrpcKeepAliveTimeSec * time.Second,
-		// Wait `Timeout` second for the ping ack before assuming the
-		// connection is dead
-		Timeout: constants.TunnelANPGrpcKeepAliveTimeoutSec * time.Second,
-	}
-
-	grpcServer := grpc.NewServer(serverOption,
-		grpc.KeepaliveParams(ka))
+	grpcServer := grpc.NewServer(append([]grpc.ServerOption{serverOption,
+		grpc.KeepaliveParams(ka)}, opts...)...)
 
 	anpagent.RegisterAgentServiceServer(grpcServer, proxyServer)
-	listener, err := net.Listen("tcp", agentServerAddr)
-	klog.Info("start handling connection from agents")
+	listeners, err := listen(agentServerAddrs)
 	if err != nil {
-		return fmt.Errorf("fail to listen to agent on %s: %s", agentServerAddr, err)
+		return err
 	}
-	go grpcServer.Serve(listener)
+	klog.Infof("start handling connection from agents at %s", strings.Join(agentServerAddrs, ","))
+	for _, l := range listeners {
+		go grpcServer.Serve(l)
+	}
+	go func() {
+		<-stopCh
+		grpcServer.Stop()
+	}()
 	return nil
 }
 
@@ -0,0 +1,431 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
+)
+
+const (
+	closeReasonClient = "closed by client"
+	closeReasonAgent  = "closed by agent"
+	closeReasonNoDial = "no tunnel available"
+)
+
+// connectionAuditor records the tunneled connections into the audit log.
+// The HTTP-CONNECT requests are observed by the tunnel handler wrapper, and
+// the agent serving the request is observed by the grpc interceptor of the
+// agent server. The tunnel handler hijacks the connection and then sends
+// the dial request to the agent in the same goroutine, so the connections
+// to the same destination are serialized from the hijacking to sending
+// the dial request, which correlates each dial request to exactly one
+// connection by the destination address.
+type connectionAuditor struct {
+	logger *audit.Logger
+
+	mu sync.Mutex
+	// pending is the hijacked connection waiting for sending the dial
+	// request of each destination
+	pending map[string]*tunnelConn
+	// released is signaled once a destination is not pending
+	released *sync.Cond
+	// dialing are the requests waiting for dial response, keyed by random
+	dialing map[int64]*tunnelConn
+}
+
+// tunnelConn records a tunneled connection
+type tunnelConn struct {
+	source      string
+	user        string
+	destination string
+	start       time.Time
+	// agentID is protected by the lock of connectionAuditor
+	agentID     string
+	closeReason string
+	// bytesIn and bytesOut are updated atomically
+	bytesIn        int64
+	bytesOut       int64
+	closedByServer int32
+}
+
+func newConnectionAuditor(logger *audit.Logger) *connectionAuditor {
+	ca := &connectionAuditor{
+		logger:  logger,
+		pending: make(map[string]*tunnelConn),
+		dialing: make(map[int64]*tunnelConn),
+	}
+	ca.released = sync.NewCond(&ca.mu)
+	return ca
+}
+
+// WrapTunnel wraps the HTTP-CONNECT tunnel handler to audit the connections,
+// udsName is recorded as the source if it is not empty
+func (ca *connectionAuditor) WrapTunnel(h http.Handler, udsName string) http.Handler {
+	if ca.logger == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+		tc := &tunnelConn{
+			source:      r.RemoteAddr,
+			user:        getPeerCommonName(r),
+			destination: r.Host,
+			start:       time.Now(),
+		}
+		if udsName != "" {
+			tc.source = "uds:" + udsName
+		}
+
+		h.ServeHTTP(&tunnelResponseWriter{ResponseWriter: w, tc: tc, auditor: ca}, r)
+		agentID := ca.remove(tc)
+
+		if tc.closeReason == "" {
+			tc.closeReason = closeReasonNoDial
+		}
+		ca.logger.Log(&audit.Event{
+			Type:        audit.EventConnection,
+			ClusterName: agentID,
+			Source:      tc.source,
+			User:        tc.user,
+			Protocol:    "tcp",
+			Destination: tc.destination,
+			BytesIn:     atomic.LoadInt64(&tc.bytesIn),
+			BytesOut:    atomic.LoadInt64(&tc.bytesOut),
+			Duration:    time.Since(tc.start).String(),
+			CloseReason: tc.closeReason,
+		})
+	})
+}
+
+// StreamServerInterceptor returns a grpc interceptor of the agent server
+// which records the agents and their dial results
+func (ca *connectionAuditor) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if ca.logger == nil {
+			return handler(srv, ss)
+		}
+		agentID := getStreamAgentID(ss)
+		source := getStreamPeerAddr(ss)
+		start := time.Now()
+		ca.logger.Log(&audit.Event{
+			Type:        audit.EventAgentConnected,
+			ClusterName: agentID,
+			Source:      source,
+		})
+
+		err := handler(srv, &auditServerStream{ServerStream: ss, auditor: ca, agentID: agentID})
+
+		event := &audit.Event{
+			Type:        audit.EventAgentDisconnected,
+			ClusterName: agentID,
+			Source:      source,
+			Duration:    time.Since(start).String(),
+		}
+		if err != nil {
+			event.Reason = err.Error()
+		}
+		ca.logger.Log(event)
+		return err
+	}
+}
+
+// addPending waits for the pending connection of the same destination
+// to send its dial request, and then makes the connection pending
+func (ca *connectionAuditor) addPending(tc *tunnelConn) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for ca.pending[tc.destination] != nil {
+		ca.released.Wait()
+	}
+	ca.pending[tc.destination] = tc
+}
+
+// releasePending releases the destination of the pending connection, the
+// caller must hold the lock
+func (ca *connectionAuditor) releasePending(tc *tunnelConn) {
+	if ca.pending[tc.destination] == tc {
+		delete(ca.pending, tc.destination)
+		ca.released.Broadcast()
+	}
+}
+
+// remove removes the connection from the auditor and returns the ID
+// of the agent serving it, the connection is still pending if the
+// tunnel handler fails before sending the dial request
+func (ca *connectionAuditor) remove(tc *tunnelConn) string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.releasePending(tc)
+	for random, dialing := range ca.dialing {
+		if dialing == tc {
+			delete(ca.dialing, random)
+		}
+	}
+	return tc.agentID
+}
+
+// dialRequested correlates the dial request to the pending connection
+// of the same destination
+func (ca *connectionAuditor) dialRequested(agentID string, req *client.DialRequest) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	tc := ca.pending[req.Address]
+	if tc == nil {
+		return
+	}
+	ca.releasePending(tc)
+	tc.agentID = agentID
+	ca.dialing[req.Random] = tc
+}
+
+// dialResponded records the dial failure, the tunnel handler doesn't
+// return if the dial fails, so it is recorded here
+func (ca *connectionAuditor) dialResponded(agentID string, resp *client.DialResponse) {
+	ca.mu.Lock()
+	tc, ok := ca.dialing[resp.Random]
+	delete(ca.dialing, resp.Random)
+	ca.mu.Unlock()
+	if !ok || resp.Error == "" {
+		return
+	}
+	ca.logger.Log(&audit.Event{
+		Type:        audit.EventDialFailed,
+		ClusterName: agentID,
+		Source:      tc.source,
+		User:        tc.user,
+		Protocol:    "tcp",
+		Destination: tc.destination,
+		Duration:    time.Since(tc.start).String(),
+		Reason:      resp.Error,
+	})
+}
+
+// auditServerStream observes the dial requests and responses between
+// the server and agent
+type auditServerStream struct {
+	grpc.ServerStream
+	auditor *connectionAuditor
+	agentID string
+}
+
+func (s *auditServerStream) SendMsg(m interface{}) error {
+	if pkt, ok := m.(*client.Packet); ok && pkt.Type == client.PacketType_DIAL_REQ {
+		s.auditor.dialRequested(s.agentID, pkt.GetDialRequest())
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *auditServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if pkt, ok := m.(*client.Packet); ok && pkt.Type == client.PacketType_DIAL_RSP {
+		s.auditor.dialResponded(s.agentID, pkt.GetDialResponse())
+	}
+	return nil
+}
+
+// tunnelResponseWriter counts the bytes of the hijacked connection
+type tunnelResponseWriter struct {
+	http.ResponseWriter
+	tc      *tunnelConn
+	auditor *connectionAuditor
+}
+
+func (w *tunnelResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the tunnel handler sends the dial request right after hijacking
+	w.auditor.addPending(w.tc)
+	cc := &countingConn{Conn: conn, tc: w.tc}
+	// the buffered reader may hold the data read from the connection
+	// already, so count the bytes read from it instead of the connection
+	reader := bufio.NewReader(&countingReader{r: bufrw.Reader, tc: w.tc})
+	return cc, bufio.NewReadWriter(reader, bufio.NewWriter(cc)), nil
+}
+
+// countingConn counts the bytes sent to the source
+type countingConn struct {
+	net.Conn
+	tc *tunnelConn
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.tc.bytesOut, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	atomic.StoreInt32(&c.tc.closedByServer, 1)
+	return c.Conn.Close()
+}
+
+// countingReader counts the bytes received from the source, and records
+// the close reason once the reading ends
+type countingReader struct {
+	r  io.Reader
+	tc *tunnelConn
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.tc.bytesIn, int64(n))
+	if err != nil && r.tc.closeReason == "" {
+		switch {
+		case atomic.LoadInt32(&r.tc.closedByServer) == 1:
+			r.tc.closeReason = closeReasonAgent
+		case err == io.EOF:
+			r.tc.closeReason = closeReasonClient
+		default:
+			r.tc.closeReason = err.Error()
+		}
+	}
+	return n, err
+}
+
+// auditHTTP wraps the reverse proxy handler to audit the requests sent
+// to the destination
+func auditHTTP(logger *audit.Logger, h http.Handler, destination string) http.Handler {
+	if logger == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		// the content length is -1 if the body is chunked, so count the
+		// bytes read from the body instead
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		h.ServeHTTP(sr, r)
+		logger.Log(&audit.Event{
+			Type:        audit.EventHTTPRequest,
+			Source:      r.RemoteAddr,
+			User:        getPeerCommonName(r),
+			Protocol:    r.Proto,
+			Destination: destination,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Status:      sr.status,
+			BytesIn:     atomic.LoadInt64(&body.bytes),
+			BytesOut:    sr.bytes,
+			Duration:    time.Since(start).String(),
+		})
+	})
+}
+
+// countingBody counts the bytes read from the request body
+type countingBody struct {
+	io.ReadCloser
+	// bytes is updated atomically, since the reverse proxy may read the
+	// body in another goroutine
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.bytes, int64(n))
+	return n, err
+}
+
+// statusRecorder records the status code and body size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// getPeerCommonName gets the common name of the client certificate
+func getPeerCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// getStreamAgentID gets the agent ID from the metadata of agent stream
+func getStreamAgentID(ss grpc.ServerStream) string {
+	md, ok := metadata.FromIncomingContext(ss.Context())
+	if !ok {
+		return ""
+	}
+	if agentIDs := md.Get(header.AgentID); len(agentIDs) != 0 {
+		return agentIDs[0]
+	}
+	return ""
+}
+
+// getStreamPeerAddr gets the remote address of agent stream
+func getStreamPeerAddr(ss grpc.ServerStream) string {
+	if p, ok := peer.FromContext(ss.Context()); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
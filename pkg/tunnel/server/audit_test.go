@@ -0,0 +1,172 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
+)
+
+// newTestAuditLogger creates the audit logger writing to a temp file, the
+// returned function reads the logged events
+func newTestAuditLogger(t *testing.T) (*audit.Logger, func() []audit.Event, func()) {
+	dir, err := ioutil.TempDir("", "excalibur-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	logger, err := audit.NewLogger(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := func() []audit.Event {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []audit.Event
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			e := audit.Event{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("failed to decode audit event %q: %v", line, err)
+			}
+			events = append(events, e)
+		}
+		return events
+	}
+	return logger, events, func() { os.RemoveAll(dir) }
+}
+
+func TestAuditHTTPCountsBody(t *testing.T) {
+	logger, events, cleanup := newTestAuditLogger(t)
+	defer cleanup()
+	h := auditHTTP(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte("ok"))
+	}), "hub")
+
+	for _, contentLength := range []int64{5, -1} {
+		r := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader("hello"))
+		// the body of unknown length is chunked
+		r.ContentLength = contentLength
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+
+	got := events()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got %v", got)
+	}
+	for i, expected := range []int64{5, 5, 0} {
+		if got[i].BytesIn != expected || got[i].BytesOut != 2 || got[i].Status != http.StatusOK {
+			t.Errorf("expected event %d to have %d bytes in, got %+v", i, expected, got[i])
+		}
+	}
+}
+
+// fakeTunnel sends the dial request to the agent named by the X-Agent
+// header after hijacking as the tunnel handler of anp does, with a random
+// delay so that the concurrent connections interleave
+type fakeTunnel struct {
+	auditor *connectionAuditor
+}
+
+func (f *fakeTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+	f.auditor.dialRequested(r.Header.Get("X-Agent"), &client.DialRequest{Address: r.Host, Random: rand.Int63()})
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+}
+
+func TestConnectionAuditorCorrelatesDials(t *testing.T) {
+	logger, events, cleanup := newTestAuditLogger(t)
+	defer cleanup()
+	ca := newConnectionAuditor(logger)
+	server := httptest.NewServer(ca.WrapTunnel(&fakeTunnel{auditor: ca}, ""))
+	defer server.Close()
+
+	// the connections to the same destination are served by different agents
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		agents = make(map[string]string)
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(agent string) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			mu.Lock()
+			agents[conn.LocalAddr().String()] = agent
+			mu.Unlock()
+			fmt.Fprintf(conn, "CONNECT 10.0.0.1:443 HTTP/1.1\r\nHost: 10.0.0.1:443\r\nX-Agent: %s\r\n\r\n", agent)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(fmt.Sprintf("cls-%d", i))
+	}
+	wg.Wait()
+
+	// the handlers log after the connections are closed
+	var got []audit.Event
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if got = events(); len(got) == len(agents) {
+			break
+		}
+	}
+	if len(got) != len(agents) {
+		t.Fatalf("expected %d events, got %v", len(agents), got)
+	}
+	for _, e := range got {
+		if expected := agents[e.Source]; e.ClusterName != expected {
+			t.Errorf("expected the connection from %s to be served by %s, got %s", e.Source, expected, e.ClusterName)
+		}
+	}
+	if len(ca.pending) != 0 || len(ca.dialing) != 0 {
+		t.Errorf("expected no connection left, got pending %v and dialing %v", ca.pending, ca.dialing)
+	}
+}
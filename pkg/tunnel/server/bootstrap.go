@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server/serveraddr"
+)
+
+// bootstrapPublisher publishes the connection information of the tunnel
+// server in the bootstrap configmap, and keeps it up to date with the
+// service exposing the tunnel server
+type bootstrapPublisher struct {
+	clientSet  kubernetes.Interface
+	caData     []byte
+	preference v1.IPFamily
+	interval   time.Duration
+}
+
+// newBootstrapPublisher creates a bootstrapPublisher, the endpoints of the
+// preferred ip family come first
+func newBootstrapPublisher(clientSet kubernetes.Interface, caData []byte,
+	preference v1.IPFamily, interval time.Duration) *bootstrapPublisher {
+	return &bootstrapPublisher{
+		clientSet:  clientSet,
+		caData:     caData,
+		preference: preference,
+		interval:   interval,
+	}
+}
+
+// Run publishes the configmap every interval until stopCh is closed
+func (p *bootstrapPublisher) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := p.publish(); err != nil {
+			klog.Errorf("failed to publish the bootstrap configmap: %v", err)
+		}
+	}, p.interval, stopCh)
+}
+
+// publish creates the configmap, or updates it if the information changes
+func (p *bootstrapPublisher) publish() error {
+	// the endpoints are discovered from the service rather than the
+	// configmap itself
+	endpoints, err := serveraddr.DiscoverTunnelServerAddrs(p.clientSet, p.preference)
+	if err != nil {
+		return err
+	}
+	info := &serveraddr.BootstrapInfo{
+		Endpoints:  endpoints,
+		CAData:     p.caData,
+		Transports: []string{serveraddr.TransportGRPC},
+	}
+	cm := info.ToConfigMap()
+
+	configMaps := p.clientSet.CoreV1().ConfigMaps(cm.Namespace)
+	current, err := configMaps.Get(cm.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := configMaps.Create(cm); err != nil {
+			return err
+		}
+		klog.Infof("publish the endpoints %v in the bootstrap configmap %s/%s", endpoints, cm.Namespace, cm.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(current.Data, cm.Data) {
+		return nil
+	}
+	current.Data = cm.Data
+	if _, err := configMaps.Update(current); err != nil {
+		return err
+	}
+	klog.Infof("update the endpoints %v in the bootstrap configmap %s/%s", endpoints, cm.Namespace, cm.Name)
+	return nil
+}
@@ -17,26 +17,38 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/config"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/pki"
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/pki/certmanager"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server/serveraddr"
 	"github.com/tkestack/tke-excalibur/pkg/version"
+	"google.golang.org/grpc"
 
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
-	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
 )
 
 // NewTunnelServerCommand creates a new tunnel-server command
-func NewTunnelServerCommand(provider interfaces.TunnelHookProvider, stopCh <-chan struct{}) *cobra.Command {
+func NewTunnelServerCommand(stopCh <-chan struct{}) *cobra.Command {
 	o := NewTunnelServerOptions()
 
 	cmd := &cobra.Command{
@@ -49,10 +61,13 @@ func NewTunnelServerCommand(provider interfaces.TunnelHookProvider, stopCh <-cha
 			}
 			fmt.Printf("%s version: %#v\n", version.GetServerName(), version.Get())
 
+			if err := o.loadConfig(c.Flags()); err != nil {
+				return err
+			}
 			if err := o.validate(); err != nil {
 				return err
 			}
-			if err := o.complete(provider); err != nil {
+			if err := o.complete(); err != nil {
 				return err
 			}
 			if err := o.run(stopCh); err != nil {
@@ -66,14 +81,48 @@ func NewTunnelServerCommand(provider interfaces.TunnelHookProvider, stopCh <-cha
 	flags.BoolVar(&o.version, "version", o.version,
 		fmt.Sprintf("print the version information of the %s.",
 			version.GetServerName()))
+	flags.StringVar(&o.configFile, "config", o.configFile,
+		fmt.Sprintf("path to the %s file of the %s, the flags set on the command line override the file.",
+			config.TunnelServerConfigurationKind, version.GetServerName()))
 	flags.StringVar(&o.kubeConfig, "kube-config", o.kubeConfig,
 		"path to the kubeconfig file.")
+	flags.StringVar(&o.caFile, "ca-file", o.caFile,
+		"the CA file that verifies the clients if --kube-config is not set.")
 	flags.StringVar(&o.bindAddr, "bind-address", o.bindAddr,
-		fmt.Sprintf("the ip address on which the %s will listen.",
+		fmt.Sprintf("the ip address on which the %s will listen, an IPv4 and an IPv6 address "+
+			"are comma separated for dual-stack. (e.g., 0.0.0.0,::)",
 			version.GetServerName()))
 	flags.StringVar(&o.insecureBindAddr, "insecure-bind-address", o.insecureBindAddr,
-		fmt.Sprintf("the ip address on which the %s will listen without tls.",
+		fmt.Sprintf("the ip address on which the %s will listen without tls, comma separated for dual-stack.",
 			version.GetServerName()))
+	flags.StringVar(&o.agentBindAddr, "agent-bind-address", o.agentBindAddr,
+		"the ip address of the agent port, comma separated for dual-stack, defaults to --bind-address.")
+	flags.StringVar(&o.masterBindAddr, "master-bind-address", o.masterBindAddr,
+		"the ip address of the master port, comma separated for dual-stack, defaults to --bind-address.")
+	flags.StringVar(&o.adminBindAddr, "admin-bind-address", o.adminBindAddr,
+		"the ip address of the admin port, comma separated for dual-stack, defaults to --bind-address.")
+	flags.StringVar(&o.reverseProxyBindAddr, "reverse-proxy-bind-address", o.reverseProxyBindAddr,
+		"the ip address of the reverse proxy port, comma separated for dual-stack, defaults to --bind-address.")
+	flags.IntVar(&o.serverAgentPort, "agent-port", o.serverAgentPort,
+		fmt.Sprintf("the port on which to accept the connections from %s.", version.GetAgentName()))
+	flags.IntVar(&o.serverMasterPort, "master-port", o.serverMasterPort,
+		"the port on which to accept the HTTP-CONNECT requests from master with mTLS, 0 disables it.")
+	flags.IntVar(&o.serverMasterInsecurePort, "master-insecure-port", o.serverMasterInsecurePort,
+		"the port on which to accept the HTTP-CONNECT requests from master without tls, 0 disables it.")
+	flags.IntVar(&o.serverAdminPort, "admin-port", o.serverAdminPort,
+		"the port on which to serve the admin api, 0 disables it.")
+	flags.IntVar(&o.serverReverseProxyPort, "reverse-proxy-port", o.serverReverseProxyPort,
+		"the port on which to serve the reverse proxy to the backends of the hub cluster, 0 disables it.")
+	flags.StringVar(&o.ipFamilyPreference, "ip-family-preference", o.ipFamilyPreference,
+		fmt.Sprintf("the ip family of the %s addresses published to the agents and passed to the hooks, IPv4 or IPv6, "+
+			"the primary family of %s is preferred if not set.",
+			version.GetServerName(), constants.TunnelServerServiceName))
+	flags.BoolVar(&o.publishBootstrap, "publish-bootstrap-configmap", o.publishBootstrap,
+		fmt.Sprintf("publish the endpoints and CA bundle of the %s in the configmap %s, "+
+			"which the agents prefer to the service %s.", version.GetServerName(),
+			constants.TunnelServerBootstrapConfigMapName, constants.TunnelServerServiceName))
+	flags.StringVar(&o.certDir, "cert-dir", o.certDir,
+		fmt.Sprintf("the directory where the certificate of %s is stored.", version.GetServerName()))
 	flags.StringVar(&o.certDNSNames, "cert-dns-names", o.certDNSNames,
 		"DNS names that will be added into server's certificate. (e.g., dns1,dns2)")
 	flags.StringVar(&o.certIPs, "cert-ips", o.certIPs,
@@ -84,64 +133,259 @@ func NewTunnelServerCommand(provider interfaces.TunnelHookProvider, stopCh <-cha
 		"The strategy of proxying requests from tunnel server to agent.")
 	flags.StringVar(&o.udsName, "uds-name", o.udsName,
 		"uds-name should be empty for TCP traffic. For UDS set to its name.")
+	flags.StringVar(&o.normServerURL, "norm-server-url", o.normServerURL,
+		"the backend of the /norm/api requests of the reverse proxy.")
+	flags.IntVar(&o.csrApproverWorkers, "csr-approver-workers", o.csrApproverWorkers,
+		"the number of the workers approving the CSRs of the tunnel.")
+	flags.BoolVar(&o.bindAgentIdentity, "bind-agent-identity", o.bindAgentIdentity,
+		fmt.Sprintf("only approve the certificate of an agent requested by the service account %s<cluster name> "+
+			"in the namespace of %s.", constants.TunnelAgentIdentityPrefix, version.GetServerName()))
+	flags.DurationVar(&o.keepAliveTime, "keepalive-time", o.keepAliveTime,
+		fmt.Sprintf("the idle time before pinging %s to ensure the connection is still active.",
+			version.GetAgentName()))
+	flags.DurationVar(&o.keepAliveTimeout, "keepalive-timeout", o.keepAliveTimeout,
+		"the time to wait for the ping ack before closing the connection.")
+	flags.StringVar(&o.auditLogPath, "audit-log-path", o.auditLogPath,
+		"If set, the tunneled connections and reverse proxy requests are logged to the file, '-' means standard out.")
+	flags.IntVar(&o.auditLogMaxSize, "audit-log-maxsize", o.auditLogMaxSize,
+		"The maximum size in megabytes of the audit log file before it gets rotated.")
+	flags.IntVar(&o.auditLogMaxBackups, "audit-log-maxbackup", o.auditLogMaxBackups,
+		"The maximum number of rotated audit log files to retain.")
+	flags.StringVar(&o.hookProviderNames, "hook-provider", o.hookProviderNames,
+		fmt.Sprintf("The hook provider, or a comma separated chain of providers executed in order. "+
+			"Available providers: %s", strings.Join(hook.Providers(), ",")))
+	flags.StringVar(&o.hookConfigFile, "hook-config", o.hookConfigFile,
+		"Path to the YAML or JSON file that configures the hook providers, "+
+			"the top level keys are the provider names.")
+	flags.DurationVar(&o.preStopHookTimeout, "pre-stop-hook-timeout", o.preStopHookTimeout,
+		"The time given to the pre-stop hook before the components stop.")
 	return cmd
 }
 
 // TunnelServerOptions has the information that required by the
 // tunnel-server
 type TunnelServerOptions struct {
-	kubeConfig               string
-	bindAddr                 string
-	insecureBindAddr         string
-	certDNSNames             string
-	certIPs                  string
-	version                  bool
-	serverAgentPort          int
-	serverMasterPort         int
-	serverMasterInsecurePort int
-	serverCount              int
-	serverAgentAddr          string
-	serverMasterAddr         string
-	serverMasterInsecureAddr string
-	clientSet                kubernetes.Interface
-	sharedInformerFactory    informers.SharedInformerFactory
-	proxyStrategy            string
-	udsName                  string
-	hookProvider             interfaces.TunnelHookProvider
+	configFile                string
+	kubeConfig                string
+	caFile                    string
+	bindAddr                  string
+	insecureBindAddr          string
+	agentBindAddr             string
+	masterBindAddr            string
+	adminBindAddr             string
+	reverseProxyBindAddr      string
+	certDNSNames              string
+	certIPs                   string
+	certDir                   string
+	version                   bool
+	serverAgentPort           int
+	serverMasterPort          int
+	serverMasterInsecurePort  int
+	serverAdminPort           int
+	serverReverseProxyPort    int
+	serverCount               int
+	serverAgentAddrs          []string
+	serverMasterAddrs         []string
+	serverMasterInsecureAddrs []string
+	serverAdminAddrs          []string
+	serverReverseProxyAddrs   []string
+	clientSet                 kubernetes.Interface
+	sharedInformerFactory     informers.SharedInformerFactory
+	proxyStrategy             string
+	udsName                   string
+	normServerURL             string
+	normServer                *url.URL
+	csrApproverWorkers        int
+	bindAgentIdentity         bool
+	keepAliveTime             time.Duration
+	keepAliveTimeout          time.Duration
+	hookProviderNames         string
+	hookConfigFile            string
+	hookProvider              interfaces.TunnelHookProvider
+	preStopHookTimeout        time.Duration
+	// serverAddr is the address that the agents connect to
+	serverAddr         string
+	ipFamilyPreference string
+	publishBootstrap   bool
+	auditLogPath       string
+	auditLogMaxSize    int
+	auditLogMaxBackups int
 }
 
-// NewTunnelServerOptions creates a new ExcaliburNewTunnelServerOptions
+// NewTunnelServerOptions creates a new ExcaliburNewTunnelServerOptions,
+// the defaults are the ones of the configuration file
 func NewTunnelServerOptions() *TunnelServerOptions {
-	o := &TunnelServerOptions{
-		bindAddr:                 "0.0.0.0",
-		insecureBindAddr:         "127.0.0.1",
-		serverCount:              1,
-		serverAgentPort:          constants.TunnelServerAgentPort,
-		serverMasterPort:         constants.TunnelServerMasterPort,
-		serverMasterInsecurePort: constants.TunnelServerMasterInsecurePort,
-		proxyStrategy:            string(server.ProxyStrategyDestHost),
-	}
+	cfg := &config.TunnelServerConfiguration{}
+	config.SetDefaultsTunnelServerConfiguration(cfg)
+	o := &TunnelServerOptions{}
+	o.applyConfig(cfg)
 	return o
 }
 
-// validate validates the TunnelServerOptions
+// applyConfig sets the options from the configuration
+func (o *TunnelServerOptions) applyConfig(cfg *config.TunnelServerConfiguration) {
+	o.kubeConfig = cfg.KubeConfig
+	o.caFile = cfg.CAFile
+	o.bindAddr = cfg.BindAddress
+	o.insecureBindAddr = cfg.InsecureBindAddress
+	o.ipFamilyPreference = cfg.IPFamilyPreference
+	o.publishBootstrap = *cfg.PublishBootstrapConfigMap
+	o.agentBindAddr = strings.Join(cfg.BindAddresses.Agent, ",")
+	o.masterBindAddr = strings.Join(cfg.BindAddresses.Master, ",")
+	o.adminBindAddr = strings.Join(cfg.BindAddresses.Admin, ",")
+	o.reverseProxyBindAddr = strings.Join(cfg.BindAddresses.ReverseProxy, ",")
+	o.serverAgentPort = int(*cfg.Ports.Agent)
+	o.serverMasterPort = int(*cfg.Ports.Master)
+	o.serverMasterInsecurePort = int(*cfg.Ports.MasterInsecure)
+	o.serverAdminPort = int(*cfg.Ports.Admin)
+	o.serverReverseProxyPort = int(*cfg.Ports.ReverseProxy)
+	o.certDir = cfg.Certificate.Dir
+	o.certDNSNames = strings.Join(cfg.Certificate.DNSNames, ",")
+	o.certIPs = strings.Join(cfg.Certificate.IPs, ",")
+	o.serverCount = int(cfg.ServerCount)
+	o.proxyStrategy = cfg.ProxyStrategy
+	o.udsName = cfg.UDSName
+	o.normServerURL = cfg.NormServerURL
+	o.csrApproverWorkers = int(cfg.CSRApproverWorkers)
+	o.bindAgentIdentity = cfg.BindAgentIdentity
+	o.keepAliveTime = cfg.KeepAlive.Time.Duration
+	o.keepAliveTimeout = cfg.KeepAlive.Timeout.Duration
+	o.auditLogPath = cfg.AuditLog.Path
+	o.auditLogMaxSize = int(cfg.AuditLog.MaxSize)
+	o.auditLogMaxBackups = int(cfg.AuditLog.MaxBackups)
+	o.hookProviderNames = strings.Join(cfg.Hook.Providers, ",")
+	o.hookConfigFile = cfg.Hook.ConfigFile
+	o.preStopHookTimeout = cfg.Hook.PreStopTimeout.Duration
+}
+
+// loadConfig loads the configuration file if --config is set, the flags
+// set on the command line take precedence over the file
+func (o *TunnelServerOptions) loadConfig(flags *pflag.FlagSet) error {
+	if o.configFile == "" {
+		return nil
+	}
+	cfg, err := config.LoadTunnelServerConfiguration(o.configFile)
+	if err != nil {
+		return err
+	}
+	klog.Infof("load the configuration from %s", o.configFile)
+	return config.ApplyWithFlags(flags, func() { o.applyConfig(cfg) })
+}
+
+// toConfig returns the configuration merged from the file and the flags
+func (o *TunnelServerOptions) toConfig() *config.TunnelServerConfiguration {
+	port := func(p int) *int32 {
+		v := int32(p)
+		return &v
+	}
+	cfg := &config.TunnelServerConfiguration{
+		KubeConfig:                o.kubeConfig,
+		CAFile:                    o.caFile,
+		BindAddress:               o.bindAddr,
+		InsecureBindAddress:       o.insecureBindAddr,
+		IPFamilyPreference:        o.ipFamilyPreference,
+		PublishBootstrapConfigMap: &o.publishBootstrap,
+		BindAddresses: config.TunnelServerBindAddresses{
+			Agent:        splitList(o.agentBindAddr),
+			Master:       splitList(o.masterBindAddr),
+			Admin:        splitList(o.adminBindAddr),
+			ReverseProxy: splitList(o.reverseProxyBindAddr),
+		},
+		Ports: config.TunnelServerPorts{
+			Agent:          port(o.serverAgentPort),
+			Master:         port(o.serverMasterPort),
+			MasterInsecure: port(o.serverMasterInsecurePort),
+			Admin:          port(o.serverAdminPort),
+			ReverseProxy:   port(o.serverReverseProxyPort),
+		},
+		Certificate: config.CertificateOptions{
+			Dir:      o.certDir,
+			DNSNames: splitList(o.certDNSNames),
+			IPs:      splitList(o.certIPs),
+		},
+		ServerCount:        int32(o.serverCount),
+		ProxyStrategy:      o.proxyStrategy,
+		UDSName:            o.udsName,
+		NormServerURL:      o.normServerURL,
+		BindAgentIdentity:  o.bindAgentIdentity,
+		CSRApproverWorkers: int32(o.csrApproverWorkers),
+		KeepAlive: config.KeepAliveOptions{
+			Time:    metav1.Duration{Duration: o.keepAliveTime},
+			Timeout: metav1.Duration{Duration: o.keepAliveTimeout},
+		},
+		AuditLog: config.AuditLogOptions{
+			Path:       o.auditLogPath,
+			MaxSize:    int32(o.auditLogMaxSize),
+			MaxBackups: int32(o.auditLogMaxBackups),
+		},
+		Hook: config.HookOptions{
+			Providers:      splitList(o.hookProviderNames),
+			ConfigFile:     o.hookConfigFile,
+			PreStopTimeout: metav1.Duration{Duration: o.preStopHookTimeout},
+		},
+	}
+	cfg.APIVersion = config.APIVersion
+	cfg.Kind = config.TunnelServerConfigurationKind
+	return cfg
+}
+
+// validate validates the configuration merged from the file and the
+// flags, so that the flags are validated the same as the file
 func (o *TunnelServerOptions) validate() error {
-	if len(o.bindAddr) == 0 {
-		return fmt.Errorf("%s's bind address can't be empty",
-			version.GetServerName())
+	if err := config.ValidateTunnelServerConfiguration(o.toConfig()).ToAggregate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
 	}
 	return nil
 }
 
-// complete completes all the required options
-func (o *TunnelServerOptions) complete(provider interfaces.TunnelHookProvider) error {
-	o.serverAgentAddr = fmt.Sprintf("%s:%d", o.bindAddr, o.serverAgentPort)
-	o.serverMasterAddr = fmt.Sprintf("%s:%d", o.bindAddr, o.serverMasterPort)
-	klog.Infof("server will accept %s requests at: %s, "+
-		"server will accept master https requests at: %s ",
-		version.GetAgentName(), o.serverAgentAddr, o.serverMasterAddr)
+// splitList splits a comma separated list, it returns nil if the list
+// is empty
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
+// complete completes all the required options
+func (o *TunnelServerOptions) complete() error {
 	var err error
+	if o.hookProviderNames != "" {
+		o.hookProvider, err = hook.New(o.hookProviderNames, o.hookConfigFile)
+		if err != nil {
+			return err
+		}
+		klog.Infof("set hook provider to [%s].", o.hookProvider.GetProviderName())
+	}
+
+	if o.normServer, err = url.Parse(o.normServerURL); err != nil {
+		return fmt.Errorf("--norm-server-url is invalid: %v", err)
+	}
+
+	// the listeners bind --bind-address unless their own addresses are set,
+	// and the ones of port 0 are disabled
+	bindAddrOr := func(addr string) string {
+		if addr == "" {
+			return o.bindAddr
+		}
+		return addr
+	}
+	o.serverAgentAddrs = listenAddresses(bindAddrOr(o.agentBindAddr), o.serverAgentPort)
+	o.serverMasterAddrs = listenAddresses(bindAddrOr(o.masterBindAddr), o.serverMasterPort)
+	o.serverMasterInsecureAddrs = listenAddresses(o.insecureBindAddr, o.serverMasterInsecurePort)
+	o.serverAdminAddrs = listenAddresses(bindAddrOr(o.adminBindAddr), o.serverAdminPort)
+	o.serverReverseProxyAddrs = listenAddresses(bindAddrOr(o.reverseProxyBindAddr), o.serverReverseProxyPort)
+	klog.Infof("server will accept %s requests at: %v, "+
+		"server will accept master https requests at: %v, "+
+		"server will accept master http requests at: %v, "+
+		"server will serve admin api at: %v, "+
+		"server will serve reverse proxy at: %v",
+		version.GetAgentName(), o.serverAgentAddrs, o.serverMasterAddrs, o.serverMasterInsecureAddrs,
+		o.serverAdminAddrs, o.serverReverseProxyAddrs)
+
 	o.clientSet, err = k8s.CreateClientSet(o.kubeConfig)
 	if err != nil {
 		return err
@@ -149,20 +393,20 @@ func (o *TunnelServerOptions) complete(provider interfaces.TunnelHookProvider) e
 
 	o.sharedInformerFactory =
 		informers.NewSharedInformerFactory(o.clientSet, 10*time.Second)
-
-	if o.hookProvider != nil {
-		o.hookProvider = provider
-		klog.Infof("set hook provider to [%s].", provider.GetProviderName())
-	}
 	return nil
 }
 
 // run starts the tunnel-server
 func (o *TunnelServerOptions) run(stopCh <-chan struct{}) error {
+	// the components keep running until the pre-stop hook is executed
+	runCh := make(chan struct{})
+	defer close(runCh)
+	hookCtx := hook.ContextForChannel(runCh)
 
 	// 1. excute pre start tunnel server hook
 	if o.hookProvider != nil {
-		err := o.hookProvider.PreStartTunnelServer(o.clientSet)
+		err := o.hookProvider.PreStartTunnelServer(
+			o.newHookContext(hookCtx, interfaces.PreStartTunnelServer, nil))
 		if err != nil {
 			return fmt.Errorf("faild to excute %s provider pre-start tunnel server hook due to %v",
 				o.hookProvider.GetProviderName(), err)
@@ -171,19 +415,20 @@ func (o *TunnelServerOptions) run(stopCh <-chan struct{}) error {
 
 	// 2. create a certificate manager for the tunnel server and
 	// run the csr approver for both tunnel-server and tunnel-agent
+	serverCSRs := certmanager.NewServerCSRs()
 	serverCertMgr, err :=
 		certmanager.NewTunnelServerCertManager(
-			o.clientSet, o.certDNSNames, o.certIPs, stopCh)
+			o.clientSet, o.certDir, o.certDNSNames, o.certIPs, serverCSRs, runCh)
 	if err != nil {
 		return err
 	}
 	serverCertMgr.Start()
-	go certmanager.NewCSRApprover(o.clientSet, o.sharedInformerFactory.Certificates().V1beta1().CertificateSigningRequests()).
-		Run(constants.TunnelCSRApproverThreadiness, stopCh)
+	defer serverCertMgr.Stop()
+	go certmanager.NewCSRApprover(o.clientSet, o.sharedInformerFactory.Certificates().V1beta1().CertificateSigningRequests(),
+		serverCSRs, o.bindAgentIdentity).Run(o.csrApproverWorkers, runCh)
 
 	// 3. generate the TLS configuration based on the latest certificate
-	rootCertPool, err := pki.GenRootCertPool(o.kubeConfig,
-		constants.TunnelCAFile)
+	rootCertPool, err := pki.GenRootCertPool(o.kubeConfig, o.caFile)
 	if err != nil {
 		return fmt.Errorf("fail to generate the rootCertPool: %s", err)
 	}
@@ -194,7 +439,7 @@ func (o *TunnelServerOptions) run(stopCh <-chan struct{}) error {
 	}
 
 	// 4. after all of informers are configured completed, start the shared index informer
-	o.sharedInformerFactory.Start(stopCh)
+	o.sharedInformerFactory.Start(runCh)
 
 	// 5. waiting for the certificate is generated
 	_ = wait.PollUntil(5*time.Second, func() (bool, error) {
@@ -205,39 +450,126 @@ func (o *TunnelServerOptions) run(stopCh <-chan struct{}) error {
 		klog.Infof("waiting for the master to sign the %s certificate",
 			version.GetServerName())
 		return false, nil
-	}, stopCh)
+	}, runCh)
 
-	// 6. start reverse proxy
-	rps := NewReverseProxyServer(
-		o.bindAddr,
-		constants.TunnelServerReversePorxyPort,
-		tlsCfg,
-	)
-	if err := rps.Run(); err != nil {
+	auditLogger, err := audit.NewLogger(o.auditLogPath, o.auditLogMaxSize, o.auditLogMaxBackups)
+	if err != nil {
 		return err
 	}
 
-	// 7. start the tunnel server
+	// 6. start reverse proxy unless it is disabled, the servers are stopped
+	// along with the other components
+	if len(o.serverReverseProxyAddrs) > 0 {
+		rps := NewReverseProxyServer(
+			o.serverReverseProxyAddrs,
+			tlsCfg,
+			o.normServer,
+			auditLogger,
+		)
+		if err := rps.Run(runCh); err != nil {
+			return err
+		}
+	}
+
+	// 7. start the tunnel server, notify the agent and certificate events
+	// to the hook provider, and track the agents for the admin api
+	var interceptors []grpc.StreamServerInterceptor
+	tracker := newAgentTracker()
+	if o.hookProvider != nil {
+		if o.serverAddr, err = serveraddr.GetTunnelServerAddr(o.clientSet,
+			v1.IPFamily(o.ipFamilyPreference)); err != nil {
+			klog.Warningf("failed to get the %s address for hooks: %v", version.GetServerName(), err)
+		}
+		notifier := newAgentHookNotifier(o.hookProvider, func(event interfaces.HookEvent) *interfaces.HookContext {
+			return o.newHookContext(hookCtx, event, serverCertMgr.Current())
+		})
+		go notifier.Run(runCh)
+		interceptors = append(interceptors, notifier.StreamServerInterceptor())
+
+		certmanager.WatchRotation(serverCertMgr, func(cert *tls.Certificate) {
+			err := o.hookProvider.CertificateRotated(
+				o.newHookContext(hookCtx, interfaces.CertificateRotated, cert))
+			if err != nil {
+				klog.Errorf("faild to excute %s provider certificate rotated hook due to %v",
+					o.hookProvider.GetProviderName(), err)
+			}
+		}, runCh)
+	}
+	interceptors = append(interceptors, tracker.StreamServerInterceptor())
 	ts := NewTunnelServer(
-		o.serverMasterAddr,
-		o.serverMasterInsecureAddr,
-		o.serverAgentAddr,
+		o.serverMasterAddrs,
+		o.serverMasterInsecureAddrs,
+		o.serverAgentAddrs,
 		o.serverCount,
 		tlsCfg,
 		o.proxyStrategy,
-		o.udsName)
-	if err := ts.Run(); err != nil {
+		o.udsName,
+		o.keepAliveTime,
+		o.keepAliveTimeout,
+		auditLogger,
+		interceptors...)
+	if err := ts.Run(runCh); err != nil {
 		return err
 	}
 
-	// 8. excute pre start tunnel server hook
+	// 8. start the admin api unless it is disabled
+	if len(o.serverAdminAddrs) > 0 {
+		as := newAdminServer(o.serverAdminAddrs, tlsCfg, tracker)
+		if err := as.Run(runCh); err != nil {
+			return err
+		}
+	}
+
+	// 9. publish the connection information for the agents unless it is
+	// disabled
+	if o.publishBootstrap {
+		caData, err := pki.GenRootCAData(o.kubeConfig, o.caFile)
+		if err != nil {
+			return fmt.Errorf("fail to read the root CA: %s", err)
+		}
+		go newBootstrapPublisher(o.clientSet, caData, v1.IPFamily(o.ipFamilyPreference),
+			constants.TunnelServerBootstrapSyncIntervalSec*time.Second).Run(runCh)
+	}
+
+	// 10. excute post start tunnel server hook
 	if o.hookProvider != nil {
-		err := o.hookProvider.PostStartTunnelServer(o.clientSet)
+		err := o.hookProvider.PostStartTunnelServer(
+			o.newHookContext(hookCtx, interfaces.PostStartTunnelServer, serverCertMgr.Current()))
 		if err != nil {
 			return fmt.Errorf("faild to excute %s provider post-start tunnel server hook due to %v",
 				o.hookProvider.GetProviderName(), err)
 		}
 	}
 	<-stopCh
+
+	// 11. excute pre stop tunnel server hook before the components stop
+	if o.hookProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), o.preStopHookTimeout)
+		defer cancel()
+		err := o.hookProvider.PreStopTunnelServer(
+			o.newHookContext(ctx, interfaces.PreStopTunnelServer, serverCertMgr.Current()))
+		if err != nil {
+			klog.Errorf("faild to excute %s provider pre-stop tunnel server hook due to %v",
+				o.hookProvider.GetProviderName(), err)
+		}
+	}
 	return nil
 }
+
+// newHookContext creates the context of the server hooks
+func (o *TunnelServerOptions) newHookContext(
+	ctx context.Context,
+	event interfaces.HookEvent,
+	cert *tls.Certificate) *interfaces.HookContext {
+	hostname, _ := os.Hostname()
+	return &interfaces.HookContext{
+		Context:            ctx,
+		Event:              event,
+		Component:          version.GetServerName(),
+		ServerAddress:      o.serverAddr,
+		ServerReplica:      hostname,
+		Certificate:        cert,
+		LocalClient:        o.clientSet,
+		AgentIdentityBound: o.bindAgentIdentity,
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateMergedConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "excalibur-server-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("apiVersion: excalibur.tkestack.io/v1alpha1\n"+
+		"kind: TunnelServerConfiguration\nnormServerURL: \"169.254.0.40/norm/api\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		args       []string
+		expected   string
+		unexpected string
+	}{
+		{
+			name:     "invalid norm server url flag",
+			args:     []string{"--norm-server-url=169.254.0.40:80/norm/api"},
+			expected: "normServerURL",
+		},
+		{
+			name:     "invalid norm server url in the file",
+			args:     []string{"--config=" + configFile},
+			expected: "normServerURL",
+		},
+		{
+			name:     "invalid bind address flag",
+			args:     []string{"--bind-address=0.0.0.0,localhost"},
+			expected: "bindAddress",
+		},
+		{
+			name:     "conflicted ports",
+			args:     []string{"--admin-port=10262"},
+			expected: "ports.admin",
+		},
+		{
+			name:       "disabled agent port overrides the file",
+			args:       []string{"--config=" + configFile, "--norm-server-url=http://127.0.0.1/norm/api", "--agent-port=0"},
+			expected:   "the agent listener can't be disabled",
+			unexpected: "normServerURL",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cmd := NewTunnelServerCommand(nil)
+			cmd.SetArgs(c.args)
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			err := cmd.Execute()
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("expected error containing %q, got %v", c.expected, err)
+			}
+			if c.unexpected != "" && err != nil && strings.Contains(err.Error(), c.unexpected) {
+				t.Errorf("expected error not containing %q, got %v", c.unexpected, err)
+			}
+		})
+	}
+}
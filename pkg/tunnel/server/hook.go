@@ -0,0 +1,206 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+// agentHookNotifier executes the AgentConnected and AgentDisconnected
+// hooks as the agents connect to and disconnect from the server. The
+// events are coalesced per agent so that neither the connections nor the
+// disconnections of the agents wait for the hooks, only the latest event
+// of an agent is pending, and it is skipped if the hook of the same state
+// has been executed, e.g. a reconnection before the hooks catch up
+type agentHookNotifier struct {
+	provider interfaces.TunnelHookProvider
+	// newHookContext creates the context of the hook with the common
+	// information of the server
+	newHookContext func(event interfaces.HookEvent) *interfaces.HookContext
+
+	mu sync.Mutex
+	// streams is the number of connections of each agent, an agent may
+	// connect to the server several times when the identifiers change
+	streams map[string]int
+	// pending is the latest event of each agent whose hook is not
+	// executed, order is the agents of pending in the order of the events
+	pending map[string]*interfaces.HookContext
+	order   []string
+	// signal wakes up Run when an event is pending
+	signal chan struct{}
+	// connected are the agents whose AgentConnected hook is executed, it
+	// is only accessed by Run
+	connected map[string]bool
+}
+
+// newAgentHookNotifier creates an agentHookNotifier
+func newAgentHookNotifier(
+	provider interfaces.TunnelHookProvider,
+	newHookContext func(event interfaces.HookEvent) *interfaces.HookContext) *agentHookNotifier {
+	return &agentHookNotifier{
+		provider:       provider,
+		newHookContext: newHookContext,
+		streams:        make(map[string]int),
+		pending:        make(map[string]*interfaces.HookContext),
+		signal:         make(chan struct{}, 1),
+		connected:      make(map[string]bool),
+	}
+}
+
+// Run executes the hooks until stopCh is closed, the pending events are
+// abandoned then
+func (n *agentHookNotifier) Run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-n.signal:
+		}
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			hc := n.next()
+			if hc == nil {
+				break
+			}
+			n.execute(hc)
+		}
+	}
+}
+
+// next pops the earliest pending event, it returns nil if there is none
+func (n *agentHookNotifier) next() *interfaces.HookContext {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.order) == 0 {
+		return nil
+	}
+	agentID := n.order[0]
+	n.order = n.order[1:]
+	hc := n.pending[agentID]
+	delete(n.pending, agentID)
+	return hc
+}
+
+// execute executes the hook of the event unless the agent is already in
+// the state of the event
+func (n *agentHookNotifier) execute(hc *interfaces.HookContext) {
+	connected := hc.Event == interfaces.AgentConnected
+	if n.connected[hc.ClusterName] == connected {
+		klog.V(4).Infof("skip the coalesced %s hook of agent %s", hc.Event, hc.ClusterName)
+		return
+	}
+	if connected {
+		n.connected[hc.ClusterName] = true
+	} else {
+		delete(n.connected, hc.ClusterName)
+	}
+	if err := interfaces.Execute(n.provider, hc); err != nil {
+		klog.Errorf("failed to excute %s provider %s hook of agent %s: %v",
+			n.provider.GetProviderName(), hc.Event, hc.ClusterName, err)
+	}
+}
+
+// StreamServerInterceptor returns a grpc interceptor of the agent server
+// which notifies the first connection and the last disconnection of
+// each agent
+func (n *agentHookNotifier) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		agentID := getStreamAgentID(ss)
+		identifiers := getStreamMetadata(ss, header.AgentIdentifiers)
+		agentVersion := getStreamMetadata(ss, constants.TunnelAgentVersionHeader)
+		commonName := getStreamPeerCommonName(ss)
+		if agentID == "" {
+			return handler(srv, ss)
+		}
+
+		n.mu.Lock()
+		n.streams[agentID]++
+		if n.streams[agentID] == 1 {
+			n.enqueue(interfaces.AgentConnected, agentID, identifiers, agentVersion, commonName)
+		}
+		n.mu.Unlock()
+
+		defer func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			n.streams[agentID]--
+			if n.streams[agentID] == 0 {
+				delete(n.streams, agentID)
+				n.enqueue(interfaces.AgentDisconnected, agentID, identifiers, agentVersion, commonName)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// enqueue replaces the pending event of the agent, it is called with the
+// lock held so that the latest event of an agent wins, and never blocks
+func (n *agentHookNotifier) enqueue(event interfaces.HookEvent, agentID, identifiers, agentVersion, commonName string) {
+	hc := n.newHookContext(event)
+	hc.ClusterName = agentID
+	hc.AgentIdentifiers = identifiers
+	hc.AgentVersion = agentVersion
+	hc.AgentCommonName = commonName
+	if _, ok := n.pending[agentID]; !ok {
+		n.order = append(n.order, agentID)
+	}
+	n.pending[agentID] = hc
+	select {
+	case n.signal <- struct{}{}:
+	default:
+	}
+}
+
+// getStreamPeerCommonName gets the common name of the agent's certificate
+func getStreamPeerCommonName(ss grpc.ServerStream) string {
+	p, ok := peer.FromContext(ss.Context())
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+	return tlsInfo.State.PeerCertificates[0].Subject.CommonName
+}
+
+// getStreamMetadata gets the metadata sent by the agent
+func getStreamMetadata(ss grpc.ServerStream, key string) string {
+	md, ok := metadata.FromIncomingContext(ss.Context())
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/hook/interfaces"
+)
+
+// recordingProvider records the agent events, and blocks the hooks until
+// release is closed
+type recordingProvider struct {
+	interfaces.NopHookProvider
+	release chan struct{}
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (p *recordingProvider) GetProviderName() string { return "recording" }
+
+func (p *recordingProvider) record(hc *interfaces.HookContext) error {
+	<-p.release
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, fmt.Sprintf("%s/%s", hc.Event, hc.ClusterName))
+	return nil
+}
+
+func (p *recordingProvider) AgentConnected(hc *interfaces.HookContext) error    { return p.record(hc) }
+func (p *recordingProvider) AgentDisconnected(hc *interfaces.HookContext) error { return p.record(hc) }
+
+func (p *recordingProvider) recorded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.events...)
+}
+
+func newTestNotifier(p *recordingProvider) *agentHookNotifier {
+	return newAgentHookNotifier(p, func(event interfaces.HookEvent) *interfaces.HookContext {
+		return &interfaces.HookContext{Event: event}
+	})
+}
+
+func notify(n *agentHookNotifier, event interfaces.HookEvent, agentID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.enqueue(event, agentID, "", "", "")
+}
+
+func TestAgentHookNotifierDoesNotBlock(t *testing.T) {
+	p := &recordingProvider{release: make(chan struct{})}
+	n := newTestNotifier(p)
+	stopCh := make(chan struct{})
+	go n.Run(stopCh)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// far more events than a bounded queue holds, while the first
+		// hook is blocked
+		for i := 0; i < 1000; i++ {
+			agentID := fmt.Sprintf("cls-%d", i%10)
+			notify(n, interfaces.AgentConnected, agentID)
+			notify(n, interfaces.AgentDisconnected, agentID)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events block while the hooks are slow")
+	}
+
+	close(stopCh)
+	close(p.release)
+	// the events after the notifier stops do not block either
+	notify(n, interfaces.AgentConnected, "cls-after-stop")
+}
+
+func TestAgentHookNotifierCoalesces(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []interfaces.HookEvent
+		expect []string
+	}{
+		{
+			name:   "connect",
+			events: []interfaces.HookEvent{interfaces.AgentConnected},
+			expect: []string{"AgentConnected/cls"},
+		},
+		{
+			name:   "connect then disconnect",
+			events: []interfaces.HookEvent{interfaces.AgentConnected, interfaces.AgentDisconnected},
+			expect: nil,
+		},
+		{
+			name: "reconnect",
+			events: []interfaces.HookEvent{interfaces.AgentConnected, interfaces.AgentDisconnected,
+				interfaces.AgentConnected},
+			expect: []string{"AgentConnected/cls"},
+		},
+		{
+			name:   "disconnect without connect",
+			events: []interfaces.HookEvent{interfaces.AgentDisconnected},
+			expect: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &recordingProvider{release: make(chan struct{})}
+			close(p.release)
+			n := newTestNotifier(p)
+			// queue all of the events before the hooks run
+			for _, event := range test.events {
+				notify(n, event, "cls")
+			}
+			for hc := n.next(); hc != nil; hc = n.next() {
+				n.execute(hc)
+			}
+			if got := p.recorded(); fmt.Sprint(got) != fmt.Sprint(test.expect) {
+				t.Errorf("expect hooks %v, got %v", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestAgentHookNotifierOrder(t *testing.T) {
+	p := &recordingProvider{release: make(chan struct{})}
+	close(p.release)
+	n := newTestNotifier(p)
+	notify(n, interfaces.AgentConnected, "cls-a")
+	notify(n, interfaces.AgentConnected, "cls-b")
+	for hc := n.next(); hc != nil; hc = n.next() {
+		n.execute(hc)
+	}
+	notify(n, interfaces.AgentDisconnected, "cls-b")
+	notify(n, interfaces.AgentDisconnected, "cls-a")
+	for hc := n.next(); hc != nil; hc = n.next() {
+		n.execute(hc)
+	}
+	expect := []string{"AgentConnected/cls-a", "AgentConnected/cls-b",
+		"AgentDisconnected/cls-b", "AgentDisconnected/cls-a"}
+	if got := p.recorded(); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expect hooks %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// listenAddresses joins each of the comma separated bind addresses with
+// the port, the listener is disabled and there is no address if the port
+// is 0
+func listenAddresses(bindAddrs string, port int) []string {
+	if port == 0 {
+		return nil
+	}
+	var addrs []string
+	for _, ip := range strings.Split(bindAddrs, ",") {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSpace(ip), strconv.Itoa(port)))
+	}
+	return addrs
+}
+
+// listen listens on all of the addresses, so that the conflicted ports
+// fail the startup instead of being logged in the background. A single
+// address is listened as is, e.g. :: accepts both of IPv4 and IPv6 where
+// the system supports it, while the dual-stack addresses are listened in
+// their own families
+func listen(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		network := "tcp"
+		if len(addrs) > 1 {
+			network = ipFamilyNetwork(addr)
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fail to listen on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// ipFamilyNetwork returns tcp4 or tcp6 according to the host of addr
+func ipFamilyNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "tcp"
+	}
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// serve serves the http server on the listeners in the background until
+// stopCh is closed, the connections are served with tls if useTLS is set
+func serve(server *http.Server, listeners []net.Listener, useTLS bool, stopCh <-chan struct{}) {
+	closeOnStop(server, stopCh)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			var err error
+			if useTLS {
+				err = server.ServeTLS(l, "", "")
+			} else {
+				err = server.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				klog.Errorf("failed to serve at %s: %v", l.Addr(), err)
+			}
+		}(l)
+	}
+}
+
+// closeOnStop closes the server and its connections once stopCh is closed
+func closeOnStop(server *http.Server, stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+}
@@ -24,38 +24,35 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"k8s.io/klog/v2"
-)
 
-var (
-	apiServerAddress string = "https://" +
-		net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
-	normServerAddress string = "http://169.254.0.40:80/norm/api"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
 )
 
 type reverseProxyServer struct {
-	mux     *mux.Router
-	address string
-	port    int
-	tlsCfg  *tls.Config
+	mux       *mux.Router
+	addresses []string
+	tlsCfg    *tls.Config
+	// normServerURL is the backend of the norm api
+	normServerURL *url.URL
+	auditLogger   *audit.Logger
 }
 
+// reverseProxyHandler proxies the requests to the backend, whose url is
+// parsed once when the server starts
 type reverseProxyHandler struct {
-	reverseProxy string
+	reverseProxy *httputil.ReverseProxy
 }
 
 var _ ReverseProxyServer = &reverseProxyServer{}
 
-func (o *reverseProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	remote, err := url.Parse(o.reverseProxy)
-	if err != nil {
-		panic(err)
-	}
-	reverseProxy := httputil.NewSingleHostReverseProxy(remote)
-	transport := &http.Transport{
+func newReverseProxyHandler(backend *url.URL) *reverseProxyHandler {
+	reverseProxy := httputil.NewSingleHostReverseProxy(backend)
+	reverseProxy.Transport = &http.Transport{
 		Proxy:           http.ProxyFromEnvironment,
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		DialContext: (&net.Dialer{
@@ -66,38 +63,46 @@ func (o *reverseProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		IdleConnTimeout:     90 * time.Second,
 		TLSHandshakeTimeout: 10 * time.Second,
 	}
-	reverseProxy.Transport = transport
 	reverseProxy.FlushInterval = 100 * time.Millisecond
-	reverseProxy.ServeHTTP(w, r)
+	return &reverseProxyHandler{reverseProxy: reverseProxy}
+}
+
+func (o *reverseProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.reverseProxy.ServeHTTP(w, r)
 }
 
 func (r *reverseProxyServer) registerHandler() {
+	// the apiserver of the hub cluster where the tunnel-server runs
+	apiServerURL := &url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")),
+	}
 
 	// for healthz check request
 	r.mux.HandleFunc("/v1/healthz", r.healthz).Methods("GET")
 
 	// for norm api request
-	r.mux.PathPrefix("/norm/api").Handler(&reverseProxyHandler{reverseProxy: normServerAddress})
+	r.mux.PathPrefix("/norm/api").Handler(auditHTTP(r.auditLogger,
+		newReverseProxyHandler(r.normServerURL), r.normServerURL.String()))
 
 	// for apiserver request at last
-	r.mux.PathPrefix("/").Handler(&reverseProxyHandler{reverseProxy: apiServerAddress})
+	r.mux.PathPrefix("/").Handler(auditHTTP(r.auditLogger,
+		newReverseProxyHandler(apiServerURL), apiServerURL.String()))
 }
 
-func (o *reverseProxyServer) Run() error {
+func (o *reverseProxyServer) Run(stopCh <-chan struct{}) error {
 	o.registerHandler()
 
-	go func() {
-		server := http.Server{
-			Addr:         fmt.Sprintf("%s:%d", o.address, o.port),
-			Handler:      o.mux,
-			TLSConfig:    o.tlsCfg,
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		}
-		if err := server.ListenAndServeTLS("", ""); err != nil {
-			klog.Errorf("failed to serve https request from master at %s:%d: %v", o.address, o.port, err)
-		}
-	}()
-	klog.Infof("start handling https reverse proxy request from master at %s:%d", o.address, o.port)
+	listeners, err := listen(o.addresses)
+	if err != nil {
+		return err
+	}
+	serve(&http.Server{
+		Handler:      o.mux,
+		TLSConfig:    o.tlsCfg,
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}, listeners, true, stopCh)
+	klog.Infof("start handling https reverse proxy request from master at %s", strings.Join(o.addresses, ","))
 	return nil
 }
 
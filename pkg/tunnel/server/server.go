@@ -18,53 +18,74 @@ package server
 
 import (
 	"crypto/tls"
+	"net/url"
+	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/audit"
 )
 
 // TunnelServer manages tunnels between itself and agents, receives requests
-// from apiserver, and forwards requests to corresponding agents
+// from apiserver, and forwards requests to corresponding agents until the
+// stop channel is closed
 type TunnelServer interface {
-	Run() error
+	Run(stopCh <-chan struct{}) error
 }
 
-// NewTunnelServer returns a new TunnelServer
+// NewTunnelServer returns a new TunnelServer, the server pings the agents
+// idle for keepAliveTime, the interceptors are chained after the built-in
+// ones of the agent server. The master servers without addresses are
+// disabled
 func NewTunnelServer(
-	serverMasterAddr,
-	serverMasterInsecureAddr,
-	serverAgentAddr string,
+	serverMasterAddrs,
+	serverMasterInsecureAddrs,
+	serverAgentAddrs []string,
 	serverCount int,
 	tlsCfg *tls.Config,
 	proxyStrategy string,
-	udsName string) TunnelServer {
+	udsName string,
+	keepAliveTime,
+	keepAliveTimeout time.Duration,
+	auditLogger *audit.Logger,
+	interceptors ...grpc.StreamServerInterceptor) TunnelServer {
 	ats := anpTunnelServer{
-		serverMasterAddr:         serverMasterAddr,
-		serverMasterInsecureAddr: serverMasterInsecureAddr,
-		serverAgentAddr:          serverAgentAddr,
-		serverCount:              serverCount,
-		tlsCfg:                   tlsCfg,
-		proxyStrategy:            proxyStrategy,
-		udsName:                  udsName,
+		serverMasterAddrs:         serverMasterAddrs,
+		serverMasterInsecureAddrs: serverMasterInsecureAddrs,
+		serverAgentAddrs:          serverAgentAddrs,
+		serverCount:               serverCount,
+		tlsCfg:                    tlsCfg,
+		proxyStrategy:             proxyStrategy,
+		udsName:                   udsName,
+		keepAliveTime:             keepAliveTime,
+		keepAliveTimeout:          keepAliveTimeout,
+		auditLogger:               auditLogger,
+		interceptors:              interceptors,
 	}
 	return &ats
 }
 
 // ReverseProxyServer proxy request from managed cluser to backend
-// service which located at same flat network with tunnel-server
+// service which located at same flat network with tunnel-server until
+// the stop channel is closed
 type ReverseProxyServer interface {
-	Run() error
+	Run(stopCh <-chan struct{}) error
 }
 
-// NewReverseProxyServer returns a new ReverseProxyServer
-func NewReverseProxyServer(address string, port int, tlsCfg *tls.Config) ReverseProxyServer {
+// NewReverseProxyServer returns a new ReverseProxyServer listening on the
+// addresses, the /norm/api requests are proxied to normServerURL
+func NewReverseProxyServer(addresses []string, tlsCfg *tls.Config,
+	normServerURL *url.URL, auditLogger *audit.Logger) ReverseProxyServer {
 	tlsClone := tlsCfg.Clone()
 	// ProxyServer https only provide data encryption, auth will passthrough by real bankend
 	tlsClone.ClientAuth = tls.RequestClientCert
 	rps := reverseProxyServer{
-		mux:     mux.NewRouter(),
-		address: address,
-		port:    port,
-		tlsCfg:  tlsClone,
+		mux:           mux.NewRouter(),
+		addresses:     addresses,
+		tlsCfg:        tlsClone,
+		normServerURL: normServerURL,
+		auditLogger:   auditLogger,
 	}
 	return &rps
 }
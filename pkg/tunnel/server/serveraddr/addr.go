@@ -17,10 +17,13 @@ limitations under the License.
 package serveraddr
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
 	"github.com/tkestack/tke-excalibur/pkg/version"
@@ -32,57 +35,123 @@ import (
 )
 
 // GetTunnelServerAddr gets the service address that exposes the tunnel server for
-// tunnel agent to connect
-func GetTunnelServerAddr(clientset kubernetes.Interface) (string, error) {
-	var (
-		ip      net.IP
-		host    string
-		tcpPort int32
-	)
+// tunnel agent to connect, the address of the preferred ip family is used if
+// there is one. The primary family of a dual-stack service is preferred if the
+// preference is empty
+func GetTunnelServerAddr(clientset kubernetes.Interface, preference v1.IPFamily) (string, error) {
+	addrs, err := GetTunnelServerAddrs(clientset, preference)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// GetTunnelServerAddrs gets all of the candidate addresses that expose the
+// tunnel server for tunnel agent to connect, the addresses of the preferred ip
+// family come first. The ones published in the bootstrap configmap are
+// preferred, which requires no permission on the services, endpoints and nodes
+func GetTunnelServerAddrs(clientset kubernetes.Interface, preference v1.IPFamily) ([]string, error) {
+	info, err := GetBootstrapInfo(clientset)
+	if err == nil && len(info.Endpoints) > 0 {
+		return orderAddrs(info.Endpoints, preference), nil
+	}
+	if err != nil {
+		klog.V(2).Infof("fail to get the bootstrap configmap %s, discover from the service %s: %v",
+			constants.TunnelServerBootstrapConfigMapName, constants.TunnelServerServiceName, err)
+	}
+	return DiscoverTunnelServerAddrs(clientset, preference)
+}
 
+// DiscoverTunnelServerAddrs discovers all of the candidate addresses that
+// expose the tunnel server from the service, e.g. the ones of each node of a
+// NodePort service, the addresses of the preferred ip family come first
+func DiscoverTunnelServerAddrs(clientset kubernetes.Interface, preference v1.IPFamily) ([]string, error) {
 	// get tunnel server resources
 	svc, eps, nodeLst, err := getTunnelServerResources(clientset)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// the agents dial the host of the exposure, whose server name is
+	// required to route the connections
+	if svc.exposure != nil {
+		tcpPort := svc.exposure.port
+		if tcpPort == 0 {
+			tcpPort = getAgentPort(svc.Service)
+		}
+		if tcpPort == 0 {
+			return nil, errors.New("fail to get the port number")
+		}
+		return []string{net.JoinHostPort(svc.exposure.host, strconv.Itoa(int(tcpPort)))}, nil
 	}
 
-	dnsNames, ips, err := extractTunnelServerDNSandIPs(svc, eps, nodeLst)
+	exposedDNSNames, exposedIPs, err := extractExposedDNSandIPs(svc, nodeLst)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	dnsNames, ips := appendServiceDNSandIPs(svc, eps, exposedDNSNames, exposedIPs)
 
-	for _, tmpIP := range ips {
-		// we use the first non-loopback IP address.
-		if tmpIP.String() != "127.0.0.1" {
-			ip = tmpIP
-			break
+	if preference == "" && len(svc.ipFamilies) > 0 {
+		preference = svc.ipFamilies[0]
+	}
+	// we use the non-loopback IP addresses exposing the service, and the
+	// first one of the service if there is none
+	var hosts []string
+	for _, ip := range orderIPs(exposedIPs, preference) {
+		hosts = append(hosts, ip.String())
+	}
+	if len(hosts) == 0 {
+		if ip := pickIP(ips, preference); ip != nil {
+			hosts = append(hosts, ip.String())
+		} else if len(dnsNames) != 0 {
+			hosts = append(hosts, dnsNames[0])
+		} else {
+			return nil, errors.New("there is no available ip")
 		}
 	}
 
-	if ip == nil {
-		if len(dnsNames) == 0 {
-			return "", errors.New("there is no available ip")
+	tcpPort := getAgentPort(svc.Service)
+	if tcpPort == 0 {
+		return nil, errors.New("fail to get the port number")
+	}
+
+	addrs := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(tcpPort))))
+	}
+	return addrs, nil
+}
+
+// FirstReachableAddr returns the first address that accepts the tcp
+// connection in timeout, or the first address if none of them does
+func FirstReachableAddr(addrs []string, timeout time.Duration) string {
+	if len(addrs) == 1 {
+		return addrs[0]
+	}
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			klog.Warningf("%s address %s is unreachable: %v", version.GetServerName(), addr, err)
+			continue
 		}
-		host = dnsNames[0]
-	} else {
-		host = ip.String()
+		conn.Close()
+		return addr
 	}
+	return addrs[0]
+}
 
+// getAgentPort gets the port of the service the agents connect to, which is
+// the node port of a NodePort service
+func getAgentPort(svc *v1.Service) int32 {
 	for _, port := range svc.Spec.Ports {
 		if port.Name == constants.TunnelServerAgentPortName {
-			tcpPort = port.Port
 			if svc.Spec.Type == v1.ServiceTypeNodePort {
-				tcpPort = port.NodePort
+				return port.NodePort
 			}
-			break
+			return port.Port
 		}
 	}
-
-	if tcpPort == 0 {
-		return "", errors.New("fail to get the port number")
-	}
-
-	return fmt.Sprintf("%s:%d", host, tcpPort), nil
+	return 0
 }
 
 // GetExcaliburTunelServerDNSandIP gets DNS names and IPS for generating tunnel server certificate.
@@ -104,10 +173,60 @@ func GetExcaliburTunelServerDNSandIP(
 	return extractTunnelServerDNSandIPs(svc, eps, nodeLst)
 }
 
+// tunnelServerService is the x-tunnel-server-svc service with the dual-stack
+// fields of kubernetes 1.20+, which are not in the api of client-go yet
+type tunnelServerService struct {
+	*v1.Service
+	// clusterIPs are the cluster ips of each ip family, the first one is
+	// the same as Spec.ClusterIP
+	clusterIPs []string
+	// ipFamilies are the ip families of the service, the first one is
+	// the primary family
+	ipFamilies []v1.IPFamily
+	// exposure is set by the x-tunnel-server-exposure annotation
+	exposure *exposure
+}
+
+// getTunnelServerService gets the x-tunnel-server-svc service, the raw
+// object is decoded for the dual-stack fields besides the typed service
+func getTunnelServerService(clientset kubernetes.Interface, ns string) (*tunnelServerService, error) {
+	data, err := clientset.CoreV1().RESTClient().Get().
+		Namespace(ns).
+		Resource("services").
+		Name(constants.TunnelServerServiceName).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	svc := &tunnelServerService{Service: &v1.Service{}}
+	if err := json.Unmarshal(data, svc.Service); err != nil {
+		return nil, fmt.Errorf("fail to decode service %s: %v", constants.TunnelServerServiceName, err)
+	}
+	var dualStack struct {
+		Spec struct {
+			ClusterIPs []string      `json:"clusterIPs,omitempty"`
+			IPFamilies []v1.IPFamily `json:"ipFamilies,omitempty"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(data, &dualStack); err != nil {
+		return nil, fmt.Errorf("fail to decode service %s: %v", constants.TunnelServerServiceName, err)
+	}
+	svc.clusterIPs = dualStack.Spec.ClusterIPs
+	if len(svc.clusterIPs) == 0 && svc.Spec.ClusterIP != "" {
+		svc.clusterIPs = []string{svc.Spec.ClusterIP}
+	}
+	svc.ipFamilies = dualStack.Spec.IPFamilies
+	// the single ip family of the alpha dual-stack before kubernetes 1.20
+	if len(svc.ipFamilies) == 0 && svc.Spec.IPFamily != nil {
+		svc.ipFamilies = []v1.IPFamily{*svc.Spec.IPFamily}
+	}
+	return svc, nil
+}
+
 // getTunnelServerResources get service, endpoints, and cloud nodes of tunnel server
-func getTunnelServerResources(clientset kubernetes.Interface) (*v1.Service, *v1.Endpoints, *v1.NodeList, error) {
+func getTunnelServerResources(clientset kubernetes.Interface) (*tunnelServerService, *v1.Endpoints, *v1.NodeList, error) {
 	var (
-		svc     *v1.Service
+		svc     *tunnelServerService
 		eps     *v1.Endpoints
 		nodeLst *v1.NodeList
 		err     error
@@ -116,13 +235,20 @@ func getTunnelServerResources(clientset kubernetes.Interface) (*v1.Service, *v1.
 
 	ns = os.Getenv(constants.TunnelServerNSEnv)
 	// get x-tunnel-server-svc service
-	svc, err = clientset.CoreV1().
-		Services(ns).
-		Get(constants.TunnelServerServiceName, metav1.GetOptions{})
+	svc, err = getTunnelServerService(clientset, ns)
 	if err != nil {
 		return svc, eps, nodeLst, err
 	}
 
+	// get the ingress, tlsroute or ExternalName service exposing the tunnel
+	// server instead of the service
+	if _, ok := svc.Annotations[constants.TunnelServerExposureKey]; ok {
+		svc.exposure, err = getExposure(clientset, svc.Service)
+		if err != nil {
+			return svc, eps, nodeLst, err
+		}
+	}
+
 	// get x-tunnel-server-svc endpoints
 	eps, err = clientset.CoreV1().
 		Endpoints(ns).
@@ -145,43 +271,66 @@ func getTunnelServerResources(clientset kubernetes.Interface) (*v1.Service, *v1.
 }
 
 // extractTunnelServerDNSandIPs extract tunnel server dnses and ips from service and endpoints
-func extractTunnelServerDNSandIPs(svc *v1.Service, eps *v1.Endpoints, nodeLst *v1.NodeList) ([]string, []net.IP, error) {
+func extractTunnelServerDNSandIPs(svc *tunnelServerService, eps *v1.Endpoints, nodeLst *v1.NodeList) ([]string, []net.IP, error) {
+	dnsNames, ips, err := extractExposedDNSandIPs(svc, nodeLst)
+	if err != nil {
+		return dnsNames, ips, err
+	}
+	dnsNames, ips = appendServiceDNSandIPs(svc, eps, dnsNames, ips)
+	return dnsNames, ips, nil
+}
+
+// extractExposedDNSandIPs extract the dnses and ips exposing the tunnel server
+// by the type of the service
+func extractExposedDNSandIPs(svc *tunnelServerService, nodeLst *v1.NodeList) ([]string, []net.IP, error) {
 	var (
 		dnsNames = make([]string, 0)
 		ips      = make([]net.IP, 0)
 		err      error
 	)
 
+	// extract dns and ip from the exposure set by the annotation
+	if svc.exposure != nil {
+		dnsNames = append(dnsNames, svc.exposure.dnsNames...)
+		ips = append(ips, svc.exposure.ips...)
+		return dnsNames, ips, nil
+	}
+
 	// extract dns and ip from the service
 	switch svc.Spec.Type {
 	case v1.ServiceTypeLoadBalancer:
 		// make sure lb ip address is the first index in return ips slice
-		dnsNames, ips, err = getLoadBalancerDNSandIP(svc)
+		dnsNames, ips, err = getLoadBalancerDNSandIP(svc.Service)
 	case v1.ServiceTypeClusterIP:
 		// make sure annotation setting address is the first index in return ips slice
-		dnsNames, ips, err = getClusterIPDNSandIP(svc)
+		dnsNames, ips, err = getClusterIPDNSandIP(svc.Service)
 	case v1.ServiceTypeNodePort:
-		dnsNames, ips, err = getNodePortDNSandIP(nodeLst)
+		dnsNames, ips, err = getNodePortDNSandIP(svc.Service, nodeLst)
 	default:
 		err = fmt.Errorf("unsupported service type: %s", string(svc.Spec.Type))
 	}
+	return dnsNames, ips, err
+}
 
-	if err != nil {
-		return dnsNames, ips, err
-	}
-
-	// extract dns and ip from ClusterIP info
+// appendServiceDNSandIPs appends the dnses and ips of the service, the
+// loopback addresses and the endpoints
+func appendServiceDNSandIPs(svc *tunnelServerService, eps *v1.Endpoints,
+	dnsNames []string, ips []net.IP) ([]string, []net.IP) {
+	// extract dns and ip from ClusterIP info, including the ones of each
+	// ip family of a dual-stack service
 	dnsNames = append(dnsNames, getDefaultDomainsForSvc(svc.Namespace, svc.Name)...)
-	if svc.Spec.ClusterIP != "None" {
-		ips = append(ips, net.ParseIP(svc.Spec.ClusterIP))
+	for _, clusterIP := range svc.clusterIPs {
+		if ip := net.ParseIP(clusterIP); ip != nil {
+			ips = append(ips, ip)
+		}
 	}
-	ips = append(ips, net.ParseIP("127.0.0.1"))
+	ips = append(ips, net.ParseIP("127.0.0.1"), net.IPv6loopback)
 
 	// extract dns and ip from the endpoint
 	for _, ss := range eps.Subsets {
 		for _, addr := range ss.Addresses {
-			if len(addr.IP) != 0 {
-				ips = append(ips, net.ParseIP(addr.IP))
+			if ip := net.ParseIP(addr.IP); ip != nil {
+				ips = append(ips, ip)
 			}
 
 			if len(addr.Hostname) != 0 {
@@ -189,8 +338,7 @@ func extractTunnelServerDNSandIPs(svc *v1.Service, eps *v1.Endpoints, nodeLst *v
 			}
 		}
 	}
-
-	return dnsNames, ips, nil
+	return dnsNames, ips
 }
 
 // getLoadBalancerDNSandIP gets the DNS names and IPs from the LoadBalancer service.
@@ -205,8 +353,8 @@ func getLoadBalancerDNSandIP(svc *v1.Service) ([]string, []net.IP, error) {
 	}
 
 	for _, ingress := range svc.Status.LoadBalancer.Ingress {
-		if ingress.IP != "" {
-			ips = append(ips, net.ParseIP(ingress.IP))
+		if ip := net.ParseIP(ingress.IP); ip != nil {
+			ips = append(ips, ip)
 		}
 
 		if ingress.Hostname != "" {
@@ -242,31 +390,81 @@ func getClusterIPDNSandIP(svc *v1.Service) ([]string, []net.IP, error) {
 	return dnsNames, ips, nil
 }
 
-// getClusterIPDNSandIP gets the DNS names and IPs from the NodePort service
-func getNodePortDNSandIP(nodeLst *v1.NodeList) ([]string, []net.IP, error) {
+// getNodePortDNSandIP gets the DNS names and IPs from the NodePort service, which
+// are the addresses of all of the ready and schedulable nodes, the addresses of
+// the type set by the x-tunnel-server-node-address-type annotation come first
+func getNodePortDNSandIP(svc *v1.Service, nodeLst *v1.NodeList) ([]string, []net.IP, error) {
 	var (
-		dnsNames = make([]string, 0)
-		ips      = make([]net.IP, 0)
-		ipFound  bool
+		dnsNames     = make([]string, 0)
+		ips          = make([]net.IP, 0)
+		preferredIPs = make([]net.IP, 0)
+		addressType  = v1.NodeInternalIP
 	)
 
 	if nodeLst == nil || len(nodeLst.Items) == 0 {
 		return dnsNames, ips, errors.New("there is no cloud node")
 	}
 
-	for _, addr := range nodeLst.Items[0].Status.Addresses {
-		if addr.Type == v1.NodeInternalIP {
-			ipFound = true
-			ips = append(ips, net.ParseIP(addr.Address))
+	if t, ok := svc.Annotations[constants.TunnelServerNodeAddressTypeKey]; ok {
+		switch v1.NodeAddressType(t) {
+		case v1.NodeInternalIP, v1.NodeExternalIP:
+			addressType = v1.NodeAddressType(t)
+		default:
+			return dnsNames, ips, fmt.Errorf("unsupported node address type of annotation %s: %s, must be %s or %s",
+				constants.TunnelServerNodeAddressTypeKey, t, v1.NodeInternalIP, v1.NodeExternalIP)
+		}
+	}
+
+	nodes := getAvailableNodes(nodeLst.Items)
+	if len(nodes) == 0 {
+		// it is better to try the nodes than nothing, e.g. all of them are
+		// cordoned for the maintenance
+		klog.Warningf("none of the %d %s nodes is ready and schedulable, use all of them",
+			len(nodeLst.Items), version.GetServerName())
+		nodes = nodeLst.Items
+	}
+
+	// a dual-stack node has an internal ip of each ip family
+	for _, node := range nodes {
+		for _, addr := range node.Status.Addresses {
+			ip := net.ParseIP(addr.Address)
+			if ip == nil {
+				continue
+			}
+			switch addr.Type {
+			case addressType:
+				preferredIPs = append(preferredIPs, ip)
+			case v1.NodeInternalIP, v1.NodeExternalIP:
+				ips = append(ips, ip)
+			}
 		}
 	}
-	if !ipFound {
-		// there is no qualified address (i.e. NodeInternalIP)
+	ips = append(preferredIPs, ips...)
+	if len(ips) == 0 {
+		// there is no qualified address (i.e. NodeInternalIP or NodeExternalIP)
 		return dnsNames, ips, errors.New("can't find node IP")
 	}
 	return dnsNames, ips, nil
 }
 
+// getAvailableNodes gets the nodes which are ready, schedulable and not
+// being deleted
+func getAvailableNodes(nodes []v1.Node) []v1.Node {
+	var available []v1.Node
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || node.DeletionTimestamp != nil {
+			continue
+		}
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == v1.NodeReady && cond.Status == v1.ConditionTrue {
+				available = append(available, node)
+				break
+			}
+		}
+	}
+	return available
+}
+
 // getDefaultDomainsForSvc get default domains for specified service
 func getDefaultDomainsForSvc(ns, name string) []string {
 	domains := make([]string, 0)
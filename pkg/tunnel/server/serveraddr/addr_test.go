@@ -0,0 +1,181 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serveraddr
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+)
+
+func parseIPs(ips ...string) []net.IP {
+	var parsed []net.IP
+	for _, ip := range ips {
+		parsed = append(parsed, net.ParseIP(ip))
+	}
+	return parsed
+}
+
+func ipStrings(ips []net.IP) []string {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+func TestValidateIPFamilyPreference(t *testing.T) {
+	for _, preference := range []string{"", "IPv4", "IPv6"} {
+		if err := ValidateIPFamilyPreference(preference); err != nil {
+			t.Errorf("unexpected error of %q: %v", preference, err)
+		}
+	}
+	if err := ValidateIPFamilyPreference("ipv4"); err == nil {
+		t.Error("expected the lower case ip family to be invalid")
+	}
+}
+
+func TestOrderIPs(t *testing.T) {
+	ips := parseIPs("127.0.0.1", "fd00::1", "10.0.0.1", "::1", "fd00::2", "10.0.0.2")
+	cases := []struct {
+		name       string
+		ips        []net.IP
+		preference v1.IPFamily
+		expected   []string
+	}{
+		{name: "no preference", ips: ips, expected: []string{"fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2"}},
+		{name: "ipv4", ips: ips, preference: v1.IPv4Protocol,
+			expected: []string{"10.0.0.1", "10.0.0.2", "fd00::1", "fd00::2"}},
+		{name: "ipv6", ips: ips, preference: v1.IPv6Protocol,
+			expected: []string{"fd00::1", "fd00::2", "10.0.0.1", "10.0.0.2"}},
+		{name: "fall back to the other family", ips: parseIPs("10.0.0.1"), preference: v1.IPv6Protocol,
+			expected: []string{"10.0.0.1"}},
+		{name: "only loopback", ips: parseIPs("127.0.0.1", "::1"), preference: v1.IPv4Protocol},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ipStrings(orderIPs(c.ips, c.preference))
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+			picked := pickIP(c.ips, c.preference)
+			if len(c.expected) == 0 && picked != nil {
+				t.Errorf("expected no ip picked, got %v", picked)
+			}
+			if len(c.expected) != 0 && (picked == nil || picked.String() != c.expected[0]) {
+				t.Errorf("expected %s picked, got %v", c.expected[0], picked)
+			}
+		})
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	addrs := []string{"[fd00::1]:31502", "tunnel.example.com:443", "10.0.0.1:31502"}
+	cases := []struct {
+		preference v1.IPFamily
+		expected   []string
+	}{
+		{preference: "", expected: addrs},
+		{preference: v1.IPv4Protocol, expected: []string{"tunnel.example.com:443", "10.0.0.1:31502", "[fd00::1]:31502"}},
+		{preference: v1.IPv6Protocol, expected: []string{"[fd00::1]:31502", "tunnel.example.com:443", "10.0.0.1:31502"}},
+	}
+	for _, c := range cases {
+		if got := orderAddrs(addrs, c.preference); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("expected %v of preference %q, got %v", c.expected, c.preference, got)
+		}
+	}
+}
+
+// node creates a node with the addresses, which are internal ones unless
+// they are prefixed with "external:"
+func node(name string, ready, unschedulable bool, addrs ...string) v1.Node {
+	n := v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	n.Spec.Unschedulable = unschedulable
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	n.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: status}}
+	for _, addr := range addrs {
+		addrType := v1.NodeInternalIP
+		if strings.HasPrefix(addr, "external:") {
+			addrType, addr = v1.NodeExternalIP, strings.TrimPrefix(addr, "external:")
+		}
+		n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: addrType, Address: addr})
+	}
+	n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: name})
+	return n
+}
+
+func TestGetNodePortDNSandIP(t *testing.T) {
+	deleting := node("deleting", true, false, "10.0.0.4")
+	deleting.DeletionTimestamp = &metav1.Time{}
+	cases := []struct {
+		name        string
+		addressType string
+		nodes       []v1.Node
+		expected    []string
+		// err is the substring of the error, empty means no error
+		err string
+	}{
+		{name: "no node", err: "there is no cloud node"},
+		{name: "available nodes", nodes: []v1.Node{
+			node("ready", true, false, "10.0.0.1", "fd00::1", "external:1.1.1.1"),
+			node("not-ready", false, false, "10.0.0.2"),
+			node("cordoned", true, true, "10.0.0.3"),
+			deleting,
+		}, expected: []string{"10.0.0.1", "fd00::1", "1.1.1.1"}},
+		{name: "external addresses first", addressType: "ExternalIP", nodes: []v1.Node{
+			node("a", true, false, "10.0.0.1", "external:1.1.1.1"),
+			node("b", true, false, "10.0.0.2", "external:1.1.1.2"),
+		}, expected: []string{"1.1.1.1", "1.1.1.2", "10.0.0.1", "10.0.0.2"}},
+		{name: "all of the nodes if none is available", nodes: []v1.Node{
+			node("a", false, false, "10.0.0.1"),
+			node("b", true, true, "10.0.0.2"),
+		}, expected: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "unsupported address type", addressType: "Hostname",
+			nodes: []v1.Node{node("a", true, false, "10.0.0.1")}, err: "unsupported node address type"},
+		{name: "no address", nodes: []v1.Node{node("a", true, false)}, err: "can't find node IP"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			svc := &v1.Service{}
+			if c.addressType != "" {
+				svc.Annotations = map[string]string{constants.TunnelServerNodeAddressTypeKey: c.addressType}
+			}
+			_, ips, err := getNodePortDNSandIP(svc, &v1.NodeList{Items: c.nodes})
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("expected error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got := ipStrings(ips); !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serveraddr
+
+import (
+	"os"
+	"strings"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the keys of the data of the bootstrap configmap
+const (
+	// BootstrapEndpointsKey is the comma separated candidate addresses
+	// the agents dial
+	BootstrapEndpointsKey = "endpoints"
+	// BootstrapCAKey is the PEM encoded CA bundle verifying the tunnel
+	// server
+	BootstrapCAKey = "ca.crt"
+	// BootstrapTransportsKey is the comma separated transports the tunnel
+	// server accepts from the agents
+	BootstrapTransportsKey = "transports"
+)
+
+// TransportGRPC is the transport of the agents, i.e. the grpc
+// connections over mTLS
+const TransportGRPC = "grpc"
+
+// BootstrapInfo is the connection information of the tunnel server which
+// is published in the bootstrap configmap, so that the agents connect to
+// the tunnel server without the permissions on the services, endpoints
+// and nodes of the hub cluster
+type BootstrapInfo struct {
+	// Endpoints are the candidate addresses the agents dial
+	Endpoints []string
+	// CAData is the PEM encoded CA bundle verifying the tunnel server
+	CAData []byte
+	// Transports are the transports the tunnel server accepts
+	Transports []string
+}
+
+// ToConfigMap converts the information to the bootstrap configmap in the
+// namespace of the tunnel server
+func (b *BootstrapInfo) ToConfigMap() *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      constants.TunnelServerBootstrapConfigMapName,
+			Namespace: os.Getenv(constants.TunnelServerNSEnv),
+		},
+		Data: map[string]string{
+			BootstrapEndpointsKey:  strings.Join(b.Endpoints, ","),
+			BootstrapCAKey:         string(b.CAData),
+			BootstrapTransportsKey: strings.Join(b.Transports, ","),
+		},
+	}
+}
+
+// GetBootstrapInfo gets the connection information of the tunnel server
+// from the bootstrap configmap
+func GetBootstrapInfo(clientset kubernetes.Interface) (*BootstrapInfo, error) {
+	cm, err := clientset.CoreV1().
+		ConfigMaps(os.Getenv(constants.TunnelServerNSEnv)).
+		Get(constants.TunnelServerBootstrapConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &BootstrapInfo{
+		Endpoints:  splitList(cm.Data[BootstrapEndpointsKey]),
+		CAData:     []byte(cm.Data[BootstrapCAKey]),
+		Transports: splitList(cm.Data[BootstrapTransportsKey]),
+	}, nil
+}
+
+// splitList splits the comma separated list, the empty items are dropped
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
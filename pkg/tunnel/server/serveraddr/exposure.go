@@ -0,0 +1,296 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serveraddr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the sources of the exposure set by the x-tunnel-server-exposure annotation
+const (
+	exposureIngress      = "ingress"
+	exposureTLSRoute     = "tlsroute"
+	exposureExternalName = "externalname"
+
+	// the ingress controllers and gateways passthrough the tls connections
+	// on the https port by default
+	defaultTLSPassthroughPort = 443
+)
+
+var (
+	ingressVersions  = []string{"v1", "v1beta1"}
+	tlsRouteVersions = []string{"v1alpha3", "v1alpha2"}
+	gatewayVersions  = []string{"v1", "v1beta1"}
+)
+
+// exposure is the address exposing the tunnel server other than the
+// x-tunnel-server-svc service itself, e.g. an ingress with tls passthrough
+type exposure struct {
+	// host is dialed by the agents, which is the server name of the tls
+	// handshake as well, so that the connections are routed by SNI
+	host string
+	// port is dialed by the agents, the agent port of the service is used
+	// if it is 0
+	port int32
+	// dnsNames and ips are added into the tunnel-server certificate
+	dnsNames []string
+	ips      []net.IP
+}
+
+// getExposure gets the exposure set by the x-tunnel-server-exposure
+// annotation of the service, in the form of {ingress|tlsroute|externalname}/{name},
+// the object is in the namespace of the service
+func getExposure(clientset kubernetes.Interface, svc *v1.Service) (*exposure, error) {
+	source := svc.Annotations[constants.TunnelServerExposureKey]
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("annotation %s(%s) of %s service should be in the form of "+
+			"{ingress|tlsroute|externalname}/{name}",
+			constants.TunnelServerExposureKey, source, constants.TunnelServerServiceName)
+	}
+
+	var (
+		exp *exposure
+		err error
+	)
+	switch kind, name := strings.ToLower(parts[0]), parts[1]; kind {
+	case exposureIngress:
+		exp, err = getIngressExposure(clientset, svc.Namespace, name)
+	case exposureTLSRoute:
+		exp, err = getTLSRouteExposure(clientset, svc.Namespace, name)
+	case exposureExternalName:
+		exp, err = getExternalNameExposure(clientset, svc.Namespace, name)
+	default:
+		err = fmt.Errorf("unsupported exposure of annotation %s: %s",
+			constants.TunnelServerExposureKey, parts[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to get the exposure %s of %s service: %v",
+			source, constants.TunnelServerServiceName, err)
+	}
+	if exp.host == "" {
+		return nil, fmt.Errorf("%s has no host for the agents to dial", source)
+	}
+	return exp, nil
+}
+
+// ingress is the part of networking.k8s.io ingress used by the discovery,
+// which is the same in v1 and v1beta1
+type ingress struct {
+	Spec struct {
+		TLS []struct {
+			Hosts []string `json:"hosts,omitempty"`
+		} `json:"tls,omitempty"`
+		Rules []struct {
+			Host string `json:"host,omitempty"`
+		} `json:"rules,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer v1.LoadBalancerStatus `json:"loadBalancer,omitempty"`
+	} `json:"status"`
+}
+
+// getIngressExposure gets the exposure of the ingress whose controller
+// passthroughs the tls connections of the rule host to the tunnel server
+func getIngressExposure(clientset kubernetes.Interface, ns, name string) (*exposure, error) {
+	ing := &ingress{}
+	if err := getRaw(clientset, "networking.k8s.io", ingressVersions, ns, "ingresses", name, ing); err != nil {
+		return nil, err
+	}
+
+	exp := &exposure{port: defaultTLSPassthroughPort}
+	for _, rule := range ing.Spec.Rules {
+		exp.addHost(rule.Host)
+	}
+	for _, tls := range ing.Spec.TLS {
+		for _, host := range tls.Hosts {
+			exp.addHost(host)
+		}
+	}
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		exp.addAddress(lb.IP)
+		exp.addAddress(lb.Hostname)
+	}
+	return exp, nil
+}
+
+// tlsRoute is the part of gateway.networking.k8s.io TLSRoute used by the
+// discovery
+type tlsRoute struct {
+	Spec struct {
+		ParentRefs []struct {
+			Namespace   *string `json:"namespace,omitempty"`
+			Name        string  `json:"name"`
+			SectionName *string `json:"sectionName,omitempty"`
+			Port        *int32  `json:"port,omitempty"`
+		} `json:"parentRefs,omitempty"`
+		Hostnames []string `json:"hostnames,omitempty"`
+	} `json:"spec"`
+}
+
+// gateway is the part of gateway.networking.k8s.io Gateway used by the
+// discovery
+type gateway struct {
+	Spec struct {
+		Listeners []struct {
+			Name     string  `json:"name"`
+			Hostname *string `json:"hostname,omitempty"`
+			Port     int32   `json:"port"`
+			Protocol string  `json:"protocol"`
+		} `json:"listeners,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Value string `json:"value"`
+		} `json:"addresses,omitempty"`
+	} `json:"status"`
+}
+
+// getTLSRouteExposure gets the exposure of the TLSRoute, the agents dial
+// the route hostname on the port of the listener of its first parent
+// gateway
+func getTLSRouteExposure(clientset kubernetes.Interface, ns, name string) (*exposure, error) {
+	route := &tlsRoute{}
+	if err := getRaw(clientset, "gateway.networking.k8s.io", tlsRouteVersions, ns, "tlsroutes", name, route); err != nil {
+		return nil, err
+	}
+	if len(route.Spec.ParentRefs) == 0 {
+		return nil, fmt.Errorf("tlsroute %s/%s has no parent gateway", ns, name)
+	}
+
+	exp := &exposure{port: defaultTLSPassthroughPort}
+	for _, host := range route.Spec.Hostnames {
+		exp.addHost(host)
+	}
+
+	ref := route.Spec.ParentRefs[0]
+	gwNamespace := ns
+	if ref.Namespace != nil && *ref.Namespace != "" {
+		gwNamespace = *ref.Namespace
+	}
+	gw := &gateway{}
+	if err := getRaw(clientset, "gateway.networking.k8s.io", gatewayVersions, gwNamespace, "gateways", ref.Name, gw); err != nil {
+		return nil, err
+	}
+	// the listener of the section, or the first tls one
+	for _, l := range gw.Spec.Listeners {
+		if (ref.SectionName != nil && l.Name == *ref.SectionName) ||
+			(ref.SectionName == nil && strings.EqualFold(l.Protocol, "TLS")) {
+			exp.port = l.Port
+			if l.Hostname != nil {
+				exp.addHost(*l.Hostname)
+			}
+			break
+		}
+	}
+	if ref.Port != nil {
+		exp.port = *ref.Port
+	}
+	for _, addr := range gw.Status.Addresses {
+		exp.addAddress(addr.Value)
+	}
+	return exp, nil
+}
+
+// getExternalNameExposure gets the exposure of the ExternalName service,
+// the agents dial the external name on the port named tcp of the service
+// if there is one
+func getExternalNameExposure(clientset kubernetes.Interface, ns, name string) (*exposure, error) {
+	svc, err := clientset.CoreV1().Services(ns).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if svc.Spec.Type != v1.ServiceTypeExternalName {
+		return nil, fmt.Errorf("service %s/%s is not an ExternalName service", ns, name)
+	}
+
+	exp := &exposure{}
+	exp.addAddress(svc.Spec.ExternalName)
+	exp.host = strings.TrimSuffix(svc.Spec.ExternalName, ".")
+	for _, port := range svc.Spec.Ports {
+		if port.Name == constants.TunnelServerAgentPortName {
+			exp.port = port.Port
+			break
+		}
+	}
+	return exp, nil
+}
+
+// addHost adds the host to the dns names, the first non-wildcard one is
+// dialed by the agents
+func (e *exposure) addHost(host string) {
+	if host == "" {
+		return
+	}
+	if e.host == "" && !strings.HasPrefix(host, "*") {
+		e.host = host
+	}
+	e.addAddress(host)
+}
+
+// addAddress adds the ip or dns name into the certificate
+func (e *exposure) addAddress(addr string) {
+	addr = strings.TrimSuffix(addr, ".")
+	if addr == "" {
+		return
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		e.ips = append(e.ips, ip)
+		return
+	}
+	for _, name := range e.dnsNames {
+		if name == addr {
+			return
+		}
+	}
+	e.dnsNames = append(e.dnsNames, addr)
+}
+
+// getRaw gets the object of the first version served by the hub, the
+// objects of the api groups which are not in the api of client-go are
+// decoded from the raw response
+func getRaw(clientset kubernetes.Interface, group string, versions []string,
+	ns, resource, name string, into interface{}) error {
+	var err error
+	for _, version := range versions {
+		var data []byte
+		data, err = clientset.Discovery().RESTClient().Get().
+			AbsPath("/apis", group, version, "namespaces", ns, resource, name).
+			DoRaw()
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, into); err != nil {
+			return fmt.Errorf("fail to decode %s %s/%s: %v", resource, ns, name, err)
+		}
+		return nil
+	}
+	return err
+}
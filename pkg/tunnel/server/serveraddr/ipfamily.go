@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serveraddr
+
+import (
+	"fmt"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ValidateIPFamilyPreference validates the preferred ip family of the
+// tunnel server address, which is IPv4, IPv6 or empty for no preference
+func ValidateIPFamilyPreference(preference string) error {
+	switch v1.IPFamily(preference) {
+	case "", v1.IPv4Protocol, v1.IPv6Protocol:
+		return nil
+	}
+	return fmt.Errorf("unsupported ip family %q, must be %s or %s",
+		preference, v1.IPv4Protocol, v1.IPv6Protocol)
+}
+
+// pickIP picks the first non-loopback ip of the preferred family, or the
+// first non-loopback one of the other family if there is none
+func pickIP(ips []net.IP, preference v1.IPFamily) net.IP {
+	if ordered := orderIPs(ips, preference); len(ordered) > 0 {
+		return ordered[0]
+	}
+	return nil
+}
+
+// orderIPs returns the non-loopback ips, the ones of the preferred family
+// come first and the order of the ips of the same family is kept
+func orderIPs(ips []net.IP, preference v1.IPFamily) []net.IP {
+	var preferred, others []net.IP
+	for _, ip := range ips {
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		if preference == "" || getIPFamily(ip) == preference {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// getIPFamily gets the family of the ip
+func getIPFamily(ip net.IP) v1.IPFamily {
+	if ip.To4() != nil {
+		return v1.IPv4Protocol
+	}
+	return v1.IPv6Protocol
+}
+
+// orderAddrs returns the addresses whose hosts are of the preferred family
+// first, the hosts which are not ips are regarded as preferred
+func orderAddrs(addrs []string, preference v1.IPFamily) []string {
+	var preferred, others []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || preference == "" || getIPFamily(ip) == preference {
+			preferred = append(preferred, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	return append(preferred, others...)
+}
@@ -36,6 +36,10 @@ func GetAgentName() string {
 	return componentPrefix + "tunnel-agent"
 }
 
+func GetCtlName() string {
+	return componentPrefix + "tunnel-ctl"
+}
+
 // GetTunnelServerLabelKey returns the tunnel server label, which is used to
 // launch tunnel server
 func GetTunnelServerLabelKey() string {
@@ -0,0 +1,418 @@
+//go:build e2e
+// +build e2e
+
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/config"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server/serveraddr"
+	"github.com/tkestack/tke-excalibur/test/e2e/framework"
+)
+
+// scenario is an end-to-end scenario, the scenarios run in order against
+// the same deployment
+type scenario struct {
+	name string
+	run  func(f *framework.Framework) error
+}
+
+var scenarios = []scenario{
+	{"server certificate issuance", testServerCertificate},
+	{"agent registration", testAgentRegistration},
+	{"proxy through the master mTLS port", testMasterProxy},
+	{"proxy through the master insecure port", testInsecureMasterProxy},
+	{"reverse proxy routing", testReverseProxy},
+	{"agent reconnect after server restart", testAgentReconnect},
+	{"proxy through the master unix socket", testUDSProxy},
+	{"server configuration file", testServerConfig},
+	{"dual-stack and disabled listeners", testListeners},
+	{"bootstrap configmap publication", testBootstrapConfigMap},
+}
+
+var (
+	clusterName = flag.String("cluster-name", "cls-e2e", "The name of the managed cluster.")
+	logFile     = flag.String("log-file", "", "The log file of the server and agent, "+
+		"a temporary file is used if not set.")
+)
+
+func TestMain(m *testing.M) {
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	if *logFile == "" {
+		file, err := ioutil.TempFile("", "excalibur-e2e-*.log")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to create the log file: %v\n", err)
+			os.Exit(1)
+		}
+		file.Close()
+		*logFile = file.Name()
+	}
+	flag.Set("logtostderr", "false")
+	flag.Set("alsologtostderr", "false")
+	flag.Set("stderrthreshold", "FATAL")
+	flag.Set("log_file", *logFile)
+	fmt.Printf("logs of the server and agent: %s\n", *logFile)
+
+	code := m.Run()
+	klog.Flush()
+	os.Exit(code)
+}
+
+// TestTunnel runs the scenarios in order, and stops at the first failed
+// one since the later ones depend on it
+func TestTunnel(t *testing.T) {
+	f, err := framework.New(*clusterName)
+	if err != nil {
+		t.Fatalf("fail to set up: %v", err)
+	}
+	defer f.Close()
+
+	for _, s := range scenarios {
+		s := s
+		passed := t.Run(s.name, func(t *testing.T) {
+			if err := s.run(f); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !passed {
+			t.FailNow()
+		}
+	}
+}
+
+// testServerCertificate starts the server, which creates a CSR, approves
+// it and is served with the certificate signed by the hub
+func testServerCertificate(f *framework.Framework) error {
+	if err := f.StartServer(); err != nil {
+		return fmt.Errorf("fail to start the server: %v", err)
+	}
+	return expectSignedCSR(f, constants.TunnelServerCSRCN)
+}
+
+// testAgentRegistration starts the agent, whose CSR is approved by the
+// server, and expects it to be listed by the admin api
+func testAgentRegistration(f *framework.Framework) error {
+	if err := f.StartAgent(); err != nil {
+		return fmt.Errorf("fail to start the agent: %v", err)
+	}
+	if err := expectSignedCSR(f, f.ClusterName); err != nil {
+		return err
+	}
+	client, err := f.AdminClient()
+	if err != nil {
+		return err
+	}
+	list, err := client.ListAgents()
+	if err != nil {
+		return err
+	}
+	for _, a := range list.Items {
+		if a.ID == f.ClusterName && a.CommonName == f.ClusterName {
+			return nil
+		}
+	}
+	return fmt.Errorf("agent %s is not listed: %+v", f.ClusterName, list.Items)
+}
+
+func testMasterProxy(f *framework.Framework) error {
+	client, err := f.MasterClient()
+	if err != nil {
+		return err
+	}
+	return expectBackend(f, client)
+}
+
+func testInsecureMasterProxy(f *framework.Framework) error {
+	return expectBackend(f, f.InsecureMasterClient())
+}
+
+// testReverseProxy expects the health check to be served by the reverse
+// proxy and the other requests to be proxied to the hub apiserver
+func testReverseProxy(f *framework.Framework) error {
+	tlsCfg, err := f.ClientTLSConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		Timeout:   10 * time.Second,
+	}
+	base := "https://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(f.Ports.ReverseProxy))
+
+	body, err := get(client, base+"/v1/healthz", nil)
+	if err != nil {
+		return err
+	}
+	if body != "OK" {
+		return fmt.Errorf("unexpected health check response: %q", body)
+	}
+
+	body, err = get(client, base+"/version", http.Header{"Authorization": {"Bearer " + framework.HubToken}})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(body, "excalibur-e2e") {
+		return fmt.Errorf("request is not proxied to the hub apiserver: %q", body)
+	}
+	return nil
+}
+
+// testAgentReconnect restarts the server and expects the agent to
+// connect to the new server
+func testAgentReconnect(f *framework.Framework) error {
+	if err := f.StopServer(); err != nil {
+		return fmt.Errorf("fail to stop the server: %v", err)
+	}
+	if err := f.StartServer(); err != nil {
+		return fmt.Errorf("fail to restart the server: %v", err)
+	}
+	if err := f.WaitForAgent(); err != nil {
+		return fmt.Errorf("agent does not reconnect: %v", err)
+	}
+	return testMasterProxy(f)
+}
+
+// testUDSProxy restarts the server with the master unix socket
+func testUDSProxy(f *framework.Framework) error {
+	udsName := filepath.Join(f.Dir, "uds", "proxy.sock")
+	if err := os.MkdirAll(filepath.Dir(udsName), 0700); err != nil {
+		return err
+	}
+	if err := f.StopServer(); err != nil {
+		return fmt.Errorf("fail to stop the server: %v", err)
+	}
+	if err := f.StartServer("--uds-name=" + udsName); err != nil {
+		return fmt.Errorf("fail to restart the server: %v", err)
+	}
+	if err := f.WaitForAgent(); err != nil {
+		return fmt.Errorf("agent does not reconnect: %v", err)
+	}
+	return expectBackend(f, f.UDSClient(udsName))
+}
+
+// testServerConfig restarts the server with a configuration file, which
+// proxies the norm api to the managed apiserver, and whose ports are
+// overridden by the flags of the framework
+func testServerConfig(f *framework.Framework) error {
+	configFile := filepath.Join(f.Dir, "server-config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`apiVersion: %s
+kind: %s
+ports:
+  agent: 1
+  admin: 2
+normServerURL: %s
+keepAlive:
+  time: 20s
+`, config.APIVersion, config.TunnelServerConfigurationKind, f.Backend.URL)), 0600); err != nil {
+		return err
+	}
+	if err := f.StopServer(); err != nil {
+		return fmt.Errorf("fail to stop the server: %v", err)
+	}
+	if err := f.StartServer("--config=" + configFile); err != nil {
+		return fmt.Errorf("fail to restart the server: %v", err)
+	}
+	if err := f.WaitForAgent(); err != nil {
+		return fmt.Errorf("agent does not reconnect: %v", err)
+	}
+
+	tlsCfg, err := f.ClientTLSConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		Timeout:   10 * time.Second,
+	}
+	body, err := get(client, "https://"+net.JoinHostPort("127.0.0.1", strconv.Itoa(f.Ports.ReverseProxy))+
+		"/norm/api/v1", nil)
+	if err != nil {
+		return err
+	}
+	if want := f.ClusterName + " /norm/api/v1"; body != want {
+		return fmt.Errorf("norm api is not proxied to normServerURL, got %q, expect %q", body, want)
+	}
+	return nil
+}
+
+// testListeners restarts the server with the insecure master port on both
+// of IPv4 and IPv6 loopback addresses, and the reverse proxy disabled
+func testListeners(f *framework.Framework) error {
+	if err := f.StopServer(); err != nil {
+		return fmt.Errorf("fail to stop the server: %v", err)
+	}
+	if err := f.StartServer("--insecure-bind-address=127.0.0.1,::1", "--reverse-proxy-port=0"); err != nil {
+		return fmt.Errorf("fail to restart the server: %v", err)
+	}
+	if err := f.WaitForAgent(); err != nil {
+		return fmt.Errorf("agent does not reconnect: %v", err)
+	}
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		if err := expectBackend(f, f.InsecureMasterClientAt(host)); err != nil {
+			return fmt.Errorf("fail to proxy through %s: %v", host, err)
+		}
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(f.Ports.ReverseProxy))
+	if conn, err := net.DialTimeout("tcp", address, 5*time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("reverse proxy is still listening on %s", address)
+	}
+	return nil
+}
+
+// testBootstrapConfigMap expects the server to publish the address of the
+// service and the hub CA in the bootstrap configmap, which the agent
+// discovers the server from without the permissions on the services,
+// endpoints and nodes
+func testBootstrapConfigMap(f *framework.Framework) error {
+	var cm *v1.ConfigMap
+	err := wait.PollImmediate(500*time.Millisecond, 10*time.Second, func() (bool, error) {
+		var err error
+		cm, err = f.Hub.ConfigMap(framework.Namespace, constants.TunnelServerBootstrapConfigMapName)
+		return err == nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("configmap %s is not published: %v", constants.TunnelServerBootstrapConfigMapName, err)
+	}
+	endpoint := net.JoinHostPort("10.96.0.100", strconv.Itoa(constants.TunnelServerAgentPort))
+	if got := cm.Data[serveraddr.BootstrapEndpointsKey]; got != endpoint {
+		return fmt.Errorf("unexpected endpoints %q, expect %q", got, endpoint)
+	}
+	if got := cm.Data[serveraddr.BootstrapCAKey]; got != string(f.CA.CertPEM) {
+		return fmt.Errorf("published CA is not the hub CA: %q", got)
+	}
+	if got := cm.Data[serveraddr.BootstrapTransportsKey]; got != serveraddr.TransportGRPC {
+		return fmt.Errorf("unexpected transports %q", got)
+	}
+
+	client, err := f.AgentHubClient()
+	if err != nil {
+		return err
+	}
+	addrs, err := serveraddr.GetTunnelServerAddrs(client, "")
+	if err != nil {
+		return fmt.Errorf("agent fails to discover the server: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != endpoint {
+		return fmt.Errorf("agent discovers %v, expect %s", addrs, endpoint)
+	}
+	if forbidden := f.Hub.Forbidden(); len(forbidden) != 0 {
+		return fmt.Errorf("agent is denied by the hub: %v", forbidden)
+	}
+	// the agent can't fall back to the service, so the discovery above
+	// was served by the configmap
+	if _, err := serveraddr.DiscoverTunnelServerAddrs(client, ""); !apierrors.IsForbidden(err) {
+		return fmt.Errorf("expect the agent forbidden to discover from the service, got %v", err)
+	}
+	return nil
+}
+
+// expectSignedCSR expects a CSR with the common name is approved and
+// signed by the hub
+func expectSignedCSR(f *framework.Framework, commonName string) error {
+	csrs, err := f.Hub.CSRs()
+	if err != nil {
+		return err
+	}
+	for _, csr := range csrs {
+		block, _ := pem.Decode(csr.Spec.Request)
+		if block == nil {
+			continue
+		}
+		req, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || req.Subject.CommonName != commonName {
+			continue
+		}
+		if !approved(&csr) {
+			return fmt.Errorf("csr %s of %s is not approved", csr.Name, commonName)
+		}
+		if len(csr.Status.Certificate) == 0 {
+			return fmt.Errorf("csr %s of %s is not signed", csr.Name, commonName)
+		}
+		return nil
+	}
+	return fmt.Errorf("no csr of %s is found", commonName)
+}
+
+func approved(csr *certificates.CertificateSigningRequest) bool {
+	for _, c := range csr.Status.Conditions {
+		if c.Type == certificates.CertificateApproved {
+			return true
+		}
+	}
+	return false
+}
+
+// expectBackend expects the request is tunneled to the managed apiserver
+func expectBackend(f *framework.Framework, client *http.Client) error {
+	body, err := get(client, f.Backend.URL+"/api", nil)
+	if err != nil {
+		return err
+	}
+	if want := f.ClusterName + " /api"; body != want {
+		return fmt.Errorf("unexpected response %q, expect %q", body, want)
+	}
+	return nil
+}
+
+func get(client *http.Client, url string, header http.Header) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status + ": " + string(data))
+	}
+	return string(data), nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// dialFunc dials the master port of the tunnel server
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// MasterClient returns a client that tunnels the requests to the managed
+// cluster through the mTLS master port, like the hub apiserver does
+func (f *Framework) MasterClient() (*http.Client, error) {
+	tlsCfg, err := f.ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(f.Ports.Master))
+	return f.tunnelClient(func(ctx context.Context) (net.Conn, error) {
+		dialer := &tls.Dialer{Config: tlsCfg}
+		return dialer.DialContext(ctx, "tcp", address)
+	}), nil
+}
+
+// InsecureMasterClient returns a client that tunnels the requests to the
+// managed cluster through the master port without tls
+func (f *Framework) InsecureMasterClient() *http.Client {
+	return f.InsecureMasterClientAt("127.0.0.1")
+}
+
+// InsecureMasterClientAt is InsecureMasterClient that dials the master
+// port on the host, e.g. ::1
+func (f *Framework) InsecureMasterClientAt(host string) *http.Client {
+	address := net.JoinHostPort(host, strconv.Itoa(f.Ports.MasterInsecure))
+	return f.tunnelClient(func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	})
+}
+
+// UDSClient returns a client that tunnels the requests to the managed
+// cluster through the unix socket of the server
+func (f *Framework) UDSClient(udsName string) *http.Client {
+	return f.tunnelClient(func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", udsName)
+	})
+}
+
+// tunnelClient returns a client that sends HTTP-CONNECT requests over the
+// connections dialed by dial, and trusts the managed apiserver
+func (f *Framework) tunnelClient(dial dialFunc) *http.Client {
+	transport := f.Backend.Client().Transport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := connect(conn, address); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// connect asks the server to tunnel the connection to the address
+func connect(conn net.Conn, address string) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address); err != nil {
+		return err
+	}
+	// the server does not send anything before the client, so the
+	// buffered reader does not consume the tunneled data, and the body
+	// must not be read since the tunnel starts right after the header
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s failed with %s", address, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package framework runs the tunnel server and agent in process against a
+// fake hub apiserver, a fake managed apiserver and ephemeral ports, so that
+// the end-to-end scenarios run without a kubernetes cluster
+package framework
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/admin"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/agent"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/k8s"
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/server"
+)
+
+const (
+	// Namespace is the namespace of the tunnel server in the hub cluster
+	Namespace = "tkestack"
+	// HubToken is the bearer token of the hub apiserver used by the server
+	HubToken = "excalibur-e2e-token"
+	// AgentToken is the bearer token of the hub apiserver used by the agent,
+	// which is only allowed to request its certificate and read the
+	// bootstrap configmap
+	AgentToken = "excalibur-e2e-agent-token"
+	// stopTimeout is the time to wait for a component to stop
+	stopTimeout = 30 * time.Second
+)
+
+// Ports are the ports the tunnel server listens on
+type Ports struct {
+	Agent          int
+	Master         int
+	MasterInsecure int
+	Admin          int
+	ReverseProxy   int
+}
+
+// Framework is an in-process deployment of the tunnel server and agent
+type Framework struct {
+	// ClusterName is the name of the managed cluster served by the agent
+	ClusterName string
+	// Dir is the temporary directory of the certificates, kubeconfigs and
+	// unix sockets
+	Dir string
+	CA  *CA
+	Hub *Hub
+	// Backend is the apiserver of the managed cluster, it answers every
+	// request with the request path
+	Backend *httptest.Server
+	Ports   Ports
+
+	hubKubeConfig   string
+	localKubeConfig string
+	caFile          string
+	tokenFile       string
+
+	server *component
+	agent  *component
+}
+
+// component is a tunnel server or agent running in a goroutine
+type component struct {
+	stopCh chan struct{}
+	done   chan struct{}
+	err    error
+}
+
+// New sets up the hub, the managed cluster and the files of a deployment,
+// the server and the agent are started by StartServer and StartAgent
+func New(clusterName string) (*Framework, error) {
+	dir, err := ioutil.TempDir("", "excalibur-e2e-")
+	if err != nil {
+		return nil, err
+	}
+	f := &Framework{ClusterName: clusterName, Dir: dir}
+	if err := f.setup(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Framework) setup() error {
+	var err error
+	if f.CA, err = NewCA(); err != nil {
+		return err
+	}
+	if f.Hub, err = NewHub(f.CA, HubToken, AgentToken); err != nil {
+		return err
+	}
+	f.Backend = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", f.ClusterName, r.URL.Path)
+	}))
+
+	for _, port := range []*int{&f.Ports.Agent, &f.Ports.Master, &f.Ports.MasterInsecure,
+		&f.Ports.Admin, &f.Ports.ReverseProxy} {
+		if *port, err = freePort(); err != nil {
+			return err
+		}
+	}
+	if err := f.seedHub(); err != nil {
+		return fmt.Errorf("fail to seed the hub: %v", err)
+	}
+
+	if err := f.writeFiles(); err != nil {
+		return err
+	}
+
+	// the server and the agent find the namespace, the pod ip and the hub
+	// apiserver in the environment like in a pod
+	hubHost, hubPort, _ := net.SplitHostPort(f.Hub.Address)
+	for key, value := range map[string]string{
+		constants.TunnelServerNSEnv:   Namespace,
+		constants.TunnelAgentPodIPEnv: "127.0.0.1",
+		"KUBERNETES_SERVICE_HOST":     hubHost,
+		"KUBERNETES_SERVICE_PORT":     hubPort,
+	} {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedHub creates the namespace, service and endpoints of the tunnel
+// server in the hub
+func (f *Framework) seedHub() error {
+	for _, obj := range []runtime.Object{
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: Namespace}},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: constants.TunnelServerServiceName, Namespace: Namespace},
+			Spec: v1.ServiceSpec{
+				Type:      v1.ServiceTypeClusterIP,
+				ClusterIP: "10.96.0.100",
+				Ports: []v1.ServicePort{{
+					Name: constants.TunnelServerAgentPortName,
+					Port: constants.TunnelServerAgentPort,
+				}},
+			},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: constants.TunnelEndpointsName, Namespace: Namespace},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "127.0.0.1"}},
+				Ports: []v1.EndpointPort{{
+					Name: constants.TunnelServerAgentPortName,
+					Port: int32(f.Ports.Agent),
+				}},
+			}},
+		},
+	} {
+		if err := f.Hub.Create(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFiles writes the kubeconfig of the server, the service account of
+// the agent in the hub and the kubeconfig of the managed cluster
+func (f *Framework) writeFiles() error {
+	f.hubKubeConfig = filepath.Join(f.Dir, "hub.kubeconfig")
+	if err := writeKubeConfig(f.hubKubeConfig, "hub",
+		k8s.Cluster{Server: f.Hub.URL, CertificateAuthorityData: f.CA.CertPEM}); err != nil {
+		return err
+	}
+	f.localKubeConfig = filepath.Join(f.Dir, "local.kubeconfig")
+	if err := writeKubeConfig(f.localKubeConfig, f.ClusterName,
+		k8s.Cluster{Server: f.Backend.URL, InsecureSkipTLSVerify: true}); err != nil {
+		return err
+	}
+
+	f.caFile = filepath.Join(f.Dir, "ca.crt")
+	if err := ioutil.WriteFile(f.caFile, f.CA.CertPEM, 0600); err != nil {
+		return err
+	}
+	f.tokenFile = filepath.Join(f.Dir, "token")
+	return ioutil.WriteFile(f.tokenFile, []byte(AgentToken), 0600)
+}
+
+// StartServer starts the tunnel server with the extra flags and waits
+// until its admin api is served
+func (f *Framework) StartServer(extraArgs ...string) error {
+	if f.server != nil {
+		return fmt.Errorf("the server is running")
+	}
+	args := append([]string{
+		"--kube-config=" + f.hubKubeConfig,
+		"--bind-address=127.0.0.1",
+		"--insecure-bind-address=127.0.0.1",
+		"--agent-port=" + strconv.Itoa(f.Ports.Agent),
+		"--master-port=" + strconv.Itoa(f.Ports.Master),
+		"--master-insecure-port=" + strconv.Itoa(f.Ports.MasterInsecure),
+		"--admin-port=" + strconv.Itoa(f.Ports.Admin),
+		"--reverse-proxy-port=" + strconv.Itoa(f.Ports.ReverseProxy),
+		"--cert-dir=" + filepath.Join(f.Dir, "server-pki"),
+	}, extraArgs...)
+	f.server = start(server.NewTunnelServerCommand, args)
+
+	client, err := f.AdminClient()
+	if err != nil {
+		return err
+	}
+	return f.wait(f.server, func() bool {
+		_, err := client.ListAgents()
+		return err == nil
+	})
+}
+
+// StopServer stops the tunnel server
+func (f *Framework) StopServer() error {
+	err := f.server.stop()
+	f.server = nil
+	return err
+}
+
+// StartAgent starts the tunnel agent and waits until it is connected to
+// the server
+func (f *Framework) StartAgent(extraArgs ...string) error {
+	if f.agent != nil {
+		return fmt.Errorf("the agent is running")
+	}
+	args := append([]string{
+		"--cluster-name=" + f.ClusterName,
+		"--apiserver-addr=" + f.Hub.Address,
+		"--tunnelserver-addr=" + net.JoinHostPort("127.0.0.1", strconv.Itoa(f.Ports.Agent)),
+		"--kube-config=" + f.localKubeConfig,
+		"--ca-file=" + f.caFile,
+		"--token-file=" + f.tokenFile,
+		"--cert-dir=" + filepath.Join(f.Dir, "agent-pki"),
+		"--agent-identifiers=ipv4=127.0.0.1",
+		"--allowed-cidrs=127.0.0.1/32",
+	}, extraArgs...)
+	f.agent = start(agent.NewTunnelAgentCommand, args)
+	return f.WaitForAgent()
+}
+
+// StopAgent stops the tunnel agent
+func (f *Framework) StopAgent() error {
+	err := f.agent.stop()
+	f.agent = nil
+	return err
+}
+
+// WaitForAgent waits until the agent is listed by the admin api
+func (f *Framework) WaitForAgent() error {
+	client, err := f.AdminClient()
+	if err != nil {
+		return err
+	}
+	return f.wait(f.agent, func() bool {
+		list, err := client.ListAgents()
+		if err != nil {
+			return false
+		}
+		for _, a := range list.Items {
+			if a.ID == f.ClusterName {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// wait waits until the condition is met or the component exits
+func (f *Framework) wait(c *component, condition func() bool) error {
+	return wait.PollImmediate(200*time.Millisecond, time.Minute, func() (bool, error) {
+		select {
+		case <-c.done:
+			return false, fmt.Errorf("exited unexpectedly: %v", c.err)
+		default:
+		}
+		return condition(), nil
+	})
+}
+
+// AgentHubClient returns the client of the hub apiserver created from the
+// token and CA files of the agent, as the agent does
+func (f *Framework) AgentHubClient() (kubernetes.Interface, error) {
+	return k8s.CreateClientSetApiserverAddr(f.Hub.Address, f.tokenFile, f.caFile)
+}
+
+// ClientTLSConfig returns the TLS configuration of a master client, whose
+// certificate is signed by the hub CA in the system:masters group
+func (f *Framework) ClientTLSConfig() (*tls.Config, error) {
+	cert, err := f.CA.NewCertificate(pkix.Name{
+		CommonName:   "excalibur-e2e",
+		Organization: []string{constants.TunnelServerCSROrg},
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      f.CA.Pool(),
+	}, nil
+}
+
+// AdminClient returns a client of the admin api of the server
+func (f *Framework) AdminClient() (*admin.Client, error) {
+	tlsCfg, err := f.ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return admin.NewClient(net.JoinHostPort("127.0.0.1", strconv.Itoa(f.Ports.Admin)),
+		tlsCfg, 5*time.Second), nil
+}
+
+// Close stops the components and removes the temporary directory
+func (f *Framework) Close() {
+	if f.agent != nil {
+		f.StopAgent()
+	}
+	if f.server != nil {
+		f.StopServer()
+	}
+	if f.Backend != nil {
+		f.Backend.Close()
+	}
+	if f.Hub != nil {
+		f.Hub.Close()
+	}
+	os.RemoveAll(f.Dir)
+}
+
+// start runs the command in a goroutine until the component is stopped
+func start(newCommand func(<-chan struct{}) *cobra.Command, args []string) *component {
+	c := &component{
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	cmd := newCommand(c.stopCh)
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	go func() {
+		defer close(c.done)
+		c.err = cmd.Execute()
+	}()
+	return c
+}
+
+// stop stops the component and waits until its command returns
+func (c *component) stop() error {
+	close(c.stopCh)
+	select {
+	case <-c.done:
+		return c.err
+	case <-time.After(stopTimeout):
+		return fmt.Errorf("timeout waiting for the component to stop")
+	}
+}
+
+func writeKubeConfig(path, clusterName string, cluster k8s.Cluster) error {
+	data, err := k8s.NewKubeConfig(clusterName, cluster, k8s.AuthInfo{Token: HubToken}).Marshal()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// freePort returns a free tcp port on the loopback address
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,631 @@
+/*
+Copyright 2020 The OpenExcalibur Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	certificates "k8s.io/api/certificates/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/testing"
+	"k8s.io/klog/v2"
+
+	"github.com/tkestack/tke-excalibur/pkg/tunnel/constants"
+)
+
+// hubResource describes a resource served by the fake hub apiserver
+type hubResource struct {
+	kind       string
+	namespaced bool
+}
+
+var hubResources = map[schema.GroupVersionResource]hubResource{
+	{Version: "v1", Resource: "namespaces"}: {kind: "Namespace"},
+	{Version: "v1", Resource: "nodes"}:      {kind: "Node"},
+	{Version: "v1", Resource: "services"}:   {kind: "Service", namespaced: true},
+	{Version: "v1", Resource: "endpoints"}:  {kind: "Endpoints", namespaced: true},
+	{Version: "v1", Resource: "configmaps"}: {kind: "ConfigMap", namespaced: true},
+	{Version: "v1", Resource: "secrets"}:    {kind: "Secret", namespaced: true},
+	csrResource:                             {kind: "CertificateSigningRequest"},
+}
+
+var csrResource = certificates.SchemeGroupVersion.WithResource("certificatesigningrequests")
+
+// Hub is a fake hub cluster apiserver, it serves the handful of resources
+// the tunnel server and agent use from an in-memory object tracker and
+// signs the approved CSRs with the hub CA, like the kube-controller-manager
+type Hub struct {
+	// URL is the https url of the hub apiserver
+	URL string
+	// Address is the host:port of the hub apiserver
+	Address string
+
+	ca      *CA
+	token   string
+	tracker testing.ObjectTracker
+	server  *httptest.Server
+	rv      int64
+	signed  int32
+	// agentToken is only granted the permissions of the hub identity of
+	// the agents in the manifests
+	agentToken string
+
+	lock   sync.Mutex
+	stopCh chan struct{}
+	// forbidden are the requests of the agent token denied by the hub
+	forbidden []string
+}
+
+// NewHub starts a fake hub apiserver on the loopback address, requests must
+// carry the bearer token or the agent token
+func NewHub(ca *CA, token, agentToken string) (*Hub, error) {
+	cert, err := ca.NewCertificate(pkix.Name{CommonName: "kube-apiserver"},
+		[]string{"localhost", "kubernetes.default.svc"}, []net.IP{net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return nil, fmt.Errorf("fail to create the hub apiserver certificate: %v", err)
+	}
+	h := &Hub{
+		ca:         ca,
+		token:      token,
+		agentToken: agentToken,
+		tracker:    testing.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder()),
+		stopCh:     make(chan struct{}),
+	}
+	h.server = httptest.NewUnstartedServer(http.HandlerFunc(h.serveHTTP))
+	h.server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	h.server.StartTLS()
+	h.URL = h.server.URL
+	h.Address = h.server.Listener.Addr().String()
+
+	w, err := h.tracker.Watch(csrResource, "")
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	go h.runSigner(w)
+	return h, nil
+}
+
+// Close stops the hub apiserver and the CSR signer
+func (h *Hub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	select {
+	case <-h.stopCh:
+		return
+	default:
+	}
+	close(h.stopCh)
+	h.server.CloseClientConnections()
+	h.server.Close()
+}
+
+// Create stores the object in the hub
+func (h *Hub) Create(obj runtime.Object) error {
+	gvr, namespace, err := h.resourceFor(obj)
+	if err != nil {
+		return err
+	}
+	_, err = h.create(gvr, namespace, obj)
+	return err
+}
+
+// ConfigMap returns the configmap stored in the hub
+func (h *Hub) ConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	obj, err := h.tracker.Get(v1.SchemeGroupVersion.WithResource("configmaps"), namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.ConfigMap), nil
+}
+
+// CSRs returns the certificate signing requests stored in the hub
+func (h *Hub) CSRs() ([]certificates.CertificateSigningRequest, error) {
+	obj, err := h.tracker.List(csrResource, certificates.SchemeGroupVersion.WithKind("CertificateSigningRequest"), "")
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*certificates.CertificateSigningRequestList).Items, nil
+}
+
+// Forbidden returns the requests of the agent token denied by the hub
+func (h *Hub) Forbidden() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string(nil), h.forbidden...)
+}
+
+// Signed returns the number of the CSRs signed by the hub
+func (h *Hub) Signed() int {
+	return int(atomic.LoadInt32(&h.signed))
+}
+
+// runSigner signs the approved CSRs until the hub is closed
+func (h *Hub) runSigner(w watch.Interface) {
+	defer w.Stop()
+	for {
+		select {
+		case <-h.stopCh:
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+			csr, ok := event.Object.(*certificates.CertificateSigningRequest)
+			if !ok || len(csr.Status.Certificate) != 0 || !isApproved(csr) {
+				continue
+			}
+			if err := h.sign(csr.Name); err != nil {
+				klog.Errorf("hub fail to sign csr %s: %v", csr.Name, err)
+			}
+		}
+	}
+}
+
+func (h *Hub) sign(name string) error {
+	obj, err := h.tracker.Get(csrResource, "", name)
+	if err != nil {
+		return err
+	}
+	csr := obj.(*certificates.CertificateSigningRequest).DeepCopy()
+	if len(csr.Status.Certificate) != 0 {
+		return nil
+	}
+	certPEM, err := h.ca.SignCSR(csr.Spec.Request, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	csr.Status.Certificate = certPEM
+	if _, err := h.update(csrResource, "", csr); err != nil {
+		return err
+	}
+	atomic.AddInt32(&h.signed, 1)
+	klog.Infof("hub signed csr %s", csr.Name)
+	return nil
+}
+
+func isApproved(csr *certificates.CertificateSigningRequest) bool {
+	approved := false
+	for _, c := range csr.Status.Conditions {
+		switch c.Type {
+		case certificates.CertificateApproved:
+			approved = true
+		case certificates.CertificateDenied:
+			return false
+		}
+	}
+	return approved
+}
+
+func (h *Hub) resourceFor(obj runtime.Object) (schema.GroupVersionResource, string, error) {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return schema.GroupVersionResource{}, "", err
+	}
+	for gvr, r := range hubResources {
+		if gvr.GroupVersion() == gvks[0].GroupVersion() && r.kind == gvks[0].Kind {
+			objMeta, err := meta.Accessor(obj)
+			if err != nil {
+				return gvr, "", err
+			}
+			return gvr, objMeta.GetNamespace(), nil
+		}
+	}
+	return schema.GroupVersionResource{}, "", fmt.Errorf("kind %v is not served by the hub", gvks[0])
+}
+
+func (h *Hub) nextResourceVersion() string {
+	return strconv.FormatInt(atomic.AddInt64(&h.rv, 1), 10)
+}
+
+func (h *Hub) create(gvr schema.GroupVersionResource, namespace string, obj runtime.Object) (runtime.Object, error) {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	if objMeta.GetName() == "" && objMeta.GetGenerateName() != "" {
+		objMeta.SetName(objMeta.GetGenerateName() + utilrand.String(5))
+	}
+	if objMeta.GetName() == "" {
+		return nil, apierrors.NewBadRequest("name or generateName is required")
+	}
+	objMeta.SetNamespace(namespace)
+	objMeta.SetUID(types.UID(utilrand.String(16)))
+	objMeta.SetCreationTimestamp(metav1.Now())
+	objMeta.SetResourceVersion(h.nextResourceVersion())
+	if err := h.tracker.Create(gvr, obj, namespace); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (h *Hub) update(gvr schema.GroupVersionResource, namespace string, obj runtime.Object) (runtime.Object, error) {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	old, err := h.tracker.Get(gvr, namespace, objMeta.GetName())
+	if err != nil {
+		return nil, err
+	}
+	oldMeta, err := meta.Accessor(old)
+	if err != nil {
+		return nil, err
+	}
+	objMeta.SetNamespace(namespace)
+	objMeta.SetUID(oldMeta.GetUID())
+	objMeta.SetCreationTimestamp(oldMeta.GetCreationTimestamp())
+	objMeta.SetResourceVersion(h.nextResourceVersion())
+	if err := h.tracker.Update(gvr, obj, namespace); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// request is a parsed hub apiserver request path
+type request struct {
+	gvr         schema.GroupVersionResource
+	namespace   string
+	name        string
+	subresource string
+}
+
+func parseRequest(path string) (*request, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	r := &request{}
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		r.gvr.Version, parts = parts[1], parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		r.gvr.Group, r.gvr.Version, parts = parts[1], parts[2], parts[3:]
+	default:
+		return nil, false
+	}
+	if parts[0] == "namespaces" && len(parts) >= 3 {
+		r.namespace, parts = parts[1], parts[2:]
+	}
+	r.gvr.Resource = parts[0]
+	if len(parts) > 1 {
+		r.name = parts[1]
+	}
+	if len(parts) > 2 {
+		r.subresource = parts[2]
+	}
+	return r, len(parts) <= 3
+}
+
+func (h *Hub) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	isAgent := h.agentToken != "" && auth == "Bearer "+h.agentToken
+	if h.token != "" && auth != "Bearer "+h.token && !isAgent {
+		writeStatus(w, apierrors.NewUnauthorized("invalid bearer token"))
+		return
+	}
+	switch req.URL.Path {
+	case "/healthz", "/readyz", "/livez":
+		w.Write([]byte("ok"))
+		return
+	case "/version":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"major":      "1",
+			"minor":      "16",
+			"gitVersion": "v1.16.9-excalibur-e2e",
+			"platform":   "linux/amd64",
+		})
+		return
+	}
+
+	r, ok := parseRequest(req.URL.Path)
+	if !ok {
+		writeStatus(w, apierrors.NewNotFound(schema.GroupResource{}, req.URL.Path))
+		return
+	}
+	if r.gvr == authorizationv1.SchemeGroupVersion.WithResource("selfsubjectaccessreviews") && req.Method == http.MethodPost {
+		h.serveAccessReview(w, req)
+		return
+	}
+	if isAgent && !agentAllowed(req.Method, r) {
+		h.lock.Lock()
+		h.forbidden = append(h.forbidden, req.Method+" "+req.URL.Path)
+		h.lock.Unlock()
+		writeStatus(w, apierrors.NewForbidden(r.gvr.GroupResource(), r.name,
+			fmt.Errorf("the agent is not allowed to %s %s", req.Method, req.URL.Path)))
+		return
+	}
+	res, ok := hubResources[r.gvr]
+	if !ok || (r.namespace != "" && !res.namespaced) {
+		writeStatus(w, apierrors.NewNotFound(r.gvr.GroupResource(), r.name))
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && r.name == "" && req.URL.Query().Get("watch") == "true":
+		h.serveWatch(w, req, r)
+	case req.Method == http.MethodGet && r.name == "":
+		h.serveList(w, req, r, res)
+	case req.Method == http.MethodGet && r.subresource == "":
+		obj, err := h.tracker.Get(r.gvr, r.namespace, r.name)
+		writeResult(w, r.gvr, http.StatusOK, obj, err)
+	case req.Method == http.MethodPost && r.name == "":
+		obj, err := h.decode(req)
+		if err == nil {
+			obj, err = h.create(r.gvr, r.namespace, obj)
+		}
+		writeResult(w, r.gvr, http.StatusCreated, obj, err)
+	case req.Method == http.MethodPut && r.name != "":
+		obj, err := h.decode(req)
+		if err == nil {
+			obj, err = h.update(r.gvr, r.namespace, obj)
+		}
+		writeResult(w, r.gvr, http.StatusOK, obj, err)
+	case req.Method == http.MethodDelete && r.name != "" && r.subresource == "":
+		if err := h.tracker.Delete(r.gvr, r.namespace, r.name); err != nil {
+			writeStatus(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusSuccess,
+		})
+	default:
+		writeStatus(w, apierrors.NewMethodNotSupported(r.gvr.GroupResource(), req.Method))
+	}
+}
+
+// agentAllowed authorizes the request of the agent token like the
+// excalibur-tunnel-agent cluster role and the bootstrap configmap reader
+// role of config/setup/excalibur-tunnel-server.yaml, i.e. the agent can
+// create and read the CSRs and get the bootstrap configmap only
+func agentAllowed(method string, r *request) bool {
+	switch r.gvr {
+	case csrResource:
+		return r.subresource == "" && (method == http.MethodGet || (method == http.MethodPost && r.name == ""))
+	case v1.SchemeGroupVersion.WithResource("configmaps"):
+		return method == http.MethodGet && r.namespace == Namespace &&
+			r.name == constants.TunnelServerBootstrapConfigMapName && r.subresource == ""
+	}
+	return false
+}
+
+func (h *Hub) decode(req *http.Request) (runtime.Object, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, nil)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	return obj, nil
+}
+
+// serveAccessReview allows everything, the hub only authorizes the resource
+// requests of the agent token
+func (h *Hub) serveAccessReview(w http.ResponseWriter, req *http.Request) {
+	obj, err := h.decode(req)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	review, ok := obj.(*authorizationv1.SelfSubjectAccessReview)
+	if !ok {
+		writeStatus(w, apierrors.NewBadRequest("expect a SelfSubjectAccessReview"))
+		return
+	}
+	review.Status = authorizationv1.SubjectAccessReviewStatus{Allowed: true, Reason: "excalibur e2e hub"}
+	writeResult(w, authorizationv1.SchemeGroupVersion.WithResource("selfsubjectaccessreviews"),
+		http.StatusCreated, review, nil)
+}
+
+func (h *Hub) serveList(w http.ResponseWriter, req *http.Request, r *request, res hubResource) {
+	obj, err := h.tracker.List(r.gvr, r.gvr.GroupVersion().WithKind(res.kind), r.namespace)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	items, err := meta.ExtractList(obj)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	filter, err := newFilter(req)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	var selected []runtime.Object
+	for _, item := range items {
+		if filter(item) {
+			selected = append(selected, item)
+		}
+	}
+	if err := meta.SetList(obj, selected); err != nil {
+		writeStatus(w, err)
+		return
+	}
+	if listMeta, err := meta.ListAccessor(obj); err == nil {
+		listMeta.SetResourceVersion(strconv.FormatInt(atomic.LoadInt64(&h.rv), 10))
+	}
+	writeResult(w, r.gvr, http.StatusOK, obj, nil)
+}
+
+func (h *Hub) serveWatch(w http.ResponseWriter, req *http.Request, r *request) {
+	filter, err := newFilter(req)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	watcher, err := h.tracker.Watch(r.gvr, r.namespace)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	defer watcher.Stop()
+
+	timeout := time.Hour
+	if s := req.URL.Query().Get("timeoutSeconds"); s != "" {
+		if seconds, err := strconv.Atoi(s); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	send := func(eventType watch.EventType, obj runtime.Object) error {
+		if !filter(obj) {
+			return nil
+		}
+		data, err := runtime.Encode(scheme.Codecs.LegacyCodec(r.gvr.GroupVersion()), obj)
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(&metav1.WatchEvent{
+			Type:   string(eventType),
+			Object: runtime.RawExtension{Raw: data},
+		}); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// the tracker has no history, replay the objects changed after the
+	// requested resource version so that a list+watch does not miss them
+	if since, err := strconv.ParseInt(req.URL.Query().Get("resourceVersion"), 10, 64); err == nil && since > 0 {
+		if obj, err := h.tracker.List(r.gvr, r.gvr.GroupVersion().WithKind(hubResources[r.gvr].kind), r.namespace); err == nil {
+			items, _ := meta.ExtractList(obj)
+			for _, item := range items {
+				itemMeta, err := meta.Accessor(item)
+				if err != nil {
+					continue
+				}
+				if rv, _ := strconv.ParseInt(itemMeta.GetResourceVersion(), 10, 64); rv > since {
+					if err := send(watch.Modified, item); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-h.stopCh:
+			return
+		case <-timer.C:
+			return
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			if err := send(event.Type, event.Object); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newFilter returns the label and field selector of the request as a filter
+func newFilter(req *http.Request) (func(runtime.Object) bool, error) {
+	labelSelector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	fieldSelector, err := fields.ParseSelector(req.URL.Query().Get("fieldSelector"))
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	return func(obj runtime.Object) bool {
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return false
+		}
+		return labelSelector.Matches(labels.Set(objMeta.GetLabels())) &&
+			fieldSelector.Matches(fields.Set{
+				"metadata.name":      objMeta.GetName(),
+				"metadata.namespace": objMeta.GetNamespace(),
+			})
+	}, nil
+}
+
+func writeResult(w http.ResponseWriter, gvr schema.GroupVersionResource, code int, obj runtime.Object, err error) {
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	data, err := runtime.Encode(scheme.Codecs.LegacyCodec(gvr.GroupVersion()), obj)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func writeStatus(w http.ResponseWriter, err error) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		status = apierrors.NewInternalError(err)
+	}
+	s := status.Status()
+	s.Kind = "Status"
+	s.APIVersion = "v1"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(s.Code))
+	json.NewEncoder(w).Encode(&s)
+}